@@ -0,0 +1,98 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Export guts for testing on linux.
+// Since testing imports os and os imports internal/poll,
+// the internal/poll tests can not be in package poll.
+
+package poll
+
+import "sync/atomic"
+
+type Pipe = pipe
+
+var (
+	GetPipe = getPipe
+	PutPipe = putPipe
+)
+
+const (
+	MinPipeSize = minPipeSize
+	MaxPipeSize = maxPipeSize
+)
+
+// SetPipeResizeHook installs f as the hook called when a pipe is
+// resized, and returns a function restoring the previous hook.
+func SetPipeResizeHook(f func(size int)) (restore func()) {
+	old := testHookPipeResize
+	testHookPipeResize = f
+	return func() { testHookPipeResize = old }
+}
+
+// SetPipeSizeHook installs f as the hook which turns the capacity of a
+// pipe reported by the kernel into the capacity recorded, and returns a
+// function restoring the previous hook.
+func SetPipeSizeHook(f func(size int) int) (restore func()) {
+	old := testHookPipeSize
+	testHookPipeSize = f
+	return func() { testHookPipeSize = old }
+}
+
+// SetRelayBothBlockedHook installs f as the hook called when a relay
+// waits with both of its descriptors blocked and a partly filled pipe,
+// and returns a function restoring the previous hook.
+func SetRelayBothBlockedHook(f func()) (restore func()) {
+	old := testHookRelayBothBlocked
+	testHookRelayBothBlocked = f
+	return func() { testHookRelayBothBlocked = old }
+}
+
+// SetRelaySkipWaitReadHook installs f as the hook called when a relay is
+// about to wait for its source, which skips the wait if it returns true,
+// and returns a function restoring the previous hook.
+func SetRelaySkipWaitReadHook(f func() bool) (restore func()) {
+	old := testHookRelaySkipWaitRead
+	testHookRelaySkipWaitRead = f
+	return func() { testHookRelaySkipWaitRead = old }
+}
+
+// SetSplicerWaitedWriteHook installs f as the hook called when a Splicer
+// has waited for its destination to become writable, and returns a
+// function restoring the previous hook.
+func SetSplicerWaitedWriteHook(f func()) (restore func()) {
+	old := testHookSplicerWaitedWrite
+	testHookSplicerWaitedWrite = f
+	return func() { testHookSplicerWaitedWrite = old }
+}
+
+// SetDropFileCacheHook installs f as the hook called with each region
+// of a file which the kernel is advised to drop from the page cache, and
+// returns a function restoring the previous hook.
+func SetDropFileCacheHook(f func(fd int, off, n int64)) (restore func()) {
+	old := testHookDropFileCache
+	testHookDropFileCache = f
+	return func() { testHookDropFileCache = old }
+}
+
+// SetPipeFlags sets the flags with which new pipes are created, besides
+// O_CLOEXEC and O_NONBLOCK, and returns a function restoring the previous
+// flags. Pooled pipes created with other flags are not reused.
+func SetPipeFlags(flags int) (restore func()) {
+	old := pipeFlags
+	pipeFlags = flags
+	return func() { pipeFlags = old }
+}
+
+// PipeDescriptors returns the read and write ends of p.
+func PipeDescriptors(p *pipe) (rfd, wfd int) {
+	return p.rfd, p.wfd
+}
+
+// ResetSpliceSupport forgets whether splice has been found usable, so
+// that the next pipe allocated finds out again, and returns a function
+// restoring what was known.
+func ResetSpliceSupport() (restore func()) {
+	old := atomic.SwapInt32(&spliceSupport, spliceUnknown)
+	return func() { atomic.StoreInt32(&spliceSupport, old) }
+}
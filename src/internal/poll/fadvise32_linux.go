@@ -0,0 +1,12 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build 386 arm mips mipsle
+
+package poll
+
+// fadviseDontNeed does nothing on 32-bit systems, where the 64-bit
+// arguments of fadvise64_64 are passed in an order which depends on the
+// architecture.
+func fadviseDontNeed(fd int, off, n int64) {}
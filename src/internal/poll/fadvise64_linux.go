@@ -0,0 +1,21 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build amd64 arm64 mips64 mips64le ppc64 ppc64le s390x
+
+package poll
+
+import (
+	"runtime"
+	"syscall"
+)
+
+func fadviseDontNeed(fd int, off, n int64) {
+	// POSIX_FADV_DONTNEED is 6 rather than 4 on s390x.
+	advice := 4
+	if runtime.GOARCH == "s390x" {
+		advice = 6
+	}
+	syscall.Syscall6(syscall.SYS_FADVISE64, uintptr(fd), uintptr(off), uintptr(n), uintptr(advice), 0, 0)
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+// testHookDropFileCache is called with each region of a file which the
+// kernel is advised to drop from the page cache.
+var testHookDropFileCache = func(fd int, off, n int64) {}
+
+// dropFileCache advises the kernel that the n bytes of the file fd at
+// off won't be needed again. The advice is best-effort.
+func dropFileCache(fd int, off, n int64) {
+	testHookDropFileCache(fd, off, n)
+	fadviseDontNeed(fd, off, n)
+}
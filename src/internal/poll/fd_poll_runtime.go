@@ -28,6 +28,15 @@ func runtime_pollUnblock(ctx uintptr)
 
 type pollDesc struct {
 	runtimeCtx uintptr
+
+	// The deadlines of the descriptor, as runtimeNano times, and a
+	// channel which is closed, and forgotten, once a deadline is set
+	// or the descriptor is evicted. They let a goroutine which waits
+	// for something other than the descriptor notice either; see
+	// watch.
+	mu      sync.Mutex
+	rd, wd  int64
+	changed chan struct{}
 }
 
 var serverInit sync.Once
@@ -56,12 +65,38 @@ func (pd *pollDesc) close() {
 
 // Evict evicts fd from the pending list, unblocking any I/O running on fd.
 func (pd *pollDesc) evict() {
+	pd.notify()
 	if pd.runtimeCtx == 0 {
 		return
 	}
 	runtime_pollUnblock(pd.runtimeCtx)
 }
 
+// watch returns a channel which is closed once pd is evicted or has a
+// deadline set, and the deadline for mode, 'r' or 'w', as a runtimeNano
+// time, or 0 if there is none.
+func (pd *pollDesc) watch(mode int) (changed <-chan struct{}, deadline int64) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if pd.changed == nil {
+		pd.changed = make(chan struct{})
+	}
+	if mode == 'r' {
+		return pd.changed, pd.rd
+	}
+	return pd.changed, pd.wd
+}
+
+// notify closes the channel returned by watch, if any.
+func (pd *pollDesc) notify() {
+	pd.mu.Lock()
+	if pd.changed != nil {
+		close(pd.changed)
+		pd.changed = nil
+	}
+	pd.mu.Unlock()
+}
+
 func (pd *pollDesc) prepare(mode int, isFile bool) error {
 	if pd.runtimeCtx == 0 {
 		return nil
@@ -151,6 +186,15 @@ func setDeadlineImpl(fd *FD, t time.Time, mode int) error {
 		return errors.New("file type does not support deadlines")
 	}
 	runtime_pollSetDeadline(fd.pd.runtimeCtx, d, mode)
+	fd.pd.mu.Lock()
+	if mode == 'r' || mode == 'r'+'w' {
+		fd.pd.rd = d
+	}
+	if mode == 'w' || mode == 'r'+'w' {
+		fd.pd.wd = d
+	}
+	fd.pd.mu.Unlock()
+	fd.pd.notify()
 	fd.decref()
 	return nil
 }
@@ -36,6 +36,11 @@ type FD struct {
 
 	// Whether this is a file rather than a network socket.
 	isFile bool
+
+	// Whether this socket is in blocking mode, which it shares with
+	// descriptors the caller doesn't own, although the poller watches
+	// it. Only splices use such a socket.
+	isBlocking bool
 }
 
 // Init initializes the FD. The Sysfd field should already be set.
@@ -0,0 +1,85 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// Peek copies the first len(p) bytes queued for reading on fd, a TCP
+// socket, into p without removing them from the socket, waiting until
+// that much data has arrived. If the stream ends first, Peek returns
+// the data queued and io.ErrUnexpectedEOF, or io.EOF if there is none,
+// like io.ReadFull.
+func (fd *FD) Peek(p []byte) (int, error) {
+	if err := fd.readLock(); err != nil {
+		return 0, err
+	}
+	defer fd.readUnlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := fd.pd.prepareRead(fd.isFile); err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		m, _, err := syscall.Recvfrom(fd.Sysfd, p, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if err == nil && m == 0 {
+			if n > 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+			return 0, io.EOF
+		}
+		if err == nil {
+			if n = m; n == len(p) {
+				return n, nil
+			}
+			// A peek doesn't see past the data queued to the
+			// end of the stream.
+			if peerClosed(fd.Sysfd) {
+				return n, io.ErrUnexpectedEOF
+			}
+			// The socket keeps what is queued, so a short peek
+			// has to wait for more to arrive, which the poller
+			// reports as an event of its own.
+			err = syscall.EAGAIN
+		}
+		if err != syscall.EAGAIN || !fd.pd.pollable() {
+			return n, err
+		}
+		if err := fd.pd.waitRead(fd.isFile); err != nil {
+			return n, err
+		}
+	}
+}
+
+// peerClosed reports whether the peer of the TCP socket s has closed its
+// side of the connection, so that no more data will be queued on s.
+func peerClosed(s int) bool {
+	// The first byte of struct tcp_info is tcpi_state.
+	var state uint8
+	size := uint32(unsafe.Sizeof(state))
+	if err := getsockopt(s, syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&state), &size); err != nil {
+		return false
+	}
+	switch state {
+	case tcpTimeWait, tcpClose, tcpCloseWait, tcpLastAck, tcpClosing:
+		return true
+	}
+	return false
+}
+
+// The TCP states in which the peer has closed its side, from the Linux
+// include/net/tcp_states.h.
+const (
+	tcpTimeWait  = 6
+	tcpClose     = 7
+	tcpCloseWait = 8
+	tcpLastAck   = 9
+	tcpClosing   = 11
+)
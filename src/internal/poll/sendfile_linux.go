@@ -4,7 +4,10 @@
 
 package poll
 
-import "syscall"
+import (
+	"io"
+	"syscall"
+)
 
 // maxSendfileSize is the largest chunk size we ask the kernel to copy
 // at a time.
@@ -12,11 +15,43 @@ const maxSendfileSize int = 4 << 20
 
 // SendFile wraps the sendfile system call.
 func SendFile(dstFD *FD, src int, remain int64) (int64, error) {
+	return sendFile(dstFD, src, nil, remain, false)
+}
+
+// SendFileRange is like SendFile, but sends the n bytes of src starting at
+// offset off, without using or changing the file offset of src. Several
+// ranges of src may therefore be sent at once.
+func SendFileRange(dstFD *FD, src int, off, n int64) (int64, error) {
+	return sendFile(dstFD, src, &off, n, false)
+}
+
+// SendFileDropCache is like SendFile, but once each chunk of src has been
+// sent, it advises the kernel with posix_fadvise(POSIX_FADV_DONTNEED) that
+// the chunk won't be needed again, so that sending a large file does not
+// evict more useful data from the page cache. No advice is given if src
+// is not seekable.
+func SendFileDropCache(dstFD *FD, src int, remain int64) (int64, error) {
+	return sendFile(dstFD, src, nil, remain, true)
+}
+
+// sendFile sends remain bytes of src to dstFD, starting at *offp, which is
+// advanced past the data sent, or at the file offset of src if offp is
+// nil.
+func sendFile(dstFD *FD, src int, offp *int64, remain int64, dropCache bool) (int64, error) {
 	if err := dstFD.writeLock(); err != nil {
 		return 0, err
 	}
 	defer dstFD.writeUnlock()
 
+	// off is the offset of src at which the next chunk starts, or
+	// -1 if no advice is to be given.
+	off := int64(-1)
+	if dropCache {
+		if o, err := syscall.Seek(src, 0, io.SeekCurrent); err == nil {
+			off = o
+		}
+	}
+
 	dst := int(dstFD.Sysfd)
 	var written int64
 	var err error
@@ -25,10 +60,14 @@ func SendFile(dstFD *FD, src int, remain int64) (int64, error) {
 		if int64(n) > remain {
 			n = int(remain)
 		}
-		n, err1 := syscall.Sendfile(dst, src, nil, n)
+		n, err1 := syscall.Sendfile(dst, src, offp, n)
 		if n > 0 {
 			written += int64(n)
 			remain -= int64(n)
+			if off >= 0 {
+				dropFileCache(src, off, int64(n))
+				off += int64(n)
+			}
 		}
 		if n == 0 && err1 == nil {
 			break
@@ -0,0 +1,36 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+// RelayStats accumulates the time spent in the splices of one or more
+// relays, and how often they waited and drained their source. Its fields
+// are updated atomically.
+type RelayStats struct {
+	// WaitNanos is the time spent waiting for a descriptor to
+	// become ready, in nanoseconds.
+	WaitNanos int64
+
+	// ActiveNanos is the rest of the time spent splicing, in
+	// nanoseconds.
+	ActiveNanos int64
+
+	// ReadWaits is the number of times a relay waited for src to
+	// become readable.
+	ReadWaits int64
+
+	// Drains is the number of splices which moved data from src
+	// to the pipe, and DrainedBytes the data they moved.
+	Drains       int64
+	DrainedBytes int64
+
+	// WriteWaits is the number of times a relay waited for dst to
+	// become writable.
+	WriteWaits int64
+
+	// Pumps is the number of splices which moved data from the pipe
+	// to dst, and PumpedBytes the data they moved.
+	Pumps       int64
+	PumpedBytes int64
+}
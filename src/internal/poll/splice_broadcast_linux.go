@@ -0,0 +1,307 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrBroadcastDropped is reported for a destination which a Broadcast
+// dropped because it fell behind.
+var ErrBroadcastDropped = errors.New("broadcast destination dropped")
+
+// A Broadcast holds the parameters of a splice from one descriptor to
+// several. The zero value waits for the slowest destination.
+type Broadcast struct {
+	// DropAfter, if positive, makes the broadcast drop a destination
+	// whose pipe stays full for DropAfter once more data has arrived
+	// from src, rather than wait for it. The write deadline of a
+	// dropped destination is set in the past, to interrupt the write
+	// in progress.
+	DropAfter time.Duration
+}
+
+// broadcastBatches is the number of times the data held by the source
+// pipe may be buffered for a destination.
+const broadcastBatches = 4
+
+// SpliceBroadcast copies src to every descriptor in dsts until src
+// reaches EOF, using the splice and tee system calls. The data is read
+// from src once, and copied within the kernel to a pipe for each
+// destination, which is written to its destination by a goroutine of its
+// own, so that a slow destination holds back the others only once its
+// pipe is full.
+//
+// SpliceBroadcast returns, for each destination, the number of bytes
+// written to it and the error which stopped copying to it, if any.
+// If err != nil, sc is the system call which caused the error while
+// reading src.
+func SpliceBroadcast(src *FD, dsts []*FD) (written []int64, errs []error, handled bool, sc string, err error) {
+	var b Broadcast
+	return b.Splice(src, dsts)
+}
+
+// broadcastDst is the state of one destination of a Broadcast.
+type broadcastDst struct {
+	fd *FD
+	p  *pipe
+
+	// slots holds a token for each batch buffered in p, so that p
+	// never holds more batches than it has room for.
+	slots chan struct{}
+
+	// work carries the size of each batch teed into p to the
+	// destination's goroutine.
+	work chan int
+
+	// dead is closed when writing to the destination fails.
+	dead chan struct{}
+
+	stopped bool  // no more batches are sent; owned by the broadcast
+	dropped int32 // set atomically when the destination is dropped
+
+	// Owned by the destination's goroutine until it exits.
+	written int64
+	err     error
+}
+
+// Splice is like the SpliceBroadcast function, but uses the parameters
+// in b.
+func (b *Broadcast) Splice(src *FD, dsts []*FD) (written []int64, errs []error, handled bool, sc string, err error) {
+	if !src.IsStream {
+		return nil, nil, false, "", nil
+	}
+	for _, dst := range dsts {
+		if !dst.IsStream {
+			return nil, nil, false, "", nil
+		}
+	}
+	in, sc, err := getPipe()
+	if err != nil {
+		return nil, nil, false, sc, err
+	}
+	defer putPipe(in)
+	bds := make([]*broadcastDst, 0, len(dsts))
+	defer func() {
+		for _, d := range bds {
+			putPipe(d.p)
+		}
+	}()
+	for _, dst := range dsts {
+		p, sc, err := getPipe()
+		if err != nil {
+			return nil, nil, false, sc, err
+		}
+		// Each batch adds at most as many buffers to p as in has,
+		// so with room for broadcastBatches batches a tee never
+		// finds p full. If the kernel won't grow p, settle for
+		// fewer batches.
+		if p.size < broadcastBatches*in.size {
+			p.resize(broadcastBatches * in.size)
+		}
+		batches := p.size / in.size
+		if batches < 1 {
+			batches = 1
+		}
+		bds = append(bds, &broadcastDst{
+			fd:    dst,
+			p:     p,
+			slots: make(chan struct{}, batches),
+			work:  make(chan int, batches),
+			dead:  make(chan struct{}),
+		})
+	}
+
+	if err := src.readLock(); err != nil {
+		return nil, nil, true, "", err
+	}
+	defer src.readUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return nil, nil, true, "", err
+	}
+	for _, d := range bds {
+		if err := d.fd.writeLock(); err != nil {
+			return nil, nil, true, "", err
+		}
+		defer d.fd.writeUnlock()
+		if err := d.fd.pd.prepareWrite(d.fd.isFile); err != nil {
+			return nil, nil, true, "", err
+		}
+	}
+
+	sc, err = b.run(src, in, bds)
+	written = make([]int64, len(bds))
+	errs = make([]error, len(bds))
+	for i, d := range bds {
+		written[i] = d.written
+		errs[i] = d.err
+		if atomic.LoadInt32(&d.dropped) != 0 {
+			errs[i] = ErrBroadcastDropped
+		}
+	}
+	return written, errs, true, sc, err
+}
+
+// run moves the data from src to the destinations' pipes, and returns
+// once src is exhausted or no destination is left, and every
+// destination's goroutine has exited.
+func (b *Broadcast) run(src *FD, in *pipe, bds []*broadcastDst) (sc string, err error) {
+	var wg sync.WaitGroup
+	for _, d := range bds {
+		wg.Add(1)
+		go func(d *broadcastDst) {
+			defer wg.Done()
+			d.pump()
+		}(d)
+	}
+	defer func() {
+		for _, d := range bds {
+			if !d.stopped {
+				close(d.work)
+			}
+		}
+		wg.Wait()
+	}()
+
+	targets := make([]*broadcastDst, 0, len(bds))
+	for {
+		if in.data == 0 {
+			_, err := in.drainFrom(src, in.size)
+			if err == syscall.EAGAIN {
+				if err := src.pd.waitRead(src.isFile); err != nil {
+					return "", err
+				}
+				continue
+			}
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "splice", err
+			}
+			continue
+		}
+
+		targets = targets[:0]
+		var deadline time.Time
+		if b.DropAfter > 0 {
+			deadline = time.Now().Add(b.DropAfter)
+		}
+		for _, d := range bds {
+			if d.stopped {
+				continue
+			}
+			if !d.acquire(deadline) {
+				d.stopped = true
+				close(d.work)
+				continue
+			}
+			targets = append(targets, d)
+		}
+		if len(targets) == 0 {
+			return "", nil
+		}
+		// Tee the data to every destination but the last, which
+		// takes it from the pipe, leaving the pipe empty.
+		for i, d := range targets {
+			var n int64
+			var err error
+			sc := "tee"
+			if i < len(targets)-1 {
+				n, err = syscall.Tee(in.rfd, d.p.wfd, in.data, spliceNonblock)
+			} else {
+				sc = "splice"
+				// splice returns an int on some 32-bit
+				// architectures.
+				m, serr := syscall.Splice(in.rfd, nil, d.p.wfd, nil, in.data, spliceNonblock)
+				n, err = int64(m), serr
+			}
+			if err == nil && int(n) != in.data {
+				// The destination pipe is sized so that
+				// this can't happen.
+				err = syscall.EAGAIN
+			}
+			if err != nil {
+				return sc, err
+			}
+			d.work <- in.data
+		}
+		in.data = 0
+	}
+}
+
+// acquire reserves room in d's pipe for a batch, waiting for d to make
+// room. If deadline is not zero and passes first, d is dropped. acquire
+// reports whether d can take the batch.
+func (d *broadcastDst) acquire(deadline time.Time) bool {
+	if deadline.IsZero() {
+		select {
+		case d.slots <- struct{}{}:
+			return true
+		case <-d.dead:
+			return false
+		}
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-d.dead:
+		return false
+	default:
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-d.dead:
+		return false
+	case <-t.C:
+	}
+	atomic.StoreInt32(&d.dropped, 1)
+	d.fd.SetWriteDeadline(time.Unix(1, 0))
+	return false
+}
+
+// pump writes the batches teed into d's pipe to d's destination, until
+// the broadcast closes d.work.
+func (d *broadcastDst) pump() {
+	for n := range d.work {
+		d.p.data += n
+		for d.err == nil && d.p.data > 0 {
+			if atomic.LoadInt32(&d.dropped) != 0 {
+				d.err = ErrBroadcastDropped
+				break
+			}
+			n, err := d.p.pumpTo(d.fd, d.p.data)
+			if err == syscall.EAGAIN {
+				d.err = d.fd.pd.waitWrite(d.fd.isFile)
+				continue
+			}
+			if err != nil {
+				d.err = err
+				break
+			}
+			d.written += int64(n)
+		}
+		if d.err != nil {
+			// Keep accounting for the batches still on their
+			// way, so that the pipe is not pooled with data in
+			// it.
+			select {
+			case <-d.dead:
+			default:
+				close(d.dead)
+			}
+			continue
+		}
+		<-d.slots
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// spliceGift is SPLICE_F_GIFT from <fcntl.h>: the pages passed
+	// to vmsplice are not touched again by the caller.
+	spliceGift = 0x8
+
+	// maxDatagramSize is the size of the largest datagram payload.
+	maxDatagramSize = 1 << 16
+
+	// datagramBatchSize is the size of the memory into which a batch
+	// of datagrams is read before it is moved to the pipe. A batch
+	// ends once the memory left can't be sure to hold a datagram.
+	datagramBatchSize = 4 * maxDatagramSize
+)
+
+// SpliceFromDatagrams reads datagrams from src, a datagram socket, and
+// writes their payloads, in the order in which they were received, to the
+// stream dst, until reading from src fails. It returns the number of
+// bytes written to dst.
+//
+// The datagrams are read into memory of their own, outside of the Go
+// heap, which is moved into a pipe with vmsplice and then unmapped, and
+// spliced from the pipe to dst. So the payloads are copied once, when
+// they are read, rather than twice, and unmapping the memory ensures
+// that the data dst still refers to is never overwritten.
+//
+// If err != nil, sc is the system call which caused the error.
+func SpliceFromDatagrams(dst, src *FD) (written int64, spliced bool, sc string, err error) {
+	if !dst.IsStream || src.IsStream {
+		return 0, false, "", syscall.EINVAL
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, true, "", err
+	}
+
+	for {
+		b, err := syscall.Mmap(-1, 0, datagramBatchSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+		if err != nil {
+			return written, true, "mmap", err
+		}
+		n, rsc, rerr := readDatagrams(src, b)
+		n, sc, err := p.giveTo(dst, b[:n])
+		written += int64(n)
+		syscall.Munmap(b)
+		if err != nil {
+			return written, true, sc, err
+		}
+		if rerr != nil {
+			return written, true, rsc, rerr
+		}
+	}
+}
+
+// readDatagrams reads datagrams from src into b, one after the other,
+// until b may not have room for another one or src has no more
+// datagrams ready. It waits for the first datagram, if need be. It
+// returns the size of the payloads read, and the error which stopped the
+// batch, if any, after which the payloads read still have to be
+// written.
+func readDatagrams(src *FD, b []byte) (n int, sc string, err error) {
+	for len(b)-n >= maxDatagramSize {
+		m, err := syscall.Read(src.Sysfd, b[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			if n > 0 {
+				return n, "", nil
+			}
+			if err = src.pd.waitRead(src.isFile); err != nil {
+				return n, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return n, "read", err
+		}
+		n += m
+	}
+	return n, "", nil
+}
+
+// giveTo moves b into the pipe with vmsplice, and splices it to dst,
+// waiting for dst as needed. b must not be written to afterwards, since
+// the pipe, and then dst, may refer to its pages rather than to a copy.
+// It returns the number of bytes written to dst.
+func (p *pipe) giveTo(dst *FD, b []byte) (written int, sc string, err error) {
+	for len(b) > 0 || p.data > 0 {
+		if len(b) > 0 && p.data < p.size {
+			iov := syscall.Iovec{Base: &b[0]}
+			iov.SetLen(len(b))
+			n, _, errno := syscall.Syscall6(syscall.SYS_VMSPLICE, uintptr(p.wfd), uintptr(unsafe.Pointer(&iov)), 1, spliceNonblock|spliceGift, 0, 0)
+			if errno != 0 && errno != syscall.EAGAIN {
+				return written, "vmsplice", errno
+			}
+			if errno == 0 {
+				p.data += int(n)
+				b = b[n:]
+			}
+		}
+		n, err := p.pumpTo(dst, p.data)
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return written, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return written, "splice", err
+		}
+		written += n
+	}
+	return written, "", nil
+}
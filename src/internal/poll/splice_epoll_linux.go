@@ -0,0 +1,132 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import "syscall"
+
+// dedicatedPollInterval is the longest time, in milliseconds, that a
+// dedicatedPoller waits in epoll_wait before checking the descriptors
+// for an expired deadline or a concurrent Close.
+const dedicatedPollInterval = 10
+
+// epollET is EPOLLET as an event mask; syscall.EPOLLET is negative on
+// some architectures.
+const epollET = 1 << 31
+
+// A dedicatedPoller waits for the descriptors of a splice with an epoll
+// instance of its own, on the calling thread, rather than parking the
+// goroutine in the runtime's shared poller. This avoids a wakeup from
+// the poller's thread for every wait, which pays off when the relay runs
+// on a goroutine locked to its own OS thread.
+//
+// Like the runtime's poller, a dedicatedPoller uses edge-triggered
+// notifications and remembers readiness it has seen but not yet used.
+type dedicatedPoller struct {
+	epfd     int
+	src, dst *FD
+
+	srcReady, dstReady bool
+}
+
+// newDedicatedPoller returns a dedicatedPoller for src and dst. If err
+// != nil, sc is the system call which caused the error.
+func newDedicatedPoller(src, dst *FD) (*dedicatedPoller, string, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, "epoll_create1", err
+	}
+	dp := &dedicatedPoller{epfd: epfd, src: src, dst: dst}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | epollET, Fd: int32(src.Sysfd)}
+	if dst.Sysfd == src.Sysfd {
+		// An echo relay; a descriptor can only be added once.
+		ev.Events |= syscall.EPOLLOUT
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, src.Sysfd, &ev); err != nil {
+		CloseFunc(epfd)
+		return nil, "epoll_ctl", err
+	}
+	if dst.Sysfd == src.Sysfd {
+		return dp, "", nil
+	}
+	ev = syscall.EpollEvent{Events: syscall.EPOLLOUT | epollET, Fd: int32(dst.Sysfd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, dst.Sysfd, &ev); err != nil {
+		CloseFunc(epfd)
+		return nil, "epoll_ctl", err
+	}
+	return dp, "", nil
+}
+
+const (
+	dedicatedReadEvents  = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLERR | syscall.EPOLLHUP
+	dedicatedWriteEvents = syscall.EPOLLOUT | syscall.EPOLLERR | syscall.EPOLLHUP
+)
+
+// close releases the epoll instance.
+func (dp *dedicatedPoller) close() {
+	if dp != nil {
+		CloseFunc(dp.epfd)
+	}
+}
+
+// waitRead waits until src is readable. If dp is nil, it waits in the
+// runtime's poller.
+func (dp *dedicatedPoller) waitRead(src *FD) error {
+	if dp == nil {
+		return src.pd.waitRead(src.isFile)
+	}
+	for !dp.srcReady {
+		if err := src.pd.prepareRead(src.isFile); err != nil {
+			return err
+		}
+		if err := dp.poll(); err != nil {
+			return err
+		}
+	}
+	dp.srcReady = false
+	return nil
+}
+
+// waitWrite waits until dst is writable. If dp is nil, it waits in the
+// runtime's poller.
+func (dp *dedicatedPoller) waitWrite(dst *FD) error {
+	if dp == nil {
+		return dst.pd.waitWrite(dst.isFile)
+	}
+	for !dp.dstReady {
+		if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+			return err
+		}
+		if err := dp.poll(); err != nil {
+			return err
+		}
+	}
+	dp.dstReady = false
+	return nil
+}
+
+// poll waits for at most dedicatedPollInterval for events on src or dst
+// and records them.
+func (dp *dedicatedPoller) poll() error {
+	var events [2]syscall.EpollEvent
+	n, err := syscall.EpollWait(dp.epfd, events[:], dedicatedPollInterval)
+	if err == syscall.EINTR {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, ev := range events[:n] {
+		// Errors and hangups are reported to whichever side
+		// waits next, by the splice that follows the wakeup.
+		// src and dst may be the same descriptor.
+		if int(ev.Fd) == dp.src.Sysfd && ev.Events&dedicatedReadEvents != 0 {
+			dp.srcReady = true
+		}
+		if int(ev.Fd) == dp.dst.Sysfd && ev.Events&dedicatedWriteEvents != 0 {
+			dp.dstReady = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,2635 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// spliceNonblock makes calls to splice(2) non-blocking.
+	spliceNonblock = 0x2
+
+	// spliceMore tells splice(2) that more data will follow, so that
+	// a TCP socket holds back a partial segment, as for MSG_MORE.
+	spliceMore = 0x4
+
+	// maxCaptureSize is the maximum amount of data a relay passes to
+	// its Capture function at once.
+	maxCaptureSize = 64 << 10
+
+	// maxSpliceSize is the maximum amount of data Splice asks
+	// the kernel to move in a single call to splice(2).
+	maxSpliceSize = 4 << 20
+
+	// tcpNotSentLowat is the TCP_NOTSENT_LOWAT socket option, which
+	// package syscall lacks.
+	tcpNotSentLowat = 0x19
+)
+
+// Splice transfers at most remain bytes of data from src to dst, using the
+// splice system call to minimize copies of data from and to userspace.
+//
+// Splice creates a temporary pipe, to serve as a buffer for the data transfer.
+// src and dst must both be stream-oriented sockets. Splice has no notion of
+// message boundaries, so it does not handle packet-oriented descriptors.
+// src and dst may be the same socket, to echo its input back to its peer;
+// the read and write locks of an FD are independent. src may also be the
+// read end of a pipe, which reaches EOF once its writers are closed; until
+// then, Splice waits for more data, however long the pipe is idle.
+//
+// An error left pending on src by an earlier operation, which splice
+// reports as EOF, is returned if src reaches EOF before any data is
+// transferred; see pendingError.
+//
+// If err != nil, sc is the system call which caused the error.
+func Splice(dst, src *FD, remain int64) (written int64, handled bool, sc string, err error) {
+	var r Relay
+	return r.Splice(dst, src, remain)
+}
+
+// A Relay holds the parameters of a splice between two descriptors.
+// The zero value splices with the default parameters.
+type Relay struct {
+	// PreferDrain makes the relay fill its pipe from src, until the
+	// pipe is full or src would block, before pumping the pipe to dst.
+	// This trades latency for fewer, larger writes to dst. By default,
+	// data is pumped to dst as soon as it has been drained from src.
+	PreferDrain bool
+
+	// MaxPipeFDs, if positive, limits the file descriptors held by
+	// the pipes of the splice functions, as reported by PipeFDs, when
+	// the relay needs a new pipe. Once the limit is reached, the relay
+	// does as LimitPolicy says. Pooled pipes are reused regardless.
+	MaxPipeFDs int
+
+	// LimitPolicy is the policy of the relay once MaxPipeFDs is
+	// reached: PipeLimitFallback, PipeLimitWait or PipeLimitExceed.
+	LimitPolicy int
+
+	// Urgent makes the relay forward TCP urgent data as urgent data:
+	// the data before the mark is written to dst first, then the
+	// urgent byte is sent with MSG_OOB, and the splice resumes after
+	// it. If dst does not support urgent data, the byte is dropped, as
+	// it is by a copy made with read and write. An urgent byte which
+	// arrives after the data before it has been spliced does not make
+	// src readable, so it is only forwarded once more data, or EOF,
+	// follows. Checking for the mark costs a system call each time src
+	// runs dry, so without Urgent, the relay stops at the mark as
+	// splice does: it reports EOF there if the peer has shut down its
+	// side of the connection, and otherwise waits for more data.
+	Urgent bool
+
+	// DedicatedPoller makes the relay wait for src and dst with an
+	// epoll instance of its own, blocking the calling thread, rather
+	// than in the runtime's shared poller. It is meant for relays on
+	// goroutines locked to an OS thread with runtime.LockOSThread.
+	// Deadlines and Close are noticed with a delay of up to 10ms.
+	// DedicatedPoller is ignored if GOMAXPROCS is 1.
+	DedicatedPoller bool
+
+	// DrainLimit, if positive, limits the data held in the pipe, and
+	// so the size of each splice from src, to DrainLimit bytes. A
+	// small limit lets dst see the data sooner after a burst from src,
+	// at the cost of more system calls.
+	DrainLimit int
+
+	// AdaptivePipe makes the relay resize its pipe as the traffic
+	// changes: the pipe grows, up to 1 MiB, while src keeps filling
+	// it, and shrinks, down to 16 KiB, while only a small part of it
+	// is used, so that idle relays hold less kernel memory.
+	AdaptivePipe bool
+
+	// LowWater, if positive, sets the SO_RCVLOWAT option of src to
+	// LowWater bytes for the duration of the splice, so that the
+	// relay is woken, and drains src, only once that much data has
+	// arrived. EOF wakes the relay regardless. LowWater is capped
+	// to the data the pipe holds, and lowered to the remaining data
+	// when less than that is left to copy. The previous value of the
+	// option is restored before Splice returns.
+	LowWater int
+
+	// PipeSize, if positive, resizes the pipe to PipeSize bytes, or
+	// as close to it as the kernel allows, for the duration of the
+	// splice. By default the pipe has the kernel's default size,
+	// usually 64 KiB.
+	PipeSize int
+
+	// NotSentLowWater, if positive, sets the TCP_NOTSENT_LOWAT option
+	// of dst to NotSentLowWater bytes for the duration of the splice,
+	// so that dst is writable, and the relay pumps to it, only while
+	// less than that is queued on it unsent. Unless PipeSize is set,
+	// the pipe is also shrunk to NotSentLowWater bytes, or as close to
+	// it as the kernel allows, so that little data waits in the pipe
+	// either. The previous value of the option is restored before
+	// Splice returns.
+	NotSentLowWater int
+
+	// Stats, if not nil, accumulates the time spent by the relay
+	// waiting for its descriptors and moving data.
+	Stats *RelayStats
+
+	// Account, if not nil, is called after each splice to dst with
+	// the number of bytes written so far. If it returns an error,
+	// Splice returns that error at once, discarding the data left in
+	// the pipe.
+	Account func(written int64) error
+
+	// Budget, if not nil, paces the data pumped to dst. The relay
+	// pumps no more than Budget makes available; while nothing is,
+	// the data stays in the pipe, and the relay neither pumps nor
+	// drains until the budget replenishes. Deadlines and Done are
+	// noticed within 10ms while the relay waits for its budget.
+	Budget RelayBudget
+
+	// Inspect, if not empty, receives a copy of the first len(Inspect)
+	// bytes spliced, or as many as there are, which are duplicated with
+	// tee(2) from the pipe as they are drained from src, without
+	// holding up their splice to dst. A redirected relay fills no part
+	// of Inspect.
+	Inspect []byte
+
+	// Capture, if not nil, is passed a copy of the data spliced, as it
+	// is drained from src, before it is pumped to dst, in order and
+	// with each byte passed once. The copy is duplicated with tee(2)
+	// from the pipe and read into a buffer, which Capture must not
+	// retain. A redirected relay passes nothing to Capture.
+	Capture func(b []byte)
+
+	// Timestamp, if not nil, enables transmit timestamps of the data
+	// spliced to dst, a TCP socket, with its SO_TIMESTAMPING option
+	// for the duration of the splice, and is called with each one
+	// reaped from dst's error queue: the offset in the data spliced
+	// just past the bytes stamped, whether the peer acknowledging them
+	// rather than their transmission was stamped, and the software
+	// and hardware times, either of which may be zero. The error
+	// queue is reaped after each splice to dst, and once the transfer
+	// ends; a transfer which completes first waits, for up to a
+	// second, for the acknowledgment of all its data. The previous
+	// value of the option is restored before Splice returns.
+	// Redirected relays report no timestamps.
+	Timestamp func(offset int64, acked bool, sw, hw time.Time)
+
+	// Redirected tells the relay that the kernel itself moves the
+	// data of src to dst, as an eBPF program attached to a sockmap
+	// holding src does with bpf_sk_redirect_map. The relay then uses
+	// no pipe: it waits for src to reach EOF and for the data to be
+	// queued on dst, and reports how much data src received. Data
+	// found queued for reading on src makes Splice return
+	// ErrNotRedirected. Redirected relays ignore remain, and relays
+	// between sockets which are not TCP splice as usual.
+	Redirected bool
+
+	// SliceEnd, if not zero, ends the relay's time slice: from then
+	// on, the relay drains no more data from src, pumps the data left
+	// in its pipe to dst, and returns ErrSliceExpired. A wait for src
+	// which fails with ErrTimeout once the slice is over, because the
+	// caller has set the read deadline of src to SliceEnd, ends the
+	// slice too. A transfer which completes is not cut short.
+	SliceEnd time.Time
+
+	// Header, if not empty, is written to dst before any data is
+	// spliced, under the lock on dst which Splice holds for the whole
+	// transfer, so that no other write to dst comes between Header
+	// and the data. Header is written once Splice has its pipe; if
+	// Splice returns handled == false, none of it has been written.
+	// Header is not counted in written. Redirected is ignored when
+	// there is a Header, which the kernel would not put first.
+	Header []byte
+
+	// ID, if not empty, identifies the relay to SpliceTrace.
+	ID string
+
+	// Done, if not nil, cancels the relay when it is closed. A
+	// cancelled relay makes a best-effort attempt to pump the data
+	// left in its pipe to dst, releases the pipe and returns
+	// ErrCanceled.
+	Done <-chan struct{}
+}
+
+// A RelayBudget limits the rate at which a Relay writes to dst.
+type RelayBudget interface {
+	// Available returns how many of the next want bytes may be
+	// written now. If it returns 0, wait is how long until some may.
+	Available(want int) (n int, wait time.Duration)
+
+	// Spend records that n bytes were written.
+	Spend(n int)
+}
+
+// waitBudget waits for up to d, or until r is canceled or dst is closed
+// or reaches its deadline. It waits for at least 1ms, so that a budget
+// which reports no wait doesn't make the relay spin.
+func (r *Relay) waitBudget(dst *FD, d time.Duration) error {
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	w := watchRelay(dst, nil)
+	defer w.stop()
+	for {
+		if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+			return err
+		}
+		select {
+		case <-r.Done:
+			return nil
+		case <-t.C:
+			return nil
+		case <-w.dstChanged:
+			w.renew()
+		case <-w.expired:
+			return ErrTimeout
+		}
+	}
+}
+
+// A relayWatch wakes a relay which waits for something other than its
+// descriptors, such as a pipe or its budget, once one of them is closed,
+// has a deadline set, or reaches its deadline. The relay checks the
+// descriptors after starting or renewing the watch, so that it misses
+// none of these.
+type relayWatch struct {
+	dst, src *FD
+	// dstChanged and srcChanged are closed once dst or src is closed
+	// or has a deadline set; srcChanged is nil if src isn't watched.
+	dstChanged, srcChanged <-chan struct{}
+	timer                  *time.Timer
+	// expired receives once the earlier deadline of dst and src
+	// passes; it is nil if neither has one.
+	expired <-chan time.Time
+}
+
+// watchRelay starts watching dst for writing and, if src is not nil, src
+// for reading.
+func watchRelay(dst, src *FD) *relayWatch {
+	w := &relayWatch{dst: dst, src: src}
+	w.renew()
+	return w
+}
+
+// renew watches the descriptors again, once one has changed.
+func (w *relayWatch) renew() {
+	w.stop()
+	var deadline, rd int64
+	w.dstChanged, deadline = w.dst.pd.watch('w')
+	if w.src != nil {
+		w.srcChanged, rd = w.src.pd.watch('r')
+		if rd != 0 && (deadline == 0 || rd < deadline) {
+			deadline = rd
+		}
+	}
+	w.timer, w.expired = nil, nil
+	if deadline != 0 {
+		w.timer = time.NewTimer(time.Duration(deadline - runtimeNano()))
+		w.expired = w.timer.C
+	}
+}
+
+// stop stops the timer of the watch, if any.
+func (w *relayWatch) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// relayTimer divides the duration of a splice between waiting and
+// moving data. Its methods do nothing if the timer has not been
+// started.
+type relayTimer struct {
+	start, waitStart time.Time
+	waited           time.Duration
+
+	readWaits, drains, drained int64
+	writeWaits, pumps, pumped  int64
+}
+
+func (t *relayTimer) begin() {
+	t.start = time.Now()
+}
+
+func (t *relayTimer) beginWait() {
+	if !t.start.IsZero() {
+		t.waitStart = time.Now()
+	}
+}
+
+func (t *relayTimer) endWait() {
+	if !t.start.IsZero() {
+		t.waited += time.Since(t.waitStart)
+	}
+}
+
+// drain records a splice of n bytes from src.
+func (t *relayTimer) drain(n int) {
+	t.drains++
+	t.drained += int64(n)
+}
+
+// pump records a splice of n bytes to dst.
+func (t *relayTimer) pump(n int) {
+	t.pumps++
+	t.pumped += int64(n)
+}
+
+// flush adds what t has recorded since it began, or since it was last
+// flushed, to st.
+func (t *relayTimer) flush(st *RelayStats) {
+	now := time.Now()
+	total := now.Sub(t.start)
+	atomic.AddInt64(&st.WaitNanos, int64(t.waited))
+	atomic.AddInt64(&st.ActiveNanos, int64(total-t.waited))
+	atomic.AddInt64(&st.ReadWaits, t.readWaits)
+	atomic.AddInt64(&st.Drains, t.drains)
+	atomic.AddInt64(&st.DrainedBytes, t.drained)
+	atomic.AddInt64(&st.WriteWaits, t.writeWaits)
+	atomic.AddInt64(&st.Pumps, t.pumps)
+	atomic.AddInt64(&st.PumpedBytes, t.pumped)
+	*t = relayTimer{start: now}
+}
+
+// ErrCanceled is returned by Relay.Splice when the relay's Done channel
+// is closed before the transfer completes.
+var ErrCanceled = errors.New("splice canceled")
+
+// ErrSliceExpired is returned by Relay.Splice when the relay's time slice
+// ends before the transfer completes.
+var ErrSliceExpired = errors.New("relay time slice expired")
+
+// sliceOver reports whether r's time slice, if any, has ended.
+func (r *Relay) sliceOver() bool {
+	return !r.SliceEnd.IsZero() && !time.Now().Before(r.SliceEnd)
+}
+
+// canceled reports whether r's Done channel is closed.
+func (r *Relay) canceled() bool {
+	select {
+	case <-r.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closing reports whether fd has been closed. The locks of a copy keep
+// the descriptor of fd open until the copy returns, but a copy which
+// never waits for fd would not otherwise notice the Close.
+func (fd *FD) closing() bool {
+	return atomic.LoadUint64(&fd.fdmu.state)&mutexClosed != 0
+}
+
+// SpliceTrace, if not nil, is called as each transfer handled by
+// Relay.Splice ends, with the descriptors, the number of bytes written,
+// the size of the pipe, the send buffer of dst if it was small enough
+// to limit the data handed to dst at once or else 0, and how the
+// transfer ended: "eof", "limit", "canceled", or the error which
+// stopped it, and the ID of the Relay.
+var SpliceTrace func(dst, src int, written int64, pipeSize, sendBuf int, end, id string)
+
+// The ways in which a transfer handled by Relay.Splice ends, which
+// index spliceEnds.
+const (
+	endEOF      = iota // src reached EOF and the pipe was emptied to dst
+	endLimit           // remain bytes were copied
+	endCanceled        // the relay was canceled
+	endExpired         // the relay's time slice ended
+	endError           // the transfer failed
+	numEnds
+)
+
+// spliceEnds counts the transfers handled by Relay.Splice by how they
+// ended. It is updated atomically.
+var spliceEnds [numEnds]uint64
+
+// countEnd counts a transfer handled by Relay.Splice which returned err
+// with remain bytes left to copy.
+func countEnd(err error, remain int64) {
+	end := endError
+	switch {
+	case err == nil && remain == 0:
+		end = endLimit
+	case err == nil:
+		end = endEOF
+	case err == ErrCanceled:
+		end = endCanceled
+	case err == ErrSliceExpired:
+		end = endExpired
+	}
+	atomic.AddUint64(&spliceEnds[end], 1)
+}
+
+// SpliceEnds returns the numbers of transfers handled by Relay.Splice
+// since the program started which ended because src reached EOF, because
+// remain bytes were copied, because the relay was canceled, because its
+// time slice ended, and because of an error.
+func SpliceEnds() (eof, limit, canceled, expired, failed uint64) {
+	return atomic.LoadUint64(&spliceEnds[endEOF]),
+		atomic.LoadUint64(&spliceEnds[endLimit]),
+		atomic.LoadUint64(&spliceEnds[endCanceled]),
+		atomic.LoadUint64(&spliceEnds[endExpired]),
+		atomic.LoadUint64(&spliceEnds[endError])
+}
+
+// Splice is like the Splice function, but uses the parameters in r.
+func (r *Relay) Splice(dst, src *FD, remain int64) (written int64, handled bool, sc string, err error) {
+	if !src.IsStream || !dst.IsStream {
+		return 0, false, "", nil
+	}
+	defer func() {
+		if handled {
+			countEnd(err, remain)
+		}
+	}()
+	if r.Redirected && len(r.Header) == 0 {
+		if written, handled, sc, err := r.spliceRedirected(dst, src); handled {
+			return written, handled, sc, err
+		}
+	}
+	// The pipes are taken before the locks on src and dst, since the
+	// relay may wait for them, and a waiting relay must not hold up
+	// other reads from src or writes to dst. A deadline which has
+	// already passed, or a closed descriptor, fails the transfer
+	// before it takes a pipe.
+	if err := checkRelay(dst, src); err != nil {
+		return 0, true, "", err
+	}
+	// tp, through which data is duplicated into r.Inspect and for
+	// r.Capture, is taken along with p, so that a relay which runs
+	// short of pipes does so before it moves any data.
+	tee := len(r.Inspect) > 0 || r.Capture != nil
+	p, tp, sc, err := r.getPipes(dst, src, tee)
+	switch {
+	case err == errPipeLimit || sc != "":
+		// The pipes could not be had, so let the caller copy the
+		// data by other means.
+		return 0, false, sc, err
+	case err != nil:
+		return 0, true, "", err
+	}
+	// A cancelled relay releases its pipes rather than pooling them,
+	// so that no descriptor outlives the transfer it was made for.
+	defer func() {
+		for _, p := range [...]*pipe{p, tp} {
+			switch {
+			case p == nil:
+			case err == ErrCanceled:
+				runtime.SetFinalizer(p, nil)
+				p.release()
+			default:
+				putPipe(p)
+			}
+		}
+	}()
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, true, "", err
+	}
+	var sndbuf sendBuffer
+	if SpliceTrace != nil {
+		defer func() {
+			if !handled {
+				return
+			}
+			var end string
+			switch {
+			case err == nil && remain == 0:
+				end = "limit"
+			case err == nil:
+				end = "eof"
+			case err == ErrCanceled:
+				end = "canceled"
+			case sc != "":
+				end = sc + ": " + err.Error()
+			default:
+				end = err.Error()
+			}
+			var sendBuf int
+			if sndbuf.capped {
+				sendBuf = sndbuf.size
+			}
+			SpliceTrace(dst.Sysfd, src.Sysfd, written, p.size, sendBuf, end, r.ID)
+		}()
+	}
+
+	// With a single P, the thread blocked in the dedicated poller
+	// would keep every other goroutine from running.
+	var dp *dedicatedPoller
+	if r.DedicatedPoller && runtime.GOMAXPROCS(0) > 1 {
+		if dp, sc, err = newDedicatedPoller(src, dst); err != nil {
+			return 0, false, sc, err
+		}
+		defer dp.close()
+	}
+
+	if len(r.Header) > 0 {
+		if sc, err := writeAll(dst, r.Header); err != nil {
+			return 0, true, sc, err
+		}
+	}
+
+	// The wait for the timestamps of the last acknowledgments comes
+	// after the transfer, and so out of its stats.
+	var ts *txTimestamps
+	if r.Timestamp != nil {
+		if t, ok := enableTimestamps(dst, r.Timestamp); ok {
+			ts = t
+			defer func() {
+				ts.finish(r, dst, written, err == nil)
+			}()
+		}
+	}
+
+	var timer relayTimer
+	if r.Stats != nil {
+		timer.begin()
+		defer timer.flush(r.Stats)
+	}
+
+	if size := r.pipeSize(p); size != p.size {
+		// Best-effort: the pipe keeps its size if the kernel
+		// refuses the new one. putPipe restores the size.
+		p.resize(size)
+	}
+	if r.NotSentLowWater > 0 {
+		if old, ok := setNotSentLowWater(dst, r.NotSentLowWater); ok {
+			defer setNotSentLowWater(dst, old)
+		}
+	}
+
+	// pipeFull is set when the pipe refuses more data before p.size
+	// bytes are buffered. The kernel spends a pipe buffer slot on every
+	// chunk of socket data it moves, so a pipe can run out of slots
+	// well before it runs out of bytes when the chunks are small.
+	limit := r.limit(p)
+	lowat := r.lowWater(src, limit, remain)
+	if lowat.size > 0 {
+		defer lowat.restore(src)
+	}
+	var sizer pipeSizer
+	sndbuf.read(dst)
+	// inspected and captured are the numbers of bytes copied to
+	// r.Inspect and passed to r.Capture, through tp.
+	var inspected, captured int64
+	var capBuf []byte
+	// atMark is set when src has been drained up to the mark of its
+	// urgent data, which splice does not move past. unsure is set when
+	// srcEAGAIN may have come from a full pipe rather than from src.
+	var srcEAGAIN, dstEAGAIN, pipeFull, seenEOF, atMark, unsure bool
+	// sizeSynced is set once the size of the pipe has been checked
+	// against the kernel's.
+	var sizeSynced bool
+	// sliceOver is set once the relay's time slice has ended.
+	var sliceOver bool
+	for {
+		if r.canceled() {
+			if p.data > 0 {
+				if n, err := p.pumpTo(dst, p.data); err == nil {
+					written += int64(n)
+					if r.Budget != nil {
+						r.Budget.Spend(n)
+					}
+				}
+			}
+			return written, true, "", ErrCanceled
+		}
+		if src.closing() {
+			return written, true, "", errClosing(src.isFile)
+		}
+		if dst.closing() {
+			return written, true, "", errClosing(dst.isFile)
+		}
+		if !sliceOver && r.sliceOver() {
+			sliceOver = true
+		}
+		var werr error
+		canDrain := p.data < limit && !pipeFull && remain > 0 && !srcEAGAIN && !seenEOF && !atMark && !sliceOver
+		switch {
+		case p.data == 0 && (seenEOF || remain == 0):
+			// Everything that was asked for has been moved to dst.
+			return written, true, "", nil
+		case p.data == 0 && sliceOver:
+			return written, true, "", ErrSliceExpired
+		case p.data > 0 && !dstEAGAIN && !(r.PreferDrain && canDrain):
+			max := sndbuf.max(p.data)
+			if inspected < int64(len(r.Inspect)) {
+				// Only data which has been copied to
+				// r.Inspect goes to dst.
+				if inspected < written+int64(p.data) {
+					n, sc, err := p.teeInto(tp, r.Inspect[written:])
+					if err != nil {
+						return written, true, sc, err
+					}
+					inspected = written + int64(n)
+				}
+				if n := int(inspected - written); n < max {
+					max = n
+				}
+			}
+			if r.Capture != nil {
+				// Only data which has been captured goes
+				// to dst.
+				if captured < written+int64(p.data) {
+					if capBuf == nil {
+						capBuf = make([]byte, maxCaptureSize)
+					}
+					n, sc, err := p.teeInto(tp, capBuf)
+					if err != nil {
+						return written, true, sc, err
+					}
+					// The head of the pipe may have been
+					// captured before.
+					if skip := int(captured - written); n > skip {
+						r.Capture(capBuf[skip:n])
+						captured = written + int64(n)
+					}
+				}
+				if n := int(captured - written); n < max {
+					max = n
+				}
+			}
+			if r.Budget != nil {
+				n, wait := r.Budget.Available(max)
+				if n <= 0 {
+					// The data stays in the pipe until the
+					// budget allows it to be written.
+					timer.beginWait()
+					werr = r.waitBudget(dst, wait)
+					timer.endWait()
+					break
+				}
+				if n < max {
+					max = n
+				}
+			}
+			n, err := p.pumpTo(dst, max)
+			if err == syscall.EAGAIN {
+				dstEAGAIN = true
+				continue
+			}
+			if err != nil {
+				return written, true, "splice", err
+			}
+			written += int64(n)
+			timer.pump(n)
+			if r.Budget != nil {
+				r.Budget.Spend(n)
+			}
+			if ts != nil {
+				ts.reap(dst, written)
+			}
+			if r.Account != nil {
+				// Account may look at the stats of the
+				// copy so far.
+				if r.Stats != nil {
+					timer.flush(r.Stats)
+				}
+				if err := r.Account(written); err != nil {
+					return written, true, "", err
+				}
+			}
+			pipeFull = false
+			if unsure {
+				// The pipe has room now, so src is tried
+				// before the relay waits for it.
+				srcEAGAIN, unsure = false, false
+			}
+			if r.AdaptivePipe && sizer.settle(p) {
+				limit = r.limit(p)
+			}
+		case atMark && p.data == 0:
+			// The data before the mark has all been moved to
+			// dst, so the urgent byte goes next.
+			n, sc, err := forwardUrgent(dst, src, remain)
+			if err != nil {
+				return written, true, sc, err
+			}
+			written += int64(n)
+			remain -= int64(n)
+			atMark = false
+			if r.Account != nil {
+				if err := r.Account(written); err != nil {
+					return written, true, "", err
+				}
+			}
+		case canDrain:
+			max := limit - p.data
+			if int64(max) > remain {
+				max = int(remain)
+			}
+			n, err := p.drainFrom(src, max)
+			if (err == syscall.EAGAIN || err == io.EOF) && r.Urgent && atUrgentMark(src) {
+				atMark = true
+				continue
+			}
+			if err == syscall.EAGAIN {
+				if p.data == 0 {
+					srcEAGAIN = true
+					continue
+				}
+				// With data in the pipe, EAGAIN may come from
+				// the pipe rather than from src. A pipe which
+				// refuses data short of p.size may be smaller
+				// than recorded.
+				if !sizeSynced && p.data < p.size {
+					sizeSynced = true
+					if p.syncSize() {
+						limit = r.limit(p)
+					}
+				}
+				// Telling the two apart costs a system call,
+				// which only the adaptive pipe needs. Without
+				// it, src is taken to be empty until the pipe
+				// has been pumped, and tried again then.
+				if !r.AdaptivePipe {
+					srcEAGAIN, unsure = true, true
+				} else if srcReadable(src) {
+					pipeFull = true
+					if sizer.observe(p, true) {
+						limit = r.limit(p)
+					}
+				} else {
+					srcEAGAIN = true
+				}
+				continue
+			}
+			if err == io.EOF {
+				// A relay which has moved nothing reports
+				// the error which may lie behind the EOF.
+				if written == 0 && p.data == 0 && len(r.Header) == 0 {
+					if err := pendingError(src); err != nil {
+						return 0, true, "splice", err
+					}
+				}
+				seenEOF = true
+				continue
+			}
+			if err != nil {
+				// EINVAL before any data moved means that
+				// splice does not support this pair of
+				// descriptors, so let the caller fall back.
+				handled = written > 0 || p.data > 0 || err != syscall.EINVAL
+				return written, handled, "splice", err
+			}
+			remain -= int64(n)
+			timer.drain(n)
+			if r.AdaptivePipe && sizer.observe(p, p.data >= p.size) {
+				limit = r.limit(p)
+			}
+		case p.data == 0 && srcEAGAIN:
+			// Nothing to pump until src has more data. Don't
+			// wait for more than is left to copy.
+			if int64(lowat.size) > remain {
+				lowat.set(src, int(remain))
+			}
+			timer.readWaits++
+			timer.beginWait()
+			if !testHookRelaySkipWaitRead() {
+				werr = dp.waitRead(src)
+			}
+			if werr == ErrTimeout && r.sliceOver() {
+				werr = nil
+			}
+			timer.endWait()
+			srcEAGAIN, unsure = false, false
+		case p.data >= limit || pipeFull || seenEOF || remain == 0 || sliceOver:
+			// The pipe can't take any more from src, so dst
+			// has to make room.
+			if ts != nil {
+				// Timestamps queued for dst wake its
+				// waiters, as errors do.
+				ts.reap(dst, written)
+			}
+			timer.writeWaits++
+			timer.beginWait()
+			werr = dp.waitWrite(dst)
+			timer.endWait()
+			if sndbuf.capped {
+				// TCP may have grown the buffer which
+				// held dst back while the relay waited.
+				sndbuf.read(dst)
+			}
+			dstEAGAIN = false
+		default:
+			// The pipe holds some data and has room for more,
+			// but both src and dst would block. The data in the
+			// pipe has to go first, so wait for dst; src is
+			// tried again once dst has taken some of it.
+			testHookRelayBothBlocked()
+			if ts != nil {
+				ts.reap(dst, written)
+			}
+			timer.writeWaits++
+			timer.beginWait()
+			werr = dp.waitWrite(dst)
+			timer.endWait()
+			if sndbuf.capped {
+				// TCP may have grown the buffer which
+				// held dst back while the relay waited.
+				sndbuf.read(dst)
+			}
+			srcEAGAIN, dstEAGAIN, unsure = false, false, false
+		}
+		// A wait interrupted by cancellation, usually through a
+		// deadline in the past, is reported as ErrCanceled at the
+		// top of the loop.
+		if werr != nil && !r.canceled() {
+			return written, true, "", werr
+		}
+	}
+}
+
+// testHookRelayBothBlocked is called when a relay waits with data in its
+// pipe, room for more, and both src and dst blocked.
+var testHookRelayBothBlocked = func() {}
+
+// testHookRelaySkipWaitRead is called when a relay is about to wait for
+// src to become readable. If it returns true, the relay goes on without
+// waiting, as if it had been woken up spuriously.
+var testHookRelaySkipWaitRead = func() bool { return false }
+
+// testHookSplicerWaitedWrite is called when a Splicer has waited for
+// dst to become writable, before it writes to dst again.
+var testHookSplicerWaitedWrite = func() {}
+
+// srcReadable reports whether src, a socket, has data ready to be read.
+// A splice from src into a pipe which already holds data fails with
+// EAGAIN if either src is empty or the pipe is full, which srcReadable
+// tells apart. If src can't be checked, it is assumed to be readable.
+func srcReadable(src *FD) bool {
+	var b [1]byte
+	_, _, err := syscall.Recvfrom(src.Sysfd, b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	return err != syscall.EAGAIN
+}
+
+// SetSharedBlocking records that fd, a socket which the poller watches,
+// is in blocking mode, which it shares with other descriptors for the
+// same socket and which must therefore be left alone. Splices then check
+// that fd is ready before each system call which could block on it, and
+// wait for the poller if it isn't, rather than relying on EAGAIN.
+func (fd *FD) SetSharedBlocking() {
+	fd.isBlocking = true
+}
+
+// ready reports whether poll reports any of events, or an error or hang
+// up, on fd, without waiting. If poll fails, fd is taken to be ready.
+func ready(fd int, events int16) bool {
+	pfd := struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{fd: int32(fd), events: events}
+	var ts syscall.Timespec
+	n, _, e := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	return e != 0 || n > 0
+}
+
+// blockingSendMax returns how much of n bytes can be spliced to dst, a
+// socket in blocking mode which poll reported writable, without blocking:
+// half of the room left in its send buffer, which also holds the
+// kernel's bookkeeping for the data, but at least a page, which a
+// writable socket always takes.
+func blockingSendMax(dst *FD, n int) int {
+	max := syscall.Getpagesize()
+	size, err := syscall.GetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if queued, ok := tcpOutq(dst.Sysfd); err == nil && ok && (size-int(queued))/2 > max {
+		max = (size - int(queued)) / 2
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// pendingError returns the error pending on src, a socket, if any. The
+// kernel's splice, like read, reports EOF rather than a pending error
+// once the peer has shut down its side of the connection, so a relay
+// started on a TCP socket which received a FIN and then a reset would
+// otherwise complete without a word, having moved nothing.
+//
+// Reading SO_ERROR clears the error, so it is only read once poll has
+// reported POLLERR, and the error is then returned to the caller.
+func pendingError(src *FD) error {
+	pfd := struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{fd: int32(src.Sysfd)}
+	var ts syscall.Timespec
+	_, _, e := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if e != 0 || pfd.revents&_POLLERR == 0 {
+		return nil
+	}
+	errno, err := syscall.GetsockoptInt(src.Sysfd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil || errno == 0 {
+		return nil
+	}
+	return syscall.Errno(errno)
+}
+
+// Poll events: data to read, room to write, and an error pending.
+const (
+	_POLLIN  = 0x1
+	_POLLOUT = 0x4
+	_POLLERR = 0x8
+)
+
+// atUrgentMark reports whether src, a socket, has been read up to the
+// mark of TCP urgent data. splice stops at the mark, however much data
+// follows it, and reports EAGAIN there, or EOF if the peer has shut down
+// its side of the connection.
+func atUrgentMark(src *FD) bool {
+	var mark int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(src.Sysfd), syscall.SIOCATMARK, uintptr(unsafe.Pointer(&mark)))
+	return errno == 0 && mark != 0
+}
+
+// forwardUrgent sends the urgent byte at the mark of src to dst as urgent
+// data, and then reads past the mark with an ordinary read of at most one
+// byte, which splice can't do, and writes the byte read, if any, to dst.
+// If src has SO_OOBINLINE set, the urgent byte is only read by the
+// ordinary read, and so is forwarded in-band. forwardUrgent returns the
+// number of bytes read from src, all of which have been written to dst.
+// If err != nil, sc is the system call which caused the error.
+func forwardUrgent(dst, src *FD, remain int64) (n int, sc string, err error) {
+	var b [1]byte
+	for {
+		_, _, err = syscall.Recvfrom(src.Sysfd, b[:], syscall.MSG_OOB)
+		if err != syscall.EAGAIN {
+			break
+		}
+		// The urgent pointer arrived ahead of the urgent byte.
+		if err = src.pd.waitRead(src.isFile); err != nil {
+			return 0, "", err
+		}
+	}
+	switch err {
+	case nil:
+		n = 1
+		for {
+			_, err = syscall.SendmsgN(dst.Sysfd, b[:], nil, nil, syscall.MSG_OOB)
+			if err != syscall.EAGAIN {
+				break
+			}
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return n, "", err
+			}
+		}
+		if err != nil && err != syscall.EOPNOTSUPP {
+			return n, "sendmsg", err
+		}
+	case syscall.EINVAL:
+		// The urgent byte is in-band, or has already been read.
+	default:
+		return 0, "recvfrom", err
+	}
+
+	for remain > int64(n) {
+		m, _, err := syscall.Recvfrom(src.Sysfd, b[:], 0)
+		if err == syscall.EAGAIN && n == 0 {
+			// Nothing has moved, so the in-band urgent byte
+			// has yet to arrive.
+			if err = src.pd.waitRead(src.isFile); err != nil {
+				return n, "", err
+			}
+			continue
+		}
+		if err == syscall.EAGAIN {
+			// The read only skipped the urgent byte.
+			break
+		}
+		if err != nil {
+			return n, "recvfrom", err
+		}
+		if m > 0 {
+			if sc, err := writeAll(dst, b[:m]); err != nil {
+				return n, sc, err
+			}
+			n += m
+		}
+		break
+	}
+	return n, "", nil
+}
+
+// lowWater is the SO_RCVLOWAT option of a relay's src, as set for the
+// duration of a splice.
+type lowWater struct {
+	size, old int
+}
+
+// lowWater sets the SO_RCVLOWAT option of src according to r.LowWater,
+// capped to limit and remain. Setting the option is best-effort: if src
+// doesn't take it, the relay runs without it.
+func (r *Relay) lowWater(src *FD, limit int, remain int64) lowWater {
+	size := r.LowWater
+	if size > limit {
+		size = limit
+	}
+	if int64(size) > remain {
+		size = int(remain)
+	}
+	if size <= 1 {
+		return lowWater{}
+	}
+	old, err := syscall.GetsockoptInt(src.Sysfd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT)
+	if err != nil {
+		return lowWater{}
+	}
+	lw := lowWater{old: old}
+	lw.set(src, size)
+	return lw
+}
+
+// set lowers the SO_RCVLOWAT option of src to size.
+func (lw *lowWater) set(src *FD, size int) {
+	if syscall.SetsockoptInt(src.Sysfd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, size) == nil {
+		lw.size = size
+	}
+}
+
+// restore sets the SO_RCVLOWAT option of src back to its value before
+// the splice.
+func (lw *lowWater) restore(src *FD) {
+	syscall.SetsockoptInt(src.Sysfd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, lw.old)
+}
+
+// sendBufferPumps is the most data a relay hands to dst in one splice,
+// in multiples of the send buffer of dst. While the pipe holds more than
+// splice(2) passes to the socket in one go, it sends with MSG_MORE, so
+// when a small send buffer cuts a large splice short, TCP holds back
+// the partial segment at its end, and the connection idles until a
+// timer pushes it out. With the minimum send buffer and a 64 KiB pipe,
+// that slowed a loopback relay to a few MB/s.
+const sendBufferPumps = 4
+
+// A sendBuffer tracks the send buffer of a relay's destination, which
+// TCP may grow during the transfer, to cap the data handed to it. The
+// buffer is read when the transfer starts, and again after a wait for
+// dst only once it has capped a splice.
+type sendBuffer struct {
+	size   int  // SO_SNDBUF of dst, or 0 if unknown
+	capped bool // some splice to dst was cut down by max
+}
+
+// read updates sb from the SO_SNDBUF option of dst.
+func (sb *sendBuffer) read(dst *FD) {
+	size, err := syscall.GetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		size = 0
+	}
+	sb.size = size
+}
+
+// max returns how much of n bytes to hand to dst in one splice.
+func (sb *sendBuffer) max(n int) int {
+	if sb.size > 0 && n > sendBufferPumps*sb.size {
+		sb.capped = true
+		return sendBufferPumps * sb.size
+	}
+	return n
+}
+
+// limit returns the most data r holds in p at once.
+func (r *Relay) limit(p *pipe) int {
+	if r.DrainLimit > 0 && r.DrainLimit < p.size {
+		return r.DrainLimit
+	}
+	return p.size
+}
+
+// pipeSize returns the size of the pipe p for the splice: PipeSize, if
+// set, or else NotSentLowWater, if set and smaller than p.
+func (r *Relay) pipeSize(p *pipe) int {
+	switch {
+	case r.PipeSize > 0:
+		return r.PipeSize
+	case r.NotSentLowWater > 0 && r.NotSentLowWater < p.size:
+		return r.NotSentLowWater
+	}
+	return p.size
+}
+
+// setNotSentLowWater sets the TCP_NOTSENT_LOWAT option of dst to size,
+// and returns its previous value. Setting the option is best-effort:
+// if dst is not a TCP socket, or the kernel predates the option, ok is
+// false and the relay runs without it.
+func setNotSentLowWater(dst *FD, size int) (old int, ok bool) {
+	old, err := syscall.GetsockoptInt(dst.Sysfd, syscall.IPPROTO_TCP, tcpNotSentLowat)
+	if err != nil {
+		return 0, false
+	}
+	return old, syscall.SetsockoptInt(dst.Sysfd, syscall.IPPROTO_TCP, tcpNotSentLowat, size) == nil
+}
+
+const (
+	// minPipeSize and maxPipeSize bound the size of the pipe of an
+	// adaptive relay. maxPipeSize is the default limit for
+	// unprivileged users, in /proc/sys/fs/pipe-max-size.
+	minPipeSize = 16 << 10
+	maxPipeSize = 1 << 20
+
+	// pipeSizeWindow is the number of drains over which an adaptive
+	// relay measures the use of its pipe.
+	pipeSizeWindow = 16
+
+	// pipeSizeSustain is the number of consecutive windows of
+	// saturation, or of low use, after which the pipe is resized.
+	pipeSizeSustain = 4
+)
+
+// A pipeSizer decides when an adaptive relay resizes its pipe. A window
+// in which at least half of the drains fill the pipe counts as
+// saturated, and one in which no drain fills more than a quarter of it
+// counts as underused. After pipeSizeSustain saturated windows in a row
+// the pipe doubles in size, and after as many underused windows it is
+// halved. Since the kernel can't shrink a pipe below the data it holds,
+// shrinking waits until the pipe is empty.
+type pipeSizer struct {
+	drains, full int // drains in this window, and those that filled the pipe
+	peak         int // most data held by the pipe in this window
+
+	hot, cold int // consecutive saturated and underused windows
+
+	shrink bool // shrink the pipe once it is empty
+	maxed  bool // the kernel refused to grow the pipe
+}
+
+// observe records a drain which left p holding p.data bytes, and
+// whether it filled p. observe grows p after sustained saturation, and
+// reports whether it did.
+func (s *pipeSizer) observe(p *pipe, full bool) bool {
+	s.drains++
+	if full {
+		s.full++
+	}
+	if p.data > s.peak {
+		s.peak = p.data
+	}
+	if s.drains < pipeSizeWindow {
+		return false
+	}
+	switch {
+	case 2*s.full >= s.drains:
+		s.hot++
+		s.cold = 0
+	case 4*s.peak <= p.size:
+		s.cold++
+		s.hot = 0
+	default:
+		s.hot, s.cold = 0, 0
+	}
+	s.drains, s.full, s.peak = 0, 0, 0
+
+	if s.cold >= pipeSizeSustain {
+		s.cold = 0
+		s.shrink = p.size > minPipeSize
+	}
+	if s.hot < pipeSizeSustain || s.maxed || p.size >= maxPipeSize {
+		return false
+	}
+	s.hot = 0
+	s.shrink = false
+	if p.resize(2*p.size) != nil {
+		// Most likely the user has reached its limit of pipe
+		// buffer pages; keep the current size.
+		s.maxed = true
+		return false
+	}
+	return true
+}
+
+// settle halves p if a shrink is pending and p is empty, and reports
+// whether it did.
+func (s *pipeSizer) settle(p *pipe) bool {
+	if !s.shrink || p.data != 0 {
+		return false
+	}
+	s.shrink = false
+	size := p.size / 2
+	if size < minPipeSize {
+		size = minPipeSize
+	}
+	return p.resize(size) == nil
+}
+
+// SpliceToFile transfers data from src to dst, a descriptor in blocking
+// mode such as a regular file or a pipe, until src reaches EOF, using the
+// splice system call. SpliceToFile waits for src with the runtime poller,
+// but blocks the calling thread while writing to dst.
+//
+// If handled is false, dst does not support splice and the caller should
+// copy the rest of the data by other means. In that case written counts
+// the data transferred before the failure, which is usually none.
+// If err != nil, sc is the system call which caused the error.
+func SpliceToFile(dst int, src *FD) (written int64, handled bool, sc string, err error) {
+	return SpliceToFileFunc(dst, src, nil)
+}
+
+// SpliceToFileFunc is like SpliceToFile, but calls wrote, if not nil,
+// with the number of bytes of each write to dst once it has completed.
+// If wrote returns an error, the transfer stops with that error.
+func SpliceToFileFunc(dst int, src *FD, wrote func(n int64) error) (written int64, handled bool, sc string, err error) {
+	if !src.IsStream {
+		return 0, false, "", nil
+	}
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	for {
+		_, err := p.drainFrom(src, maxSpliceSize)
+		if err == syscall.EAGAIN {
+			if err = src.pd.waitRead(src.isFile); err != nil {
+				return written, true, "", err
+			}
+			continue
+		}
+		if err == io.EOF {
+			return written, true, "", nil
+		}
+		if err != nil {
+			handled = written > 0 || err != syscall.EINVAL
+			return written, handled, "splice", err
+		}
+		for p.data > 0 {
+			n, err := syscall.Splice(p.rfd, nil, dst, nil, p.data, 0)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EINVAL {
+				// dst does not take spliced data. Hand
+				// over what is already in the pipe with
+				// write(2) and let the caller carry on.
+				n, sc, err := p.writeOut(dst)
+				written += int64(n)
+				if err == nil && wrote != nil {
+					if err := wrote(int64(n)); err != nil {
+						return written, true, "", err
+					}
+				}
+				return written, err != nil, sc, err
+			}
+			if err != nil {
+				return written, true, "splice", err
+			}
+			p.data -= int(n)
+			written += int64(n)
+			if wrote != nil {
+				if err := wrote(int64(n)); err != nil {
+					return written, true, "", err
+				}
+			}
+		}
+	}
+}
+
+// SplicePipe transfers at most remain bytes from src to dst, one of which
+// is a stream socket and the other a pipe, such as a FIFO, in
+// non-blocking mode, until src reaches EOF. Unlike Splice, it splices
+// between src and dst directly: the pipe serves as the buffer which
+// Splice would otherwise make of a pipe of its own. A pipe src reaches
+// EOF once its writers are closed. A pipe dst whose readers are closed
+// fails with EPIPE.
+//
+// If err != nil, sc is the system call which caused the error.
+func SplicePipe(dst, src *FD, remain int64) (written int64, sc string, err error) {
+	if err := src.readLock(); err != nil {
+		return 0, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, "", err
+	}
+
+	// dstFull is set once a splice fails with EAGAIN although src
+	// has data queued, which means that dst has no room for it.
+	dstFull := false
+	for written < remain {
+		max := maxSpliceSize
+		if int64(max) > remain-written {
+			max = int(remain - written)
+		}
+		n, err := syscall.Splice(src.Sysfd, nil, dst.Sysfd, nil, max, spliceNonblock)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			// Either src has no data, or dst has no room. Data
+			// which arrived since the splice makes it worth
+			// another try before waiting for dst. The kernel
+			// checks for room in a pipe dst before it looks at
+			// a socket src, so a src which has nothing left but
+			// its EOF waits for dst too.
+			switch {
+			case !readable(src.Sysfd) && !atEOF(src.Sysfd):
+				err = src.pd.waitRead(src.isFile)
+			case dstFull:
+				err = dst.pd.waitWrite(dst.isFile)
+			default:
+				dstFull = true
+				continue
+			}
+			if err != nil {
+				return written, "", err
+			}
+			dstFull = false
+			continue
+		}
+		if err != nil {
+			return written, "splice", err
+		}
+		if n == 0 {
+			break
+		}
+		written += int64(n)
+		dstFull = false
+	}
+	return written, "", nil
+}
+
+// readable reports whether data is queued for reading on fd, a socket or
+// a pipe.
+func readable(fd int) bool {
+	var n int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	return errno == 0 && n > 0
+}
+
+// atEOF reports whether fd, a socket, has reached the end of its stream
+// with no data left queued. It reports false for a pipe.
+func atEOF(fd int) bool {
+	var b [1]byte
+	n, _, err := syscall.Recvfrom(fd, b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	return err == nil && n == 0
+}
+
+// SpliceFromFile transfers at most remain bytes from src, a descriptor in
+// blocking mode such as a regular file, to dst, starting at the file
+// offset of src, using the splice system call. It is the splice
+// counterpart of SendFile: the data goes through a pipe, and SpliceFromFile
+// waits for dst with the runtime poller but blocks the calling thread
+// while reading src.
+//
+// If handled is false, src does not support splice and SpliceFromFile
+// has performed no work. If err != nil, sc is the system call which
+// caused the error.
+func SpliceFromFile(dst *FD, src int, remain int64) (written int64, handled bool, sc string, err error) {
+	return spliceFile(dst, src, nil, remain)
+}
+
+// SpliceFileRange is like SpliceFromFile, but transfers the n bytes of
+// src starting at offset *offp, without using or changing the file
+// offset of src. *offp is advanced atomically past the data as it is
+// written to dst, not as it is read from src into the pipe, so that it
+// may be read while SpliceFileRange runs, and is the offset from which
+// to resume a transfer which SpliceFileRange abandoned with data still
+// in the pipe.
+func SpliceFileRange(dst *FD, src int, offp *int64, n int64) (written int64, handled bool, sc string, err error) {
+	return spliceFile(dst, src, offp, n)
+}
+
+// spliceFile implements SpliceFromFile and SpliceFileRange. If offp is
+// nil, it reads src from its file offset.
+func spliceFile(dst *FD, src int, offp *int64, remain int64) (written int64, handled bool, sc string, err error) {
+	if !dst.IsStream {
+		return 0, false, "", nil
+	}
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, true, "", err
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	// roff is the offset from which src is read, which is ahead of
+	// *offp while the pipe holds data.
+	var roffp *int64
+	if offp != nil {
+		roff := atomic.LoadInt64(offp)
+		roffp = &roff
+	}
+	for remain > 0 {
+		max := p.size
+		if int64(max) > remain {
+			max = int(remain)
+		}
+		// The pipe is empty, so the splice only waits for the file.
+		// A file can't be polled; a read which the block layer
+		// throttles, such as for a cgroup's io.max, sleeps in the
+		// kernel until it is let through.
+		n, err := syscall.Splice(src, roffp, p.wfd, nil, max, spliceNonblock)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return written, written > 0 || err != syscall.EINVAL, "splice", err
+		}
+		if n == 0 {
+			break
+		}
+		p.data += int(n)
+		remain -= int64(n)
+		for p.data > 0 {
+			n, err := p.pumpTo(dst, p.data)
+			if err == syscall.EAGAIN {
+				if err = dst.pd.waitWrite(dst.isFile); err != nil {
+					return written, true, "", err
+				}
+				continue
+			}
+			if err != nil {
+				return written, true, "splice", err
+			}
+			written += int64(n)
+			if offp != nil {
+				atomic.AddInt64(offp, int64(n))
+			}
+		}
+	}
+	return written, true, "", nil
+}
+
+// writeOut reads the data buffered in the pipe into userspace and writes
+// it to dst, which must be in blocking mode. If err != nil, sc is the
+// system call which caused the error.
+func (p *pipe) writeOut(dst int) (written int, sc string, err error) {
+	b := make([]byte, p.data)
+	n, err := syscall.Read(p.rfd, b)
+	if err != nil {
+		return 0, "read", err
+	}
+	p.data -= n
+	for b = b[:n]; len(b) > 0; {
+		n, err := syscall.Write(dst, b)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return written, "write", err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, "", nil
+}
+
+// A Splicer splices data from Src through a pipe which it keeps between
+// calls. A Splicer drains as much as Src has available into the pipe,
+// so that after a bounded transfer the pipe may hold data following it,
+// such as the header of the next frame of a protocol. That data can be
+// read into userspace with ReadBuffered.
+//
+// A Splicer is not safe for concurrent use. Close releases its pipe.
+type Splicer struct {
+	Src *FD
+
+	// DstFailed is set by SpliceTo when it returns an error from
+	// dst rather than from Src. The data which was not written to
+	// dst stays buffered in the pipe.
+	DstFailed bool
+
+	// Hold, if not nil, is called by SpliceTo before each read from
+	// Src and each write to dst, and blocks for as long as the
+	// transfer is to be held, such as while a flow controller has
+	// paused it.
+	Hold func()
+
+	// Combine, if positive, makes SpliceTo combine the writes of
+	// small transfers to the same dst. Rather than writing the data
+	// it transfers to dst, SpliceTo holds it in the pipe until
+	// Combine bytes, or as much as the pipe takes, have built up, and
+	// then writes it in one burst. FlushCombined writes the data held
+	// so far. The data held must be flushed before a transfer to
+	// another dst, and before ReadBuffered is called.
+	Combine int
+
+	p *pipe
+
+	// combined is the data at the head of the pipe which SpliceTo
+	// has transferred to combinedDst, but not yet written.
+	combined    int
+	combinedDst *FD
+}
+
+// SpliceTo transfers exactly n bytes from s.Src, starting with the data
+// already buffered in the pipe, to dst. It returns io.EOF if Src reaches
+// EOF before n bytes have been transferred.
+//
+// If err != nil, sc is the system call which caused the error.
+func (s *Splicer) SpliceTo(dst *FD, n int64) (written int64, handled bool, sc string, err error) {
+	s.DstFailed = false
+	if !s.Src.IsStream || !dst.IsStream {
+		return 0, false, "", nil
+	}
+	if s.p == nil {
+		if s.p, sc, err = getPipe(); err != nil {
+			return 0, false, sc, err
+		}
+	}
+	p, src := s.p, s.Src
+
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		s.DstFailed = true
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		s.DstFailed = true
+		return 0, true, "", err
+	}
+
+	// The data held for combining is written once there is limit
+	// bytes of it, or once the pipe is full of it.
+	combine, limit := s.Combine > 0, s.Combine
+	if limit > p.size {
+		limit = p.size
+	}
+
+	var srcEAGAIN, dstEAGAIN, pipeFull, seenEOF bool
+	for written < n || combine && s.combined >= limit {
+		if s.Hold != nil {
+			s.Hold()
+		}
+		switch {
+		case combine && s.combined > 0 && (s.combined >= limit || pipeFull && p.data == s.combined) && !dstEAGAIN:
+			// The rest of the transfer follows the burst.
+			pump := p.pumpTo
+			if written < n {
+				pump = p.pumpMoreTo
+			}
+			m, err := pump(dst, s.combined)
+			if err == syscall.EAGAIN {
+				dstEAGAIN = true
+				continue
+			}
+			if err != nil {
+				s.DstFailed = true
+				return written, true, "splice", err
+			}
+			s.combined -= m
+			pipeFull = false
+		case combine && p.data > s.combined && written < n:
+			// Transfer the data in the pipe by holding it.
+			m := p.data - s.combined
+			if int64(m) > n-written {
+				m = int(n - written)
+			}
+			s.combined += m
+			s.combinedDst = dst
+			written += int64(m)
+		case !combine && p.data > 0 && !dstEAGAIN:
+			max := p.data
+			if int64(max) > n-written {
+				max = int(n - written)
+			}
+			m, err := p.pumpTo(dst, max)
+			if err == syscall.EAGAIN {
+				dstEAGAIN = true
+				continue
+			}
+			if err != nil {
+				s.DstFailed = true
+				return written, true, "splice", err
+			}
+			written += int64(m)
+			pipeFull = false
+		case p.data < p.size && !pipeFull && !srcEAGAIN && !seenEOF:
+			// Unlike Relay.Splice, take whatever src has to
+			// offer, even beyond the n bytes asked for.
+			_, err := p.drainFrom(src, maxSpliceSize)
+			if err == syscall.EAGAIN {
+				if p.data > 0 {
+					pipeFull = true
+				} else {
+					srcEAGAIN = true
+				}
+				continue
+			}
+			if err == io.EOF {
+				seenEOF = true
+				continue
+			}
+			if err != nil {
+				handled = written > 0 || p.data > 0 || err != syscall.EINVAL
+				return written, handled, "splice", err
+			}
+		case p.data == s.combined && seenEOF:
+			return written, true, "", io.EOF
+		case p.data == s.combined && srcEAGAIN:
+			if err := src.pd.waitRead(src.isFile); err != nil {
+				return written, true, "", err
+			}
+			srcEAGAIN = false
+		default:
+			if err := dst.pd.waitWrite(dst.isFile); err != nil {
+				s.DstFailed = true
+				return written, true, "", err
+			}
+			testHookSplicerWaitedWrite()
+			srcEAGAIN, dstEAGAIN = false, false
+		}
+	}
+	return written, true, "", nil
+}
+
+// Combined returns the number of bytes held in the pipe for combining.
+func (s *Splicer) Combined() int {
+	return s.combined
+}
+
+// FlushCombined writes the data held in the pipe for combining to the
+// dst of the transfers which it belongs to, waiting for it as needed.
+//
+// If err != nil, sc is the system call which caused the error.
+func (s *Splicer) FlushCombined() (written int64, sc string, err error) {
+	if s.combined == 0 {
+		return 0, "", nil
+	}
+	dst := s.combinedDst
+	if err := dst.writeLock(); err != nil {
+		return 0, "", err
+	}
+	defer dst.writeUnlock()
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, "", err
+	}
+	for s.combined > 0 {
+		n, err := s.p.pumpTo(dst, s.combined)
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return written, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return written, "splice", err
+		}
+		s.combined -= n
+		written += int64(n)
+	}
+	s.combinedDst = nil
+	return written, "", nil
+}
+
+// Buffered returns the number of bytes buffered in the pipe, other than
+// those held for combining.
+func (s *Splicer) Buffered() int {
+	if s.p == nil {
+		return 0
+	}
+	return s.p.data - s.combined
+}
+
+// ReadBuffered reads up to len(b) bytes of the data buffered in the pipe
+// into b. It returns io.EOF once the pipe is empty.
+func (s *Splicer) ReadBuffered(b []byte) (int, error) {
+	if s.Buffered() == 0 {
+		return 0, io.EOF
+	}
+	if len(b) > s.p.data {
+		b = b[:s.p.data]
+	}
+	n, err := syscall.Read(s.p.rfd, b)
+	if n < 0 {
+		n = 0
+	}
+	s.p.data -= n
+	return n, err
+}
+
+// Flush transfers the data buffered in the pipe to dst, waiting for dst
+// as needed, once it has written the data held for combining, as
+// FlushCombined does. Unlike SpliceTo, it never reads from Src.
+//
+// If err != nil, sc is the system call which caused the error.
+func (s *Splicer) Flush(dst *FD) (written int64, sc string, err error) {
+	if _, sc, err := s.FlushCombined(); err != nil {
+		return 0, sc, err
+	}
+	if s.Buffered() == 0 {
+		return 0, "", nil
+	}
+	if err := dst.writeLock(); err != nil {
+		return 0, "", err
+	}
+	defer dst.writeUnlock()
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, "", err
+	}
+	for s.p.data > 0 {
+		n, err := s.p.pumpTo(dst, s.p.data)
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return written, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return written, "splice", err
+		}
+		written += int64(n)
+	}
+	return written, "", nil
+}
+
+// Close releases the Splicer's pipe, discarding any data buffered in it,
+// including the data held for combining.
+func (s *Splicer) Close() error {
+	if s.p != nil {
+		putPipe(s.p)
+		s.p = nil
+	}
+	s.combined, s.combinedDst = 0, nil
+	return nil
+}
+
+// Discard skips the next n bytes of data from src by splicing them into
+// /dev/null, without copying them into userspace. It returns io.EOF if
+// src reaches EOF before n bytes have been discarded.
+//
+// If err != nil, sc is the system call which caused the error.
+func Discard(src *FD, n int64) (discarded int64, handled bool, sc string, err error) {
+	null, err := devNull()
+	if err != nil {
+		return 0, false, "open", err
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+
+	for discarded < n {
+		max := maxSpliceSize
+		if int64(max) > n-discarded {
+			max = int(n - discarded)
+		}
+		_, err := p.drainFrom(src, max)
+		if err == syscall.EAGAIN {
+			if err = src.pd.waitRead(src.isFile); err == nil {
+				continue
+			}
+			return discarded, true, "", err
+		}
+		if err == io.EOF {
+			return discarded, true, "", io.EOF
+		}
+		if err != nil {
+			handled = discarded > 0 || err != syscall.EINVAL
+			return discarded, handled, "splice", err
+		}
+		for p.data > 0 {
+			m, err := syscall.Splice(p.rfd, nil, null, nil, p.data, 0)
+			if err != nil {
+				return discarded, true, "splice", err
+			}
+			p.data -= int(m)
+			discarded += int64(m)
+		}
+	}
+	return discarded, true, "", nil
+}
+
+// maxPacketSize is the size of the largest packet which can be framed
+// by the 2-byte length prefix of SpliceFromPacket and SpliceToPacket.
+const maxPacketSize = 1<<16 - 1
+
+// SpliceFromPacket moves the next packet from src, a packet-oriented
+// descriptor such as a tun device, to the stream dst. The packet is
+// preceded on dst by its length, as a 2-byte big-endian integer, so that
+// SpliceToPacket can restore the packet boundary at the far end of the
+// stream. It returns the length of the packet.
+//
+// If spliced is false and err is nil, src does not support splice, and
+// nothing has been read from it; the caller should use ordinary reads and
+// writes instead. If err != nil, sc is the system call which caused the
+// error.
+func SpliceFromPacket(dst, src *FD) (n int, spliced bool, sc string, err error) {
+	if !dst.IsStream {
+		return 0, false, "", syscall.EINVAL
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, true, "", err
+	}
+
+	// A single splice from a packet device moves a single packet,
+	// which always fits in an empty pipe.
+	for {
+		n, err = p.drainFrom(src, maxPacketSize)
+		if err == syscall.EAGAIN {
+			if err = src.pd.waitRead(src.isFile); err != nil {
+				return 0, true, "", err
+			}
+			continue
+		}
+		if err == io.EOF {
+			return 0, true, "", io.EOF
+		}
+		if err == syscall.EINVAL {
+			return 0, false, "", nil
+		}
+		if err != nil {
+			return 0, true, "splice", err
+		}
+		break
+	}
+	hdr := [2]byte{byte(n >> 8), byte(n)}
+	if sc, err := writeAll(dst, hdr[:]); err != nil {
+		return 0, true, sc, err
+	}
+	for p.data > 0 {
+		_, err := p.pumpTo(dst, p.data)
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return 0, true, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, true, "splice", err
+		}
+	}
+	return n, true, "", nil
+}
+
+// SpliceToPacket reads the next packet, framed as by SpliceFromPacket,
+// from the stream src and writes it to dst, a packet-oriented descriptor
+// such as a tun device, with a single call so that dst receives it as
+// one packet. It returns the length of the packet, or io.EOF if src is
+// at EOF. If src reaches EOF in the middle of a packet, SpliceToPacket
+// returns io.ErrUnexpectedEOF.
+//
+// If dst does not support splice, the packet is copied out of the pipe
+// and written to dst with write(2) instead. In that case spliced is false
+// and err is nil, and the caller should use ordinary reads and writes for
+// further packets. If err != nil, sc is the system call which caused the
+// error.
+func SpliceToPacket(dst, src *FD) (n int, spliced bool, sc string, err error) {
+	if !src.IsStream {
+		return 0, false, "", syscall.EINVAL
+	}
+	p, sc, err := getPipe()
+	if err != nil {
+		return 0, false, sc, err
+	}
+	defer putPipe(p)
+
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+	if err := dst.pd.prepareWrite(dst.isFile); err != nil {
+		return 0, true, "", err
+	}
+
+	var hdr [2]byte
+	if sc, err := readFull(src, hdr[:]); err != nil {
+		return 0, true, sc, err
+	}
+	n = int(hdr[0])<<8 | int(hdr[1])
+	for p.data < n {
+		_, err := p.drainFrom(src, n-p.data)
+		if err == syscall.EAGAIN {
+			if err = src.pd.waitRead(src.isFile); err != nil {
+				return 0, true, "", err
+			}
+			continue
+		}
+		if err == io.EOF {
+			return 0, true, "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, true, "splice", err
+		}
+	}
+	for {
+		m, err := p.pumpTo(dst, n)
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return 0, true, "", err
+			}
+			continue
+		}
+		if err == syscall.EINVAL {
+			if sc, err := p.copyTo(dst); err != nil {
+				return 0, true, sc, err
+			}
+			return n, false, "", nil
+		}
+		if err != nil {
+			return 0, true, "splice", err
+		}
+		if m != n {
+			// The packet was split by dst.
+			return 0, true, "splice", syscall.EIO
+		}
+		return n, true, "", nil
+	}
+}
+
+// copyTo reads the data buffered in the pipe into userspace and writes
+// it to dst with a single successful call to write(2). If err != nil, sc
+// is the system call which caused the error.
+func (p *pipe) copyTo(dst *FD) (sc string, err error) {
+	b := make([]byte, p.data)
+	n, err := syscall.Read(p.rfd, b)
+	if err != nil {
+		return "read", err
+	}
+	p.data -= n
+	for {
+		_, err := syscall.Write(dst.Sysfd, b[:n])
+		if err == syscall.EAGAIN {
+			if err = dst.pd.waitWrite(dst.isFile); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "write", err
+		}
+		return "", nil
+	}
+}
+
+// writeAll writes b to the locked descriptor fd. If err != nil, sc is
+// the system call which caused the error.
+func writeAll(fd *FD, b []byte) (sc string, err error) {
+	for len(b) > 0 {
+		n, err := syscall.Write(fd.Sysfd, b)
+		if err == syscall.EAGAIN {
+			if err = fd.pd.waitWrite(fd.isFile); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "write", err
+		}
+		b = b[n:]
+	}
+	return "", nil
+}
+
+// readFull fills b from the locked descriptor fd. It returns io.EOF if
+// fd is at EOF before any data is read, and io.ErrUnexpectedEOF if it
+// reaches EOF part way through b. If err != nil, sc is the system call
+// which caused the error.
+func readFull(fd *FD, b []byte) (sc string, err error) {
+	for i := 0; i < len(b); {
+		n, err := syscall.Read(fd.Sysfd, b[i:])
+		if err == syscall.EAGAIN {
+			if err = fd.pd.waitRead(fd.isFile); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "read", err
+		}
+		if n == 0 {
+			if i == 0 {
+				return "", io.EOF
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		i += n
+	}
+	return "", nil
+}
+
+var (
+	devNullOnce sync.Once
+	devNullFD   int
+	devNullErr  error
+)
+
+// devNull returns a descriptor for /dev/null, opened for writing, which
+// is shared by all calls to Discard.
+func devNull() (int, error) {
+	devNullOnce.Do(func() {
+		devNullFD, devNullErr = syscall.Open("/dev/null", syscall.O_WRONLY|syscall.O_CLOEXEC, 0)
+	})
+	return devNullFD, devNullErr
+}
+
+// pipe is a kernel pipe used as the intermediate buffer of a splice.
+type pipe struct {
+	rfd, wfd int
+
+	// size is the capacity of the pipe, in bytes.
+	size int
+
+	// allocSize is the capacity the pipe was created with. A pipe
+	// resized by an adaptive relay is restored to it before it is
+	// pooled.
+	allocSize int
+
+	// data is the number of bytes currently buffered in the pipe.
+	data int
+
+	// flags are the pipeFlags the pipe was created with.
+	flags int
+}
+
+// pipeFlags are the flags with which pipes are created, besides the
+// O_CLOEXEC and O_NONBLOCK flags which every pipe needs. It is only
+// changed by tests, while no splice runs, to try candidate flags without
+// editing the source; see BenchmarkPipeFlags. Of the flags pipe2 takes,
+// O_DIRECT, which makes a packet-mode pipe, has not been found to make
+// splicing any faster, so no flag is set by default.
+var pipeFlags = 0
+
+// drainFrom moves at most max bytes from src into the pipe, without
+// waiting for src to become readable. It returns io.EOF once src is
+// exhausted.
+func (p *pipe) drainFrom(src *FD, max int) (int, error) {
+	if free := p.size - p.data; max > free {
+		max = free
+	}
+	// A socket in blocking mode would block the splice where one in
+	// non-blocking mode fails with EAGAIN: while it is empty, and at the
+	// mark of urgent data.
+	if src.isBlocking && (!ready(src.Sysfd, _POLLIN) || atUrgentMark(src)) {
+		return 0, syscall.EAGAIN
+	}
+	n, err := syscall.Splice(src.Sysfd, nil, p.wfd, nil, max, spliceNonblock)
+	if err == syscall.EIO && src.isFile {
+		// A pseudo-terminal master reports EIO, rather than
+		// EOF, once every descriptor for its slave is closed
+		// and the data written to the slave has been read.
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	p.data += int(n)
+	return int(n), nil
+}
+
+// pumpTo moves at most max bytes of the data buffered in the pipe to dst,
+// without waiting for dst to become writable.
+func (p *pipe) pumpTo(dst *FD, max int) (int, error) {
+	return p.pump(dst, max, spliceNonblock)
+}
+
+// teeInto copies the data buffered in the pipe into b, up to len(b)
+// bytes, leaving it in the pipe, and returns the number of bytes copied.
+// The data goes through tp, an empty pipe, which is left empty. teeInto
+// may copy less than the pipe holds if tp fills up first.
+func (p *pipe) teeInto(tp *pipe, b []byte) (int, string, error) {
+	max := len(b)
+	if max > p.data {
+		max = p.data
+	}
+	n, err := syscall.Tee(p.rfd, tp.wfd, max, spliceNonblock)
+	if err != nil {
+		return 0, "tee", err
+	}
+	m, err := syscall.Read(tp.rfd, b[:n])
+	if err != nil {
+		return 0, "read", err
+	}
+	return m, "", nil
+}
+
+// pumpMoreTo is like pumpTo, but tells dst that more data follows.
+func (p *pipe) pumpMoreTo(dst *FD, max int) (int, error) {
+	return p.pump(dst, max, spliceNonblock|spliceMore)
+}
+
+// pump is pumpTo with the given splice flags.
+func (p *pipe) pump(dst *FD, max, flags int) (int, error) {
+	if max > p.data {
+		max = p.data
+	}
+	if dst.isBlocking {
+		if !ready(dst.Sysfd, _POLLOUT) {
+			return 0, syscall.EAGAIN
+		}
+		max = blockingSendMax(dst, max)
+	}
+	n, err := syscall.Splice(p.rfd, nil, dst.Sysfd, nil, max, flags)
+	if err != nil {
+		return 0, err
+	}
+	p.data -= int(n)
+	return int(n), nil
+}
+
+// pipePool caches pipes between calls to Splice, so that relays do not
+// pay for pipe2 and fcntl on every transfer.
+var pipePool sync.Pool
+
+// pipePoolHits and pipePoolMisses count the calls to getPipe which
+// were satisfied by pipePool and those which had to allocate a new
+// pipe, respectively. They are updated atomically.
+var pipePoolHits, pipePoolMisses uint64
+
+// PipePoolStats returns the numbers of pipes which the splice functions
+// have taken from the pool of pipes kept for reuse, and which they have
+// had to create, since the program started.
+func PipePoolStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&pipePoolHits), atomic.LoadUint64(&pipePoolMisses)
+}
+
+// getPipe returns a pipe from pipePool, or a new pipe if the pool is
+// empty. If err != nil, sc is the system call which caused the error.
+func getPipe() (*pipe, string, error) {
+	return getPipeLimit(0)
+}
+
+// getPipeLimit is like getPipe, but returns errPipeLimit rather than
+// create a pipe while the pipes hold maxFDs file descriptors or more,
+// if maxFDs is positive.
+func getPipeLimit(maxFDs int) (*pipe, string, error) {
+	if v := pipePool.Get(); v != nil {
+		p := v.(*pipe)
+		if p.flags == pipeFlags {
+			atomic.AddUint64(&pipePoolHits, 1)
+			return p, "", nil
+		}
+		runtime.SetFinalizer(p, nil)
+		p.release()
+	}
+	atomic.AddUint64(&pipePoolMisses, 1)
+	p, sc, err := newPipe(maxFDs)
+	if err != nil {
+		return nil, sc, err
+	}
+	// Pipes dropped from the pool are closed by the finalizer.
+	runtime.SetFinalizer(p, (*pipe).finalize)
+	return p, "", nil
+}
+
+// tryGetPipe returns a pipe for the relay's transfer, like getPipe, but
+// returns errPipeLimit if it would have to create one while the pipes
+// hold r.MaxPipeFDs file descriptors or more, unless r.LimitPolicy is
+// PipeLimitExceed.
+func (r *Relay) tryGetPipe() (*pipe, string, error) {
+	if r.LimitPolicy == PipeLimitExceed {
+		return getPipeLimit(0)
+	}
+	return getPipeLimit(r.MaxPipeFDs)
+}
+
+// tryGetPipes returns a pipe for the relay's transfer, and, if tee is
+// set, another through which to duplicate its data, like tryGetPipe.
+// It returns both or neither.
+func (r *Relay) tryGetPipes(tee bool) (p, tp *pipe, sc string, err error) {
+	if p, sc, err = r.tryGetPipe(); err != nil || !tee {
+		return p, nil, sc, err
+	}
+	if tp, sc, err = r.tryGetPipe(); err != nil {
+		putPipe(p)
+		return nil, nil, sc, err
+	}
+	return p, tp, "", nil
+}
+
+// getPipes returns the pipes of the relay's transfer from src to dst,
+// like tryGetPipes. If the pipes hold the file descriptors allowed by
+// r.MaxPipeFDs and r.LimitPolicy is PipeLimitWait, it waits for another
+// transfer to return or close a pipe. The wait fails with ErrCanceled if
+// r.Done is closed first, and with the error of src or dst if either is
+// closed or its deadline passes. The relay holds neither lock while it
+// waits, so it watches them rather than waiting on the poller.
+func (r *Relay) getPipes(dst, src *FD, tee bool) (p, tp *pipe, sc string, err error) {
+	p, tp, sc, err = r.tryGetPipes(tee)
+	if err != errPipeLimit || r.LimitPolicy != PipeLimitWait {
+		return p, tp, sc, err
+	}
+	atomic.AddInt32(&pipeWaiters, 1)
+	defer atomic.AddInt32(&pipeWaiters, -1)
+	w := watchRelay(dst, src)
+	defer w.stop()
+	if err := checkRelay(dst, src); err != nil {
+		return nil, nil, "", err
+	}
+	for {
+		// A pipe returned or closed before pipeWaiters counted
+		// this relay is found here, rather than handed over.
+		p, tp, sc, err = r.tryGetPipes(tee)
+		if err != errPipeLimit {
+			// Another waiter may have missed a wakeup which
+			// coincided with the one which got this relay here.
+			if atomic.LoadInt32(&pipeWaiters) > 1 {
+				notifyPipeFreed()
+			}
+			return p, tp, sc, err
+		}
+		// Pipes idle in pipePool for another P are out of reach,
+		// until a garbage collection empties the pool and their
+		// finalizers close them, which wakes the relay too.
+		select {
+		case p = <-pipeHandoff:
+			if !tee {
+				return p, nil, "", nil
+			}
+			// Holding p while waiting for a second pipe could
+			// starve the relays which wait for one, so both
+			// are taken at once, or p is given up.
+			if tp, sc, err = r.tryGetPipe(); err != errPipeLimit {
+				if err != nil {
+					putPipe(p)
+					p = nil
+				}
+				return p, tp, sc, err
+			}
+			putPipe(p)
+		case <-pipeFreed:
+		case <-r.Done:
+			return nil, nil, "", ErrCanceled
+		case <-w.dstChanged:
+			w.renew()
+			if err := checkRelay(dst, src); err != nil {
+				return nil, nil, "", err
+			}
+		case <-w.srcChanged:
+			w.renew()
+			if err := checkRelay(dst, src); err != nil {
+				return nil, nil, "", err
+			}
+		case <-w.expired:
+			return nil, nil, "", ErrTimeout
+		}
+	}
+}
+
+// checkRelay returns the error with which a transfer from src to dst
+// would fail at once, because either is closed or its deadline has
+// passed. It holds the locks of src and dst only while it checks them,
+// as preparing a descriptor for a wait is only safe under its lock.
+func checkRelay(dst, src *FD) error {
+	if err := src.readLock(); err != nil {
+		return err
+	}
+	err := src.pd.prepareRead(src.isFile)
+	src.readUnlock()
+	if err != nil {
+		return err
+	}
+	if err := dst.writeLock(); err != nil {
+		return err
+	}
+	defer dst.writeUnlock()
+	return dst.pd.prepareWrite(dst.isFile)
+}
+
+// putPipe returns p to pipePool, or hands it to a relay waiting for a
+// pipe. A pipe which still holds data can't be reused by another
+// transfer, so it is closed instead. A resized pipe gets its original
+// size back, or is closed if the kernel refuses.
+func putPipe(p *pipe) {
+	if p.data != 0 || p.size != p.allocSize && p.resize(p.allocSize) != nil {
+		runtime.SetFinalizer(p, nil)
+		p.release()
+		return
+	}
+	// A pipe in pipePool may be out of reach of a waiting relay
+	// running on another P, so it gets the pipe directly, or, if it
+	// is not ready for it, a slot for a new pipe.
+	if atomic.LoadInt32(&pipeWaiters) > 0 {
+		select {
+		case pipeHandoff <- p:
+		default:
+			runtime.SetFinalizer(p, nil)
+			p.release()
+		}
+		return
+	}
+	pipePool.Put(p)
+}
+
+// TrimPipePool closes the pipes kept in pipePool for reuse, returning
+// their kernel buffers to the system, and returns the number of pipes
+// closed. A garbage collection empties the pool too, leaving the pipes
+// to their finalizers. A pipe put back by a goroutine running on another
+// P may be out of reach of TrimPipePool until then.
+func TrimPipePool() int {
+	n := 0
+	for {
+		v := pipePool.Get()
+		if v == nil {
+			return n
+		}
+		p := v.(*pipe)
+		runtime.SetFinalizer(p, nil)
+		p.release()
+		n++
+	}
+}
+
+// openPipes is the number of pipes which have been allocated and not yet
+// released, whether in use or in pipePool. It is updated atomically.
+var openPipes int64
+
+// errPipeLimit is returned by getPipeLimit when a new pipe would take
+// the file descriptors held by pipes over its limit.
+var errPipeLimit = errors.New("splice pipe limit reached")
+
+// PipeFDs returns the number of file descriptors held by the pipes of
+// the splice functions, both in use and kept for reuse.
+func PipeFDs() int {
+	return 2 * int(atomic.LoadInt64(&openPipes))
+}
+
+// Policies of a Relay which needs a new pipe once the pipes hold the file
+// descriptors allowed by its MaxPipeFDs.
+const (
+	// PipeLimitFallback makes the splice report that it has not
+	// handled the transfer, so that the caller copies the data
+	// through userspace.
+	PipeLimitFallback = iota
+
+	// PipeLimitWait makes the relay wait until another transfer
+	// returns or closes a pipe, or the relay is canceled.
+	PipeLimitWait
+
+	// PipeLimitExceed allocates the pipe regardless of the limit.
+	PipeLimitExceed
+)
+
+// pipeWaiters is the number of relays waiting for a pipe under
+// PipeLimitWait. It is updated atomically.
+var pipeWaiters int32
+
+// pipeHandoff carries pipes returned by putPipe to waiting relays.
+var pipeHandoff = make(chan *pipe)
+
+// pipeFreed wakes a waiting relay once a pipe is closed.
+var pipeFreed = make(chan struct{}, 1)
+
+// notifyPipeFreed wakes a waiting relay, if it isn't already awake.
+func notifyPipeFreed() {
+	select {
+	case pipeFreed <- struct{}{}:
+	default:
+	}
+}
+
+// reservePipe counts a new pipe in openPipes, unless that would take
+// the file descriptors held by pipes over maxFDs, if positive, and
+// reports whether it did.
+func reservePipe(maxFDs int) bool {
+	n := atomic.AddInt64(&openPipes, 1)
+	if maxFDs > 0 && 2*n > int64(maxFDs) {
+		atomic.AddInt64(&openPipes, -1)
+		return false
+	}
+	return true
+}
+
+// States of spliceSupport.
+const (
+	spliceUnknown = iota
+	spliceUsable
+	spliceUnusable
+)
+
+// spliceSupport records whether splice is known to be usable on this
+// system, which the first pipes allocated tell. It is accessed
+// atomically. Pipes allocated at once may each find out; a finding that
+// splice is unusable overrides any other, so that it isn't lost to a
+// racing allocation which found nothing wrong.
+var spliceSupport int32
+
+// newPipe returns a pipe ready to buffer a splice, or errPipeLimit if
+// the pipes would then hold more than maxFDs file descriptors, if
+// positive. If err != nil, sc is the system call which caused the
+// error.
+func newPipe(maxFDs int) (p *pipe, sc string, err error) {
+	support := atomic.LoadInt32(&spliceSupport)
+	if support == spliceUnusable {
+		return nil, "pipe2", syscall.EINVAL
+	}
+	if !reservePipe(maxFDs) {
+		return nil, "", errPipeLimit
+	}
+	p = new(pipe)
+	if sc, err = p.alloc(); err != nil {
+		atomic.AddInt64(&openPipes, -1)
+		return nil, sc, err
+	}
+	if p.size <= 0 {
+		// F_GETPIPE_SZ was added in 2.6.35, which does not
+		// have the -EAGAIN bug, so use it to detect kernels
+		// on which splice is unreliable.
+		atomic.StoreInt32(&spliceSupport, spliceUnusable)
+		p.release()
+		return nil, "fcntl", syscall.EINVAL
+	}
+	if support == spliceUnknown {
+		atomic.CompareAndSwapInt32(&spliceSupport, spliceUnknown, spliceUsable)
+	}
+	return p, "", nil
+}
+
+// alloc creates the pipe file descriptors and records the pipe size.
+func (p *pipe) alloc() (string, error) {
+	rfd, wfd, err := allocPipe(syscall.O_CLOEXEC | syscall.O_NONBLOCK | pipeFlags)
+	if err != nil {
+		return "pipe2", err
+	}
+	p.rfd, p.wfd, p.flags = rfd, wfd, pipeFlags
+	size, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p.rfd), syscall.F_GETPIPE_SZ, 0)
+	if errno == 0 {
+		p.size = testHookPipeSize(int(size))
+		p.allocSize = p.size
+	}
+	return "", nil
+}
+
+// pipeAllocator holds the pipeAllocFunc set by SetPipeAllocator, which
+// holds pipeAllocatorMu.
+var (
+	pipeAllocator   atomic.Value
+	pipeAllocatorMu sync.Mutex
+)
+
+// A pipeAllocFunc is the function set by SetPipeAllocator. It is wrapped
+// in a struct, since an atomic.Value can't hold a nil function.
+type pipeAllocFunc struct {
+	f func(flags int) (rfd, wfd int, err error)
+}
+
+// SetPipeAllocator sets the function which creates the pipes of the
+// splice functions in place of pipe2(2), and returns the previous one.
+// alloc is called with the flags to pass to pipe2, and returns the read
+// and write ends of a pipe created with them. It may, for instance,
+// create the pipe on a thread bound to the NUMA node of the calling
+// thread, to have the kernel allocate the pipe's bookkeeping there. The
+// pages holding the pipe's data, unless they are taken from the source,
+// are allocated by the thread moving data into the pipe, wherever the
+// pipe was created. If alloc is nil, pipes are created with pipe2, which
+// is the default. Pooled pipes created by the previous function are
+// still reused.
+func SetPipeAllocator(alloc func(flags int) (rfd, wfd int, err error)) func(flags int) (rfd, wfd int, err error) {
+	pipeAllocatorMu.Lock()
+	defer pipeAllocatorMu.Unlock()
+	old, _ := pipeAllocator.Load().(pipeAllocFunc)
+	pipeAllocator.Store(pipeAllocFunc{alloc})
+	return old.f
+}
+
+// allocPipe creates a pipe with flags, with the function set by
+// SetPipeAllocator, if any.
+func allocPipe(flags int) (rfd, wfd int, err error) {
+	if a, _ := pipeAllocator.Load().(pipeAllocFunc); a.f != nil {
+		return a.f(flags)
+	}
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], flags); err != nil {
+		return -1, -1, err
+	}
+	return fds[0], fds[1], nil
+}
+
+// testHookPipeSize is called with the capacity of a pipe reported by
+// F_GETPIPE_SZ, and returns the capacity to record.
+var testHookPipeSize = func(size int) int { return size }
+
+// syncSize sets p.size to the capacity of the pipe reported by the
+// kernel, and reports whether it differed. p.size only bounds how much
+// data each splice into the pipe asks for, while p.data counts what the
+// kernel moved, so a stale size costs failed splices, but never makes the
+// count of buffered data wrong. The size the pipe is restored to when it
+// is pooled follows, unless the pipe has been resized.
+func (p *pipe) syncSize() bool {
+	n, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p.rfd), syscall.F_GETPIPE_SZ, 0)
+	if errno != 0 {
+		return false
+	}
+	size := testHookPipeSize(int(n))
+	if size <= 0 || size == p.size {
+		return false
+	}
+	if p.size == p.allocSize {
+		p.allocSize = size
+	}
+	p.size = size
+	return true
+}
+
+// testHookPipeResize is called with the new size of a resized pipe.
+var testHookPipeResize = func(size int) {}
+
+// resize asks the kernel to change the capacity of the pipe to size
+// bytes, which it rounds up to a power of two pages. A pipe can't
+// shrink below the data it holds.
+func (p *pipe) resize(size int) error {
+	n, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p.rfd), syscall.F_SETPIPE_SZ, uintptr(size))
+	if errno != 0 {
+		return errno
+	}
+	p.size = int(n)
+	testHookPipeResize(p.size)
+	return nil
+}
+
+// release closes the pipe file descriptors, discarding any data still
+// buffered in the pipe.
+func (p *pipe) release() {
+	CloseFunc(p.rfd)
+	CloseFunc(p.wfd)
+	atomic.AddInt64(&openPipes, -1)
+	if atomic.LoadInt32(&pipeWaiters) > 0 {
+		notifyPipeFreed()
+	}
+}
+
+// finalize releases a pipe which was dropped from the pool. It runs on
+// the finalizer goroutine, with nothing ordering it after changes to
+// CloseFunc, so it closes the descriptors itself.
+func (p *pipe) finalize() {
+	syscall.Close(p.rfd)
+	syscall.Close(p.wfd)
+	atomic.AddInt64(&openPipes, -1)
+	if atomic.LoadInt32(&pipeWaiters) > 0 {
+		notifyPipeFreed()
+	}
+}
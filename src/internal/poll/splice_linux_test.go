@@ -0,0 +1,1089 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll_test
+
+import (
+	"bytes"
+	"fmt"
+	"internal/poll"
+	"internal/race"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestPipePoolStats(t *testing.T) {
+	// A garbage collection empties the pool, so the next
+	// pipe has to be allocated.
+	runtime.GC()
+	hits0, misses0 := poll.PipePoolStats()
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	hits1, misses1 := poll.PipePoolStats()
+	if hits1 != hits0 || misses1 != misses0+1 {
+		t.Errorf("cold get: hits %d -> %d, misses %d -> %d; want a single miss", hits0, hits1, misses0, misses1)
+	}
+
+	// The pool is per-P, so a returned pipe is not guaranteed to
+	// be handed back to this goroutine; allow a few attempts.
+	for i := 0; i < 10; i++ {
+		poll.PutPipe(p)
+		if p, _, err = poll.GetPipe(); err != nil {
+			t.Fatal(err)
+		}
+		if hits, _ := poll.PipePoolStats(); hits > hits1 {
+			poll.PutPipe(p)
+			return
+		}
+	}
+	poll.PutPipe(p)
+	t.Errorf("reused pipe was never counted as a pool hit")
+}
+
+func TestTrimPipePool(t *testing.T) {
+	if race.Enabled {
+		t.Skip("sync.Pool drops objects at random under the race detector")
+	}
+	// Start from an empty pool.
+	runtime.GC()
+	var pipes []*poll.Pipe
+	for i := 0; i < 4; i++ {
+		p, _, err := poll.GetPipe()
+		if err != nil {
+			t.Skipf("splice not available: %v", err)
+		}
+		pipes = append(pipes, p)
+	}
+	idle := make(map[int]bool)
+	for _, p := range pipes {
+		rfd, wfd := poll.PipeDescriptors(p)
+		idle[rfd], idle[wfd] = true, true
+		poll.PutPipe(p)
+	}
+
+	var mu sync.Mutex
+	closed := make(map[int]bool)
+	closeFunc := poll.CloseFunc
+	defer func() { poll.CloseFunc = closeFunc }()
+	poll.CloseFunc = func(fd int) error {
+		mu.Lock()
+		closed[fd] = true
+		mu.Unlock()
+		return closeFunc(fd)
+	}
+	if n := poll.TrimPipePool(); n != len(pipes) {
+		t.Errorf("TrimPipePool() = %d; want %d", n, len(pipes))
+	}
+	mu.Lock()
+	for fd := range idle {
+		if !closed[fd] {
+			t.Errorf("idle pipe descriptor %d was not closed", fd)
+		}
+	}
+	mu.Unlock()
+
+	// The pool is empty again.
+	if n := poll.TrimPipePool(); n != 0 {
+		t.Errorf("second TrimPipePool() = %d; want 0", n)
+	}
+	_, misses0 := poll.PipePoolStats()
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll.PutPipe(p)
+	if _, misses := poll.PipePoolStats(); misses != misses0+1 {
+		t.Errorf("pipe taken after a trim came from the pool")
+	}
+}
+
+// newStreamFD returns an FD for one end of a Unix stream socket pair,
+// and the other end for the test to use with blocking reads and writes.
+func newStreamFD(t testing.TB) (*poll.FD, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+	fd := &poll.FD{Sysfd: fds[0], IsStream: true, ZeroReadIsEOF: true}
+	if err := fd.Init("unix", true); err != nil {
+		t.Fatal(err)
+	}
+	return fd, fds[1]
+}
+
+// TestSpliceSupportRace checks that when two pipes are allocated at once,
+// before splice is known to be usable, and only one of them finds that it
+// isn't, splice is disabled, whichever allocation finishes last.
+func TestSpliceSupportRace(t *testing.T) {
+	if p, _, err := poll.GetPipe(); err != nil {
+		t.Skipf("splice not available: %v", err)
+	} else {
+		poll.PutPipe(p)
+	}
+	runtime.GC()
+	poll.TrimPipePool()
+	defer poll.ResetSpliceSupport()()
+
+	// The first allocation finds no pipe size, as on a kernel on
+	// which splice is unreliable, but only once the second has
+	// started. The second finishes last.
+	firstIn, secondIn, firstDone := make(chan bool), make(chan bool), make(chan bool)
+	var calls int32
+	defer poll.SetPipeSizeHook(func(size int) int {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(firstIn)
+			<-secondIn
+			return 0
+		}
+		close(secondIn)
+		<-firstDone
+		return size
+	})()
+	secondDone := make(chan error, 1)
+	go func() {
+		<-firstIn
+		p, _, err := poll.GetPipe()
+		if err == nil {
+			poll.PutPipe(p)
+		}
+		secondDone <- err
+	}()
+	if _, _, err := poll.GetPipe(); err != syscall.EINVAL {
+		t.Errorf("first allocation: %v; want %v", err, syscall.EINVAL)
+	}
+	close(firstDone)
+	if err := <-secondDone; err != nil {
+		t.Errorf("second allocation: %v", err)
+	}
+	runtime.GC()
+	poll.TrimPipePool()
+	if p, _, err := poll.GetPipe(); err != syscall.EINVAL {
+		if err == nil {
+			poll.PutPipe(p)
+		}
+		t.Errorf("allocation after splice was found unusable: %v; want %v", err, syscall.EINVAL)
+	}
+}
+
+func TestRelayAdaptivePipe(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	var mu sync.Mutex
+	var sizes []int
+	defer poll.SetPipeResizeHook(func(size int) {
+		mu.Lock()
+		sizes = append(sizes, size)
+		mu.Unlock()
+	})()
+	resized := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), sizes...)
+	}
+
+	src, in := newStreamFD(t)
+	defer src.Close()
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	r := &poll.Relay{AdaptivePipe: true}
+	spliceDone := make(chan error, 1)
+	go func() {
+		_, _, _, err := r.Splice(dst, src, 1<<62)
+		spliceDone <- err
+	}()
+
+	// A burst which keeps the pipe full should grow it.
+	const burst = 32 << 20
+	go func() {
+		b := make([]byte, 64<<10)
+		for n := 0; n < burst; n += len(b) {
+			if _, err := syscall.Write(in, b); err != nil {
+				return
+			}
+		}
+	}()
+	b := make([]byte, 64<<10)
+	for n := 0; n < burst; {
+		m, err := syscall.Read(out, b)
+		if err != nil || m == 0 {
+			t.Fatalf("read after %d bytes: %d, %v", n, m, err)
+		}
+		n += m
+	}
+	grown := resized()
+	if len(grown) == 0 {
+		t.Fatal("pipe was not grown during a burst")
+	}
+	for i, size := range grown {
+		if size > poll.MaxPipeSize || i > 0 && size <= grown[i-1] {
+			t.Fatalf("pipe sizes during burst: %v; want growth up to %d", grown, poll.MaxPipeSize)
+		}
+	}
+
+	// Small messages, sent one at a time, use little of the pipe,
+	// which should shrink to the minimum.
+	for i := 0; i < 5000; i++ {
+		if _, err := syscall.Write(in, b[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syscall.Read(out, b[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if s := resized(); s[len(s)-1] == poll.MinPipeSize {
+			break
+		}
+	}
+	all := resized()
+	shrunk := all[len(grown):]
+	if len(shrunk) == 0 || shrunk[len(shrunk)-1] != poll.MinPipeSize {
+		t.Fatalf("pipe sizes while idle: %v; want shrinking to %d", shrunk, poll.MinPipeSize)
+	}
+	for i, size := range shrunk {
+		if size < poll.MinPipeSize || i > 0 && size >= shrunk[i-1] {
+			t.Fatalf("pipe sizes while idle: %v; want shrinking down to %d", shrunk, poll.MinPipeSize)
+		}
+	}
+
+	syscall.Close(in)
+	if err := <-spliceDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRelayBothBlocked drives a relay, round after round, into the state
+// in which its pipe holds some data and has room for more, while both
+// src and dst would block, and checks that it makes progress from there.
+func TestRelayBothBlocked(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	blocked := make(chan struct{}, 1)
+	defer poll.SetRelayBothBlockedHook(func() {
+		select {
+		case blocked <- struct{}{}:
+		default:
+		}
+	})()
+
+	src, in := newStreamFD(t)
+	defer src.Close()
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	var r poll.Relay
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, _, _, err := r.Splice(dst, src, 1<<62)
+		spliceDone <- result{n, err}
+	}()
+
+	const rounds, chunk = 20, 32 << 10
+	want := make([]byte, chunk)
+	got := make([]byte, chunk)
+	filler := make([]byte, 1<<10)
+	readFull := func(b []byte) error {
+		for n := 0; n < len(b); {
+			m, err := syscall.Read(out, b[n:])
+			if err != nil || m == 0 {
+				return fmt.Errorf("read after %d bytes: %d, %v", n, m, err)
+			}
+			n += m
+		}
+		return nil
+	}
+	for round := 0; round < rounds; round++ {
+		// While the relay waits for src, fill dst up, so that
+		// the relay can pump only part of the next chunk, if
+		// any, before dst blocks. Then it finds src empty, with
+		// data left in the pipe.
+		filled := 0
+		for {
+			n, err := syscall.Write(dst.Sysfd, filler)
+			if err == syscall.EAGAIN {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			filled += n
+		}
+		for i := range want {
+			want[i] = byte(round + i%251)
+		}
+		if _, err := syscall.Write(in, want); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-blocked:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: relay never waited with both descriptors blocked", round)
+		}
+		if err := readFull(make([]byte, filled)); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if err := readFull(got); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("round %d: received data differs from data sent", round)
+		}
+	}
+
+	syscall.Close(in)
+	select {
+	case res := <-spliceDone:
+		if res.err != nil || res.n != rounds*chunk {
+			t.Fatalf("relay returned %d, %v; want %d, <nil>", res.n, res.err, rounds*chunk)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return after src was closed")
+	}
+}
+
+// TestRelaySpuriousWakeup wakes a relay waiting for its source again and
+// again while the source has no data, and checks that the relay, finding
+// nothing to read each time, waits again rather than failing or spinning,
+// and moves the data which arrives later.
+func TestRelaySpuriousWakeup(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	const spurious = 100
+	var waits int32
+	waiting := make(chan struct{}, 1)
+	defer poll.SetRelaySkipWaitReadHook(func() bool {
+		if atomic.AddInt32(&waits, 1) <= spurious {
+			return true
+		}
+		select {
+		case waiting <- struct{}{}:
+		default:
+		}
+		return false
+	})()
+
+	src, in := newStreamFD(t)
+	defer src.Close()
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	var r poll.Relay
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, _, _, err := r.Splice(dst, src, 1<<62)
+		spliceDone <- result{n, err}
+	}()
+	select {
+	case <-waiting:
+	case res := <-spliceDone:
+		t.Fatalf("relay returned %d, %v after spurious wakeups", res.n, res.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay never waited for src after spurious wakeups")
+	}
+
+	want := []byte("after the wakeups")
+	if _, err := syscall.Write(in, want); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(in)
+	var res result
+	select {
+	case res = <-spliceDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return after src was closed")
+	}
+	if res.err != nil || res.n != int64(len(want)) {
+		t.Fatalf("relay returned %d, %v; want %d, <nil>", res.n, res.err, len(want))
+	}
+	got := make([]byte, len(want)+1)
+	n, err := syscall.Read(out, got)
+	if err != nil || !bytes.Equal(got[:n], want) {
+		t.Fatalf("received %q, %v; want %q", got[:n], err, want)
+	}
+	// Each spurious wakeup costs one more wait, and the data one or
+	// two; a relay which spun would have waited far more.
+	if n := atomic.LoadInt32(&waits); n > spurious+3 {
+		t.Errorf("relay waited %d times for %d spurious wakeups", n, spurious)
+	}
+}
+
+// TestRelayStalePipeSize checks that a relay whose pipe is smaller than
+// recorded moves all of the data, counts it right, and records the size
+// of the pipe once the pipe refuses data short of the recorded size.
+func TestRelayStalePipeSize(t *testing.T) {
+	// A garbage collection empties the pool, so the relay gets a new
+	// pipe, whose size goes through the hook.
+	runtime.GC()
+	var mu sync.Mutex
+	var reported []int
+	defer poll.SetPipeSizeHook(func(size int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, size)
+		if len(reported) == 1 {
+			return 4 * size
+		}
+		return size
+	})()
+
+	src, in := newStreamFD(t)
+	defer src.Close()
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	// PreferDrain makes the relay fill its pipe before it pumps it.
+	r := &poll.Relay{PreferDrain: true}
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, _, _, err := r.Splice(dst, src, 1<<62)
+		spliceDone <- result{n, err}
+	}()
+
+	want := make([]byte, 4<<20)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	go func() {
+		syscall.Write(in, want)
+		syscall.Close(in)
+	}()
+	got := make([]byte, 0, len(want))
+	b := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(out, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		got = append(got, b[:n]...)
+		if len(got) == len(want) {
+			break
+		}
+	}
+	res := <-spliceDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.n != int64(len(want)) {
+		t.Errorf("relay counted %d bytes; want %d", res.n, len(want))
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("relayed %d bytes which differ from the %d bytes sent", len(got), len(want))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 2 {
+		t.Fatalf("pipe size read %d times; want 2, once when the pipe was made and once when it filled up", len(reported))
+	}
+}
+
+func TestSendFileDropCache(t *testing.T) {
+	f, err := ioutil.TempFile("", "sendfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	const size, start = 1<<20 + 3, 4096
+	want := make([]byte, size)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	// The advice starts at the file's offset.
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	want = want[start:]
+	fd := int(f.Fd())
+
+	type region struct{ off, n int64 }
+	var mu sync.Mutex
+	var regions []region
+	defer poll.SetDropFileCacheHook(func(hfd int, off, n int64) {
+		if hfd != fd {
+			return
+		}
+		mu.Lock()
+		regions = append(regions, region{off, n})
+		mu.Unlock()
+	})()
+
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+	type result struct {
+		n   int64
+		err error
+	}
+	sendDone := make(chan result, 1)
+	go func() {
+		n, err := poll.SendFileDropCache(dst, fd, 1<<62)
+		sendDone <- result{n, err}
+	}()
+	got := make([]byte, len(want))
+	for n := 0; n < len(got); {
+		m, err := syscall.Read(out, got[n:])
+		if err != nil || m == 0 {
+			t.Fatalf("read after %d bytes: %d, %v", n, m, err)
+		}
+		n += m
+	}
+	res := <-sendDone
+	if res.err != nil || res.n != int64(len(want)) {
+		t.Fatalf("SendFileDropCache returned %d, %v; want %d, <nil>", res.n, res.err, len(want))
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("received data differs from the file")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	off := int64(start)
+	for _, r := range regions {
+		if r.off != off || r.n <= 0 {
+			t.Fatalf("advised regions %v; want consecutive regions from %d to %d", regions, start, size)
+		}
+		off += r.n
+	}
+	if off != size {
+		t.Fatalf("advised regions %v; want consecutive regions from %d to %d", regions, start, size)
+	}
+}
+
+func TestSplicePipeSource(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	w := fds[1]
+	defer func() {
+		if w >= 0 {
+			syscall.Close(w)
+		}
+	}()
+	src := &poll.FD{Sysfd: fds[0], IsStream: true, ZeroReadIsEOF: true}
+	if err := src.Init("file", true); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, out := newStreamFD(t)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, _, _, err := poll.Splice(dst, src, 1<<62)
+		spliceDone <- result{n, err}
+	}()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		for m := 0; m < n; {
+			k, err := syscall.Read(out, b[m:])
+			if err != nil || k == 0 {
+				t.Fatalf("read after %d bytes: %d, %v", m, k, err)
+			}
+			m += k
+		}
+		return b
+	}
+
+	// While the pipe's writer is open, the splice waits for it,
+	// however long it is idle.
+	want := bytes.Repeat([]byte("pipe"), 1<<10)
+	for i := 0; i < 2; i++ {
+		if _, err := syscall.Write(w, want); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(len(want)); !bytes.Equal(got, want) {
+			t.Fatalf("round %d: got %q; want %q", i, got, want)
+		}
+		select {
+		case res := <-spliceDone:
+			t.Fatalf("splice returned (%d, %v) with the writer open", res.n, res.err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Closing the writer is EOF.
+	syscall.Close(w)
+	w = -1
+	select {
+	case res := <-spliceDone:
+		if res.n != int64(2*len(want)) || res.err != nil {
+			t.Fatalf("got (%d, %v); want (%d, <nil>)", res.n, res.err, 2*len(want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("splice did not return after the writer was closed")
+	}
+}
+
+// BenchmarkPipeFlags compares splices between Unix sockets through pipes
+// created with each of the candidate flags of pipe2. With -v, it reports
+// the throughput of each flag relative to the default.
+func BenchmarkPipeFlags(b *testing.B) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		b.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	flags := []struct {
+		name  string
+		flags int
+	}{
+		{"default", 0},
+		{"O_DIRECT", syscall.O_DIRECT},
+	}
+	chunkSizes := []int{4 << 10, 64 << 10}
+	// rates holds the throughput, in bytes per second, of the last
+	// run of each sub-benchmark.
+	rates := make(map[string]float64)
+	for _, chunkSize := range chunkSizes {
+		for _, f := range flags {
+			name := fmt.Sprintf("%s/chunk=%d", f.name, chunkSize)
+			b.Run(name, func(b *testing.B) {
+				defer poll.SetPipeFlags(f.flags)()
+				d := benchSpliceFDs(b, chunkSize)
+				rates[name] = float64(chunkSize) * float64(b.N) / d.Seconds()
+			})
+		}
+	}
+	for _, chunkSize := range chunkSizes {
+		def := rates[fmt.Sprintf("default/chunk=%d", chunkSize)]
+		for _, f := range flags[1:] {
+			if r := rates[fmt.Sprintf("%s/chunk=%d", f.name, chunkSize)]; def > 0 && r > 0 {
+				b.Logf("chunk=%d: %s %.0f MB/s, %+.1f%% against the default", chunkSize, f.name, r/1e6, 100*(r-def)/def)
+			}
+		}
+	}
+}
+
+// BenchmarkPipeNUMA compares splices through pipes created on the NUMA
+// node of the CPU running them with splices through pipes created on
+// another node, using SetPipeAllocator. It is skipped on machines with a
+// single node.
+func BenchmarkPipeNUMA(b *testing.B) {
+	local, err := numaNodeCPUs(0)
+	if err != nil {
+		b.Skipf("no NUMA topology: %v", err)
+	}
+	remote, err := numaNodeCPUs(1)
+	if err != nil {
+		b.Skip("single NUMA node")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var saved cpuMask
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &saved); err != nil {
+		b.Skipf("sched_getaffinity: %v", err)
+	}
+	defer schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &saved)
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &local); err != nil {
+		b.Skipf("sched_setaffinity: %v", err)
+	}
+
+	for _, node := range []struct {
+		name string
+		cpus cpuMask
+	}{
+		{"local", local},
+		{"remote", remote},
+	} {
+		b.Run(node.name, func(b *testing.B) {
+			defer poll.SetPipeAllocator(poll.SetPipeAllocator(func(flags int) (int, int, error) {
+				return pipeOnCPUs(&node.cpus, flags)
+			}))
+			// Empty the pipe pool, so that the splice gets a pipe
+			// from the allocator.
+			runtime.GC()
+			poll.TrimPipePool()
+			benchSpliceFDs(b, 64<<10)
+		})
+	}
+}
+
+// cpuMask is a CPU set of sched_setaffinity(2).
+type cpuMask [1024 / 64]uint64
+
+// numaNodeCPUs returns the CPUs of a NUMA node.
+func numaNodeCPUs(node int) (cpuMask, error) {
+	var m cpuMask
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node))
+	if err != nil {
+		return m, err
+	}
+	// The list is like "0-15,32-47".
+	for _, r := range strings.Split(strings.TrimSpace(string(b)), ",") {
+		var lo, hi int
+		if n, _ := fmt.Sscanf(r, "%d-%d", &lo, &hi); n == 1 {
+			hi = lo
+		} else if n != 2 {
+			return m, fmt.Errorf("bad cpulist %q", b)
+		}
+		for cpu := lo; cpu <= hi && cpu < 64*len(m); cpu++ {
+			m[cpu/64] |= 1 << uint(cpu%64)
+		}
+	}
+	return m, nil
+}
+
+// schedAffinity gets or sets the CPU set of the calling thread with
+// trap, SYS_SCHED_GETAFFINITY or SYS_SCHED_SETAFFINITY.
+func schedAffinity(trap uintptr, m *cpuMask) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*m), uintptr(unsafe.Pointer(m)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// pipeOnCPUs creates a pipe with flags on a thread bound to cpus, which
+// has the kernel allocate the pipe on their NUMA node.
+func pipeOnCPUs(cpus *cpuMask, flags int) (rfd, wfd int, err error) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// The thread is left locked, so that it exits with its
+		// CPU set when the goroutine does.
+		runtime.LockOSThread()
+		if err = schedAffinity(syscall.SYS_SCHED_SETAFFINITY, cpus); err != nil {
+			return
+		}
+		var fds [2]int
+		err = syscall.Pipe2(fds[:], flags)
+		rfd, wfd = fds[0], fds[1]
+	}()
+	<-done
+	return rfd, wfd, err
+}
+
+// benchSpliceFDs splices b.N chunks of chunkSize bytes from one Unix
+// socket to another, and returns the time it took.
+func benchSpliceFDs(b *testing.B, chunkSize int) time.Duration {
+	src, in := newStreamFD(b)
+	defer src.Close()
+	dst, out := newStreamFD(b)
+	defer dst.Close()
+	defer syscall.Close(out)
+
+	total := int64(chunkSize) * int64(b.N)
+	readDone := make(chan int64)
+	go func() {
+		buf := make([]byte, 1<<16)
+		var n int64
+		for n < total {
+			m, err := syscall.Read(out, buf)
+			if err != nil || m == 0 {
+				break
+			}
+			n += int64(m)
+		}
+		readDone <- n
+	}()
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(int64(chunkSize))
+	b.ResetTimer()
+	start := time.Now()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := syscall.Write(in, chunk); err != nil {
+				break
+			}
+		}
+		syscall.Close(in)
+	}()
+	written, _, _, err := poll.Splice(dst, src, total)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n := <-readDone; n != total || written != total {
+		b.Fatalf("spliced %d and read %d bytes; want %d", written, n, total)
+	}
+	return time.Since(start)
+}
+
+func TestSpliceExpiredDeadline(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	past := time.Now().Add(-time.Second)
+	for _, tt := range []struct {
+		name   string
+		expire func(dst, src *poll.FD) error
+	}{
+		{"read", func(dst, src *poll.FD) error { return src.SetReadDeadline(past) }},
+		{"write", func(dst, src *poll.FD) error { return dst.SetWriteDeadline(past) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, in := newStreamFD(t)
+			defer src.Close()
+			defer syscall.Close(in)
+			dst, out := newStreamFD(t)
+			defer dst.Close()
+			defer syscall.Close(out)
+			if err := tt.expire(dst, src); err != nil {
+				t.Fatal(err)
+			}
+			// Data waiting on src would be spliced if the
+			// deadline were not checked first.
+			if _, err := syscall.Write(in, []byte("expired")); err != nil {
+				t.Fatal(err)
+			}
+
+			hits0, misses0 := poll.PipePoolStats()
+			n, handled, _, err := poll.Splice(dst, src, 1<<62)
+			if n != 0 || !handled || err != poll.ErrTimeout {
+				t.Errorf("got (%d, %t, %v); want (0, true, %v)", n, handled, err, poll.ErrTimeout)
+			}
+			if hits, misses := poll.PipePoolStats(); hits+misses != hits0+misses0 {
+				t.Errorf("splice took a pipe: hits %d -> %d, misses %d -> %d", hits0, hits, misses0, misses)
+			}
+		})
+	}
+}
+
+// newTCPFD returns an FD for one end of a loopback TCP connection, and
+// the other end for the test to use with blocking reads and writes. The
+// connection buffers little data, so that the FD soon blocks when the
+// other end isn't read.
+func newTCPFD(t testing.TB) (*poll.FD, int) {
+	const bufSize = 16 << 10
+	ln, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(ln)
+	// The receive buffer of an accepted connection is that of its
+	// listener.
+	if err := syscall.SetsockoptInt(ln, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bufSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(ln, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(ln, 1); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_SNDBUF, bufSize); err != nil {
+		syscall.Close(s)
+		t.Fatal(err)
+	}
+	if err := syscall.Connect(s, sa); err != nil {
+		syscall.Close(s)
+		t.Fatal(err)
+	}
+	peer, _, err := syscall.Accept4(ln, syscall.SOCK_CLOEXEC)
+	if err != nil {
+		syscall.Close(s)
+		t.Fatal(err)
+	}
+	if err := syscall.SetNonblock(s, true); err != nil {
+		t.Fatal(err)
+	}
+	fd := &poll.FD{Sysfd: s, IsStream: true, ZeroReadIsEOF: true}
+	if err := fd.Init("tcp", true); err != nil {
+		t.Fatal(err)
+	}
+	return fd, peer
+}
+
+// TestSplicerResetAfterWaitWrite resets the peer of a Splicer's dst just
+// after the Splicer has found dst writable, so that its next write fails
+// with ECONNRESET. The error is returned with the data written before it
+// counted, and the data which was not written is left in the pipe and on
+// src, in order.
+func TestSplicerResetAfterWaitWrite(t *testing.T) {
+	p, _, err := poll.GetPipe()
+	if err != nil {
+		t.Skipf("splice not available: %v", err)
+	}
+	poll.PutPipe(p)
+
+	src, in := newStreamFD(t)
+	defer src.Close()
+	defer syscall.Close(in)
+	dst, peer := newTCPFD(t)
+	defer dst.Close()
+
+	const size = 4 << 20
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	// The write is left blocked once the Splicer stops, until src
+	// is read below.
+	go syscall.Write(in, data)
+
+	var armed int32
+	waited := make(chan struct{})
+	reset := make(chan struct{})
+	defer poll.SetSplicerWaitedWriteHook(func() {
+		if atomic.CompareAndSwapInt32(&armed, 1, 2) {
+			close(waited)
+			<-reset
+		}
+	})()
+
+	s := &poll.Splicer{Src: src}
+	defer s.Close()
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, _, _, err := s.SpliceTo(dst, size)
+		spliceDone <- result{n, err}
+	}()
+
+	// Read from the peer until the Splicer has had to wait for dst
+	// and found it writable again.
+	atomic.StoreInt32(&armed, 1)
+	if err := syscall.SetNonblock(peer, true); err != nil {
+		t.Fatal(err)
+	}
+	var received int
+	b := make([]byte, 64<<10)
+	for done := false; !done; {
+		select {
+		case <-waited:
+			done = true
+		case res := <-spliceDone:
+			t.Fatalf("SpliceTo returned %d, %v without waiting for dst", res.n, res.err)
+		default:
+			n, err := syscall.Read(peer, b)
+			if err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if err != nil || n == 0 {
+				t.Fatalf("peer read after %d bytes: %d, %v", received, n, err)
+			}
+			if !bytes.Equal(b[:n], data[received:received+n]) {
+				t.Fatalf("peer received data which differs from data sent at %d", received)
+			}
+			received += n
+		}
+	}
+	// Closing with a zero linger time resets the connection.
+	if err := syscall.SetsockoptLinger(peer, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0}); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(peer)
+	close(reset)
+
+	var res result
+	select {
+	case res = <-spliceDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Splicer did not return after dst was reset")
+	}
+	if res.err != syscall.ECONNRESET {
+		t.Fatalf("SpliceTo returned %d, %v; want %v", res.n, res.err, syscall.ECONNRESET)
+	}
+	if !s.DstFailed {
+		t.Error("DstFailed is not set")
+	}
+	// Data written to dst may have been queued there, unsent, when
+	// the connection was reset.
+	if res.n < int64(received) || res.n >= size {
+		t.Fatalf("SpliceTo wrote %d bytes; want at least the %d received, and less than %d", res.n, received, size)
+	}
+
+	// The data after the bytes counted as written is what is left,
+	// first in the pipe, then on src.
+	rest := make([]byte, 0, size-res.n)
+	for {
+		n, err := s.ReadBuffered(b)
+		rest = append(rest, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffered := len(rest)
+	for int64(len(rest)) < size-res.n {
+		n, err := syscall.Read(src.Sysfd, b)
+		if err == syscall.EAGAIN {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil || n == 0 {
+			t.Fatalf("reading src: %d, %v", n, err)
+		}
+		rest = append(rest, b[:n]...)
+	}
+	if !bytes.Equal(rest, data[res.n:]) {
+		t.Errorf("the %d bytes left in the pipe and the %d left on src differ from the %d not written", buffered, len(rest)-buffered, size-res.n)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//go:linkname getsockopt syscall.getsockopt
+func getsockopt(s, level, name int, val unsafe.Pointer, vallen *uint32) error
+
+// ErrNotRedirected is returned by Relay.Splice when a relay with
+// Redirected set finds data queued for reading on src, which the
+// kernel was expected to redirect to dst instead.
+var ErrNotRedirected = errors.New("data not redirected by the kernel")
+
+// tcpInfoBytes is the part of struct tcp_info which holds
+// tcpi_bytes_acked and tcpi_bytes_received, as uint64s, in its last two
+// elements. Those fields were added in Linux 4.1.
+type tcpInfoBytes [17]uint64
+
+// tcpBytes returns the number of bytes sent on the TCP socket s which
+// its peer has acknowledged, and the number of bytes received on s. ok
+// is false if the kernel does not report them.
+func tcpBytes(s int) (acked, received int64, ok bool) {
+	var info tcpInfoBytes
+	size := uint32(unsafe.Sizeof(info))
+	if err := getsockopt(s, syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&info), &size); err != nil || size < uint32(unsafe.Sizeof(info)) {
+		return 0, 0, false
+	}
+	return int64(info[15]), int64(info[16]), true
+}
+
+// tcpQueued returns the number of bytes queued for sending on the TCP
+// socket s since it was connected, whether or not they have been sent
+// or acknowledged since. ok is false if that can't be had.
+func tcpQueued(s int) (queued int64, ok bool) {
+	acked, _, ok := tcpBytes(s)
+	if !ok {
+		return 0, false
+	}
+	var outq int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s), syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&outq))); errno != 0 {
+		return 0, false
+	}
+	return acked + int64(outq), true
+}
+
+// spliceRedirected is Splice for a relay whose data the kernel moves
+// from src to dst by itself. It waits for src to reach EOF, and then for
+// the data which src received in the meantime to be queued on dst,
+// which the kernel does from a work queue of its own. handled is false
+// if the kernel can't report how much data src received and dst sent,
+// in which case spliceRedirected has done nothing.
+func (r *Relay) spliceRedirected(dst, src *FD) (written int64, handled bool, sc string, err error) {
+	// The descriptors are locked before they are inspected, so that a
+	// concurrent Close can't release them, and the kernel reuse their
+	// numbers, in between.
+	if err := src.readLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer src.readUnlock()
+	if err := dst.writeLock(); err != nil {
+		return 0, true, "", err
+	}
+	defer dst.writeUnlock()
+	_, received0, ok := tcpBytes(src.Sysfd)
+	if !ok {
+		return 0, false, "", nil
+	}
+	queued0, ok := tcpQueued(dst.Sysfd)
+	if !ok {
+		return 0, false, "", nil
+	}
+	if err := src.pd.prepareRead(src.isFile); err != nil {
+		return 0, true, "", err
+	}
+
+	var timer relayTimer
+	if r.Stats != nil {
+		timer.begin()
+		defer timer.flush(r.Stats)
+	}
+
+	// progress returns the data queued on dst so far.
+	progress := func() int64 {
+		queued, _ := tcpQueued(dst.Sysfd)
+		return queued - queued0
+	}
+	for {
+		if r.canceled() {
+			return progress(), true, "", ErrCanceled
+		}
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(src.Sysfd, b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN {
+			timer.readWaits++
+			timer.beginWait()
+			werr := src.pd.waitRead(src.isFile)
+			timer.endWait()
+			if werr != nil && !r.canceled() {
+				return progress(), true, "", werr
+			}
+			continue
+		}
+		if err != nil {
+			return progress(), true, "recvfrom", err
+		}
+		if n > 0 {
+			return progress(), true, "", ErrNotRedirected
+		}
+		break
+	}
+
+	// The FIN which ended the stream counts as a byte received.
+	_, received, _ := tcpBytes(src.Sysfd)
+	want := received - received0 - 1
+	for delay := time.Millisecond; ; {
+		if written = progress(); written >= want {
+			return want, true, "", nil
+		}
+		if r.canceled() {
+			return written, true, "", ErrCanceled
+		}
+		if err := pendingError(dst); err != nil {
+			return written, true, "", err
+		}
+		timer.beginWait()
+		time.Sleep(delay)
+		timer.endWait()
+		if delay < 10*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
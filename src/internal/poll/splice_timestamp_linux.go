@@ -0,0 +1,190 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package poll
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//go:linkname recvmsg syscall.recvmsg
+func recvmsg(s int, msg *syscall.Msghdr, flags int) (n int, err error)
+
+// Flags of the SO_TIMESTAMPING option, from the Linux
+// include/uapi/linux/net_tstamp.h.
+const (
+	sofTimestampingTxHardware  = 1 << 0
+	sofTimestampingTxSoftware  = 1 << 1
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+	sofTimestampingOptID       = 1 << 7
+	sofTimestampingTxAck       = 1 << 9
+	sofTimestampingOptTsonly   = 1 << 11
+	sofTimestampingOptIDTCP    = 1 << 16 // Linux 6.2 and later
+)
+
+const (
+	// scmTstampAck is the ee_info of a timestamp taken when the peer
+	// acknowledged the data, rather than when it was transmitted.
+	scmTstampAck = 2
+
+	// soEEOriginTimestamping is the ee_origin of a timestamp.
+	soEEOriginTimestamping = 4
+)
+
+// sockExtendedErr is struct sock_extended_err, which describes each
+// message on the error queue of a socket.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+// timestampAckWait bounds how long a transfer which completes waits for
+// the timestamps of the acknowledgment of its data.
+const timestampAckWait = time.Second
+
+// txTimestamps reaps the transmit timestamps of the data a transfer
+// writes to dst from dst's error queue.
+type txTimestamps struct {
+	report func(offset int64, acked bool, sw, hw time.Time)
+	old    int // SO_TIMESTAMPING of dst before the transfer
+
+	// base is the number of bytes queued on dst before the transfer,
+	// which the kernel counts, in the IDs of the timestamps, with
+	// those written by the transfer if it predates
+	// SOF_TIMESTAMPING_OPT_ID_TCP.
+	base int64
+
+	acked int64 // the data acknowledged so far, by the timestamps
+	oob   []byte
+}
+
+// enableTimestamps enables transmit timestamps of the data written to
+// dst from now on, reported to report. Enabling them is best-effort: if
+// dst is not a TCP socket, or the kernel doesn't support them, ok is
+// false and the transfer runs without them.
+func enableTimestamps(dst *FD, report func(offset int64, acked bool, sw, hw time.Time)) (ts *txTimestamps, ok bool) {
+	old, err := syscall.GetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING)
+	if err != nil {
+		return nil, false
+	}
+	// The IDs count from when SOF_TIMESTAMPING_OPT_ID is set, so it
+	// is cleared first if it is set already.
+	if old&sofTimestampingOptID != 0 {
+		if syscall.SetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, 0) != nil {
+			return nil, false
+		}
+	}
+	ts = &txTimestamps{report: report, old: old}
+	flags := sofTimestampingTxSoftware | sofTimestampingSoftware |
+		sofTimestampingTxHardware | sofTimestampingRawHardware |
+		sofTimestampingTxAck | sofTimestampingOptID | sofTimestampingOptTsonly
+	if syscall.SetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags|sofTimestampingOptIDTCP) != nil {
+		// Without SOF_TIMESTAMPING_OPT_ID_TCP, the IDs count from
+		// the first byte which hasn't been acknowledged yet.
+		queued, ok := tcpOutq(dst.Sysfd)
+		if !ok || syscall.SetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags) != nil {
+			syscall.SetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, old)
+			return nil, false
+		}
+		ts.base = queued
+	}
+	return ts, true
+}
+
+// tcpOutq returns the number of bytes queued on the TCP socket s which
+// its peer has not acknowledged.
+func tcpOutq(s int) (int64, bool) {
+	var outq int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s), syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&outq))); errno != 0 {
+		return 0, false
+	}
+	return int64(outq), true
+}
+
+// reap reports the timestamps waiting on the error queue of dst, to
+// which written bytes have been written since the timestamps were
+// enabled.
+func (ts *txTimestamps) reap(dst *FD, written int64) {
+	if ts.oob == nil {
+		ts.oob = make([]byte, 256)
+	}
+	var b [1]byte
+	for {
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		msg := syscall.Msghdr{Iov: &iov, Iovlen: 1, Control: &ts.oob[0]}
+		msg.SetControllen(len(ts.oob))
+		if _, err := recvmsg(dst.Sysfd, &msg, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT); err != nil {
+			return
+		}
+		cmsgs, err := syscall.ParseSocketControlMessage(ts.oob[:msg.Controllen])
+		if err != nil {
+			continue
+		}
+		var stamps *[3]syscall.Timespec
+		var serr *sockExtendedErr
+		for i := range cmsgs {
+			m := &cmsgs[i]
+			switch {
+			case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_TIMESTAMPING:
+				if len(m.Data) >= int(unsafe.Sizeof(*stamps)) {
+					stamps = (*[3]syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+				}
+			case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR,
+				m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR:
+				if len(m.Data) >= int(unsafe.Sizeof(*serr)) {
+					serr = (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+				}
+			}
+		}
+		if stamps == nil || serr == nil || serr.Origin != soEEOriginTimestamping {
+			continue
+		}
+		// The ID is that of the last byte stamped, counted modulo
+		// 2^32, and so the offset just past it is at most written.
+		end := uint32(ts.base + int64(serr.Data) + 1)
+		offset := written - int64(uint32(written)-end)
+		acked := serr.Info == scmTstampAck
+		if acked && offset > ts.acked {
+			ts.acked = offset
+		}
+		var sw, hw time.Time
+		if stamps[0] != (syscall.Timespec{}) {
+			sw = time.Unix(stamps[0].Unix())
+		}
+		if stamps[2] != (syscall.Timespec{}) {
+			hw = time.Unix(stamps[2].Unix())
+		}
+		ts.report(offset, acked, sw, hw)
+	}
+}
+
+// finish reaps the timestamps of a transfer which wrote written bytes to
+// dst, waiting for those of the acknowledgment of all of them if the
+// transfer completed, and restores the previous SO_TIMESTAMPING of dst.
+func (ts *txTimestamps) finish(r *Relay, dst *FD, written int64, completed bool) {
+	ts.reap(dst, written)
+	if completed {
+		deadline := time.Now().Add(timestampAckWait)
+		for delay := time.Millisecond; ts.acked < written && time.Now().Before(deadline); {
+			if r.canceled() || dst.closing() {
+				break
+			}
+			time.Sleep(delay)
+			ts.reap(dst, written)
+			if delay < 10*time.Millisecond {
+				delay *= 2
+			}
+		}
+	}
+	syscall.SetsockoptInt(dst.Sysfd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, ts.old)
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// adaptiveWindow is the number of writes over which an adaptive
+	// relay measures where its copy waits.
+	adaptiveWindow = 16
+
+	// maxAdaptiveBuffer bounds the socket buffers which an adaptive
+	// relay grows.
+	maxAdaptiveBuffer = 4 << 20
+)
+
+// AdaptiveRelay relays data between a and b in both directions, tuning
+// each direction to the conditions it meets, until both directions
+// reach EOF or a copy fails. It returns the number of bytes copied from
+// a to b and from b to a, and the first error encountered. A direction
+// whose source reaches EOF closes the writing side of its destination,
+// if it has a CloseWrite method, and leaves the other direction
+// running; a direction which fails stops the other. AdaptiveRelay
+// closes neither connection.
+//
+// Each direction is copied by a Relay with AdaptivePipe set, whose
+// kernel buffer follows the traffic, and which watches where its copy
+// waits. When a quarter or more of the writes in a window of 16 had to
+// wait for the destination, the relay doubles the destination's send
+// buffer, to at least four TCP segments so that the receiver's delayed
+// acknowledgments can't stall it; when a quarter or more of the reads
+// waited for the source while no write did, it doubles the source's
+// receive buffer, so that the peer can send further ahead. The buffers
+// only grow, up to 4 MiB, or the system's limit if that is lower, which
+// bounds the data held by each connection. The relay tunes only spliced
+// copies, and so only on Linux; elsewhere AdaptiveRelay copies as Relay
+// does.
+func AdaptiveRelay(a, b Conn) (toB, toA int64, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+	)
+	relay := func(dst, src Conn, written *int64) {
+		defer wg.Done()
+		n, cerr := newAdaptiveRelay(dst, src).CopyContext(ctx, dst, src)
+		*written = n
+		if cerr != nil {
+			errOnce.Do(func() {
+				err = cerr
+				cancel()
+			})
+			return
+		}
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+	}
+	wg.Add(2)
+	go relay(b, a, &toB)
+	go relay(a, b, &toA)
+	wg.Wait()
+	return toB, toA, err
+}
+
+// newAdaptiveRelay returns the Relay with which AdaptiveRelay copies
+// from src to dst.
+func newAdaptiveRelay(dst, src Conn) *Relay {
+	rl := &Relay{AdaptivePipe: true}
+	t := &bufferTuner{rl: rl, dst: dst, src: src}
+	rl.Account = t.account
+	return rl
+}
+
+// A bufferTuner grows the socket buffers of the connections of an
+// adaptive relay from the waits recorded in the relay's stats.
+type bufferTuner struct {
+	rl       *Relay
+	dst, src Conn
+	last     RelayStats // stats at the start of the window
+
+	// dstMaxed and srcMaxed are set once the buffer of dst or src
+	// can't grow any further.
+	dstMaxed, srcMaxed bool
+}
+
+// account is the Account function of the relay, called after each of
+// its writes.
+func (t *bufferTuner) account(int64) error {
+	st := t.rl.Stats()
+	writes := st.Writes - t.last.Writes
+	if writes < adaptiveWindow {
+		return nil
+	}
+	writeWaits := st.WriteWaits - t.last.WriteWaits
+	reads := st.Reads - t.last.Reads
+	readWaits := st.ReadWaits - t.last.ReadWaits
+	t.last = st
+	switch {
+	case 4*writeWaits >= writes && !t.dstMaxed:
+		t.dstMaxed = !growBuffer(t.dst, true)
+	case 4*readWaits >= reads && writeWaits == 0 && !t.srcMaxed:
+		t.srcMaxed = !growBuffer(t.src, false)
+	}
+	return nil
+}
+
+// growBuffer doubles the send buffer of c, if send is set, to at least
+// four segments, or else its receive buffer, up to maxAdaptiveBuffer,
+// and reports whether the buffer grew.
+func growBuffer(c Conn, send bool) bool {
+	size := socketBufferSize(c, send)
+	if size <= 0 || size >= maxAdaptiveBuffer {
+		return false
+	}
+	grown := 2 * size
+	if send {
+		// A send buffer which holds fewer than two segments
+		// waits for each to be acknowledged, and so on the
+		// receiver's delayed acknowledgments.
+		if min := 4 * tcpMSS(c); grown < min {
+			grown = min
+		}
+	}
+	if grown > maxAdaptiveBuffer {
+		grown = maxAdaptiveBuffer
+	}
+	var err error
+	if send {
+		if c, ok := c.(interface {
+			SetWriteBuffer(int) error
+		}); ok {
+			err = c.SetWriteBuffer(grown)
+		}
+	} else {
+		if c, ok := c.(interface {
+			SetReadBuffer(int) error
+		}); ok {
+			err = c.SetReadBuffer(grown)
+		}
+	}
+	// The system caps the buffer to its limit without an error.
+	return err == nil && socketBufferSize(c, send) > size
+}
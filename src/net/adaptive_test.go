@@ -0,0 +1,171 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveRelay(t *testing.T) {
+	aPeer, a, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aPeer.Close()
+	defer a.Close()
+	b, bPeer, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer bPeer.Close()
+
+	up := make([]byte, 1<<20)
+	for i := range up {
+		up[i] = byte(i % 251)
+	}
+	down := bytes.Repeat([]byte("reply"), 1<<16)
+	send := func(c Conn, data []byte) {
+		c.Write(data)
+		c.(*TCPConn).CloseWrite()
+	}
+	go send(aPeer, up)
+	go send(bPeer, down)
+	upDone := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(bPeer)
+		upDone <- got
+	}()
+	downDone := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(aPeer)
+		downDone <- got
+	}()
+
+	toB, toA, err := AdaptiveRelay(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toB != int64(len(up)) || toA != int64(len(down)) {
+		t.Errorf("AdaptiveRelay copied %d and %d bytes; want %d and %d", toB, toA, len(up), len(down))
+	}
+	// Each direction passed its EOF on.
+	if got := <-upDone; !bytes.Equal(got, up) {
+		t.Errorf("b's peer received %d bytes which differ from the %d bytes sent", len(got), len(up))
+	}
+	if got := <-downDone; !bytes.Equal(got, down) {
+		t.Errorf("a's peer received %d bytes which differ from the %d bytes sent", len(got), len(down))
+	}
+}
+
+func TestAdaptiveRelayFailure(t *testing.T) {
+	aPeer, a, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aPeer.Close()
+	defer a.Close()
+	b, bPeer, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer bPeer.Close()
+
+	// b's peer resets its connection, which fails the copy to b, and
+	// has to stop the copy from b, which would otherwise wait for b.
+	go ioutil.ReadAll(bPeer)
+	bPeer.(*TCPConn).SetLinger(0)
+	bPeer.Close()
+	go aPeer.Write(make([]byte, 1<<20))
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := AdaptiveRelay(a, b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("AdaptiveRelay to a reset connection succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AdaptiveRelay hung after a copy failed")
+	}
+}
+
+// relayBursts copies bursts of data written by a peer of src to dst with
+// the relay returned by newRelay, where dst starts with a send buffer so
+// small that most writes to it wait, and returns the stats of the relay
+// and the final send buffer of dst.
+func relayBursts(t *testing.T, newRelay func(dst, src Conn) *Relay) (RelayStats, int) {
+	writer, s, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	defer s.Close()
+	d, reader, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer reader.Close()
+	src, dst := s.(*TCPConn), d.(*TCPConn)
+	if err := dst.SetWriteBuffer(4 << 10); err != nil {
+		t.Fatal(err)
+	}
+	rl := newRelay(dst, src)
+
+	const bursts, burst = 16, 512 << 10
+	go func() {
+		b := make([]byte, burst)
+		for i := 0; i < bursts; i++ {
+			writer.Write(b)
+			time.Sleep(time.Millisecond)
+		}
+		writer.(*TCPConn).CloseWrite()
+	}()
+	readDone := make(chan int, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, reader)
+		readDone <- int(n)
+	}()
+	n, err := rl.Copy(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.CloseWrite()
+	if n != bursts*burst || <-readDone != bursts*burst {
+		t.Fatalf("relayed %d bytes; want %d", n, bursts*burst)
+	}
+	return rl.Stats(), socketBufferSize(dst, true)
+}
+
+// Tests that an adaptive relay, copying bursts to a destination whose
+// send buffer starts out too small, grows the buffer and so waits less
+// than a relay with a fixed configuration.
+func TestAdaptiveRelayConverges(t *testing.T) {
+	fixed, fixedBuf := relayBursts(t, func(dst, src Conn) *Relay { return new(Relay) })
+	adaptive, adaptiveBuf := relayBursts(t, newAdaptiveRelay)
+	if adaptiveBuf <= fixedBuf {
+		t.Errorf("adaptive relay left a send buffer of %d bytes; want more than the %d bytes it started with", adaptiveBuf, fixedBuf)
+	}
+	fixedWaits := fixed.ReadWaits + fixed.WriteWaits
+	adaptiveWaits := adaptive.ReadWaits + adaptive.WriteWaits
+	if adaptiveWaits >= fixedWaits {
+		t.Errorf("adaptive relay waited %d times; want fewer than the %d waits of a fixed relay", adaptiveWaits, fixedWaits)
+	}
+	// Growing the buffer mustn't stall the copy either.
+	if adaptive.Wait > 2*fixed.Wait+100*time.Millisecond {
+		t.Errorf("adaptive relay waited for %v; want no longer than about the %v of a fixed relay", adaptive.Wait, fixed.Wait)
+	}
+}
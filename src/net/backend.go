@@ -0,0 +1,99 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"syscall"
+	"time"
+)
+
+// CopyBackend relays data in both directions between client, an accepted
+// connection, and backend, an established connection to a backend server
+// such as one kept warm in a pool, until the client is done. On Linux,
+// both directions are spliced, as by Copy.
+//
+// Once client reaches EOF, the data it sent has been written to backend,
+// but backend's writing side is left open, unlike a proxy which passes
+// the half-close on, so that backend can serve another client. The
+// backend's reply is relayed to client until backend has sent nothing for
+// linger, at which point the relay from backend stops with all of the
+// data it read written to client. reusable then reports that backend may
+// be returned to its pool: it is open in both directions, and no data
+// read from it is left behind. Data which backend sends after that
+// belongs to no client, and a pool should check for it.
+//
+// If backend reaches EOF, client's writing side is closed, and backend
+// is not reusable; neither is it if a copy fails, in which case the
+// other copy is stopped and the first error is returned. CopyBackend
+// closes neither connection. It clears the read deadline of a reusable
+// backend.
+func (rl *Relay) CopyBackend(client, backend *TCPConn, linger time.Duration) (reusable bool, err error) {
+	if !client.ok() || !backend.ok() {
+		return false, syscall.EINVAL
+	}
+	upDone := make(chan error, 1)
+	downDone := make(chan error, 1)
+	go func() {
+		_, err := rl.Copy(backend, client)
+		upDone <- err
+	}()
+	go func() {
+		_, err := rl.Copy(client, backend)
+		downDone <- err
+	}()
+
+	// lingering is set once the relay from backend has been given a
+	// read deadline to stop at.
+	var lingering, backendEOF bool
+	var upErr, downErr error
+	for up, down := upDone, downDone; up != nil || down != nil; {
+		select {
+		case upErr = <-up:
+			up = nil
+			switch {
+			case down == nil:
+			case upErr == nil:
+				backend.SetReadDeadline(time.Now().Add(linger))
+				lingering = true
+			default:
+				// Stop the relay from backend, wherever
+				// it is blocked.
+				backend.SetReadDeadline(aLongTimeAgo)
+				client.SetWriteDeadline(aLongTimeAgo)
+			}
+		case downErr = <-down:
+			down = nil
+			switch {
+			case downErr == nil:
+				backendEOF = true
+				client.CloseWrite()
+			case lingering && isTimeout(downErr):
+				downErr = nil
+			case up != nil:
+				client.SetReadDeadline(aLongTimeAgo)
+				backend.SetWriteDeadline(aLongTimeAgo)
+			}
+		}
+		if err == nil {
+			if upErr != nil {
+				err = upErr
+			} else if downErr != nil {
+				err = downErr
+			}
+		}
+	}
+	if err != nil || backendEOF {
+		return false, err
+	}
+	backend.SetReadDeadline(noDeadline)
+	return true, nil
+}
+
+// isTimeout reports whether err is a timeout, such as a deadline
+// passing.
+func isTimeout(err error) bool {
+	ne, ok := err.(Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRelayCopyBackend(t *testing.T) {
+	for _, spliced := range []bool{true, false} {
+		t.Run(fmt.Sprintf("spliced=%v", spliced), func(t *testing.T) {
+			if !spliced {
+				defer func(s SpliceStrategy) { testHookSpliceStrategy = s }(testHookSpliceStrategy)
+				testHookSpliceStrategy = GenericStrategy
+			}
+			testRelayCopyBackend(t, spliced)
+		})
+	}
+}
+
+func testRelayCopyBackend(t *testing.T, spliced bool) {
+	c, s, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, server := c.(*TCPConn), s.(*TCPConn)
+	defer backend.Close()
+	defer server.Close()
+
+	// The server answers each request of 8 bytes with a reply
+	// twice as long, in two parts, over the same connection. It hangs
+	// up after answering "request4".
+	serverDone := make(chan error, 1)
+	go func() {
+		req := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(server, req); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				serverDone <- err
+				return
+			}
+			server.Write(req)
+			time.Sleep(10 * time.Millisecond)
+			server.Write(req)
+			if string(req) == "request4" {
+				server.CloseWrite()
+			}
+		}
+	}()
+
+	// serve relays one client's request over backend, and returns
+	// the reply the client got.
+	serve := func(req string) (reply string, reusable bool) {
+		c, s, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, accepted := c.(*TCPConn), s.(*TCPConn)
+		defer client.Close()
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(client)
+			readDone <- b
+		}()
+		client.Write([]byte(req))
+		client.CloseWrite()
+		rl := new(Relay)
+		reusable, err = rl.CopyBackend(accepted, backend, 100*time.Millisecond)
+		if err != nil {
+			t.Fatalf("CopyBackend: %v", err)
+		}
+		if got := rl.Stats().Active != 0; got != spliced {
+			t.Errorf("relay spliced: %v; want %v", got, spliced)
+		}
+		accepted.Close()
+		return string(<-readDone), reusable
+	}
+
+	for _, req := range []string{"request1", "request2"} {
+		reply, reusable := serve(req)
+		if want := req + req; reply != want || !reusable {
+			t.Fatalf("reply %q, reusable %v; want %q, true", reply, reusable, want)
+		}
+	}
+	// The backend can still be used directly.
+	backend.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := backend.Write([]byte("request3")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(backend, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "request3request3" {
+		t.Errorf("reply %q; want %q", reply, "request3request3")
+	}
+	backend.SetDeadline(noDeadline)
+
+	// A backend which hangs up can't be reused.
+	reply2, reusable := serve("request4")
+	if want := "request4request4"; reply2 != want || reusable {
+		t.Errorf("reply %q, reusable %v; want %q, false", reply2, reusable, want)
+	}
+	backend.Close()
+	if err := <-serverDone; err != nil {
+		t.Error(err)
+	}
+}
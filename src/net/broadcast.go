@@ -0,0 +1,201 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrBroadcastDropped is reported for a destination which a Broadcaster
+// dropped because it fell behind.
+var ErrBroadcastDropped = errors.New("broadcast destination fell behind")
+
+var errDuplicateDestination = errors.New("duplicate broadcast destination")
+
+// A Broadcaster copies the data of one TCP connection to several others,
+// as a publish/subscribe relay does. On Linux, a Broadcaster uses the
+// splice and tee system calls, so that the data is read from the source
+// once and is not copied into userspace.
+//
+// Each destination is written to by a goroutine of its own, from a buffer
+// of its own, so that a slow destination holds back the others only once
+// its buffer is full. The zero value then waits for the destination to
+// catch up.
+type Broadcaster struct {
+	// DropAfter, if positive, makes the broadcaster drop a destination
+	// whose buffer stays full for DropAfter once more data has arrived
+	// from the source, instead of waiting for it. A dropped destination
+	// stops receiving data at an arbitrary point, and has its write
+	// deadline set in the past to interrupt the write in progress, so
+	// it should usually be closed.
+	DropAfter time.Duration
+}
+
+// Copy copies src to every connection in dsts until src reaches EOF or
+// an error occurs reading it. The connections in dsts must be distinct.
+//
+// Copy returns the number of bytes written to each destination and the
+// error which stopped copying to it, if any, which is ErrBroadcastDropped
+// for a dropped destination. err is the error encountered reading src, if
+// any; a successful Copy returns err == nil, not err == EOF.
+func (b *Broadcaster) Copy(dsts []*TCPConn, src *TCPConn) (written []int64, errs []error, err error) {
+	if !src.ok() {
+		return nil, nil, syscall.EINVAL
+	}
+	for i, c := range dsts {
+		if !c.ok() {
+			return nil, nil, syscall.EINVAL
+		}
+		for _, prev := range dsts[:i] {
+			if prev == c {
+				return nil, nil, errDuplicateDestination
+			}
+		}
+	}
+	written, errs, err, handled := spliceBroadcast(dsts, src, b.DropAfter)
+	if handled {
+		return written, errs, err
+	}
+	return genericBroadcast(dsts, src, b.DropAfter)
+}
+
+const (
+	// genericBroadcastChunk is the size of the reads from the source
+	// of a broadcast which can't be spliced.
+	genericBroadcastChunk = 32 << 10
+
+	// genericBroadcastChunks is the number of chunks buffered for each
+	// destination.
+	genericBroadcastChunks = 4
+)
+
+// broadcastDest is the state of one destination of genericBroadcast.
+type broadcastDest struct {
+	c       *TCPConn
+	chunks  chan []byte
+	dead    chan struct{} // closed when writing to c fails
+	stopped bool          // no more chunks are sent
+	dropped int32         // set atomically when c is dropped
+
+	// Owned by the destination's goroutine until it exits.
+	written int64
+	err     error
+}
+
+// send queues b for d, waiting for d to make room. If deadline is not
+// zero and passes first, d is dropped. send reports whether b was
+// queued.
+func (d *broadcastDest) send(b []byte, deadline time.Time) bool {
+	if deadline.IsZero() {
+		select {
+		case d.chunks <- b:
+			return true
+		case <-d.dead:
+			return false
+		}
+	}
+	select {
+	case d.chunks <- b:
+		return true
+	case <-d.dead:
+		return false
+	default:
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case d.chunks <- b:
+		return true
+	case <-d.dead:
+		return false
+	case <-t.C:
+	}
+	atomic.StoreInt32(&d.dropped, 1)
+	d.c.SetWriteDeadline(aLongTimeAgo)
+	return false
+}
+
+// Fallback implementation of Broadcaster.Copy, when splice isn't
+// applicable.
+func genericBroadcast(dsts []*TCPConn, src *TCPConn, dropAfter time.Duration) (written []int64, errs []error, err error) {
+	ds := make([]*broadcastDest, len(dsts))
+	var wg sync.WaitGroup
+	for i, c := range dsts {
+		d := &broadcastDest{
+			c:      c,
+			chunks: make(chan []byte, genericBroadcastChunks),
+			dead:   make(chan struct{}),
+		}
+		ds[i] = d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range d.chunks {
+				if d.err != nil {
+					continue
+				}
+				if atomic.LoadInt32(&d.dropped) != 0 {
+					d.err = ErrBroadcastDropped
+					continue
+				}
+				n, err := d.c.Write(b)
+				d.written += int64(n)
+				if err != nil {
+					d.err = err
+					close(d.dead)
+				}
+			}
+		}()
+	}
+
+	for active := len(ds); active > 0; {
+		// The destinations hold on to the chunks they are sent, so
+		// each read needs a chunk of its own.
+		b := make([]byte, genericBroadcastChunk)
+		n, rerr := src.Read(b)
+		var deadline time.Time
+		if dropAfter > 0 {
+			deadline = time.Now().Add(dropAfter)
+		}
+		for _, d := range ds {
+			if n == 0 || d.stopped {
+				continue
+			}
+			if !d.send(b[:n], deadline) {
+				d.stopped = true
+				close(d.chunks)
+				active--
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	for _, d := range ds {
+		if !d.stopped {
+			close(d.chunks)
+		}
+	}
+	wg.Wait()
+
+	written = make([]int64, len(ds))
+	errs = make([]error, len(ds))
+	for i, d := range ds {
+		written[i] = d.written
+		errs[i] = d.err
+		if atomic.LoadInt32(&d.dropped) != 0 {
+			errs[i] = ErrBroadcastDropped
+		}
+	}
+	return written, errs, err
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBroadcaster(t *testing.T) {
+	if !testableNetwork("tcp") {
+		t.Skip("tcp not testable")
+	}
+	copyFuncs := []struct {
+		name string
+		copy func(dsts []*TCPConn, src *TCPConn, dropAfter time.Duration) ([]int64, []error, error)
+	}{
+		{"default", func(dsts []*TCPConn, src *TCPConn, dropAfter time.Duration) ([]int64, []error, error) {
+			b := &Broadcaster{DropAfter: dropAfter}
+			return b.Copy(dsts, src)
+		}},
+		{"generic", genericBroadcast},
+	}
+	for _, cf := range copyFuncs {
+		t.Run(cf.name, func(t *testing.T) {
+			t.Run("backpressure", func(t *testing.T) {
+				testBroadcasterBackpressure(t, cf.copy)
+			})
+			t.Run("dropAfter", func(t *testing.T) {
+				testBroadcasterDropAfter(t, cf.copy)
+			})
+		})
+	}
+}
+
+// broadcastTestConns returns the source of a broadcast and the client
+// writing to it, and n destinations and the clients reading from them.
+func broadcastTestConns(t *testing.T, n int) (src, writer *TCPConn, dsts, readers []*TCPConn) {
+	c, s, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, src = c.(*TCPConn), s.(*TCPConn)
+	for i := 0; i < n; i++ {
+		c, s, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, c.(*TCPConn))
+		dsts = append(dsts, s.(*TCPConn))
+	}
+	return src, writer, dsts, readers
+}
+
+func closeBroadcastTestConns(src, writer *TCPConn, dsts, readers []*TCPConn) {
+	src.Close()
+	writer.Close()
+	for i := range dsts {
+		dsts[i].Close()
+		readers[i].Close()
+	}
+}
+
+func broadcastTestData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func testBroadcasterBackpressure(t *testing.T, copy func([]*TCPConn, *TCPConn, time.Duration) ([]int64, []error, error)) {
+	src, writer, dsts, readers := broadcastTestConns(t, 3)
+	defer closeBroadcastTestConns(src, writer, dsts, readers)
+
+	want := broadcastTestData(2 << 20)
+	type result struct {
+		b   []byte
+		err error
+	}
+	results := make([]chan result, len(readers))
+	for i, r := range readers {
+		results[i] = make(chan result, 1)
+		go func(r *TCPConn, res chan<- result, slow bool) {
+			if !slow {
+				b, err := ioutil.ReadAll(r)
+				res <- result{b, err}
+				return
+			}
+			var buf bytes.Buffer
+			b := make([]byte, 16<<10)
+			for {
+				n, err := r.Read(b)
+				buf.Write(b[:n])
+				if err == io.EOF {
+					res <- result{buf.Bytes(), nil}
+					return
+				}
+				if err != nil {
+					res <- result{buf.Bytes(), err}
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(r, results[i], i == len(readers)-1)
+	}
+
+	copyDone := make(chan struct{})
+	var written []int64
+	var errs []error
+	var err error
+	go func() {
+		written, errs, err = copy(dsts, src, 0)
+		// Don't leave the writer blocked if the broadcast
+		// gives up early.
+		src.CloseRead()
+		for _, c := range dsts {
+			c.CloseWrite()
+		}
+		close(copyDone)
+	}()
+	if _, err := writer.Write(want); err != nil {
+		t.Error(err)
+	}
+	writer.CloseWrite()
+	<-copyDone
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dsts {
+		if errs[i] != nil || written[i] != int64(len(want)) {
+			t.Errorf("destination %d: wrote %d bytes, %v; want %d bytes, <nil>", i, written[i], errs[i], len(want))
+		}
+		res := <-results[i]
+		if res.err != nil {
+			t.Errorf("destination %d: %v", i, res.err)
+		}
+		if !bytes.Equal(res.b, want) {
+			t.Errorf("destination %d: received %d bytes which differ from %d bytes sent", i, len(res.b), len(want))
+		}
+	}
+}
+
+func testBroadcasterDropAfter(t *testing.T, copy func([]*TCPConn, *TCPConn, time.Duration) ([]int64, []error, error)) {
+	src, writer, dsts, readers := broadcastTestConns(t, 3)
+	defer closeBroadcastTestConns(src, writer, dsts, readers)
+
+	// The last destination reads nothing until the broadcast is
+	// over, so once its socket buffers fill up, it is dropped.
+	slow := len(dsts) - 1
+	dsts[slow].SetWriteBuffer(16 << 10)
+	readers[slow].SetReadBuffer(16 << 10)
+
+	want := broadcastTestData(16 << 20)
+	type result struct {
+		b   []byte
+		err error
+	}
+	results := make([]chan result, slow)
+	for i, r := range readers[:slow] {
+		results[i] = make(chan result, 1)
+		go func(r *TCPConn, res chan<- result) {
+			b, err := ioutil.ReadAll(r)
+			res <- result{b, err}
+		}(r, results[i])
+	}
+
+	copyDone := make(chan struct{})
+	var written []int64
+	var errs []error
+	var err error
+	go func() {
+		// The fast readers must not stall for as long, even
+		// on a loaded machine running the race detector.
+		written, errs, err = copy(dsts, src, 500*time.Millisecond)
+		// Don't leave the writer blocked if the broadcast
+		// gives up early.
+		src.CloseRead()
+		for _, c := range dsts[:slow] {
+			c.CloseWrite()
+		}
+		close(copyDone)
+	}()
+	if _, err := writer.Write(want); err != nil {
+		t.Error(err)
+	}
+	writer.CloseWrite()
+	<-copyDone
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dsts[:slow] {
+		if errs[i] != nil || written[i] != int64(len(want)) {
+			t.Errorf("destination %d: wrote %d bytes, %v; want %d bytes, <nil>", i, written[i], errs[i], len(want))
+		}
+		res := <-results[i]
+		if res.err != nil {
+			t.Errorf("destination %d: %v", i, res.err)
+		}
+		if !bytes.Equal(res.b, want) {
+			t.Errorf("destination %d: received %d bytes which differ from %d bytes sent", i, len(res.b), len(want))
+		}
+	}
+	if errs[slow] != ErrBroadcastDropped || written[slow] >= int64(len(want)) {
+		t.Errorf("slow destination: wrote %d bytes, %v; want fewer than %d bytes, %v", written[slow], errs[slow], len(want), ErrBroadcastDropped)
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+// retryableErrno reports whether err is a transient error; Plan 9 has no
+// error numbers to tell.
+func retryableErrno(err error) bool {
+	return false
+}
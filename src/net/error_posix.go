@@ -19,3 +19,13 @@ func wrapSyscallError(name string, err error) error {
 	}
 	return err
 }
+
+// retryableErrno reports whether err is a syscall.Errno for a transient
+// condition; see IsRetryableSpliceError.
+func retryableErrno(err error) bool {
+	switch err {
+	case syscall.EAGAIN, syscall.EINTR, syscall.ENOMEM, syscall.ENOBUFS:
+		return true
+	}
+	return false
+}
@@ -7,6 +7,7 @@
 package net
 
 import (
+	"internal/poll"
 	"os"
 	"syscall"
 	"testing"
@@ -32,3 +33,28 @@ func TestSpuriousENOTAVAIL(t *testing.T) {
 		}
 	}
 }
+
+func TestIsRetryableSpliceError(t *testing.T) {
+	for _, tt := range []struct {
+		error
+		ok bool
+	}{
+		{syscall.ENOMEM, true},
+		{&os.SyscallError{Syscall: "splice", Err: syscall.ENOMEM}, true},
+		{&OpError{Op: "readfrom", Err: &os.SyscallError{Syscall: "splice", Err: syscall.ENOMEM}}, true},
+		{&OpError{Op: "readfrom", Err: &os.SyscallError{Syscall: "splice", Err: syscall.ENOBUFS}}, true},
+		{&OpError{Op: "readfrom", Err: syscall.EINTR}, true},
+		{&OpError{Op: "readfrom", Err: syscall.EAGAIN}, true},
+
+		{syscall.EPIPE, false},
+		{&OpError{Op: "readfrom", Err: &os.SyscallError{Syscall: "splice", Err: syscall.EPIPE}}, false},
+		{&OpError{Op: "readfrom", Err: &os.SyscallError{Syscall: "splice", Err: syscall.ECONNRESET}}, false},
+		{&OpError{Op: "readfrom", Err: poll.ErrTimeout}, false},
+		{errCanceled, false},
+		{nil, false},
+	} {
+		if ok := IsRetryableSpliceError(tt.error); ok != tt.ok {
+			t.Errorf("IsRetryableSpliceError(%v) = %v; want %v", tt.error, ok, tt.ok)
+		}
+	}
+}
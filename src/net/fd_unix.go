@@ -26,6 +26,11 @@ type netFD struct {
 	net         string
 	laddr       Addr
 	raddr       Addr
+
+	// splicePipeSize is the size of the pipe for spliced copies
+	// to or from the socket, set by ConfigureForSplice, or zero for
+	// the default. It is accessed atomically.
+	splicePipeSize int64
 }
 
 func newFD(sysfd, family, sotype int, net string) (*netFD, error) {
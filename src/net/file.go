@@ -49,3 +49,15 @@ func FilePacketConn(f *os.File) (c PacketConn, err error) {
 	}
 	return
 }
+
+// FilePacketDevice returns a copy of the packet-oriented device, such as
+// a tun or tap interface, corresponding to the open file f.
+// It is the caller's responsibility to close f when finished.
+// Closing d does not affect f, and closing f does not affect d.
+func FilePacketDevice(f *os.File) (d *PacketDevice, err error) {
+	d, err = filePacketDevice(f)
+	if err != nil {
+		err = &OpError{Op: "file", Net: "file+net", Source: nil, Addr: fileAddr(f.Name()), Err: err}
+	}
+	return
+}
@@ -133,3 +133,15 @@ func fileListener(f *os.File) (Listener, error) {
 func filePacketConn(f *os.File) (PacketConn, error) {
 	return nil, syscall.EPLAN9
 }
+
+func filePacketDevice(f *os.File) (*PacketDevice, error) {
+	return nil, syscall.EPLAN9
+}
+
+func (d *PacketDevice) read(b []byte) (int, error) {
+	return 0, syscall.EPLAN9
+}
+
+func (d *PacketDevice) write(b []byte) (int, error) {
+	return 0, syscall.EPLAN9
+}
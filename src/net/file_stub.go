@@ -14,3 +14,8 @@ import (
 func fileConn(f *os.File) (Conn, error)             { return nil, syscall.ENOPROTOOPT }
 func fileListener(f *os.File) (Listener, error)     { return nil, syscall.ENOPROTOOPT }
 func filePacketConn(f *os.File) (PacketConn, error) { return nil, syscall.ENOPROTOOPT }
+
+func filePacketDevice(f *os.File) (*PacketDevice, error) { return nil, syscall.ENOPROTOOPT }
+
+func (d *PacketDevice) read(b []byte) (int, error)  { return 0, syscall.ENOPROTOOPT }
+func (d *PacketDevice) write(b []byte) (int, error) { return 0, syscall.ENOPROTOOPT }
@@ -29,6 +29,12 @@ func newFileFD(f *os.File) (*netFD, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newSocketFD(s)
+}
+
+// newSocketFD returns a netFD for the non-blocking socket s. s is closed
+// if newSocketFD fails.
+func newSocketFD(s int) (*netFD, error) {
 	family := syscall.AF_UNSPEC
 	sotype, err := syscall.GetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_TYPE)
 	if err != nil {
@@ -114,3 +120,24 @@ func filePacketConn(f *os.File) (PacketConn, error) {
 	fd.Close()
 	return nil, syscall.EINVAL
 }
+
+func filePacketDevice(f *os.File) (*PacketDevice, error) {
+	s, err := dupSocket(f)
+	if err != nil {
+		return nil, err
+	}
+	pfd := &poll.FD{Sysfd: s, ZeroReadIsEOF: true}
+	if err := pfd.Init("file", true); err != nil {
+		poll.CloseFunc(s)
+		return nil, err
+	}
+	return &PacketDevice{name: f.Name(), pfd: pfd}, nil
+}
+
+func (d *PacketDevice) read(b []byte) (int, error) {
+	return d.pfd.Read(b)
+}
+
+func (d *PacketDevice) write(b []byte) (int, error) {
+	return d.pfd.Write(b)
+}
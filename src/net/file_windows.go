@@ -23,3 +23,15 @@ func filePacketConn(f *os.File) (PacketConn, error) {
 	// TODO: Implement this
 	return nil, syscall.EWINDOWS
 }
+
+func filePacketDevice(f *os.File) (*PacketDevice, error) {
+	return nil, syscall.EWINDOWS
+}
+
+func (d *PacketDevice) read(b []byte) (int, error) {
+	return 0, syscall.EWINDOWS
+}
+
+func (d *PacketDevice) write(b []byte) (int, error) {
+	return 0, syscall.EWINDOWS
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// A FrameDemux routes the length-delimited frames of a stream to
+// destinations chosen by their headers. Each frame is made of a 4-byte
+// big-endian body length, a routing header of HeaderLen bytes, and the
+// body.
+//
+// Lengths and headers are read in userspace. On Linux, when the stream is
+// a TCP connection, the bodies routed to TCP connections are then spliced
+// to them, so that they are not copied into userspace.
+type FrameDemux struct {
+	// HeaderLen is the length of the routing header which follows
+	// the body length of each frame. It may be 0.
+	HeaderLen int
+
+	// Route returns the destination of the body of a frame with the
+	// given routing header. Route must not retain header. If Route
+	// returns an error, ReadFrom stops and returns that error, with
+	// the body of the frame left unread.
+	Route func(header []byte) (io.Writer, error)
+}
+
+// ReadFrom reads frames from r until EOF or an error occurs, and writes
+// the body of each to the destination which Route returns for it. It
+// returns the number of bytes read from r. EOF in the middle of a frame is
+// reported as io.ErrUnexpectedEOF.
+func (d *FrameDemux) ReadFrom(r io.Reader) (n int64, err error) {
+	var sp *Splicer
+	if c, ok := r.(*TCPConn); ok && c.ok() {
+		sp = NewSplicer(c)
+		defer sp.Close()
+	}
+	f := FrameFormat{HeaderLen: 4 + d.HeaderLen, LengthSize: 4}
+	hdr := make([]byte, f.HeaderLen)
+	for {
+		fr := r
+		if sp != nil {
+			// The Splicer may have read the start of the frame
+			// from r along with the previous body.
+			fr = io.MultiReader(sp.Buffered(), r)
+		}
+		m, err := io.ReadFull(fr, hdr)
+		n += int64(m)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		body, _ := f.bodyLen(hdr)
+		w, err := d.Route(hdr[4:])
+		if err != nil {
+			return n, err
+		}
+		var copied int64
+		if c, ok := w.(*TCPConn); ok && sp != nil {
+			copied, err = sp.SpliceTo(c, body)
+		} else {
+			copied, err = io.CopyN(w, fr, body)
+		}
+		n += copied
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// errFrameLength is returned for a frame whose header gives a negative
+// body length.
+var errFrameLength = errors.New("invalid frame length")
+
+// A FrameFormat describes the framing of a protocol whose messages each
+// start with a fixed-size header which holds the length of the body
+// following it, as do the wire protocols of many databases. In MySQL's,
+// for instance, the header is a 3-byte little-endian body length followed
+// by a sequence number, which is
+//
+//	FrameFormat{HeaderLen: 4, LengthSize: 3, LittleEndian: true}
+//
+// and in PostgreSQL's, the header is a type byte followed by a 4-byte
+// big-endian length which counts itself, which is
+//
+//	FrameFormat{HeaderLen: 5, LengthOffset: 1, LengthSize: 4, LengthAdjust: -4}
+type FrameFormat struct {
+	// HeaderLen is the length of the header.
+	HeaderLen int
+
+	// LengthOffset and LengthSize are the offset and length, in the
+	// header, of the body length, an unsigned integer of 1 to 8
+	// bytes.
+	LengthOffset, LengthSize int
+
+	// LittleEndian is whether the body length is little-endian
+	// rather than big-endian.
+	LittleEndian bool
+
+	// LengthAdjust is added to the body length read from the header,
+	// for protocols whose length counts more than the body.
+	LengthAdjust int64
+}
+
+// valid reports whether f describes a body length within its header.
+func (f *FrameFormat) valid() bool {
+	return f.LengthSize >= 1 && f.LengthSize <= 8 && f.LengthOffset >= 0 && f.LengthOffset+f.LengthSize <= f.HeaderLen
+}
+
+// bodyLen returns the length of the body following the header hdr.
+func (f *FrameFormat) bodyLen(hdr []byte) (int64, error) {
+	b := hdr[f.LengthOffset : f.LengthOffset+f.LengthSize]
+	var n uint64
+	for i := range b {
+		if f.LittleEndian {
+			n |= uint64(b[i]) << uint(8*i)
+		} else {
+			n = n<<8 | uint64(b[i])
+		}
+	}
+	body := int64(n) + f.LengthAdjust
+	if int64(n) < 0 || body < 0 {
+		return 0, errFrameLength
+	}
+	return body, nil
+}
+
+// ForwardFrames forwards the frames of format f which src receives to
+// dst, until src reaches EOF or an error occurs. It returns the number of
+// bytes written to dst. EOF in the middle of a frame is reported as
+// io.ErrUnexpectedEOF.
+//
+// If inspect is not nil, it is called with the header of each frame
+// before the frame is forwarded, as by a proxy which follows the messages
+// of a protocol without looking at their contents. inspect must not
+// retain or modify the header. If inspect returns an error,
+// ForwardFrames stops and returns that error, with the frame unforwarded.
+//
+// Headers are read in userspace. On Linux, the bodies are then spliced
+// to dst, so that they are not copied into userspace.
+func ForwardFrames(dst, src *TCPConn, f FrameFormat, inspect func(header []byte) error) (written int64, err error) {
+	if !src.ok() || !dst.ok() || !f.valid() {
+		return 0, syscall.EINVAL
+	}
+	sp := NewSplicer(src)
+	defer sp.Close()
+	hdr := make([]byte, f.HeaderLen)
+	for {
+		// The Splicer may have read the start of the frame from
+		// src along with the previous body.
+		r := io.MultiReader(sp.Buffered(), src)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		body, err := f.bodyLen(hdr)
+		if err != nil {
+			return written, &OpError{Op: "read", Net: src.fd.net, Source: src.fd.laddr, Addr: src.fd.raddr, Err: err}
+		}
+		if inspect != nil {
+			if err := inspect(hdr); err != nil {
+				return written, err
+			}
+		}
+		n, err := dst.Write(hdr)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		n64, err := sp.SpliceTo(dst, body)
+		written += n64
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+// demuxFrame returns a frame routed by header and holding body.
+func demuxFrame(header byte, body []byte) []byte {
+	n := len(body)
+	f := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n), header}
+	return append(f, body...)
+}
+
+func TestFrameDemux(t *testing.T) {
+	srvs := make([]*spliceTestServer, 2)
+	for i := range srvs {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srvs[i] = srv
+	}
+
+	// Frames of all sizes, including empty ones, alternate between
+	// the destinations irregularly.
+	var (
+		stream []byte
+		want   [2][]byte
+	)
+	for i, n := range []int{100, 1 << 20, 0, 70000, 3, 256 << 10, 1, 4096} {
+		route := byte(i % 3 % 2)
+		body := make([]byte, n)
+		for j := range body {
+			body[j] = byte((i + j) % 251)
+		}
+		stream = append(stream, demuxFrame(route, body)...)
+		want[route] = append(want[route], body...)
+	}
+
+	go func() {
+		srvs[0].Write(stream)
+		srvs[0].CloseWrite()
+	}()
+	var readDone [2]chan []byte
+	for i, srv := range srvs {
+		readDone[i] = make(chan []byte, 1)
+		go func(srv *spliceTestServer, done chan []byte) {
+			b, _ := ioutil.ReadAll(srv)
+			done <- b
+		}(srv, readDone[i])
+	}
+
+	d := &FrameDemux{
+		HeaderLen: 1,
+		Route: func(header []byte) (io.Writer, error) {
+			if header[0] > 1 {
+				return nil, errors.New("bad route")
+			}
+			return srvs[header[0]].serverDown, nil
+		},
+	}
+	n, err := d.ReadFrom(srvs[0].serverUp)
+	if n != int64(len(stream)) || err != nil {
+		t.Fatalf("ReadFrom = %d, %v; want %d, <nil>", n, err, len(stream))
+	}
+	for i, srv := range srvs {
+		srv.serverDown.(*TCPConn).CloseWrite()
+		if got := <-readDone[i]; !bytes.Equal(got, want[i]) {
+			t.Errorf("destination %d got %d bytes; want the %d bytes of its bodies", i, len(got), len(want[i]))
+		}
+	}
+}
+
+func TestFrameDemuxTruncated(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go io.Copy(ioutil.Discard, srv)
+
+	f := demuxFrame(0, make([]byte, 1000))
+	srv.Write(f[:500])
+	srv.CloseWrite()
+	d := &FrameDemux{
+		HeaderLen: 1,
+		Route: func([]byte) (io.Writer, error) {
+			return srv.serverDown, nil
+		},
+	}
+	if n, err := d.ReadFrom(srv.serverUp); n != 500 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadFrom = %d, %v; want 500, %v", n, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestForwardFrames(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format FrameFormat
+		frame  func(seq int, body []byte) []byte
+	}{
+		{
+			"mysql",
+			FrameFormat{HeaderLen: 4, LengthSize: 3, LittleEndian: true},
+			func(seq int, body []byte) []byte {
+				n := len(body)
+				return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(seq)}, body...)
+			},
+		},
+		{
+			"postgres",
+			FrameFormat{HeaderLen: 5, LengthOffset: 1, LengthSize: 4, LengthAdjust: -4},
+			func(seq int, body []byte) []byte {
+				n := len(body) + 4
+				return append([]byte{'D', byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			// Large result rows among small messages.
+			var stream []byte
+			sizes := []int{5, 1 << 20, 0, 70000, 1, 1<<24 - 1, 300}
+			for i, n := range sizes {
+				body := make([]byte, n)
+				for j := range body {
+					body[j] = byte((i + j) % 251)
+				}
+				stream = append(stream, tt.frame(i, body)...)
+			}
+			go func() {
+				srv.Write(stream)
+				srv.CloseWrite()
+			}()
+			readDone := make(chan []byte, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(srv)
+				readDone <- b
+			}()
+
+			var headers [][]byte
+			inspect := func(header []byte) error {
+				headers = append(headers, append([]byte(nil), header...))
+				return nil
+			}
+			n, err := ForwardFrames(srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn), tt.format, inspect)
+			if n != int64(len(stream)) || err != nil {
+				t.Fatalf("ForwardFrames = %d, %v; want %d, <nil>", n, err, len(stream))
+			}
+			srv.serverDown.(*TCPConn).CloseWrite()
+			if got := <-readDone; !bytes.Equal(got, stream) {
+				t.Errorf("forwarded %d bytes which differ from the %d bytes of the frames", len(got), len(stream))
+			}
+			if len(headers) != len(sizes) {
+				t.Fatalf("inspected %d headers; want %d", len(headers), len(sizes))
+			}
+			for i, h := range headers {
+				if want := tt.frame(i, make([]byte, sizes[i]))[:tt.format.HeaderLen]; !bytes.Equal(h, want) {
+					t.Errorf("header %d is %x; want %x", i, h, want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardFramesErrors(t *testing.T) {
+	mysql := FrameFormat{HeaderLen: 4, LengthSize: 3, LittleEndian: true}
+	frame := []byte{0xe8, 0x03, 0x00, 0x00} // 1000 bytes
+	frame = append(frame, make([]byte, 1000)...)
+	for _, tt := range []struct {
+		name    string
+		format  FrameFormat
+		stream  []byte
+		inspect func([]byte) error
+		n       int64
+		err     error
+	}{
+		{"truncated", mysql, frame[:500], nil, 500, io.ErrUnexpectedEOF},
+		{"truncatedHeader", mysql, frame[:2], nil, 0, io.ErrUnexpectedEOF},
+		{"inspect", mysql, frame, func([]byte) error { return errors.New("rejected") }, 0, errors.New("rejected")},
+		{"invalidFormat", FrameFormat{HeaderLen: 2, LengthSize: 3}, frame, nil, 0, syscall.EINVAL},
+		{"negativeLength", FrameFormat{HeaderLen: 4, LengthSize: 3, LittleEndian: true, LengthAdjust: -2000}, frame, nil, 0, errFrameLength},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			go io.Copy(ioutil.Discard, srv)
+			srv.Write(tt.stream)
+			srv.CloseWrite()
+			n, err := ForwardFrames(srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn), tt.format, tt.inspect)
+			if oe, ok := err.(*OpError); ok {
+				err = oe.Err
+			}
+			if n != tt.n || err == nil || tt.err == nil || err.Error() != tt.err.Error() {
+				t.Fatalf("ForwardFrames = %d, %v; want %d, %v", n, err, tt.n, tt.err)
+			}
+		})
+	}
+}
@@ -19,4 +19,34 @@ var (
 		return fn(ctx, host)
 	}
 	testHookSetKeepAlive = func() {}
+
+	// testHookSpliceToFile is called with whether TCPConn.WriteTo
+	// spliced to a file.
+	testHookSpliceToFile = func(spliced bool) {}
+
+	// testHookReadFrom is called with the way TCPConn.ReadFrom, or
+	// a Relay, copied its data: "splice", "sendfile" or "generic".
+	testHookReadFrom = func(how string) {}
+
+	// testHookSpliceStrategy is the SpliceStrategy of copies whose
+	// Relay, if any, has none of its own.
+	testHookSpliceStrategy = AutoStrategy
+
+	// testHookForwardWebSocket is called with whether ForwardWebSocket
+	// splices the payload of each frame it forwards.
+	testHookForwardWebSocket = func(spliced bool) {}
+
+	// testHookLogSync is called with the result of each sync of a
+	// file by WriteToLog.
+	testHookLogSync = func(err error) {}
+
+	// testHookSpliceFail is called with the Relay, which may be nil,
+	// of each spliced copy. If it returns an error, the copy fails
+	// with that error before doing any work, as a splice which
+	// refuses the descriptors does.
+	testHookSpliceFail = func(rl *Relay) error { return nil }
+
+	// testHookRelayPipeSize, if positive, is the size of the pipe
+	// of each spliced relay.
+	testHookRelayPipeSize = 0
 )
@@ -43,6 +43,8 @@ func init() {
 var (
 	SetEnterRoundTripHook = hookSetter(&testHookEnterRoundTrip)
 	SetRoundTripRetried   = hookSetter(&testHookRoundTripRetried)
+	SetWriteRawBodyHook   = hookSetter(&testHookWriteRawBody)
+	SetReadFromFileHook   = hookSetter(&testHookReadFromFile)
 )
 
 func SetReadLoopBeforeNextReadHook(f func()) {
@@ -25,6 +25,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -1169,6 +1170,111 @@ func TestLinuxSendfileChild(*testing.T) {
 	}
 }
 
+// Tests that FileServer hands the body of a file to the connection, which
+// can send it without copying it through the server's buffers.
+func TestFileServerReadFromFile(t *testing.T) {
+	defer afterTest(t)
+	dir, err := ioutil.TempDir("", "readfrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := make([]byte, 4<<20)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big.bin"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var handed int32
+	SetReadFromFileHook(func() { atomic.AddInt32(&handed, 1) })
+	defer SetReadFromFileHook(nil)
+
+	ts := httptest.NewServer(FileServer(Dir(dir)))
+	defer ts.Close()
+
+	tests := []struct {
+		method, rangeHeader string
+		want                []byte
+		handed              int32
+	}{
+		{"GET", "", want, 1},
+		{"GET", "bytes=1000-1999", want[1000:2000], 1},
+		{"HEAD", "", nil, 0},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&handed, 0)
+		req, _ := NewRequest(tt.method, ts.URL+"/big.bin", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		res, err := DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, tt.want) {
+			t.Errorf("%s %q: got %d bytes differing from the %d bytes of the file", tt.method, tt.rangeHeader, len(body), len(tt.want))
+		}
+		if n := atomic.LoadInt32(&handed); n != tt.handed {
+			t.Errorf("%s %q: file handed to the connection %d times; want %d", tt.method, tt.rangeHeader, n, tt.handed)
+		}
+	}
+}
+
+// Tests that a file copied to a response with a Content-Length shorter
+// than the file is cut short, as it would be by Write.
+func TestServerReadFromFileContentLength(t *testing.T) {
+	defer afterTest(t)
+	f, err := ioutil.TempFile("", "readfrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := bytes.Repeat([]byte("0123456789"), 1<<16)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	const declared = 1 << 16
+
+	copyErr := make(chan error, 1)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		f, err := os.Open(f.Name())
+		if err != nil {
+			copyErr <- err
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(declared))
+		_, err = io.Copy(w, f)
+		copyErr <- err
+	}))
+	defer ts.Close()
+
+	res, err := Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data[:declared]) {
+		t.Errorf("got %d bytes; want the first %d bytes of the file", len(body), declared)
+	}
+	if err := <-copyErr; err != ErrContentLength {
+		t.Errorf("io.Copy = %v; want %v", err, ErrContentLength)
+	}
+}
+
 // Issue 18984: tests that requests for paths beyond files return not-found errors
 func TestFileServerNotDirError(t *testing.T) {
 	defer afterTest(t)
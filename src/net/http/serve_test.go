@@ -2817,6 +2817,231 @@ func TestServerBufferedChunking(t *testing.T) {
 	}
 }
 
+// Tests that a handler proxying a gzipped upstream response to a client
+// which accepts gzip copies the compressed bytes, unmodified, straight
+// from the upstream connection to the client's.
+func TestServerReadFromRawResponseBody(t *testing.T) {
+	defer afterTest(t)
+	plain := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(plain)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(plain)
+	zw.Close()
+	want := gz.Bytes()
+
+	upstream := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("upstream got Accept-Encoding %q; want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(want)))
+		w.Write(want)
+	}))
+	defer upstream.Close()
+	tr := &Transport{}
+	defer tr.CloseIdleConnections()
+	proxy := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		req, _ := NewRequest("GET", upstream.URL, nil)
+		if ae := r.Header.Get("Accept-Encoding"); ae != "" {
+			req.Header.Set("Accept-Encoding", ae)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer res.Body.Close()
+		for _, k := range []string{"Content-Type", "Content-Encoding", "Content-Length"} {
+			if v := res.Header.Get(k); v != "" {
+				w.Header().Set(k, v)
+			}
+		}
+		io.Copy(w, res.Body)
+	}))
+	defer proxy.Close()
+
+	var raw int32
+	SetWriteRawBodyHook(func() { atomic.AddInt32(&raw, 1) })
+	defer SetWriteRawBodyHook(nil)
+
+	c := &Client{Transport: &Transport{DisableCompression: true}}
+	defer c.Transport.(*Transport).CloseIdleConnections()
+	get := func(acceptEncoding string) (*Response, []byte) {
+		req, _ := NewRequest("GET", proxy.URL, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+
+	// The client accepts the upstream's encoding, so the proxy passes
+	// the body on as it was received.
+	res, body := get("gzip")
+	if ce := res.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("Content-Encoding = %q; want gzip", ce)
+	}
+	if !bytes.Equal(body, want) {
+		t.Errorf("got %d bytes differing from the upstream's %d gzipped bytes", len(body), len(want))
+	}
+	if n := atomic.LoadInt32(&raw); n != 1 {
+		t.Errorf("body copied raw %d times; want 1", n)
+	}
+
+	// The client doesn't, so the proxy's Transport asks for gzip itself
+	// and decompresses the body, which has to be read.
+	atomic.StoreInt32(&raw, 0)
+	res, body = get("")
+	if ce := res.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding = %q; want none", ce)
+	}
+	if !bytes.Equal(body, plain) {
+		t.Errorf("got %d bytes differing from the upstream's %d uncompressed bytes", len(body), len(plain))
+	}
+	if n := atomic.LoadInt32(&raw); n != 0 {
+		t.Errorf("decompressed body copied raw %d times; want 0", n)
+	}
+}
+
+// Tests that an upstream response body copied raw to a response with a
+// Content-Length shorter than the body is cut short, as it would be by
+// Write, rather than running into the next response on the connection.
+func TestServerReadFromRawResponseBodyContentLength(t *testing.T) {
+	defer afterTest(t)
+	data := bytes.Repeat([]byte("0123456789"), 1<<16)
+	const declared = 1 << 16
+
+	upstream := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer upstream.Close()
+	tr := &Transport{}
+	defer tr.CloseIdleConnections()
+	copyErr := make(chan error, 1)
+	proxy := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		req, _ := NewRequest("GET", upstream.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			copyErr <- err
+			return
+		}
+		defer res.Body.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(declared))
+		_, err = io.Copy(w, res.Body)
+		copyErr <- err
+	}))
+	defer proxy.Close()
+
+	var raw int32
+	SetWriteRawBodyHook(func() { atomic.AddInt32(&raw, 1) })
+	defer SetWriteRawBodyHook(nil)
+
+	c := &Client{Transport: &Transport{}}
+	defer c.Transport.(*Transport).CloseIdleConnections()
+	// The second request on the connection checks that nothing past
+	// the first response's body was written to it.
+	for i := 0; i < 2; i++ {
+		res, err := c.Get(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, data[:declared]) {
+			t.Errorf("got %d bytes; want the first %d bytes of the upstream body", len(body), declared)
+		}
+		if err := <-copyErr; err != ErrContentLength {
+			t.Errorf("io.Copy = %v; want %v", err, ErrContentLength)
+		}
+	}
+	if n := atomic.LoadInt32(&raw); n != 2 {
+		t.Errorf("body copied raw %d times; want 2", n)
+	}
+}
+
+// Tests that chunked upstream response bodies, with or without
+// trailers, are never copied raw, since the chunk framing and the
+// trailers have to be parsed.
+func TestServerReadFromChunkedResponseBodyNotRaw(t *testing.T) {
+	defer afterTest(t)
+	data := bytes.Repeat([]byte("0123456789"), 1<<12)
+	for _, trailer := range []bool{false, true} {
+		upstream := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+			if trailer {
+				w.Header().Set("Trailer", "X-Checksum")
+			}
+			w.Write(data[:len(data)/2])
+			w.(Flusher).Flush()
+			w.Write(data[len(data)/2:])
+			if trailer {
+				w.Header().Set("X-Checksum", "sum")
+			}
+		}))
+		tr := &Transport{}
+		gotTrailer := make(chan string, 1)
+		proxy := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+			req, _ := NewRequest("GET", upstream.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				gotTrailer <- ""
+				return
+			}
+			defer res.Body.Close()
+			if res.ContentLength != -1 {
+				t.Errorf("upstream ContentLength = %d; want chunked", res.ContentLength)
+			}
+			io.Copy(w, res.Body)
+			gotTrailer <- res.Trailer.Get("X-Checksum")
+		}))
+
+		var raw int32
+		SetWriteRawBodyHook(func() { atomic.AddInt32(&raw, 1) })
+		res, err := Get(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("trailer=%v: got %d bytes differing from the upstream's %d", trailer, len(body), len(data))
+		}
+		want := ""
+		if trailer {
+			want = "sum"
+		}
+		if got := <-gotTrailer; got != want {
+			t.Errorf("trailer=%v: upstream trailer X-Checksum = %q; want %q", trailer, got, want)
+		}
+		if n := atomic.LoadInt32(&raw); n != 0 {
+			t.Errorf("trailer=%v: chunked body copied raw %d times; want 0", trailer, n)
+		}
+		SetWriteRawBodyHook(nil)
+		proxy.Close()
+		upstream.Close()
+		tr.CloseIdleConnections()
+	}
+}
+
 // Tests that the server flushes its response headers out when it's
 // ignoring the response body and waits a bit before forcefully
 // closing the TCP connection, causing the client to get a RST.
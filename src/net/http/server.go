@@ -548,23 +548,29 @@ func srcIsRegularFile(src io.Reader) (isRegular bool, err error) {
 }
 
 // ReadFrom is here to optimize copying from an *os.File regular file
-// to a *net.TCPConn with sendfile.
+// to a *net.TCPConn with sendfile, such as the body of a file served
+// by FileServer or ServeContent, and copying the body of a response
+// received by a Transport over a *net.TCPConn, such as by a proxy, to a
+// *net.TCPConn with splice.
 func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 	// Our underlying w.conn.rwc is usually a *TCPConn (with its
 	// own ReadFrom method). If not, or if our src isn't a regular
-	// file, just fall back to the normal copy method.
+	// file or a response body which can be copied straight from
+	// its connection, just fall back to the normal copy method.
 	rf, ok := w.conn.rwc.(io.ReaderFrom)
 	regFile, err := srcIsRegularFile(src)
 	if err != nil {
 		return 0, err
 	}
-	if !ok || !regFile {
+	rawBody, isRaw := src.(*bodyEOFSignal)
+	isRaw = isRaw && rawBody.isRaw()
+	if !ok || !regFile && !isRaw {
 		bufp := copyBufPool.Get().(*[]byte)
 		defer copyBufPool.Put(bufp)
 		return io.CopyBuffer(writerOnly{w}, src, *bufp)
 	}
 
-	// sendfile path:
+	// sendfile and splice path:
 
 	if !w.wroteHeader {
 		w.WriteHeader(StatusOK)
@@ -583,7 +589,12 @@ func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 
 	// Now that cw has been flushed, its chunking field is guaranteed initialized.
 	if !w.cw.chunking && w.bodyAllowed() {
-		n0, err := rf.ReadFrom(src)
+		var n0 int64
+		if isRaw {
+			n0, err = w.writeRawBody(rawBody)
+		} else {
+			n0, err = w.readFromFile(rf, src)
+		}
 		n += n0
 		w.written += n0
 		return n, err
@@ -594,6 +605,65 @@ func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 	return n, err
 }
 
+// testHookReadFromFile is called when response.ReadFrom hands a regular
+// file to the ReadFrom method of its connection.
+var testHookReadFromFile = nop
+
+// readFromFile copies src, a regular file or an *io.LimitedReader of
+// one, to the connection with rf, its ReadFrom method, which can then
+// send the file with sendfile or splice. The file is kept directly
+// below a single *io.LimitedReader, where rf looks for it.
+//
+// If the handler declared a Content-Length, no more than the rest of
+// it is copied, and ErrContentLength is returned if the file holds
+// more, as Write would for the same data.
+func (w *response) readFromFile(rf io.ReaderFrom, src io.Reader) (n int64, err error) {
+	testHookReadFromFile()
+	if w.contentLength == -1 {
+		return rf.ReadFrom(src)
+	}
+	limit := w.contentLength - w.written
+	lr, ok := src.(*io.LimitedReader)
+	switch {
+	case ok && lr.N <= limit:
+		return rf.ReadFrom(lr)
+	case ok:
+		n, err = rf.ReadFrom(&io.LimitedReader{R: lr.R, N: limit})
+		lr.N -= n
+	default:
+		n, err = rf.ReadFrom(&io.LimitedReader{R: src, N: limit})
+	}
+	if err == nil && n == limit {
+		var b [1]byte
+		if m, _ := src.Read(b[:]); m > 0 {
+			err = ErrContentLength
+		}
+	}
+	return n, err
+}
+
+// writeRawBody copies rawBody, a response body which isRaw reports can
+// be copied straight from its connection, to the connection, which can
+// then splice it.
+//
+// If the handler declared a Content-Length, no more than the rest of it
+// is copied, and ErrContentLength is returned if the body holds more, as
+// readFromFile does for a file.
+func (w *response) writeRawBody(rawBody *bodyEOFSignal) (n int64, err error) {
+	if w.contentLength == -1 {
+		return rawBody.writeRawTo(w.conn.rwc, -1)
+	}
+	limit := w.contentLength - w.written
+	if limit < 0 {
+		limit = 0
+	}
+	n, err = rawBody.writeRawTo(w.conn.rwc, limit)
+	if err == errRawLimit {
+		err = ErrContentLength
+	}
+	return n, err
+}
+
 // debugServerConnections controls whether all server connections are wrapped
 // with a verbose logging wrapper.
 const debugServerConnections = false
@@ -820,6 +820,74 @@ func (b *body) readLocked(p []byte) (n int, err error) {
 	return n, err
 }
 
+// isRaw reports whether b is a body of known length read from r, and
+// so may be copied with writeRawTo.
+func (b *body) isRaw(r *bufio.Reader) bool {
+	lr, ok := b.src.(*io.LimitedReader)
+	return ok && lr.R == io.Reader(r) && b.hdr == nil
+}
+
+// errRawLimit is returned by writeRawTo when it stops at its limit with
+// more of the body left to read.
+var errRawLimit = errors.New("http: raw body longer than the copy limit")
+
+// writeRawTo copies the rest of b, which isRaw reports to be read from
+// r, to w. The part of b which r has already buffered is written first;
+// the rest is read straight from conn, the connection under r, with
+// io.Copy, so that the ReadFrom method of w may move it without copying
+// it through userspace. If limit is not negative, at most limit bytes
+// are copied, and if b holds more, writeRawTo returns errRawLimit,
+// leaving the rest of b to be read.
+func (b *body) writeRawTo(w io.Writer, r *bufio.Reader, conn io.Reader, limit int64) (n int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	if b.sawEOF {
+		return 0, io.EOF
+	}
+	lr := b.src.(*io.LimitedReader)
+	want := lr.N
+	if limit >= 0 && limit < want {
+		want = limit
+	}
+	k := int64(r.Buffered())
+	if k > want {
+		k = want
+	}
+	if k > 0 {
+		buf, _ := r.Peek(int(k))
+		m, werr := w.Write(buf)
+		r.Discard(m)
+		lr.N -= int64(m)
+		n += int64(m)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	if n < want {
+		rest := &io.LimitedReader{R: conn, N: want - n}
+		m, err := io.Copy(w, rest)
+		lr.N -= m
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if lr.N > 0 {
+		if n == want {
+			return n, errRawLimit
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+	b.sawEOF = true
+	if b.onHitEOF != nil {
+		b.onHitEOF()
+	}
+	return n, io.EOF
+}
+
 var (
 	singleCRLF = []byte("\r\n")
 	doubleCRLF = []byte("\r\n\r\n")
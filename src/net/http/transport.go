@@ -1614,6 +1614,7 @@ func (pc *persistConn) readLoop() {
 		waitForBodyRead := make(chan bool, 2)
 		body := &bodyEOFSignal{
 			body: resp.Body,
+			pc:   pc,
 			earlyCloseFn: func() error {
 				waitForBodyRead <- false
 				return nil
@@ -1881,6 +1882,7 @@ var (
 	testHookRoundTripRetried = nop
 	testHookPrePendingDial   = nop
 	testHookPostPendingDial  = nop
+	testHookWriteRawBody     = nop
 
 	testHookMu                     sync.Locker = fakeLocker{} // guards following
 	testHookReadLoopBeforeNextRead             = nop
@@ -2101,6 +2103,7 @@ func canonicalAddr(url *url.URL) string {
 // the return value from Close.
 type bodyEOFSignal struct {
 	body         io.ReadCloser
+	pc           *persistConn      // connection body is read from, or nil
 	mu           sync.Mutex        // guards following 4 fields
 	closed       bool              // whether Close has been called
 	rerr         error             // sticky Read error
@@ -2147,6 +2150,57 @@ func (es *bodyEOFSignal) Close() error {
 	return es.condfn(err)
 }
 
+// isRaw reports whether the rest of the body can be copied by writeRawTo,
+// straight from the TCP connection it is read from: whether the body has
+// a known length and, unless the Transport has replaced it with a gzip
+// reader, is passed on as the server encoded it.
+func (es *bodyEOFSignal) isRaw() bool {
+	if es.pc == nil {
+		return false
+	}
+	if _, ok := es.pc.conn.(*net.TCPConn); !ok {
+		return false
+	}
+	b, ok := es.body.(*body)
+	return ok && b.isRaw(es.pc.br)
+}
+
+// writeRawTo copies the rest of the body, for which isRaw must report
+// true, to w, bypassing the buffered reader of the connection once it has
+// been drained. If w is a TCP connection, its ReadFrom method can then
+// splice the data from one connection to the other. If limit is not
+// negative, at most limit bytes are copied, and if the body holds more,
+// writeRawTo returns errRawLimit, leaving the rest of it to be read.
+func (es *bodyEOFSignal) writeRawTo(w io.Writer, limit int64) (n int64, err error) {
+	es.mu.Lock()
+	closed, rerr := es.closed, es.rerr
+	es.mu.Unlock()
+	if closed {
+		return 0, errReadOnClosedResBody
+	}
+	if rerr == io.EOF {
+		return 0, nil
+	}
+	if rerr != nil {
+		return 0, rerr
+	}
+
+	testHookWriteRawBody()
+	n, err = es.body.(*body).writeRawTo(w, es.pc.br, es.pc.conn, limit)
+	if err == errRawLimit {
+		return n, err
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.rerr == nil {
+		es.rerr = err
+	}
+	if err = es.condfn(err); err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
 // caller must hold es.mu.
 func (es *bodyEOFSignal) condfn(err error) error {
 	if es.fn == nil {
@@ -84,6 +84,8 @@ import (
 	"internal/poll"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -595,6 +597,162 @@ func genericReadFrom(w io.Writer, r io.Reader) (n int64, err error) {
 	return io.Copy(writerOnly{w}, r)
 }
 
+// Fallback implementation of TCPConn's ReadFromFile, when sendfile isn't
+// applicable. Unlike seeking, reading f at an offset leaves f's offset
+// to any other user of f.
+func genericReadFromFile(c *TCPConn, f *os.File, off, n int64) (int64, error) {
+	return genericReadFrom(c, io.NewSectionReader(f, off, n))
+}
+
+// Fallback implementation of FileTransfer's SendTo, when splice isn't
+// applicable.
+func genericSendFileTransfer(c *TCPConn, t *FileTransfer) (int64, error) {
+	off := t.Offset()
+	return io.Copy(&transferWriter{c, t}, io.NewSectionReader(t.f, off, t.end-off))
+}
+
+// transferWriter is an io.Writer advancing the offset of a FileTransfer
+// past the data written to w.
+type transferWriter struct {
+	w io.Writer
+	t *FileTransfer
+}
+
+func (tw *transferWriter) Write(b []byte) (int, error) {
+	n, err := tw.w.Write(b)
+	atomic.AddInt64(&tw.t.off, int64(n))
+	return n, err
+}
+
+// Fallback implementation of TCPConn's WriteToLog, when splice isn't
+// applicable.
+func genericWriteToLog(c *TCPConn, s *logSyncer) (int64, error) {
+	return io.Copy(&logWriter{s.f, s}, tcpConnWithoutWriteTo{TCPConn: c})
+}
+
+// logWriter is an io.Writer telling a logSyncer about the data written
+// to w.
+type logWriter struct {
+	w io.Writer
+	s *logSyncer
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	n, err := lw.w.Write(b)
+	if serr := lw.s.wrote(int64(n)); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// A logSyncer syncs a file as a SyncPolicy says, as data is written to
+// it. The syncs run on a goroutine of their own.
+type logSyncer struct {
+	f        *os.File
+	policy   SyncPolicy
+	unsynced int64 // bytes written since the last sync began; accessed atomically
+	kick     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+
+	mu  sync.Mutex
+	err error // first error of a sync
+}
+
+func newLogSyncer(f *os.File, policy SyncPolicy) *logSyncer {
+	s := &logSyncer{
+		f:       f,
+		policy:  policy,
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// wrote records that n bytes have been written to the file, and
+// returns the error of an earlier sync, if any.
+func (s *logSyncer) wrote(n int64) error {
+	if atomic.AddInt64(&s.unsynced, n) >= s.policy.Bytes && s.policy.Bytes > 0 {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return s.syncErr()
+}
+
+func (s *logSyncer) syncErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *logSyncer) run() {
+	defer close(s.stopped)
+	var tick <-chan time.Time
+	if s.policy.Interval > 0 {
+		t := time.NewTicker(s.policy.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-s.kick:
+		case <-tick:
+		case <-s.done:
+			return
+		}
+		s.sync(false)
+	}
+}
+
+// sync syncs the file, if data has been written to it since the last
+// sync began, or if force is set.
+func (s *logSyncer) sync(force bool) {
+	if atomic.SwapInt64(&s.unsynced, 0) == 0 && !force {
+		return
+	}
+	var err error
+	if s.policy.DataOnly {
+		err = syncFileData(s.f)
+	} else {
+		err = s.f.Sync()
+	}
+	testHookLogSync(err)
+	if err != nil {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+	}
+}
+
+// stop stops the background syncs, syncs the file a last time and
+// returns the first error of a sync.
+func (s *logSyncer) stop() error {
+	close(s.done)
+	<-s.stopped
+	if s.syncErr() == nil {
+		s.sync(true)
+	}
+	return s.syncErr()
+}
+
+// discardWriter is an io.Writer on which all Write calls succeed
+// without doing anything.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// Fallback implementation of TCPConn's Discard, when splice isn't
+// applicable.
+func genericDiscard(r io.Reader, n int64) (int64, error) {
+	return io.CopyN(discardWriter{}, r, n)
+}
+
 // Limit the number of concurrent cgo-using goroutines, because
 // each will block an entire operating system thread. The usual culprit
 // is resolving many DNS names in separate goroutines but the DNS
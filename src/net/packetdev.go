@@ -0,0 +1,147 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"internal/poll"
+	"io"
+	"syscall"
+)
+
+// maxPacketDeviceSize is the size of the largest packet which can be
+// framed by CopyFromPacketDevice and CopyToPacketDevice.
+const maxPacketDeviceSize = 1<<16 - 1
+
+// A PacketDevice is a packet-oriented device, such as a tun or tap
+// interface. Each Read returns a single packet and each Write sends a
+// single packet.
+type PacketDevice struct {
+	name string
+	pfd  *poll.FD
+}
+
+func (d *PacketDevice) ok() bool { return d != nil && d.pfd != nil }
+
+// Read reads the next packet from the device into b.
+func (d *PacketDevice) Read(b []byte) (int, error) {
+	if !d.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := d.read(b)
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "read", Net: "file+net", Source: nil, Addr: fileAddr(d.name), Err: err}
+	}
+	return n, err
+}
+
+// Write writes b to the device as a single packet.
+func (d *PacketDevice) Write(b []byte) (int, error) {
+	if !d.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := d.write(b)
+	if err != nil {
+		err = &OpError{Op: "write", Net: "file+net", Source: nil, Addr: fileAddr(d.name), Err: err}
+	}
+	return n, err
+}
+
+// Close closes the device.
+func (d *PacketDevice) Close() error {
+	if !d.ok() {
+		return syscall.EINVAL
+	}
+	err := d.pfd.Close()
+	if err != nil {
+		err = &OpError{Op: "close", Net: "file+net", Source: nil, Addr: fileAddr(d.name), Err: err}
+	}
+	return err
+}
+
+// CopyFromPacketDevice copies packets read from dev to c until dev
+// reaches EOF or an error occurs. Each packet is preceded on c by its
+// length as a 2-byte big-endian integer, so that CopyToPacketDevice can
+// restore the packet boundaries at the other end of the connection. It
+// returns the number of packet bytes copied, not counting the lengths.
+//
+// On Linux, the packets are spliced from dev to c if the device
+// supports it.
+func CopyFromPacketDevice(c *TCPConn, dev *PacketDevice) (int64, error) {
+	if !c.ok() || !dev.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := copyFromPacketDevice(c, dev)
+	if err != nil {
+		err = &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// CopyToPacketDevice reads packets framed as by CopyFromPacketDevice
+// from c and writes each of them to dev, until c reaches EOF or an error
+// occurs. It returns the number of packet bytes copied, not counting the
+// lengths.
+//
+// On Linux, the packets are spliced from c to dev if the device
+// supports it.
+func CopyToPacketDevice(dev *PacketDevice, c *TCPConn) (int64, error) {
+	if !c.ok() || !dev.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := copyToPacketDevice(dev, c)
+	if err != nil {
+		err = &OpError{Op: "writeto", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// Fallback implementation of CopyFromPacketDevice, when splice isn't
+// applicable.
+func genericCopyFromPacketDevice(c *TCPConn, dev *PacketDevice) (int64, error) {
+	var written int64
+	buf := make([]byte, 2+maxPacketDeviceSize)
+	for {
+		n, err := dev.Read(buf[2:])
+		if n > 0 {
+			buf[0], buf[1] = byte(n>>8), byte(n)
+			if _, err := c.Write(buf[:2+n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Fallback implementation of CopyToPacketDevice, when splice isn't
+// applicable.
+func genericCopyToPacketDevice(dev *PacketDevice, c *TCPConn) (int64, error) {
+	var written int64
+	buf := make([]byte, maxPacketDeviceSize)
+	for {
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return written, err
+		}
+		n := int(buf[0])<<8 | int(buf[1])
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+		if _, err := dev.Write(buf[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openTun creates a tun interface with the given name, configured as
+// a point-to-point link from local to remote, and returns the file for
+// its packets. The interface is removed when the file is closed.
+func openTun(name, local, remote string) (*os.File, error) {
+	xname, err := exec.LookPath("ip")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		f.Close()
+		return nil, os.NewSyscallError("ioctl", errno)
+	}
+	for _, args := range [][]string{
+		{"ip", "address", "add", local, "peer", remote, "dev", name},
+		{"ip", "link", "set", "dev", name, "up"},
+	} {
+		cmd := &exec.Cmd{Path: xname, Args: args}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("args=%v out=%q err=%v", cmd.Args, string(out), err)
+		}
+	}
+	return f, nil
+}
+
+// udp4Packet returns an IPv4 packet holding a UDP datagram.
+func udp4Packet(src, dst *UDPAddr, payload []byte) []byte {
+	b := make([]byte, 28+len(payload))
+	b[0] = 0x45 // version 4, 20-byte header
+	b[2], b[3] = byte(len(b)>>8), byte(len(b))
+	b[8] = 64 // TTL
+	b[9] = syscall.IPPROTO_UDP
+	copy(b[12:16], src.IP.To4())
+	copy(b[16:20], dst.IP.To4())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	b[10], b[11] = byte(^sum>>8), byte(^sum)
+	u := b[20:]
+	u[0], u[1] = byte(src.Port>>8), byte(src.Port)
+	u[2], u[3] = byte(dst.Port>>8), byte(dst.Port)
+	u[4], u[5] = byte(len(u)>>8), byte(len(u))
+	copy(u[8:], payload)
+	return b
+}
+
+func TestPacketDeviceTun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("avoid external network")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("must be root")
+	}
+
+	// We suppose that using IPv4 link-local addresses doesn't
+	// harm anyone.
+	local, remote := "169.254.0.1", "169.254.0.254"
+	f, err := openTun("gotest5964", local, remote)
+	if err != nil {
+		t.Skipf("tun interface unavailable: %v", err)
+	}
+	defer f.Close()
+	dev, err := FilePacketDevice(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, relay, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		dev.Close()
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fromDone := make(chan error, 1)
+	go func() {
+		_, err := CopyFromPacketDevice(relay.(*TCPConn), dev)
+		fromDone <- err
+	}()
+	toDone := make(chan error, 1)
+	go func() {
+		_, err := CopyToPacketDevice(dev, relay.(*TCPConn))
+		toDone <- err
+	}()
+	defer func() {
+		c.Close()
+		if err := <-toDone; err != nil {
+			t.Errorf("CopyToPacketDevice: %v", err)
+		}
+		dev.Close()
+		<-fromDone
+		relay.Close()
+	}()
+
+	payloads := [][]byte{
+		[]byte("a"),
+		bytes.Repeat([]byte("b"), 100),
+		bytes.Repeat([]byte("c"), 1400),
+		bytes.Repeat([]byte("d"), 2),
+	}
+
+	t.Run("fromDevice", func(t *testing.T) {
+		ln, err := ListenUDP("udp4", &UDPAddr{IP: ParseIP(local)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		dst := &UDPAddr{IP: ParseIP(remote), Port: 9}
+		for _, p := range payloads {
+			if _, err := ln.WriteTo(p, dst); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The kernel may send packets of its own through the
+		// interface, so skip anything which isn't ours.
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer c.SetReadDeadline(noDeadline)
+		var hdr [2]byte
+		for i := 0; i < len(payloads); {
+			if _, err := io.ReadFull(c, hdr[:]); err != nil {
+				t.Fatal(err)
+			}
+			pkt := make([]byte, int(hdr[0])<<8|int(hdr[1]))
+			if _, err := io.ReadFull(c, pkt); err != nil {
+				t.Fatal(err)
+			}
+			if len(pkt) < 28 || pkt[0]>>4 != 4 || pkt[9] != syscall.IPPROTO_UDP || int(pkt[22])<<8|int(pkt[23]) != dst.Port {
+				continue
+			}
+			if n := int(pkt[2])<<8 | int(pkt[3]); n != len(pkt) {
+				t.Fatalf("packet %d: framed as %d bytes, IP header says %d", i, len(pkt), n)
+			}
+			if !bytes.Equal(pkt[28:], payloads[i]) {
+				t.Fatalf("packet %d: got payload %q; want %q", i, pkt[28:], payloads[i])
+			}
+			i++
+		}
+	})
+
+	t.Run("toDevice", func(t *testing.T) {
+		ln, err := ListenUDP("udp4", &UDPAddr{IP: ParseIP(local)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		src := &UDPAddr{IP: ParseIP(remote), Port: 9}
+		var stream []byte
+		for _, p := range payloads {
+			pkt := udp4Packet(src, ln.LocalAddr().(*UDPAddr), p)
+			stream = append(stream, byte(len(pkt)>>8), byte(len(pkt)))
+			stream = append(stream, pkt...)
+		}
+		if _, err := c.Write(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 2048)
+		for i, p := range payloads {
+			n, from, err := ln.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("packet %d: %v", i, err)
+			}
+			if !from.(*UDPAddr).IP.Equal(src.IP) {
+				t.Errorf("packet %d: from %v; want %v", i, from, src)
+			}
+			if !bytes.Equal(b[:n], p) {
+				t.Fatalf("packet %d: got payload %q; want %q", i, b[:n], p)
+			}
+		}
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTLSPassthroughRouter routes TLS connections to backends by the
+// server name in their ClientHello, which the router peeks at, and then
+// splices each connection, ClientHello included, to its backend without
+// terminating TLS.
+func TestTLSPassthroughRouter(t *testing.T) {
+	cert, roots, err := newTestCert("a.example", "b.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listeners are closed first, which ends their goroutines.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Each backend answers a line with its name and the line.
+	backends := make(map[string]string)
+	serverNames := make(chan string, 2)
+	for _, name := range []string{"a.example", "b.example"} {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		backends[name] = ln.Addr().String()
+		wg.Add(1)
+		go func(name string, ln net.Listener) {
+			defer wg.Done()
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err == nil {
+					serverNames <- c.(*tls.Conn).ConnectionState().ServerName
+					c.Write([]byte(name + ": " + line))
+				}
+				c.Close()
+			}
+		}(name, ln)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	relays := make(chan *net.Relay, 2)
+	routeErrs := make(chan error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			rl, err := route(c.(*net.TCPConn), backends)
+			if err != nil {
+				routeErrs <- err
+				continue
+			}
+			relays <- rl
+		}
+	}()
+
+	for _, name := range []string{"b.example", "a.example"} {
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: name, RootCAs: roots})
+		if err != nil {
+			select {
+			case err := <-routeErrs:
+				t.Fatalf("routing %s: %v", name, err)
+			default:
+			}
+			t.Fatalf("handshake with %s: %v", name, err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if want := name + ": hello\n"; got != want {
+			t.Errorf("got %q; want %q", got, want)
+		}
+		// The backend completed the handshake, whose transcript
+		// covers the ClientHello, so the router passed the
+		// ClientHello on exactly once.
+		if sn := <-serverNames; sn != name {
+			t.Errorf("backend saw server name %q; want %q", sn, name)
+		}
+		// Only a spliced relay records its activity.
+		if st := (<-relays).Stats(); st.Active == 0 {
+			t.Errorf("connection to %s was not spliced", name)
+		}
+	}
+}
+
+// route peeks at the ClientHello of the TLS connection c, and relays c to
+// the backend for the server name it asks for.
+func route(c *net.TCPConn, backends map[string]string) (*net.Relay, error) {
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The ClientHello is the first TLS record, which a 5 byte header
+	// precedes, ending with its length.
+	hdr := make([]byte, 5)
+	if _, err := c.Peek(hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x16 {
+		return nil, errors.New("not a TLS handshake")
+	}
+	rec := make([]byte, 5+int(hdr[3])<<8|int(hdr[4]))
+	if _, err := c.Peek(rec); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	name, err := clientHelloServerName(rec[5:])
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := backends[name]
+	if !ok {
+		return nil, errors.New("no backend for " + name)
+	}
+	b, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	rl := new(net.Relay)
+	upDone := make(chan struct{})
+	go func() {
+		// The client's close_notify may find the backend gone, so
+		// the error of this side is not the router's concern.
+		rl.Copy(b, c)
+		b.(*net.TCPConn).CloseWrite()
+		close(upDone)
+	}()
+	_, err = rl.Copy(c, b)
+	c.CloseWrite()
+	<-upDone
+	return rl, err
+}
+
+// clientHelloServerName returns the server name in the server_name
+// extension of the ClientHello handshake message m.
+func clientHelloServerName(m []byte) (string, error) {
+	errMalformed := errors.New("malformed ClientHello")
+	// The handshake type and length, the client version and random,
+	// and the session ID.
+	if len(m) < 4+2+32+1 || m[0] != 1 {
+		return "", errMalformed
+	}
+	m = m[4+2+32:]
+	skip := func(lenBytes int) bool {
+		if len(m) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, b := range m[:lenBytes] {
+			n = n<<8 | int(b)
+		}
+		if len(m) < lenBytes+n {
+			return false
+		}
+		m = m[lenBytes+n:]
+		return true
+	}
+	// The session ID, cipher suites and compression methods.
+	if !skip(1) || !skip(2) || !skip(1) || len(m) < 2 {
+		return "", errMalformed
+	}
+	m = m[2:]
+	for len(m) >= 4 {
+		typ, n := int(m[0])<<8|int(m[1]), int(m[2])<<8|int(m[3])
+		if len(m) < 4+n {
+			break
+		}
+		ext := m[4 : 4+n]
+		m = m[4+n:]
+		// The server_name extension holds a list of names; only
+		// host_name, of type 0, is defined.
+		if typ != 0 || len(ext) < 5 || ext[2] != 0 {
+			continue
+		}
+		nameLen := int(ext[3])<<8 | int(ext[4])
+		if len(ext) < 5+nameLen {
+			break
+		}
+		return string(ext[5 : 5+nameLen]), nil
+	}
+	return "", errors.New("no server name in ClientHello")
+}
+
+// newTestCert returns a self-signed certificate for names, and a pool of
+// roots holding it.
+func newTestCert(names ...string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots, nil
+}
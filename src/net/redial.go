@@ -0,0 +1,127 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"io"
+	"syscall"
+)
+
+// A Redialer copies the data of a TCP connection to a destination which
+// it replaces when writing to it fails, as a tunnel which outlives the
+// loss of its far end does. On Linux, a Redialer uses the splice system
+// call, so that the data is not copied into userspace.
+//
+// The data which the Redialer has read from the source, but which a
+// failed destination did not accept, is kept and written to the next
+// destination first. Data is lost only if the failed destination's
+// socket accepted it, but its peer never received it: that data, at most
+// the size of the socket's send buffer, is counted as written and is not
+// written again.
+type Redialer struct {
+	// Redial returns the connection replacing a destination which
+	// failed with err. If Redial returns an error, or is nil, the
+	// copy stops with that error, or with err.
+	Redial func(err error) (*TCPConn, error)
+}
+
+// Copy copies from src to dst until either EOF is reached on src, or an
+// error occurs reading from src or redialing. Each time writing to the
+// destination fails, Copy closes it and continues with the connection
+// returned by r.Redial. Copy returns the number of bytes written to all
+// of the destinations. It does not close the last destination.
+func (r *Redialer) Copy(dst, src *TCPConn) (written int64, err error) {
+	return r.copy(dst, src, true)
+}
+
+func (r *Redialer) copy(dst, src *TCPConn, useSplice bool) (written int64, err error) {
+	if !src.ok() {
+		return 0, syscall.EINVAL
+	}
+	var st redialState
+	defer st.s.close()
+	for {
+		if !dst.ok() {
+			return written, syscall.EINVAL
+		}
+		n, err, dstFailed := st.copy(dst, src, useSplice)
+		written += n
+		if !dstFailed {
+			return written, err
+		}
+		dst.Close()
+		if r.Redial == nil {
+			return written, err
+		}
+		if dst, err = r.Redial(err); err != nil {
+			return written, err
+		}
+	}
+}
+
+// redialState holds the data which a Redialer has read from its source
+// but not yet written to a destination.
+type redialState struct {
+	s splicer // buffers the data of spliced copies
+
+	buf     []byte
+	pending []byte // the part of buf left to write
+}
+
+// copy copies src to dst until EOF, starting with the data left over
+// by a previous destination. dstFailed reports whether err came from
+// dst, in which case the data which dst did not accept is kept.
+func (st *redialState) copy(dst, src *TCPConn, useSplice bool) (written int64, err error, dstFailed bool) {
+	for len(st.pending) > 0 {
+		n, err := dst.Write(st.pending)
+		written += int64(n)
+		st.pending = st.pending[n:]
+		if err != nil {
+			return written, err, true
+		}
+	}
+	if useSplice {
+		n, err, dstFailed, handled := st.s.relayTo(dst, src)
+		if handled {
+			switch {
+			case err == nil:
+			case dstFailed:
+				err = &OpError{Op: "write", Net: dst.fd.net, Source: dst.fd.laddr, Addr: dst.fd.raddr, Err: err}
+			default:
+				err = &OpError{Op: "read", Net: src.fd.net, Source: src.fd.laddr, Addr: src.fd.raddr, Err: err}
+			}
+			return written + n, err, dstFailed
+		}
+	}
+	n, err, dstFailed := st.genericCopy(dst, src)
+	return written + n, err, dstFailed
+}
+
+// Fallback implementation of Redialer's copy, when splice isn't
+// applicable. Unlike io.Copy, it keeps the data which dst did not
+// accept.
+func (st *redialState) genericCopy(dst, src *TCPConn) (written int64, err error, dstFailed bool) {
+	if st.buf == nil {
+		st.buf = make([]byte, 32*1024)
+	}
+	for {
+		n, rerr := src.Read(st.buf)
+		st.pending = st.buf[:n]
+		for len(st.pending) > 0 {
+			m, err := dst.Write(st.pending)
+			written += int64(m)
+			st.pending = st.pending[m:]
+			if err != nil {
+				return written, err, true
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil, false
+		}
+		if rerr != nil {
+			return written, rerr, false
+		}
+	}
+}
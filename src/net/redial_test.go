@@ -0,0 +1,117 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRedialer(t *testing.T) {
+	if !testableNetwork("tcp") {
+		t.Skip("tcp not testable")
+	}
+	t.Run("default", func(t *testing.T) {
+		testRedialer(t, true)
+	})
+	t.Run("generic", func(t *testing.T) {
+		testRedialer(t, false)
+	})
+}
+
+func testRedialer(t *testing.T, useSplice bool) {
+	c, s, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, src := c.(*TCPConn), s.(*TCPConn)
+	defer writer.Close()
+	defer src.Close()
+	var dsts, readers []*TCPConn
+	for i := 0; i < 2; i++ {
+		c, s, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		defer s.Close()
+		readers = append(readers, c.(*TCPConn))
+		dsts = append(dsts, s.(*TCPConn))
+	}
+
+	want := make([]byte, 8<<20)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	go func() {
+		writer.Write(want)
+		writer.CloseWrite()
+	}()
+
+	// The first destination's peer resets the connection after
+	// reading part of the data.
+	firstDone := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1<<20)
+		n, _ := io.ReadFull(readers[0], b)
+		readers[0].SetLinger(0)
+		readers[0].Close()
+		firstDone <- b[:n]
+	}()
+	type result struct {
+		b   []byte
+		err error
+	}
+	secondDone := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(readers[1])
+		secondDone <- result{b, err}
+	}()
+
+	var redialErrs []error
+	r := &Redialer{Redial: func(err error) (*TCPConn, error) {
+		redialErrs = append(redialErrs, err)
+		if len(redialErrs) > 1 {
+			return nil, errors.New("redialed more than once")
+		}
+		return dsts[1], nil
+	}}
+	written, err := r.copy(dsts[0], src, useSplice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsts[1].CloseWrite()
+	got1 := <-firstDone
+	res := <-secondDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	got2 := res.b
+
+	if len(redialErrs) != 1 {
+		t.Fatalf("redialed %d times; want 1", len(redialErrs))
+	}
+	if oe, ok := redialErrs[0].(*OpError); !ok || oe.Op != "write" {
+		t.Errorf("redialed after %v; want write error", redialErrs[0])
+	}
+	// Everything read from the source was accepted by one of the
+	// destinations' sockets. Only the data accepted by the first one
+	// after its peer stopped reading is lost.
+	if written != int64(len(want)) {
+		t.Errorf("wrote %d bytes; want %d", written, len(want))
+	}
+	if !bytes.Equal(got1, want[:len(got1)]) {
+		t.Errorf("first destination received %d bytes which differ from the start of the data sent", len(got1))
+	}
+	if len(got1)+len(got2) > len(want) || !bytes.Equal(got2, want[len(want)-len(got2):]) {
+		t.Errorf("second destination received %d bytes which differ from the end of the data sent", len(got2))
+	}
+	t.Logf("received %d + %d bytes, lost %d", len(got1), len(got2), len(want)-len(got1)-len(got2))
+}
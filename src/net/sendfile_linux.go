@@ -18,6 +18,9 @@ import (
 //
 // if handled == false, sendFile performed no work.
 func sendFile(c *netFD, r io.Reader) (written int64, err error, handled bool) {
+	if !strategyAllowsSendfile(nil) {
+		return 0, nil, false
+	}
 	var remain int64 = 1 << 62 // by default, copy until EOF
 
 	lr, ok := r.(*io.LimitedReader)
@@ -28,7 +31,7 @@ func sendFile(c *netFD, r io.Reader) (written int64, err error, handled bool) {
 		}
 	}
 	f, ok := r.(*os.File)
-	if !ok {
+	if !ok || !canSendFile(f) {
 		return 0, nil, false
 	}
 
@@ -39,3 +42,23 @@ func sendFile(c *netFD, r io.Reader) (written int64, err error, handled bool) {
 	}
 	return written, wrapSyscallError("sendfile", err), written > 0
 }
+
+// canSendFile reports whether f can be the source of sendfile, which
+// reads from the page cache: a regular file which isn't empty, or a block
+// device. Files of synthetic file systems such as /proc and /sys, which
+// generate their contents when they are read, look like regular files, but
+// report a size of 0 however much they hold, and sendfile either fails on
+// them or returns nothing.
+func canSendFile(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	switch mode := fi.Mode(); {
+	case mode.IsRegular():
+		return fi.Size() > 0
+	case mode&os.ModeDevice != 0:
+		return mode&os.ModeCharDevice == 0
+	}
+	return false
+}
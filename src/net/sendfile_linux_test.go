@@ -0,0 +1,193 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// sysMemfdCreate is the number of the memfd_create system call, which the
+// syscall package does not define, on each architecture.
+var sysMemfdCreate = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"s390x":    350,
+}
+
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+	fAddSeals       = 1033
+	fSealSeal       = 0x1
+	fSealShrink     = 0x2
+	fSealGrow       = 0x4
+	fSealWrite      = 0x8
+	fSealAll        = fSealSeal | fSealShrink | fSealGrow | fSealWrite
+)
+
+// sealedMemfd returns a memfd holding b, sealed against any change.
+func sealedMemfd(b []byte) (*os.File, error) {
+	trap, ok := sysMemfdCreate[runtime.GOARCH]
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+	name := []byte("net-test\x00")
+	fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(&name[0])), mfdCloexec|mfdAllowSealing, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("memfd_create", errno)
+	}
+	f := os.NewFile(fd, "memfd:net-test")
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, fSealAll); errno != 0 {
+		f.Close()
+		return nil, os.NewSyscallError("fcntl", errno)
+	}
+	return f, nil
+}
+
+// TestReadFromFileSealedMemfd serves an object cached in a sealed memfd
+// to several connections at once, each of which gets the whole object by
+// sendfile.
+func TestReadFromFileSealedMemfd(t *testing.T) {
+	want, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := sealedMemfd(want)
+	if err != nil {
+		t.Skipf("sealed memfd not available: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("wrote to a memfd sealed against writes")
+	}
+
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const conns = 8
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		c, err := Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			n, err, handled := sendFileRange(s.(*TCPConn).fd, f, 0, int64(len(want)))
+			if !handled {
+				t.Error("sendfile from a memfd was not handled")
+			}
+			if n != int64(len(want)) || err != nil {
+				t.Errorf("sent (%d, %v); want (%d, <nil>)", n, err, len(want))
+			}
+			s.(*TCPConn).CloseWrite()
+		}()
+		go func() {
+			defer wg.Done()
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("received %d bytes which differ from the %d bytes of the object", len(got), len(want))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestSendFileSource checks that ReadFrom only uses sendfile for a source
+// whose contents are in the page cache, and copies the rest through
+// userspace, and that the data is right either way.
+func TestSendFileSource(t *testing.T) {
+	cmdline := []byte(strings.Join(os.Args, "\x00") + "\x00")
+	twainData, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		want     []byte
+		sendfile bool
+	}{
+		// /proc files report a size of 0.
+		{"/proc/self/cmdline", cmdline, false},
+		{twain, twainData, true},
+	} {
+		f, err := os.Open(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if got := canSendFile(f); got != tt.sendfile {
+			t.Errorf("canSendFile(%s) = %v; want %v", tt.name, got, tt.sendfile)
+		}
+
+		c, s, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		defer s.Close()
+		type result struct {
+			b   []byte
+			err error
+		}
+		readDone := make(chan result, 1)
+		go func() {
+			b, err := ioutil.ReadAll(c)
+			readDone <- result{b, err}
+		}()
+		n, err, handled := sendFile(s.(*TCPConn).fd, f)
+		if handled != tt.sendfile {
+			t.Errorf("%s: sendfile handled = %v; want %v", tt.name, handled, tt.sendfile)
+		}
+		if !handled {
+			n, err = genericReadFrom(s.(*TCPConn), f)
+		}
+		if err != nil || n != int64(len(tt.want)) {
+			t.Errorf("%s: sent (%d, %v); want (%d, <nil>)", tt.name, n, err, len(tt.want))
+		}
+		s.(*TCPConn).CloseWrite()
+		res := <-readDone
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if !bytes.Equal(res.b, tt.want) {
+			t.Errorf("%s: received %d bytes which differ from the %d bytes of the file", tt.name, len(res.b), len(tt.want))
+		}
+	}
+}
@@ -5,12 +5,16 @@
 package net
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -88,3 +92,295 @@ func TestSendfile(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestReadFromFile(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testReadFromFile(t, (*TCPConn).ReadFromFile)
+	})
+	t.Run("generic", func(t *testing.T) {
+		testReadFromFile(t, func(c *TCPConn, f *os.File, off, n int64) (int64, error) {
+			// Like ReadFromFile, report a short file as EOF.
+			m, err := genericReadFromFile(c, f, off, n)
+			if err == nil && m < n {
+				err = io.EOF
+			}
+			return m, err
+		})
+	})
+}
+
+func testReadFromFile(t *testing.T, readFromFile func(*TCPConn, *os.File, int64, int64) (int64, error)) {
+	want, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const pos = 12345
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Each connection receives its own section of the shared file,
+	// the last one running past the end of the file.
+	const conns = 8
+	section := int64(len(want)/conns + 1)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		c, err := Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		off := int64(i) * section
+		end := off + section
+		wantErr := error(nil)
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			wantErr = io.EOF
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			n, err := readFromFile(s.(*TCPConn), f, off, section)
+			if n != end-off || err != wantErr {
+				t.Errorf("sending %d bytes at %d: got (%d, %v); want (%d, %v)", section, off, n, err, end-off, wantErr)
+			}
+			s.(*TCPConn).CloseWrite()
+		}()
+		go func() {
+			defer wg.Done()
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(got, want[off:end]) {
+				t.Errorf("section at %d: received %d bytes which differ from the %d bytes of the file", off, len(got), end-off)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, err := f.Seek(0, io.SeekCurrent); got != pos || err != nil {
+		t.Errorf("file offset is (%d, %v); want (%d, <nil>)", got, err, pos)
+	}
+}
+
+func TestFileTransferResume(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testFileTransferResume(t)
+	})
+	t.Run("generic", func(t *testing.T) {
+		defer func(s SpliceStrategy) { testHookSpliceStrategy = s }(testHookSpliceStrategy)
+		testHookSpliceStrategy = GenericStrategy
+		testFileTransferResume(t)
+	})
+}
+
+func testFileTransferResume(t *testing.T) {
+	want, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// send sends the rest of ft over a new connection, and returns
+	// what the peer received. If deadline is set, the peer doesn't read
+	// until the send is done, which the deadline interrupts.
+	send := func(ft *FileTransfer, deadline time.Duration) ([]byte, int64, error) {
+		c, err := Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if deadline > 0 {
+			// Small buffers make the interrupted send leave data
+			// in the pipe it splices through.
+			c.(*TCPConn).SetReadBuffer(8 << 10)
+			s.(*TCPConn).SetWriteBuffer(8 << 10)
+			s.SetWriteDeadline(time.Now().Add(deadline))
+		}
+		type result struct {
+			b   []byte
+			err error
+		}
+		received := make(chan result, 1)
+		ready := make(chan struct{})
+		go func() {
+			<-ready
+			b, err := ioutil.ReadAll(c)
+			received <- result{b, err}
+		}()
+		if deadline == 0 {
+			close(ready)
+		}
+		n, err := ft.SendTo(s.(*TCPConn))
+		s.Close()
+		if deadline > 0 {
+			close(ready)
+		}
+		r := <-received
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.b, n, err
+	}
+
+	const start = 1000
+	ft := NewFileTransfer(f, start, int64(len(want)-start))
+	first, n, err := send(ft, 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("first send completed; want it interrupted")
+	}
+	if n != int64(len(first)) {
+		t.Errorf("first send reported %d bytes; peer received %d", n, len(first))
+	}
+	checkpoint := ft.Offset()
+	if checkpoint != start+int64(len(first)) {
+		t.Fatalf("offset after interrupted send is %d; want %d", checkpoint, start+len(first))
+	}
+
+	// Resume as a new process would, from the checkpoint alone.
+	ft = NewFileTransfer(f, checkpoint, int64(len(want))-checkpoint)
+	rest, n, err := send(ft, 0)
+	if n != int64(len(rest)) || err != nil {
+		t.Fatalf("resumed send = %d, %v; want %d, <nil>", n, err, len(rest))
+	}
+	if ft.Offset() != int64(len(want)) || ft.Remaining() != 0 {
+		t.Errorf("offset after resumed send is %d with %d remaining; want %d with 0", ft.Offset(), ft.Remaining(), len(want))
+	}
+	if got := append(first, rest...); !bytes.Equal(got, want[start:]) {
+		t.Errorf("received %d bytes which differ from the %d bytes of the file", len(got), len(want)-start)
+	}
+	if got, err := f.Seek(0, io.SeekCurrent); got != 0 || err != nil {
+		t.Errorf("file offset is (%d, %v); want (0, <nil>)", got, err)
+	}
+}
+
+func TestFileTransferPermit(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testFileTransferPermit(t)
+	})
+	t.Run("generic", func(t *testing.T) {
+		defer func(s SpliceStrategy) { testHookSpliceStrategy = s }(testHookSpliceStrategy)
+		testHookSpliceStrategy = GenericStrategy
+		testFileTransferPermit(t)
+	})
+}
+
+func testFileTransferPermit(t *testing.T) {
+	want, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// send sends the rest of ft over a new connection, and returns
+	// what the peer received.
+	send := func(ft *FileTransfer) ([]byte, int64, error) {
+		c, err := Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		received := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(c)
+			received <- b
+		}()
+		n, err := ft.SendTo(s.(*TCPConn))
+		s.Close()
+		return <-received, n, err
+	}
+
+	// The permitted ranges overlap and are out of order: together,
+	// they permit the bytes from 0 up to 1500, and from 5000 up to
+	// 9000.
+	permitted := []FileRange{{5000, 2000}, {0, 1000}, {6000, 3000}, {1000, 500}, {3000, 0}}
+	tests := []struct {
+		off, end int64
+		ok       bool
+	}{
+		{200, 1500, true},
+		{5500, 8500, true},
+		{0, 9000, false},
+		{1400, 1600, false},
+		{4999, 5100, false},
+		{8000, 9500, false},
+		{3000, 3100, false},
+	}
+	for _, tt := range tests {
+		ft := NewFileTransfer(f, tt.off, tt.end-tt.off)
+		ft.Permit(permitted...)
+		got, n, err := send(ft)
+		if !tt.ok {
+			// Nothing moves when the section touches a
+			// forbidden range.
+			if oe, ok := err.(*OpError); !ok || oe.Err != ErrRangeForbidden {
+				t.Errorf("sending [%d, %d): got %v; want %v", tt.off, tt.end, err, ErrRangeForbidden)
+			}
+			if n != 0 || len(got) != 0 || ft.Offset() != tt.off {
+				t.Errorf("forbidden send of [%d, %d) sent %d bytes, of which the peer received %d, and moved the offset to %d", tt.off, tt.end, n, len(got), ft.Offset())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("sending [%d, %d): %v", tt.off, tt.end, err)
+		}
+		if n != tt.end-tt.off || !bytes.Equal(got, want[tt.off:tt.end]) {
+			t.Errorf("sending [%d, %d) sent %d bytes, and the peer received %d which differ from the file", tt.off, tt.end, n, len(got))
+		}
+	}
+
+	// Permitting no ranges forbids the whole file.
+	ft := NewFileTransfer(f, 0, 10)
+	ft.Permit()
+	if _, _, err := send(ft); err == nil {
+		t.Error("transfer with no permitted ranges succeeded")
+	}
+}
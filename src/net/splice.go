@@ -0,0 +1,1703 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"context"
+	"errors"
+	"internal/poll"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultSpliceBuffer is the socket buffer size used by
+// ConfigureForSplice when none is given. It holds four of the
+// 64 KiB pipes which Linux creates by default; on loopback this
+// outperforms the kernel's automatic buffer tuning, see
+// BenchmarkSpliceConfigured.
+const defaultSpliceBuffer = 256 << 10
+
+// SpliceOptions holds the socket options which ConfigureForSplice
+// applies to a connection.
+//
+// The zero value disables Nagle's algorithm, sizes the socket buffers
+// for splicing and leaves keep-alives unchanged.
+type SpliceOptions struct {
+	// ReadBuffer and WriteBuffer are the sizes, in bytes, of the
+	// operating system's receive and transmit buffers for the
+	// connection. If zero, a size which keeps several splice pipes'
+	// worth of data in flight is used. If negative, the buffers are
+	// left to the operating system.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// Delay enables Nagle's algorithm. By default it is disabled,
+	// so that spliced data is sent as soon as it reaches the socket.
+	Delay bool
+
+	// KeepAlive specifies the keep-alive period for the connection.
+	// If zero, keep-alives are left unchanged. If negative,
+	// keep-alives are disabled.
+	KeepAlive time.Duration
+
+	// PipeSize is the size, in bytes, of the kernel buffer through
+	// which copies to or from the connection are spliced, which the
+	// kernel may round up. If zero or negative, the buffer has the
+	// kernel's default size, usually 64 KiB. When both connections
+	// of a copy have a PipeSize, the larger is used.
+	PipeSize int
+}
+
+// ConfigureForSplice applies the socket options in opts to c, in
+// preparation for relaying data to or from c with its ReadFrom method.
+// A relay usually configures both of its connections. If opts is nil,
+// the zero SpliceOptions are used.
+func ConfigureForSplice(c *TCPConn, opts *SpliceOptions) error {
+	if opts == nil {
+		opts = &SpliceOptions{}
+	}
+	if err := c.SetNoDelay(!opts.Delay); err != nil {
+		return err
+	}
+	if n := spliceBufferSize(opts.ReadBuffer); n > 0 {
+		if err := c.SetReadBuffer(n); err != nil {
+			return err
+		}
+	}
+	if n := spliceBufferSize(opts.WriteBuffer); n > 0 {
+		if err := c.SetWriteBuffer(n); err != nil {
+			return err
+		}
+	}
+	switch {
+	case opts.KeepAlive < 0:
+		if err := c.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case opts.KeepAlive > 0:
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := c.SetKeepAlivePeriod(opts.KeepAlive); err != nil {
+			return err
+		}
+	}
+	setSplicePipeSize(c.fd, opts.PipeSize)
+	return nil
+}
+
+func spliceBufferSize(n int) int {
+	if n == 0 {
+		return defaultSpliceBuffer
+	}
+	return n
+}
+
+// SpliceOptimizedListener returns a Listener whose Accept method applies
+// the socket options in opts, as ConfigureForSplice does, to each TCP
+// connection accepted by ln before returning it. A connection which
+// can't be configured is closed, and the next one is accepted in its
+// place. Connections other than *TCPConn are returned as they are. If
+// opts is nil, the zero SpliceOptions are used.
+func SpliceOptimizedListener(ln Listener, opts *SpliceOptions) Listener {
+	sl := &spliceListener{Listener: ln}
+	if opts != nil {
+		sl.opts = *opts
+	}
+	return sl
+}
+
+type spliceListener struct {
+	Listener
+	opts SpliceOptions
+}
+
+func (sl *spliceListener) Accept() (Conn, error) {
+	for {
+		c, err := sl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tc, ok := c.(*TCPConn)
+		if !ok {
+			return c, nil
+		}
+		if err := ConfigureForSplice(tc, &sl.opts); err != nil {
+			tc.Close()
+			continue
+		}
+		return tc, nil
+	}
+}
+
+// RelayMode selects how a Relay balances latency against throughput.
+type RelayMode int
+
+const (
+	// LatencyMode forwards data to the destination as soon as it
+	// has been read from the source.
+	LatencyMode RelayMode = iota
+
+	// ThroughputMode buffers as much data from the source as the
+	// relay can hold, or as much as is available, before forwarding
+	// it to the destination. This results in fewer, larger writes.
+	ThroughputMode
+)
+
+// A Relay copies data from a source to a destination connection. On
+// Linux, a Relay between two TCP or Unix stream connections, including
+// those made by FileConn, uses the splice system call, so that the data
+// is not copied into userspace. So does a Relay
+// between sockets wrapped in an *os.File, such as those returned by the
+// File method of TCPConn; their sockets are in non-blocking mode while
+// the copy runs. A spliced Relay between TCP connections with Urgent set
+// forwards urgent data as urgent data, at its place in the stream.
+// Multipath TCP
+// sockets, made with IPPROTO_MPTCP and wrapped with FileConn or
+// FileListener, are TCP connections to a Relay, and are spliced too.
+//
+// Data which has been peeked at on the source, with TCPConn.Peek or a
+// recv(2) with MSG_PEEK on its raw connection, is still queued on the
+// source, and a Relay copies it exactly once, at its place at the start
+// of the stream, whether or not the copy is spliced.
+//
+// Closing the source or the destination of a copy stops it, even while
+// data keeps arriving, and the copy fails with the error for a closed
+// network connection.
+//
+// A Relay whose copies fail three times in a row in the splice system
+// call itself, rather than because of their connections, as when the
+// kernel refuses to splice between them or runs short of memory for it,
+// copies through userspace from then on; see Downgraded. A spliced copy
+// which succeeds resets the count. With GODEBUG=splicetrace=1, the
+// downgrade is logged.
+//
+// Connections which encrypt in userspace, such as a *tls.Conn, are
+// copied with Read and Write: the kernel holds neither their keys nor
+// their record state, so their data can't be spliced.
+//
+// The zero value is a Relay in LatencyMode. A Relay may be used by
+// several goroutines at once, to run several copies.
+type Relay struct {
+	// stats is first, so that its fields are 64-bit aligned
+	// for atomic access on 32-bit platforms.
+	stats poll.RelayStats
+
+	// spliceFailures counts the consecutive copies whose splice
+	// failed, and downgraded is set once they reach
+	// maxSpliceFailures. Both are accessed atomically.
+	spliceFailures int32
+	downgraded     int32
+
+	// Mode selects how the relay balances latency against
+	// throughput.
+	Mode RelayMode
+
+	// DrainLimit, if positive, limits the data which a spliced relay
+	// reads ahead of the destination to DrainLimit bytes. By default
+	// the relay reads ahead as much as its kernel buffer holds, 64 KiB
+	// or more. A small limit keeps a burst from the source from
+	// holding up the data behind it, which lowers the latency jitter
+	// of interleaved messages, at the cost of more system calls.
+	DrainLimit int
+
+	// AdaptivePipe makes a spliced relay resize its kernel buffer as
+	// its traffic changes over the life of a connection: the buffer
+	// grows, up to 1 MiB, during sustained bursts from the source,
+	// and shrinks, down to 16 KiB, while the connection is mostly
+	// idle, so that long-lived relays hold little kernel memory
+	// between bursts.
+	AdaptivePipe bool
+
+	// Urgent makes a spliced relay between TCP connections forward
+	// TCP urgent data as urgent data: the data before the urgent mark
+	// is written first, then the urgent byte is sent with MSG_OOB. It
+	// costs a system call each time the source runs dry. Without
+	// Urgent, a spliced relay stops at the mark, as the splice system
+	// call does, until more data follows it, and the urgent byte is
+	// dropped, as it is by a copy through userspace.
+	Urgent bool
+
+	// LowWater, if positive, makes a spliced relay wait until LowWater
+	// bytes are available from a socket source before reading from it,
+	// by setting the socket's SO_RCVLOWAT option for the duration of
+	// the copy. Fewer, larger reads lower the relay's CPU use when the
+	// source trickles in small segments. The end of the stream is
+	// noticed at once, but data short of LowWater waits for more to
+	// follow, so LowWater suits bulk transfers rather than
+	// request/response protocols. LowWater is capped to the relay's
+	// kernel buffer.
+	LowWater int
+
+	// NotSentLowWater, if positive, limits the data which a spliced
+	// relay keeps queued on a TCP destination without it having been
+	// sent to NotSentLowWater bytes, by setting the socket's
+	// TCP_NOTSENT_LOWAT option for the duration of the copy, and
+	// shrinks the relay's kernel buffer to match, unless the
+	// connections were given a PipeSize by ConfigureForSplice. Data
+	// then waits at the source, where TCP flow control holds it back,
+	// rather than in buffers behind data already on the wire, which
+	// lowers the latency of interactive traffic beyond what disabling
+	// Nagle's algorithm does, at the cost of more system calls and
+	// lower throughput. The previous value of the option is restored
+	// when the copy ends.
+	NotSentLowWater int
+
+	// DropCache makes a relay from a regular file to a TCP connection
+	// advise the kernel, as it goes, that the parts of the file which
+	// it has sent won't be needed again, so that they are dropped from
+	// the page cache. This keeps a large file which is sent once, such
+	// as a video served by a CDN edge, from evicting data which is used
+	// more often. DropCache has no effect on other relays, nor on the
+	// pages of a file which are dirty or in use elsewhere.
+	DropCache bool
+
+	// Transform, if not nil, transforms the data which the relay
+	// copies, such as by compressing or encrypting it. Unless
+	// Transform.Passthrough reports true at the start of a copy, the
+	// copy goes through userspace and Transform's writer, and is never
+	// spliced; the copy then counts the bytes read from the source.
+	Transform Transformer
+
+	// Account, if not nil, is called as a copy goes, each time it has
+	// written data to the destination, with the number of bytes the
+	// copy has written so far; or, with Transform, read from the
+	// source. Stats, called from Account, covers a spliced copy up to
+	// that write. If Account returns an error, the copy stops at once
+	// and returns that error, as the Err of an *OpError if the copy
+	// was spliced. Data which the relay has read from the source but
+	// not yet written is then discarded, so that nothing more reaches
+	// the destination. A copy with Account set never uses sendfile,
+	// since that can't be interrupted between writes.
+	Account func(written int64) error
+
+	// Budget, if not nil, paces the data which the relay writes to the
+	// destination. The relay writes only as much as the budget makes
+	// available, and otherwise waits for it to replenish, holding the
+	// data it has read from the source until then; a spliced relay
+	// stops reading from the source while it waits. Relays sharing a
+	// budget share its rate. A copy with Budget set never uses
+	// sendfile, and a redirected copy isn't paced.
+	Budget *OutputBudget
+
+	// Inspect, if not empty, receives a copy of the first data which
+	// the relay copies, so that the start of a stream can be inspected
+	// without a read of its own ahead of the copy, as with Peek. After
+	// a copy of n bytes, the first min(n, len(Inspect)) bytes of
+	// Inspect hold the start of the data copied. A spliced relay
+	// duplicates the data into Inspect from its kernel buffer with
+	// tee(2), as it forwards it, so the data is still not read into
+	// userspace on its way to the destination. A relay with Inspect
+	// set must not run several copies at once, and a copy with
+	// Inspect set never uses sendfile. A redirected copy fills no part
+	// of Inspect.
+	Inspect []byte
+
+	// Capture, if not nil, records the data which the relay copies,
+	// in records marked with CaptureDirection, such as 0 for the data
+	// sent by a client and 1 for that sent by its server. A spliced
+	// relay duplicates the data from its kernel buffer with tee(2)
+	// before writing it, so the copy to the destination doesn't wait
+	// for the capture. With Transform, the data read from the source
+	// is recorded. A copy with Capture set never uses sendfile, and a
+	// redirected copy records nothing.
+	Capture *Capture
+
+	// CaptureDirection marks the records of the relay's copies in
+	// Capture.
+	CaptureDirection uint8
+
+	// Timestamps, if not nil, is called with the transmit timestamps
+	// of the data which a spliced copy writes to a TCP connection, to
+	// measure the latency of the network. On Linux, the relay enables
+	// the SO_TIMESTAMPING option of the destination for the duration
+	// of the copy, for software timestamps of when the data is handed
+	// to the network device and when the peer acknowledges it, and
+	// hardware timestamps as well if the device has been configured
+	// for them. It reads the timestamps from the socket's error queue
+	// after each write, and once the copy ends, without reading the
+	// data back. A copy which completes waits, for up to a second, for
+	// the timestamps of the acknowledgment of all its data before it
+	// returns. The previous value of the option is restored when the
+	// copy ends. Timestamps is called on the goroutine of the copy,
+	// which waits for it, and isn't called for copies which aren't
+	// spliced or are redirected.
+	Timestamps func(TxTimestamp)
+
+	// TimeSlice, if positive, caps how long each copy runs, so that a
+	// scheduler can take turns between relays. Once TimeSlice has
+	// passed, the copy stops reading from the source, writes what it
+	// has already read to the destination, and returns the number of
+	// bytes copied with ErrSliceExpired, leaving the connections ready
+	// for a further copy to carry on. To interrupt a copy waiting for
+	// the source, the copy sets the read deadline of the source, if it
+	// has one, to the end of the slice, and clears it on return. A
+	// copy with TimeSlice set never uses sendfile.
+	TimeSlice time.Duration
+
+	// DedicatedPoller makes a spliced relay wait for its connections
+	// with a poller of its own, which blocks the calling thread,
+	// instead of the runtime's shared network poller. This lowers the
+	// latency of each wakeup for a relay on a goroutine locked to an
+	// OS thread with runtime.LockOSThread, at the cost of that thread.
+	// Deadlines and Close take effect within 10ms. DedicatedPoller
+	// has no effect if GOMAXPROCS is 1, since the relay's thread
+	// would then keep all other goroutines from running.
+	DedicatedPoller bool
+
+	// MaxSpliceFDs, if positive, makes a spliced copy which needs a
+	// new kernel buffer do as LimitPolicy says once the buffers of all
+	// spliced copies hold MaxSpliceFDs file descriptors, as reported
+	// by SpliceFDs. Buffers kept for reuse are taken regardless.
+	MaxSpliceFDs int
+
+	// LimitPolicy selects what a spliced copy does at the limit set
+	// by MaxSpliceFDs.
+	LimitPolicy SpliceLimitPolicy
+
+	// Strategy selects the system calls with which the relay copies
+	// data without copying it through userspace, such as to work
+	// around a kernel bug which affects a single system call. The
+	// zero value, AutoStrategy, is the one used by the ReadFrom
+	// method of TCPConn. Strategy has no effect on systems other than
+	// Linux.
+	Strategy SpliceStrategy
+
+	// Redirected tells a relay between two TCP connections that the
+	// kernel already forwards the data of the source to the
+	// destination by itself. On Linux, this is the case once an eBPF
+	// program which calls bpf_sk_redirect_map is attached to a
+	// BPF_MAP_TYPE_SOCKMAP holding the source, and the destination
+	// is in the map it redirects to. The relay then moves no data: it
+	// waits for the source to reach EOF, and for the data to be
+	// queued on the destination, and reports the number of bytes the
+	// source received. If data reaches the source's own receive
+	// queue instead, the copy fails, and that data is left to be read
+	// from the source. A redirected copy doesn't call Account, and
+	// the kernel can't stop at a limit, so CopyN ignores Redirected.
+	Redirected bool
+
+	// DSCP, if positive, marks the packets which carry the data of a
+	// copy to a TCP connection with the differentiated services code
+	// point DSCP, between 1 and 63, such as 46 for expedited
+	// forwarding. On Linux, the relay sets the IP_TOS option of the
+	// destination socket, or IPV6_TCLASS for an IPv6 one, before the
+	// copy starts, and restores its previous value when the copy
+	// returns. Data which the copy queued on the socket, and which the
+	// kernel has not sent by then, is sent with the previous marking.
+	// The relay does not set IPv6 flow labels. DSCP has no effect on
+	// other systems.
+	DSCP int
+
+	// ID, if not empty, identifies the relay in diagnostics, such as
+	// a connection ID for correlating the relay's failures with the
+	// logs of the connections it serves. The lines which
+	// GODEBUG=splicetrace=1 prints about the relay's copies include
+	// it, and the errors of its copies, other than io.EOF and
+	// ErrSliceExpired, carry it as a *RelayError: as the Err of an
+	// *OpError, if the copy fails with one, or on their own.
+	ID string
+}
+
+// maxSpliceFailures is the number of consecutive copies whose splice
+// fails after which a Relay stops splicing.
+const maxSpliceFailures = 3
+
+// Downgraded reports whether rl has stopped splicing its copies, after
+// repeated failures of splice, and copies through userspace instead.
+func (rl *Relay) Downgraded() bool {
+	return rl != nil && atomic.LoadInt32(&rl.downgraded) != 0
+}
+
+// id returns the ID of rl, which may be nil.
+func (rl *Relay) id() string {
+	if rl == nil {
+		return ""
+	}
+	return rl.ID
+}
+
+// ErrSliceExpired is returned by a copy made by a Relay with a TimeSlice
+// when the slice ends before the copy is complete.
+var ErrSliceExpired = errors.New("relay time slice expired")
+
+// A RelayError records the ID of the Relay whose copy failed, and the
+// error which failed it.
+type RelayError struct {
+	ID  string
+	Err error
+}
+
+func (e *RelayError) Error() string {
+	return "relay " + e.ID + ": " + e.Err.Error()
+}
+
+// Timeout reports whether the copy failed because a deadline passed.
+func (e *RelayError) Timeout() bool {
+	err := e.Err
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	t, ok := err.(timeout)
+	return ok && t.Timeout()
+}
+
+// Temporary reports whether the error which failed the copy is
+// temporary.
+func (e *RelayError) Temporary() bool {
+	err := e.Err
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	t, ok := err.(temporary)
+	return ok && t.Temporary()
+}
+
+// tagError returns err, the error of a copy made by rl, which may be
+// nil, marked with the ID of rl, if it has one and err isn't marked
+// already.
+func (rl *Relay) tagError(err error) error {
+	id := rl.id()
+	if id == "" || err == nil || err == io.EOF || err == ErrSliceExpired {
+		return err
+	}
+	for e := err; e != nil; {
+		switch v := e.(type) {
+		case *RelayError:
+			return err
+		case *OpError:
+			e = v.Err
+		default:
+			e = nil
+		}
+	}
+	if oe, ok := err.(*OpError); ok {
+		tagged := *oe
+		tagged.Err = &RelayError{ID: id, Err: oe.Err}
+		return &tagged
+	}
+	return &RelayError{ID: id, Err: err}
+}
+
+// A Transformer transforms the data copied by a Relay.
+type Transformer interface {
+	// Passthrough reports whether the transformer would leave the
+	// data unchanged, as when compressing data which is already
+	// compressed, so that the relay may splice it instead.
+	Passthrough() bool
+
+	// NewWriter returns a writer which transforms the data written
+	// to it and writes the result to w. The relay closes the writer
+	// once the copy is done, so that it can flush the data it holds.
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+// An OutputBudget is a token bucket which paces the data written by the
+// relays that share it. It holds up to burst bytes, and replenishes at
+// rate bytes a second. A greedy connection relayed with a budget is held
+// back, with its data left in the relay's buffer, rather than crowding out
+// the connections relayed alongside it.
+type OutputBudget struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64 // may be negative when relays overspend
+	last   time.Time
+}
+
+// NewOutputBudget returns a budget replenished at rate bytes a second,
+// holding up to burst bytes, which it starts with. If burst is not
+// positive, the budget holds up to rate bytes. NewOutputBudget panics if
+// rate is not positive.
+func NewOutputBudget(rate, burst int) *OutputBudget {
+	if rate <= 0 {
+		panic("net: non-positive rate for NewOutputBudget")
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &OutputBudget{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// replenish adds the tokens accrued since b was last used. b.mu must be
+// held.
+func (b *OutputBudget) replenish() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if max := float64(b.burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// Available returns how many of the next want bytes may be written now.
+// So that the budget isn't spent in dribs and drabs, nothing is available
+// until b holds want bytes, or burst bytes if want is larger. In that case,
+// wait is how long b takes to replenish that much.
+func (b *OutputBudget) Available(want int) (n int, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replenish()
+	need := want
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens < float64(need) {
+		return 0, time.Duration((float64(need) - b.tokens) / b.rate * float64(time.Second))
+	}
+	if b.tokens < float64(want) {
+		return int(b.tokens), 0
+	}
+	return want, 0
+}
+
+// Spend takes n bytes, which have been written, from b. The budget may
+// be overspent, by relays sharing it, in which case the debt is repaid
+// before more is available.
+func (b *OutputBudget) Spend(n int) {
+	b.mu.Lock()
+	b.replenish()
+	b.tokens -= float64(n)
+	b.mu.Unlock()
+}
+
+// A Capture records the data copied by relays to a writer, such as a
+// file, for debugging. Each record is an 8-byte timestamp, in nanoseconds
+// since the Unix epoch, the 1-byte direction of the relay, a 4-byte
+// length, and that many bytes of data; the numbers are big-endian. The
+// capture is best-effort: the records are written by a goroutine of the
+// Capture's own, so that relays don't wait for the writer, and those which
+// relays make while too many are waiting to be written are dropped.
+//
+// A Capture must be created with NewCapture.
+type Capture struct {
+	// dropped is first, so that it is 64-bit aligned for atomic
+	// access on 32-bit platforms.
+	dropped int64
+
+	w       io.Writer
+	records chan captureRecord
+	done    chan struct{}
+	err     error
+}
+
+type captureRecord struct {
+	t    time.Time
+	dir  uint8
+	data []byte
+}
+
+// maxCaptureRecords is the number of records a Capture holds waiting to be
+// written before it drops new ones.
+const maxCaptureRecords = 256
+
+// NewCapture returns a Capture which writes its records to w.
+func NewCapture(w io.Writer) *Capture {
+	c := &Capture{
+		w:       w,
+		records: make(chan captureRecord, maxCaptureRecords),
+		done:    make(chan struct{}),
+	}
+	go c.write()
+	return c
+}
+
+func (c *Capture) write() {
+	defer close(c.done)
+	var hdr [13]byte
+	for r := range c.records {
+		if c.err != nil {
+			continue
+		}
+		t := uint64(r.t.UnixNano())
+		for i := 0; i < 8; i++ {
+			hdr[i] = byte(t >> uint(56-8*i))
+		}
+		hdr[8] = r.dir
+		n := len(r.data)
+		hdr[9], hdr[10], hdr[11], hdr[12] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+		if _, c.err = c.w.Write(hdr[:]); c.err == nil {
+			_, c.err = c.w.Write(r.data)
+		}
+	}
+}
+
+// record queues a record of b, which it copies, unless too many records
+// are waiting to be written.
+func (c *Capture) record(dir uint8, b []byte) {
+	r := captureRecord{t: time.Now(), dir: dir, data: append([]byte(nil), b...)}
+	select {
+	case c.records <- r:
+	default:
+		atomic.AddInt64(&c.dropped, int64(len(b)))
+	}
+}
+
+// Dropped returns the number of bytes of data which the Capture has
+// dropped rather than written.
+func (c *Capture) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Close writes the records which are waiting to be written, and returns
+// the first error encountered writing records, if any. The relays which
+// record to c must have returned before Close is called.
+func (c *Capture) Close() error {
+	close(c.records)
+	<-c.done
+	return c.err
+}
+
+// RelayStats describes how a Relay has spent its time, and how it read
+// from its sources and wrote to its destinations. Only spliced copies
+// are accounted for.
+type RelayStats struct {
+	// Wait is the time spent waiting for the connections to become
+	// ready to read or write.
+	Wait time.Duration
+
+	// Active is the rest of the time spent relaying data.
+	Active time.Duration
+
+	// ReadWaits is the number of times the relay waited for its
+	// source to become readable.
+	ReadWaits int64
+
+	// Reads is the number of reads from the source which returned
+	// data, and ReadBytes the data they returned.
+	Reads     int64
+	ReadBytes int64
+
+	// WriteWaits is the number of times the relay waited for its
+	// destination to become writable.
+	WriteWaits int64
+
+	// Writes is the number of writes to the destination which took
+	// data, and WriteBytes the data they took.
+	Writes     int64
+	WriteBytes int64
+}
+
+// Stats returns the time spent by all of rl's copies so far. It is
+// meant for diagnosing relays which are starved, or which starve
+// others, when many relays share the runtime's network poller.
+func (rl *Relay) Stats() RelayStats {
+	return RelayStats{
+		Wait:   time.Duration(atomic.LoadInt64(&rl.stats.WaitNanos)),
+		Active: time.Duration(atomic.LoadInt64(&rl.stats.ActiveNanos)),
+
+		ReadWaits: atomic.LoadInt64(&rl.stats.ReadWaits),
+		Reads:     atomic.LoadInt64(&rl.stats.Drains),
+		ReadBytes: atomic.LoadInt64(&rl.stats.DrainedBytes),
+
+		WriteWaits: atomic.LoadInt64(&rl.stats.WriteWaits),
+		Writes:     atomic.LoadInt64(&rl.stats.Pumps),
+		WriteBytes: atomic.LoadInt64(&rl.stats.PumpedBytes),
+	}
+}
+
+// A TxTimestamp is a transmit timestamp of data which a Relay wrote to a
+// TCP connection, as reported to its Timestamps function.
+type TxTimestamp struct {
+	// Offset is the offset in the data copied just past the bytes
+	// stamped, which are the last bytes of one of the copy's writes.
+	Offset int64
+
+	// Acked is set if the timestamp is of the peer acknowledging the
+	// bytes, rather than of their being handed to the network device.
+	Acked bool
+
+	// Software is the time taken by the kernel, and Hardware that
+	// taken by the network device, or zero if it wasn't configured
+	// for timestamps. A device's timestamp may come in a TxTimestamp
+	// of its own.
+	Software, Hardware time.Time
+}
+
+// TCPInfo describes the state of a TCP connection, as reported by the
+// kernel.
+type TCPInfo struct {
+	// RTT is the smoothed round-trip time of the connection, and
+	// RTTVar its mean deviation.
+	RTT, RTTVar time.Duration
+
+	// Retransmits is the number of segments retransmitted over the
+	// life of the connection.
+	Retransmits int64
+
+	// CongestionWindow is the congestion window of the sender, in
+	// segments of MSS bytes.
+	CongestionWindow int
+
+	// MSS is the maximum segment size of the sender, in bytes.
+	MSS int
+}
+
+// A RelayResult describes a copy made by Relay.CopyTCP.
+type RelayResult struct {
+	// Written is the number of bytes copied.
+	Written int64
+
+	// Src and Dst describe the source and destination connections
+	// once the copy ended. They are nil if the system doesn't report
+	// the state of TCP connections, which only Linux does.
+	Src, Dst *TCPInfo
+}
+
+// CopyTCP is like Copy, between two TCP connections, but also captures
+// the state of both connections once the copy ends, including their
+// round-trip times, retransmissions and congestion windows, so that the
+// performance of the copy can be correlated with the conditions of the
+// network. The state is captured even if the copy fails.
+func (rl *Relay) CopyTCP(dst, src *TCPConn) (RelayResult, error) {
+	if !src.ok() || !dst.ok() {
+		return RelayResult{}, syscall.EINVAL
+	}
+	n, err := rl.copy(dst, src, nil)
+	return RelayResult{Written: n, Src: tcpInfo(src.fd), Dst: tcpInfo(dst.fd)}, err
+}
+
+// CopyWithHeader writes header to dst, then copies src to dst as Copy
+// does, such as for a proxy prefixing the connection it relays with a
+// PROXY protocol v2 header. header is written before anything is read
+// from src, so that it is sent even if src stays idle. CopyWithHeader
+// returns the number of bytes copied from src, which does not include
+// header.
+//
+// On Linux, the data is spliced, and header is written under the lock
+// on dst which the splice holds, so that no other write to dst, such as
+// one from a concurrent goroutine, comes between header and the first
+// data copied. Otherwise, header is written on its own before the copy.
+// The Redirected, TimeSlice, DSCP, Transform and DropCache parameters of
+// rl don't apply.
+func (rl *Relay) CopyWithHeader(dst, src *TCPConn, header []byte) (int64, error) {
+	if !dst.ok() || !src.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err, handled := spliceWithHeader(dst.fd, src.fd, header, rl)
+	if !handled {
+		return genericCopyWithHeader(dst, src, header, rl)
+	}
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "readfrom", Net: dst.fd.net, Source: dst.fd.laddr, Addr: dst.fd.raddr, Err: err}
+	}
+	return n, rl.tagError(err)
+}
+
+// Fallback implementation of CopyWithHeader, when splice isn't
+// applicable.
+func genericCopyWithHeader(dst, src *TCPConn, header []byte, rl *Relay) (int64, error) {
+	if _, err := dst.Write(header); err != nil {
+		return 0, rl.tagError(err)
+	}
+	return rl.copy(dst, src, nil)
+}
+
+// Copy copies from src to dst until either EOF is reached on src or an
+// error occurs, like io.Copy. It returns the number of bytes copied and
+// the first error encountered while copying, if any.
+func (rl *Relay) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return rl.copy(dst, src, nil)
+}
+
+// CopyN copies n bytes, or until an error occurs, from src to dst, like
+// io.CopyN. It returns the number of bytes copied and the first error
+// encountered while copying, if any. On return, written == n if and only
+// if err == nil. So a nil error means that the copy stopped at the limit,
+// with src still open, and a further copy can carry on from there, while
+// io.EOF means that src reached EOF before n bytes were copied.
+func (rl *Relay) CopyN(dst io.Writer, src io.Reader, n int64) (written int64, err error) {
+	written, full, err := rl.CopyUpTo(dst, src, n)
+	if !full && err == nil {
+		err = io.EOF
+	}
+	return written, err
+}
+
+// CopyUpTo copies at most n bytes from src to dst, stopping early if src
+// reaches EOF. full reports whether all n bytes were copied, in which
+// case the data following them, if any, is left on src. Unlike CopyN,
+// CopyUpTo doesn't treat a copy cut short by EOF as an error, for
+// callers to which a short copy is acceptable; err is only set if the
+// copy failed.
+func (rl *Relay) CopyUpTo(dst io.Writer, src io.Reader, n int64) (written int64, full bool, err error) {
+	written, err = rl.copy(dst, io.LimitReader(src, n), nil)
+	if err == io.EOF {
+		err = nil
+	}
+	return written, written == n, err
+}
+
+// CopyLength copies a body of the declared length n from src to dst,
+// such as one whose Content-Length a backend declared to a proxy, and
+// checks that src held all of it. CopyLength reads no more than n bytes
+// from src, so that what follows the body, such as the next response on
+// a keep-alive connection, is left on src. If src reaches EOF before n
+// bytes, CopyLength returns a *LengthError.
+//
+// If eof is set, src must also end with the body, as a connection which
+// the backend closes after it does, and CopyLength returns a
+// *LengthError with Long set if src has more data. To find out, it
+// waits for src to reach EOF or to have more data, without writing to
+// dst. A TCPConn is peeked at, as by its Peek method, on systems which
+// support it, and keeps the data past the body. From other sources,
+// CopyLength reads one more byte, which it returns as the Extra of the
+// *LengthError.
+func (rl *Relay) CopyLength(dst io.Writer, src io.Reader, n int64, eof bool) (written int64, err error) {
+	if n < 0 {
+		return 0, syscall.EINVAL
+	}
+	written, full, err := rl.CopyUpTo(dst, src, n)
+	if err != nil {
+		return written, err
+	}
+	if !full {
+		return written, &LengthError{Want: n, Got: written}
+	}
+	if !eof {
+		return written, nil
+	}
+	var b [1]byte
+	if tc, ok := src.(*TCPConn); ok {
+		m, err := tc.Peek(b[:])
+		if m > 0 {
+			return written, &LengthError{Want: n, Got: written, Long: true}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if oe, ok := err.(*OpError); !ok || oe.Err != errNoPeek {
+			return written, rl.tagError(err)
+		}
+	}
+	for {
+		m, err := src.Read(b[:])
+		if m > 0 {
+			return written, &LengthError{Want: n, Got: written, Long: true, Extra: b[:m]}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, rl.tagError(err)
+		}
+	}
+}
+
+// errNoPeek is returned by TCPConn.Peek on systems other than Linux.
+var errNoPeek = errors.New("peek not supported")
+
+// A LengthError is returned by Relay.CopyLength when the body it copies
+// is not of the declared length.
+type LengthError struct {
+	Want int64 // the declared length
+	Got  int64 // the number of bytes copied
+	Long bool  // whether src had more data than Want, rather than less
+
+	// Extra holds the data past the body which CopyLength read from
+	// src to find out that it was long, if any.
+	Extra []byte
+}
+
+func (e *LengthError) Error() string {
+	if e.Long {
+		return "body longer than declared length"
+	}
+	return "body shorter than declared length"
+}
+
+// CopyContext is like Copy, but stops copying once ctx is done. In that
+// case CopyContext returns the number of bytes copied so far and an error
+// describing the cancellation. Data which the relay had read from src but
+// not yet written to dst may be lost.
+func (rl *Relay) CopyContext(ctx context.Context, dst io.Writer, src io.Reader) (n int64, err error) {
+	if ctx.Done() == nil {
+		return rl.copy(dst, src, nil)
+	}
+	rd, _ := src.(interface {
+		SetReadDeadline(time.Time) error
+	})
+	wd, _ := dst.(interface {
+		SetWriteDeadline(time.Time) error
+	})
+
+	// Start the "interrupter" goroutine, which wakes up a copy blocked
+	// on src or dst when ctx is done, by moving their deadlines into
+	// the past.
+	done := make(chan struct{})
+	interruptRes := make(chan bool)
+	defer func() {
+		close(done)
+		if !<-interruptRes {
+			return
+		}
+		if rd != nil {
+			rd.SetReadDeadline(noDeadline)
+		}
+		if wd != nil {
+			wd.SetWriteDeadline(noDeadline)
+		}
+		if err != nil {
+			err = mapErr(ctx.Err())
+			if c, ok := dst.(*TCPConn); ok && c.ok() {
+				err = &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+			}
+			err = rl.tagError(err)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			if rd != nil {
+				rd.SetReadDeadline(aLongTimeAgo)
+			}
+			if wd != nil {
+				wd.SetWriteDeadline(aLongTimeAgo)
+			}
+			interruptRes <- true
+		case <-done:
+			interruptRes <- false
+		}
+	}()
+	return rl.copy(dst, src, ctx.Done())
+}
+
+// A RelayGroup runs copies which live and die together, such as the two
+// directions of a proxied connection. The first copy to fail cancels the
+// others, which then return, releasing their kernel buffers. A copy which
+// reaches EOF on its source leaves the others running.
+//
+// A RelayGroup must be created with NewRelayGroup.
+type RelayGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// NewRelayGroup returns a RelayGroup whose copies are canceled once ctx is
+// done, or once one of them fails.
+func NewRelayGroup(ctx context.Context) *RelayGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &RelayGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go copies from src to dst with rl, which may be nil, in a new goroutine,
+// like rl.CopyContext with the group's context.
+func (g *RelayGroup) Go(rl *Relay, dst io.Writer, src io.Reader) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if _, err := rl.CopyContext(g.ctx, dst, src); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait waits for all of the group's copies to return, and returns the
+// first error encountered, if any. A copy canceled because another failed
+// returns an error too, but that error is not the first.
+func (g *RelayGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+func (rl *Relay) copy(dst io.Writer, src io.Reader, done <-chan struct{}) (int64, error) {
+	n, err := rl.copyUntagged(dst, src, done)
+	return n, rl.tagError(err)
+}
+
+func (rl *Relay) copyUntagged(dst io.Writer, src io.Reader, done <-chan struct{}) (int64, error) {
+	var account func(int64) error
+	if rl != nil {
+		account = rl.Account
+	}
+	var fd *netFD
+	switch c := dst.(type) {
+	case *TCPConn:
+		if c.ok() {
+			fd = c.fd
+		}
+	case *UnixConn:
+		if c.ok() {
+			fd = c.fd
+		}
+	case SpliceConn:
+		if sfd, release, ok := spliceConnFD(c); ok {
+			defer release()
+			fd = sfd
+		}
+	case *os.File:
+		if sfd, release, ok := spliceFileFD(c); ok {
+			defer release()
+			fd = sfd
+		}
+	}
+	var end time.Time
+	if rl != nil && rl.TimeSlice > 0 {
+		end = time.Now().Add(rl.TimeSlice)
+		r := src
+		if lr, ok := r.(*io.LimitedReader); ok {
+			r = lr.R
+		}
+		if rd, ok := r.(interface {
+			SetReadDeadline(time.Time) error
+		}); ok {
+			rd.SetReadDeadline(end)
+			defer rd.SetReadDeadline(noDeadline)
+		}
+	}
+	if fd != nil && rl != nil && rl.DSCP > 0 {
+		restore, err := setDSCP(fd, rl.DSCP)
+		if err != nil {
+			return 0, &OpError{Op: "set", Net: fd.net, Source: nil, Addr: fd.laddr, Err: err}
+		}
+		defer restore()
+	}
+	if rl != nil && rl.Transform != nil && !rl.Transform.Passthrough() {
+		return transformCopy(rl.Transform, dst, sliceReader(rl.captureReader(rl.inspectReader(src)), end), account)
+	}
+	if fd != nil {
+		n, err, handled := splice(fd, src, rl, done, end)
+		how := "splice"
+		if !handled && strategyAllowsSendfile(rl) && (rl == nil || !rl.watchesWrites() && !rl.Downgraded()) && end.IsZero() {
+			if rl != nil && rl.DropCache {
+				n, err, handled = sendFileDropCache(fd, src)
+			} else {
+				n, err, handled = sendFile(fd, src)
+			}
+			how = "sendfile"
+		}
+		if !handled {
+			n, err, handled = spliceFile(fd, src, rl, done, end)
+			how = "splice"
+		}
+		if handled {
+			testHookReadFrom(how)
+			if err == ErrSliceExpired {
+				return n, err
+			}
+			if err != nil && err != io.EOF {
+				err = &OpError{Op: "readfrom", Net: fd.net, Source: fd.laddr, Addr: fd.raddr, Err: err}
+			}
+			return n, err
+		}
+	}
+	src = sliceReader(rl.captureReader(rl.inspectReader(src)), end)
+	if rl != nil && rl.Budget != nil {
+		dst = &budgetWriter{w: dst, budget: rl.Budget, done: done}
+	}
+	if account != nil {
+		// Hiding the ReadFrom method of dst keeps io.Copy from
+		// using sendfile.
+		dst = &accountWriter{w: dst, account: account}
+	} else if rl.Downgraded() {
+		// Hiding the ReadFrom method of dst keeps io.Copy from
+		// splicing, which the relay no longer does.
+		dst = writerOnly{dst}
+	} else if fd != nil && rl != nil && rl.MaxSpliceFDs > 0 {
+		// Nor may io.Copy splice past the relay's limit.
+		dst = writerOnly{dst}
+	} else if fd != nil && rl.strategy() != AutoStrategy {
+		// Nor may io.Copy use a system call which the relay's
+		// strategy rules out.
+		dst = writerOnly{dst}
+		testHookReadFrom("generic")
+	}
+	n, err := io.Copy(dst, src)
+	// The ReadFrom method of a connection wraps the error.
+	if oe, ok := err.(*OpError); ok && oe.Err == ErrSliceExpired {
+		err = ErrSliceExpired
+	}
+	return n, err
+}
+
+// inspectReader returns src, or, if rl has an Inspect buffer, a reader
+// which copies the start of what it reads from src into the buffer.
+func (rl *Relay) inspectReader(src io.Reader) io.Reader {
+	if rl == nil || len(rl.Inspect) == 0 {
+		return src
+	}
+	return &inspectReader{r: src, buf: rl.Inspect}
+}
+
+// An inspectReader copies the data read from r into buf until buf is
+// full.
+type inspectReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (ir *inspectReader) Read(b []byte) (int, error) {
+	n, err := ir.r.Read(b)
+	m := copy(ir.buf, b[:n])
+	ir.buf = ir.buf[m:]
+	return n, err
+}
+
+// sliceReader returns src, or, if end is not zero, a reader which reads
+// from src until end, and then fails with ErrSliceExpired.
+func sliceReader(src io.Reader, end time.Time) io.Reader {
+	if end.IsZero() {
+		return src
+	}
+	return &timeSliceReader{r: src, end: end}
+}
+
+type timeSliceReader struct {
+	r   io.Reader
+	end time.Time
+}
+
+func (sr *timeSliceReader) Read(b []byte) (int, error) {
+	if !time.Now().Before(sr.end) {
+		return 0, ErrSliceExpired
+	}
+	n, err := sr.r.Read(b)
+	// A read interrupted by the deadline of the slice ends it.
+	if ne, ok := err.(Error); ok && ne.Timeout() && !time.Now().Before(sr.end) {
+		err = ErrSliceExpired
+	}
+	return n, err
+}
+
+// watchesWrites reports whether rl has to see the data written by its
+// copies as they go, which sendfile doesn't allow.
+func (rl *Relay) watchesWrites() bool {
+	return rl.Account != nil || rl.Budget != nil || len(rl.Inspect) > 0 || rl.Capture != nil
+}
+
+// captureReader returns src, or, if rl has a Capture, a reader which
+// records what it reads from src in the Capture.
+func (rl *Relay) captureReader(src io.Reader) io.Reader {
+	if rl == nil || rl.Capture == nil {
+		return src
+	}
+	return &captureReader{r: src, c: rl.Capture, dir: rl.CaptureDirection}
+}
+
+type captureReader struct {
+	r   io.Reader
+	c   *Capture
+	dir uint8
+}
+
+func (cr *captureReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	if n > 0 {
+		cr.c.record(cr.dir, b[:n])
+	}
+	return n, err
+}
+
+// A budgetWriter paces the writes to w to budget, splitting them as the
+// budget allows. It fails a write with errCanceled if done is closed
+// while it waits.
+type budgetWriter struct {
+	w      io.Writer
+	budget *OutputBudget
+	done   <-chan struct{}
+}
+
+func (bw *budgetWriter) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, wait := bw.budget.Available(len(b) - written)
+		if n == 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-bw.done:
+				t.Stop()
+				return written, errCanceled
+			}
+			continue
+		}
+		n, err := bw.w.Write(b[written : written+n])
+		written += n
+		bw.budget.Spend(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// An accountWriter passes the running total of the bytes written to w
+// to account after each write, and fails the write with the error
+// account returns, if any.
+type accountWriter struct {
+	w       io.Writer
+	account func(written int64) error
+	written int64
+}
+
+func (aw *accountWriter) Write(b []byte) (int, error) {
+	n, err := aw.w.Write(b)
+	aw.written += int64(n)
+	if err == nil {
+		err = aw.account(aw.written)
+	}
+	return n, err
+}
+
+// transformCopy copies src to dst through the writer of t. It returns
+// the number of bytes read from src, since the size of the transformed
+// data has no bearing on how far the copy got. If account is not nil,
+// it is passed the bytes read so far as they are handed to the writer.
+func transformCopy(t Transformer, dst io.Writer, src io.Reader, account func(int64) error) (int64, error) {
+	w := t.NewWriter(dst)
+	var cw io.Writer = w
+	if account != nil {
+		cw = &accountWriter{w: w, account: account}
+	}
+	n, err := io.Copy(cw, src)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// SpliceFDs returns the number of file descriptors held by the kernel
+// buffers of spliced copies, both those in progress and those kept for
+// reuse by later copies. Each buffer is a pipe, which holds two file
+// descriptors. SpliceFDs returns 0 on systems without splice.
+func SpliceFDs() int {
+	return spliceFDs()
+}
+
+// SplicePipePoolCounts holds the numbers of kernel buffers which spliced
+// copies have reused and allocated, as returned by SplicePipePool.
+type SplicePipePoolCounts struct {
+	Hits   uint64 // a buffer kept for reuse was taken
+	Misses uint64 // a new buffer was allocated
+}
+
+// SplicePipePool returns the numbers of kernel buffers which spliced
+// copies have taken from those kept for reuse, and which they have had to
+// allocate, since the program started. A low share of hits under load
+// means that buffers are rarely reused, such as when buffers holding
+// residual data are discarded. SplicePipePool returns zero counts on
+// systems without splice.
+func SplicePipePool() SplicePipePoolCounts {
+	return splicePipePool()
+}
+
+// SpliceEndCounts holds the numbers of spliced copies which ended in
+// each way, as returned by SpliceEnds.
+type SpliceEndCounts struct {
+	EOF      uint64 // the source reached EOF, and its data was all written
+	Limit    uint64 // the copy reached its limit, as set by CopyN or an io.LimitedReader
+	Canceled uint64 // the copy was canceled, as by its context
+	Expired  uint64 // the time slice of the Relay ended
+	Errors   uint64 // the copy failed
+}
+
+// SpliceEnds returns the numbers of spliced copies between connections,
+// by Relays and by ReadFrom, which have ended in each way since the
+// program started. Together they show how relays typically end: a
+// rising share of errors points at a problem. SpliceEnds returns zero
+// counts on systems without splice.
+func SpliceEnds() SpliceEndCounts {
+	return spliceEnds()
+}
+
+// OptimalSpliceChunk returns a recommended size, in bytes, for the kernel
+// buffer of a spliced copy from src to dst, and so for the data moved by
+// each splice, such as for the PipeSize of SpliceOptions. It is derived
+// from the receive buffer of src, the send buffer of dst and the sizes
+// which pipes can have, and is meant for tuning relays and diagnosing
+// slow ones; copies don't consult it. The size is a power of two, and is
+// no larger than the smaller of the two socket buffers, so that a
+// splice neither waits for more data than src can queue nor hands dst
+// more than it can take. Connections whose buffers can't be read leave
+// the size to the pipe. OptimalSpliceChunk returns 0 on systems without
+// splice.
+func OptimalSpliceChunk(src, dst Conn) int {
+	return optimalSpliceChunk(src, dst)
+}
+
+// A SpliceLimitPolicy selects what a spliced copy by a Relay which needs
+// a new kernel buffer does once the buffers hold the file descriptors
+// allowed by its MaxSpliceFDs.
+type SpliceLimitPolicy int
+
+const (
+	// FallbackAtLimit copies through userspace instead. It is the
+	// default.
+	FallbackAtLimit SpliceLimitPolicy = iota
+
+	// WaitAtLimit waits until another copy is done with its buffer.
+	// The copy holds no lock on its connections while it waits, and
+	// fails as soon as it would otherwise: once the source or the
+	// destination is closed or its deadline passes, which is checked
+	// every 10ms, or the copy is canceled, as by Relay.CopyContext.
+	WaitAtLimit
+
+	// ExceedLimit takes a new buffer regardless of the limit.
+	ExceedLimit
+)
+
+// IsRetryableSpliceError reports whether err, an error returned by a
+// copy such as the ReadFrom method of TCPConn or Relay.Copy, comes from a
+// transient shortage or interruption, such as ENOMEM from splice when the
+// kernel could not allocate pipe buffers, so that the copy may succeed if
+// it is tried again. Errors which leave a connection unusable, such as
+// ECONNRESET and EPIPE, are not retryable, and neither are errors which
+// don't come from a system call.
+func IsRetryableSpliceError(err error) bool {
+	if oe, ok := err.(*OpError); ok {
+		err = oe.Err
+	}
+	if re, ok := err.(*RelayError); ok {
+		err = re.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return retryableErrno(err)
+}
+
+// A SpliceStrategy selects the system calls with which a Relay copies
+// data to a connection without copying it through userspace.
+type SpliceStrategy int
+
+const (
+	// AutoStrategy splices data whose source is a socket or a
+	// pseudo-terminal, uses sendfile for data whose source is a
+	// regular file or a block device, and copies everything else
+	// through userspace. It is the default.
+	AutoStrategy SpliceStrategy = iota
+
+	// SendfileOnlyStrategy uses sendfile where AutoStrategy does,
+	// and copies everything else through userspace.
+	SendfileOnlyStrategy
+
+	// SpliceOnlyStrategy splices data where AutoStrategy does, and
+	// also splices data whose source is a regular file or a block
+	// device through a pipe instead of using sendfile.
+	SpliceOnlyStrategy
+
+	// GenericStrategy copies all data through userspace.
+	GenericStrategy
+)
+
+// strategy returns the SpliceStrategy of rl, which may be nil.
+func (rl *Relay) strategy() SpliceStrategy {
+	if rl == nil || rl.Strategy == AutoStrategy {
+		return testHookSpliceStrategy
+	}
+	return rl.Strategy
+}
+
+// strategyAllowsSplice reports whether the SpliceStrategy of rl, which
+// may be nil, lets copies use splice.
+func strategyAllowsSplice(rl *Relay) bool {
+	s := rl.strategy()
+	return s == AutoStrategy || s == SpliceOnlyStrategy
+}
+
+// strategyAllowsSendfile reports whether the SpliceStrategy of rl,
+// which may be nil, lets copies use sendfile.
+func strategyAllowsSendfile(rl *Relay) bool {
+	s := rl.strategy()
+	return s == AutoStrategy || s == SendfileOnlyStrategy
+}
+
+// A SpliceConn is a connection, typically one wrapping a TCP connection,
+// whose data a Relay, or the ReadFrom method of a TCPConn, may move
+// directly to or from the socket underlying it. On Linux, such copies use
+// the splice system call and bypass the Read and Write methods of the
+// SpliceConn.
+//
+// If SyscallConn returns the raw connection of a TCPConn, the copy honors
+// the deadlines of that TCPConn. Otherwise the copy uses a duplicate of
+// the descriptor passed to the Control method of the raw connection, which
+// is put into non-blocking mode.
+type SpliceConn interface {
+	Conn
+	syscall.Conn
+
+	// CanSplice reports whether the connection's data may currently
+	// be moved directly to and from its socket. It should return
+	// false while the connection holds data of its own, such as data
+	// it has read ahead, or if it transforms the data it reads or
+	// writes.
+	CanSplice() bool
+}
+
+// A Splicer transfers framed data from a TCP connection to other TCP
+// connections. On Linux, it uses the splice system call and keeps the
+// data it has read from the source, but not yet transferred, in a kernel
+// buffer between calls. The data following a transfer, such as the
+// header of the next frame, can then be read with Buffered.
+//
+// A Splicer is not safe for concurrent use, except for its Pause and
+// Resume methods.
+type Splicer struct {
+	// Combine, if positive, makes the Splicer combine the writes of
+	// consecutive transfers to the same destination, such as the
+	// payloads of many small frames. Rather than writing the data it
+	// transfers, SpliceTo holds it in the Splicer's kernel buffer
+	// until Combine bytes, or as much as the buffer takes, have built
+	// up, and then writes it in one burst, in as few TCP segments as
+	// possible. Flush writes the data held so far. A transfer to
+	// another destination, the reader returned by Buffered, Abort,
+	// CloseWith and Close write it as well. An error writing the data
+	// held is returned by the call which writes it.
+	//
+	// Combine has no effect on systems other than Linux.
+	Combine int
+
+	src  *TCPConn
+	s    splicer
+	hold spliceHold
+}
+
+// NewSplicer returns a Splicer which reads from src.
+func NewSplicer(src *TCPConn) *Splicer {
+	return &Splicer{src: src}
+}
+
+// SpliceTo transfers exactly n bytes from the Splicer's source to dst.
+// It returns the number of bytes transferred and the first error
+// encountered, if any. SpliceTo returns io.EOF if the source reaches EOF
+// before n bytes have been transferred.
+func (sp *Splicer) SpliceTo(dst *TCPConn, n int64) (int64, error) {
+	if !sp.src.ok() || !dst.ok() {
+		return 0, syscall.EINVAL
+	}
+	if held := sp.s.combinedDst(); held != nil && (held != dst || sp.Combine <= 0) {
+		if err := sp.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	written, err := sp.s.spliceTo(dst, sp.src, n, sp.Combine, &sp.hold)
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "readfrom", Net: dst.fd.net, Source: dst.fd.laddr, Addr: dst.fd.raddr, Err: err}
+	}
+	return written, err
+}
+
+// Flush writes the data which the Splicer holds to combine writes, if
+// any, to the destination it was transferred to. See Combine.
+func (sp *Splicer) Flush() error {
+	dst := sp.s.combinedDst()
+	if dst == nil {
+		return nil
+	}
+	if _, err := sp.s.flushCombined(); err != nil {
+		return &OpError{Op: "write", Net: dst.fd.net, Source: dst.fd.laddr, Addr: dst.fd.raddr, Err: err}
+	}
+	return nil
+}
+
+// Pause holds the transfers of the Splicer, such as when a flow
+// controller learns out of band that the destination is congested. A
+// SpliceTo in progress in another goroutine stops before its next read
+// from the source or write to the destination, and a later SpliceTo
+// waits before its first, until Resume is called. The data which the
+// Splicer has read from the source is held in its kernel buffer. Once
+// that buffer and the receive buffer of the source are full, TCP flow
+// control stops the peer of the source from sending more. The
+// connections and the kernel buffer stay open while paused.
+//
+// A held SpliceTo doesn't notice the deadlines or the closing of its
+// connections until the Splicer is resumed. Pause may be called from
+// any goroutine; pausing a paused Splicer has no effect.
+func (sp *Splicer) Pause() {
+	sp.hold.pause()
+}
+
+// Resume lets the transfers held by Pause continue. Resume may be called
+// from any goroutine; resuming a Splicer which is not paused has no
+// effect.
+func (sp *Splicer) Resume() {
+	sp.hold.resume()
+}
+
+// A spliceHold holds the transfers of a paused Splicer.
+type spliceHold struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed by resume; nil unless paused
+}
+
+func (h *spliceHold) pause() {
+	h.mu.Lock()
+	if h.resumed == nil {
+		h.resumed = make(chan struct{})
+	}
+	h.mu.Unlock()
+}
+
+func (h *spliceHold) resume() {
+	h.mu.Lock()
+	if h.resumed != nil {
+		close(h.resumed)
+		h.resumed = nil
+	}
+	h.mu.Unlock()
+}
+
+// wait blocks while h is paused.
+func (h *spliceHold) wait() {
+	h.mu.Lock()
+	resumed := h.resumed
+	h.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// A heldReader reads from r once h lets it.
+type heldReader struct {
+	r io.Reader
+	h *spliceHold
+}
+
+func (hr heldReader) Read(b []byte) (int, error) {
+	hr.h.wait()
+	return hr.r.Read(b)
+}
+
+// Buffered returns a reader over the data which the Splicer has read
+// from its source but not yet transferred. The reader returns io.EOF
+// once that data is exhausted; any further data must be read from the
+// source connection itself.
+func (sp *Splicer) Buffered() io.Reader {
+	return splicerBuffer{sp}
+}
+
+// Close releases the resources held by the Splicer, discarding any
+// buffered data, once it has written the data held to combine writes.
+// It does not close the source connection.
+func (sp *Splicer) Close() error {
+	err := sp.Flush()
+	if cerr := sp.s.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Abort stops using the Splicer, for instance after a protocol error.
+// It moves the data which the Splicer has read from its source but not
+// transferred into b, and releases the Splicer's resources, like Close.
+// The data is removed from the Splicer's buffer; it is not returned to
+// the source connection, which remains open, and from which the data
+// following it can be read as usual.
+//
+// If b is too small to hold all of the buffered data, Abort fills b and
+// returns io.ErrShortBuffer. The rest of the data can be recovered by
+// calling Abort again.
+func (sp *Splicer) Abort(b []byte) (int, error) {
+	if m := sp.s.buffered(); len(b) > m {
+		b = b[:m]
+	} else if len(b) < m {
+		n, err := io.ReadFull(sp.Buffered(), b)
+		if err == nil {
+			err = io.ErrShortBuffer
+		}
+		return n, err
+	}
+	n, err := io.ReadFull(sp.Buffered(), b)
+	if err != nil {
+		return n, err
+	}
+	return n, sp.Close()
+}
+
+// A ResidualPolicy selects what Splicer.CloseWith does with the data
+// which a Splicer has read from its source but not yet transferred.
+type ResidualPolicy int
+
+const (
+	// DiscardResidual discards the data, as Close does.
+	DiscardResidual ResidualPolicy = iota
+
+	// FlushResidual transfers the data to a destination
+	// connection before closing, as a final SpliceTo would.
+	FlushResidual
+
+	// DrainResidual returns the data to the caller, as Abort does.
+	DrainResidual
+)
+
+// CloseWith releases the resources held by the Splicer, like Close, once
+// it has disposed of the data it has read from its source but not
+// transferred according to policy. With FlushResidual, the data is
+// transferred to dst, which is otherwise unused; if that fails, the data
+// not transferred is returned in residual along with the error. With
+// DrainResidual, the data is returned in residual. CloseWith does not
+// close the source connection.
+func (sp *Splicer) CloseWith(policy ResidualPolicy, dst *TCPConn) (residual []byte, err error) {
+	if err := sp.Flush(); err != nil {
+		sp.s.close()
+		return nil, err
+	}
+	switch policy {
+	case DiscardResidual:
+	case FlushResidual:
+		if !dst.ok() {
+			err = syscall.EINVAL
+			break
+		}
+		if _, err = sp.s.flush(dst); err != nil {
+			err = &OpError{Op: "write", Net: dst.fd.net, Source: dst.fd.laddr, Addr: dst.fd.raddr, Err: err}
+		}
+	case DrainResidual:
+	default:
+		return nil, syscall.EINVAL
+	}
+	if policy == DrainResidual || err != nil {
+		residual = make([]byte, sp.s.buffered())
+		n, rerr := io.ReadFull(sp.Buffered(), residual)
+		residual = residual[:n]
+		if err == nil {
+			err = rerr
+		}
+	}
+	if cerr := sp.Close(); err == nil {
+		err = cerr
+	}
+	return residual, err
+}
+
+type splicerBuffer struct {
+	sp *Splicer
+}
+
+func (b splicerBuffer) Read(p []byte) (int, error) {
+	// The data held to combine writes precedes the buffered data.
+	if err := b.sp.Flush(); err != nil {
+		return 0, err
+	}
+	n, err := b.sp.s.readBuffered(p)
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "read", Net: b.sp.src.fd.net, Source: b.sp.src.fd.laddr, Addr: b.sp.src.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// Fallback implementation of Splicer's SpliceTo, when splice isn't
+// applicable. The copy waits for h before each read from src.
+func genericSpliceTo(dst, src *TCPConn, n int64, h *spliceHold) (int64, error) {
+	return io.CopyN(dst, heldReader{src, h}, n)
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// boundDevice returns the interface to which c is bound with
+// SO_BINDTODEVICE, if any.
+func boundDevice(t *testing.T, c *TCPConn) string {
+	t.Helper()
+	var b [syscall.IFNAMSIZ]byte
+	size := uint32(len(b))
+	var err error
+	if cerr := c.fd.pfd.RawControl(func(s uintptr) {
+		err = getsockopt(int(s), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, unsafe.Pointer(&b[0]), &size)
+	}); cerr != nil || err != nil {
+		t.Fatalf("SO_BINDTODEVICE: %v, %v", cerr, err)
+	}
+	if i := bytes.IndexByte(b[:size], 0); i >= 0 {
+		size = uint32(i)
+	}
+	return string(b[:size])
+}
+
+// boundSocket returns a TCP socket bound to the interface dev.
+func boundSocket(dev string) (int, error) {
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.BindToDevice(s, dev); err != nil {
+		syscall.Close(s)
+		return -1, err
+	}
+	return s, nil
+}
+
+// fileTCPConn returns a *TCPConn for the socket s, which it closes.
+func fileTCPConn(s int) (*TCPConn, error) {
+	f := os.NewFile(uintptr(s), "")
+	defer f.Close()
+	c, err := FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*TCPConn), nil
+}
+
+// boundTCPPair returns the two ends of a loopback TCP connection made
+// between sockets bound to the interface dev before they were connected.
+// The accepted end inherits the binding of its listener.
+func boundTCPPair(dev string) (client, server *TCPConn, err error) {
+	ls, err := boundSocket(dev)
+	if err != nil {
+		return nil, nil, err
+	}
+	lf := os.NewFile(uintptr(ls), "")
+	defer lf.Close()
+	if err := syscall.Bind(ls, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.Listen(ls, 1); err != nil {
+		return nil, nil, err
+	}
+	ln, err := FileListener(lf)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	cs, err := boundSocket(dev)
+	if err != nil {
+		return nil, nil, err
+	}
+	a := ln.Addr().(*TCPAddr)
+	sa := &syscall.SockaddrInet4{Port: a.Port}
+	copy(sa.Addr[:], a.IP.To4())
+	if err := syscall.Connect(cs, sa); err != nil {
+		syscall.Close(cs)
+		return nil, nil, err
+	}
+	if client, err = fileTCPConn(cs); err != nil {
+		return nil, nil, err
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, c.(*TCPConn), nil
+}
+
+// TestSpliceBoundToDevice checks that connections whose sockets are bound
+// to an interface with SO_BINDTODEVICE, as those of a multi-homed proxy
+// are, are spliced like any others, and stay bound.
+func TestSpliceBoundToDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("SO_BINDTODEVICE requires root")
+	}
+	const dev = "lo"
+	clientUp, serverUp, err := boundTCPPair(dev)
+	if err != nil {
+		t.Skipf("binding to %s: %v", dev, err)
+	}
+	defer clientUp.Close()
+	defer serverUp.Close()
+	clientDown, serverDown, err := boundTCPPair(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDown.Close()
+	defer serverDown.Close()
+	conns := []*TCPConn{clientUp, serverUp, clientDown, serverDown}
+	for i, c := range conns {
+		if got := boundDevice(t, c); got != dev {
+			t.Fatalf("connection %d is bound to %q; want %q", i, got, dev)
+		}
+	}
+
+	var how string
+	defer func() { testHookReadFrom = func(string) {} }()
+	testHookReadFrom = func(h string) { how = h }
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	go func() {
+		clientUp.Write(data)
+		clientUp.CloseWrite()
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(clientDown)
+		readDone <- b
+	}()
+	n, err := serverDown.ReadFrom(serverUp)
+	if n != int64(len(data)) || err != nil {
+		t.Fatalf("ReadFrom = %d, %v; want %d, <nil>", n, err, len(data))
+	}
+	serverDown.CloseWrite()
+	if got := <-readDone; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+	if how != "splice" {
+		t.Errorf("ReadFrom copied with %q; want splice", how)
+	}
+	for i, c := range conns {
+		if got := boundDevice(t, c); got != dev {
+			t.Errorf("after the splice, connection %d is bound to %q; want %q", i, got, dev)
+		}
+	}
+}
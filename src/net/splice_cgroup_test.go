@@ -0,0 +1,219 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,amd64
+
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// cgroupMount returns the mount point of the cgroup hierarchy of the
+// given file system type, "cgroup2" or "cgroup", with the given option
+// among its mount options, if any.
+func cgroupMount(fstype, option string) (string, bool) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[2] != fstype {
+			continue
+		}
+		if option == "" {
+			return fields[1], true
+		}
+		for _, o := range strings.Split(fields[3], ",") {
+			if o == option {
+				return fields[1], true
+			}
+		}
+	}
+	return "", false
+}
+
+// newThrottledCgroup creates a cgroup in which reads from the block
+// device dev are limited to bps bytes a second, with the io.max of
+// cgroup v2 or, failing that, the blkio controller of cgroup v1. It
+// returns the file to which a process writes its pid to join the cgroup,
+// and a function removing the cgroup once its processes are gone.
+func newThrottledCgroup(dev string, bps int) (procs string, remove func(), err error) {
+	name := fmt.Sprintf("go-splice-test-%d", os.Getpid())
+	if root, ok := cgroupMount("cgroup2", ""); ok {
+		controllers, _ := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+		if bytes.Contains(controllers, []byte("io")) {
+			ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+io"), 0)
+			dir := filepath.Join(root, name)
+			if err := os.Mkdir(dir, 0755); err == nil {
+				limit := fmt.Sprintf("%s rbps=%d", dev, bps)
+				if err := ioutil.WriteFile(filepath.Join(dir, "io.max"), []byte(limit), 0); err == nil {
+					return filepath.Join(dir, "cgroup.procs"), func() { os.Remove(dir) }, nil
+				}
+				os.Remove(dir)
+			}
+		}
+	}
+	if root, ok := cgroupMount("cgroup", "blkio"); ok {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return "", nil, err
+		}
+		limit := fmt.Sprintf("%s %d", dev, bps)
+		if err := ioutil.WriteFile(filepath.Join(dir, "blkio.throttle.read_bps_device"), []byte(limit), 0); err != nil {
+			os.Remove(dir)
+			return "", nil, err
+		}
+		return filepath.Join(dir, "cgroup.procs"), func() { os.Remove(dir) }, nil
+	}
+	return "", nil, errors.New("no io controller")
+}
+
+// blockDevice returns the major and minor numbers of the disk holding
+// the file system of f, which is what a cgroup throttles.
+func blockDevice(f *os.File) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return "", err
+	}
+	major, minor := (st.Dev>>8)&0xfff|(st.Dev>>32)&^0xfff, st.Dev&0xff|(st.Dev>>12)&^0xff
+	if major == 0 {
+		return "", errors.New("not on a block device")
+	}
+	sys := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		// Throttling applies to whole disks only.
+		b, err := ioutil.ReadFile(filepath.Join(sys, "..", "dev"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// TestSpliceFromThrottledFile splices a file to a socket in a cgroup
+// which throttles reads from the file's disk. A throttled read sleeps in
+// the kernel, so the transfer proceeds at the throttled rate without
+// keeping a CPU busy.
+func TestSpliceFromThrottledFile(t *testing.T) {
+	const (
+		size = 4 << 20
+		bps  = 2 << 20
+	)
+	if name := os.Getenv("GOTEST_SPLICE_CGROUP_FILE"); name != "" {
+		// In child process, in the cgroup: splice the file to a
+		// connection and report the time taken and the CPU time
+		// used on stdout.
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// Reads which hit the page cache aren't throttled.
+		const fadvDontNeed = 4
+		if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0); errno != 0 {
+			fmt.Fprintln(os.Stderr, "fadvise:", errno)
+			os.Exit(1)
+		}
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(srv.serverUp)
+			readDone <- b
+		}()
+		var r0, r1 syscall.Rusage
+		syscall.Getrusage(syscall.RUSAGE_SELF, &r0)
+		start := time.Now()
+		n, err := (&Relay{Strategy: SpliceOnlyStrategy}).Copy(srv.clientUp, f)
+		elapsed := time.Since(start)
+		syscall.Getrusage(syscall.RUSAGE_SELF, &r1)
+		if err != nil || n != size {
+			fmt.Fprintf(os.Stderr, "Copy = %d, %v; want %d, <nil>\n", n, err, size)
+			os.Exit(1)
+		}
+		srv.clientUp.(*TCPConn).CloseWrite()
+		want, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if got := <-readDone; !bytes.Equal(got, want) {
+			fmt.Fprintf(os.Stderr, "received %d bytes differ from the %d bytes of the file\n", len(got), len(want))
+			os.Exit(1)
+		}
+		cpu := syscall.TimevalToNsec(r1.Utime) - syscall.TimevalToNsec(r0.Utime) + syscall.TimevalToNsec(r1.Stime) - syscall.TimevalToNsec(r0.Stime)
+		fmt.Printf("%d %d", elapsed, cpu)
+		os.Exit(0)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("cgroups require root")
+	}
+	f, err := ioutil.TempFile("", "splice-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	// Only data on disk can be dropped from the page cache.
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := blockDevice(f)
+	if err != nil {
+		t.Skipf("temporary directory: %v", err)
+	}
+	procs, remove, err := newThrottledCgroup(dev, bps)
+	if err != nil {
+		t.Skipf("setting up throttled cgroup: %v", err)
+	}
+	defer remove()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `echo $$ > "$1" && exec "$2" -test.run=^TestSpliceFromThrottledFile$`, "sh", procs, os.Args[0])
+	cmd.Env = append(os.Environ(), "GOTEST_SPLICE_CGROUP_FILE="+f.Name())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("child: %v: %s", err, stderr.Bytes())
+	}
+	var elapsed, cpu time.Duration
+	if _, err := fmt.Sscan(stdout.String(), &elapsed, &cpu); err != nil {
+		t.Fatalf("child reported %q: %v", stdout.String(), err)
+	}
+	t.Logf("spliced %d bytes in %v, using %v of CPU", size, elapsed, cpu)
+	// The throttle lets a burst through before it applies.
+	if min := time.Duration(size/bps) * time.Second / 2; elapsed < min {
+		t.Skipf("transfer took %v; the reads were not throttled", elapsed)
+	}
+	if cpu > elapsed/4 {
+		t.Errorf("transfer used %v of CPU in %v; want most of it spent sleeping", cpu, elapsed)
+	}
+}
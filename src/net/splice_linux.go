@@ -0,0 +1,1033 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"internal/poll"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// spliceTrace makes every splice print a line describing its outcome to
+// standard error: the descriptors, whether the data was spliced, and if
+// so, the number of bytes moved, the size of the pipe, the send buffer
+// of c if it was small enough to slow the transfer down, and how the
+// transfer ended. A splice which the kernel does by copying the data is
+// preceded by a line saying so. It is set by GODEBUG=splicetrace=1.
+var spliceTrace = goDebugString("splicetrace") == "1"
+
+func init() {
+	if spliceTrace {
+		poll.SpliceTrace = func(dst, src int, written int64, pipeSize, sendBuf int, end, id string) {
+			traceSplice(dst, src, id)
+			print(" = ", written, " bytes, pipe ", pipeSize, ", ")
+			if sendBuf > 0 {
+				print("small send buffer ", sendBuf, ", ")
+			}
+			print(end, "\n")
+		}
+	}
+}
+
+// traceSplice prints the start of a trace line about a splice from the
+// descriptor src to dst, made by the relay with the given ID, if any.
+func traceSplice(dst, src int, id string) {
+	print("go package net: splice(", dst, " <- ", src, ")")
+	if id != "" {
+		print(" relay ", id)
+	}
+}
+
+// traceFD returns the descriptor of fd for a trace line if spliceTrace
+// is set, or else -1. The descriptor is read without a reference to fd,
+// which races with a concurrent Close, so only a trace reads it.
+func traceFD(fd *netFD) int {
+	if !spliceTrace {
+		return -1
+	}
+	return fd.pfd.Sysfd
+}
+
+// traceNotSpliced prints the reason why a copy from src, a descriptor or
+// -1 if r has none, to c by the relay with the given ID was not spliced,
+// if spliceTrace is set.
+func traceNotSpliced(c *netFD, src int, id, why string) {
+	if spliceTrace {
+		traceSplice(c.pfd.Sysfd, src, id)
+		print(": not spliced, ", why, "\n")
+	}
+}
+
+// traceCopied prints a line saying that the kernel copies the data of a
+// splice from the descriptor src to dst by the relay with the given ID,
+// if spliceTrace is set and it does. Checking the descriptors costs two
+// system calls, which only the trace is worth.
+func traceCopied(dst, src int, id string) {
+	if spliceTrace && !spliceIsZeroCopy(dst, src) {
+		traceSplice(dst, src, id)
+		print(": copied by the kernel\n")
+	}
+}
+
+// spliceIsZeroCopy reports whether splicing from the descriptor src to
+// dst moves the data between them by reference. For some kinds of files
+// the kernel accepts the splice but copies the data into or out of the
+// pipe, which spares the copies through userspace but not the copy
+// itself. The known combinations are:
+//
+//	- sockets, at either end: the pipe takes and gives references to
+//	  the pages of the socket buffers;
+//	- a regular file as the source: the pipe takes references to the
+//	  page cache;
+//	- a pipe as the destination: the pipe's buffers are moved to it;
+//	- a regular file as the destination: the data is copied into the
+//	  page cache;
+//	- a pseudo-terminal master, or any other character device, at
+//	  either end: the kernel reads or writes it through a buffer, as
+//	  read and write would.
+//
+// spliceIsZeroCopy returns false if either kind can't be had.
+func spliceIsZeroCopy(dst, src int) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(src, &st); err != nil {
+		return false
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFSOCK, syscall.S_IFREG, syscall.S_IFIFO:
+	default:
+		return false
+	}
+	if err := syscall.Fstat(dst, &st); err != nil {
+		return false
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFSOCK, syscall.S_IFIFO:
+		return true
+	}
+	return false
+}
+
+// splice transfers data from r to c using the splice system call to minimize
+// copies from and to userspace. c must be a stream socket. Currently, splice
+// is only enabled if r is also a TCP connection, a Unix stream connection or
+// a SpliceConn. Files are left to sendFile first, and then to spliceFile.
+// Splice only moves byte streams; packet-oriented connections such as
+// IPConn and UDPConn are never spliced, so that their message boundaries
+// are preserved.
+//
+// The relay parameters are taken from rl, which may be nil. If done is
+// closed before the transfer completes, splice stops and returns
+// poll.ErrCanceled. If end is not zero, splice stops reading from r at
+// end, and returns ErrSliceExpired once it has written what it read.
+//
+// If splice returns handled == false, it has performed no work.
+func splice(c *netFD, r io.Reader, rl *Relay, done <-chan struct{}, end time.Time) (written int64, err error, handled bool) {
+	if isFileReader(r) {
+		return 0, nil, false
+	}
+	return spliceFrom(c, r, rl, done, end)
+}
+
+// spliceFile is like splice for r, an *os.File for a stream socket, a
+// pseudo-terminal master or a pipe, such as a FIFO. It is tried once
+// sendFile has declined r, so that regular files are sent without
+// probing them first.
+func spliceFile(c *netFD, r io.Reader, rl *Relay, done <-chan struct{}, end time.Time) (written int64, err error, handled bool) {
+	if !isFileReader(r) {
+		return 0, nil, false
+	}
+	return spliceFrom(c, r, rl, done, end)
+}
+
+// isFileReader reports whether r is an *os.File, or an *io.LimitedReader
+// of one.
+func isFileReader(r io.Reader) bool {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	_, ok := r.(*os.File)
+	return ok
+}
+
+// spliceFrom does the work of splice and spliceFile.
+func spliceFrom(c *netFD, r io.Reader, rl *Relay, done <-chan struct{}, end time.Time) (written int64, err error, handled bool) {
+	if !strategyAllowsSplice(rl) {
+		traceNotSpliced(c, -1, rl.id(), "disabled by the SpliceStrategy")
+		return 0, nil, false
+	}
+	if rl.Downgraded() {
+		traceNotSpliced(c, -1, rl.id(), "relay downgraded after repeated splice failures")
+		return 0, nil, false
+	}
+	defer func() {
+		rl.noteSplice(c, err, handled)
+	}()
+	var remain int64 = 1 << 62 // by default, copy until EOF
+	lr, ok := r.(*io.LimitedReader)
+	if ok {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, nil, true
+		}
+	}
+	var s *netFD
+	switch v := r.(type) {
+	case *TCPConn:
+		s = v.fd
+	case tcpConnWithoutWriteTo:
+		s = v.TCPConn.fd
+	case *UnixConn:
+		// Unix datagram and seqpacket connections are not
+		// streams, and are left to the caller by poll.
+		s = v.fd
+	case SpliceConn:
+		fd, release, ok := spliceConnFD(v)
+		if !ok {
+			traceNotSpliced(c, -1, rl.id(), "SpliceConn can't be spliced")
+			return 0, nil, false
+		}
+		defer release()
+		s = fd
+	case *os.File:
+		fd, release, ok := spliceFileFD(v)
+		if !ok {
+			if rl.strategy() == SpliceOnlyStrategy && canSendFile(v) {
+				written, err, handled = spliceFromFile(c, v, remain)
+				if lr != nil {
+					lr.N -= written
+				}
+				return written, err, handled
+			}
+			traceNotSpliced(c, -1, rl.id(), "file is not a socket or pty master")
+			return 0, nil, false
+		}
+		defer release()
+		s = fd
+	default:
+		traceNotSpliced(c, -1, rl.id(), "unsupported source")
+		return 0, nil, false
+	}
+
+	traceCopied(traceFD(c), traceFD(s), rl.id())
+
+	// A pipe serves as the buffer of a splice to or from it, unless
+	// the relay needs a pipe of its own for its parameters.
+	if (c.net == "fifo" || s.net == "fifo") && rl == nil && done == nil && end.IsZero() {
+		written, sc, err := poll.SplicePipe(&c.pfd, &s.pfd, remain)
+		if lr != nil {
+			lr.N -= written
+		}
+		return written, wrapSyscallError(sc, err), true
+	}
+
+	var sc string
+	pr := rl.pollRelay(done)
+	pr.SliceEnd = end
+	if lr != nil {
+		pr.Redirected = false
+	}
+	if pr.PipeSize == 0 {
+		pr.PipeSize = splicePipeSize(c, s)
+	}
+	if herr := testHookSpliceFail(rl); herr != nil {
+		// The hook stands in for a splice which refuses the
+		// descriptors before doing any work.
+		sc, err = "splice", herr
+	} else {
+		written, handled, sc, err = pr.Splice(&c.pfd, &s.pfd, remain)
+	}
+	if lr != nil {
+		lr.N -= written
+	}
+	if !handled {
+		why := "not a stream socket"
+		if err != nil {
+			why = err.Error()
+		}
+		traceNotSpliced(c, traceFD(s), rl.id(), why)
+	}
+	if err == poll.ErrSliceExpired {
+		return written, ErrSliceExpired, handled
+	}
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// spliceWithHeader writes header to c, then splices s to c until EOF,
+// with the parameters of rl which apply to a plain spliced copy.
+//
+// If spliceWithHeader returns handled == false, it has performed no
+// work.
+func spliceWithHeader(c, s *netFD, header []byte, rl *Relay) (written int64, err error, handled bool) {
+	if !strategyAllowsSplice(rl) {
+		traceNotSpliced(c, -1, rl.id(), "disabled by the SpliceStrategy")
+		return 0, nil, false
+	}
+	if rl.Downgraded() {
+		traceNotSpliced(c, -1, rl.id(), "relay downgraded after repeated splice failures")
+		return 0, nil, false
+	}
+	defer func() {
+		rl.noteSplice(c, err, handled)
+	}()
+	traceCopied(traceFD(c), traceFD(s), rl.id())
+	pr := rl.pollRelay(nil)
+	pr.Header = header
+	if pr.PipeSize == 0 {
+		pr.PipeSize = splicePipeSize(c, s)
+	}
+	written, handled, sc, err := pr.Splice(&c.pfd, &s.pfd, 1<<62)
+	if !handled {
+		why := "not a stream socket"
+		if err != nil {
+			why = err.Error()
+		}
+		traceNotSpliced(c, traceFD(s), rl.id(), why)
+	}
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// isSpliceFailure reports whether err, returned by a copy which tried to
+// splice, is a failure of the splice system call itself rather than of
+// the connections: splice refused the descriptors, or failed for a
+// transient shortage, such as of memory for the pipe's buffers.
+func isSpliceFailure(err error, handled bool) bool {
+	se, ok := err.(*os.SyscallError)
+	return ok && se.Syscall == "splice" && (!handled || retryableErrno(se.Err))
+}
+
+// noteSplice records the outcome of a copy to c by rl, which may be nil,
+// which tried to splice, and downgrades rl once maxSpliceFailures copies
+// in a row have failed to.
+func (rl *Relay) noteSplice(c *netFD, err error, handled bool) {
+	if rl == nil {
+		return
+	}
+	if !isSpliceFailure(err, handled) {
+		if handled && err == nil {
+			atomic.StoreInt32(&rl.spliceFailures, 0)
+		}
+		return
+	}
+	if atomic.AddInt32(&rl.spliceFailures, 1) < maxSpliceFailures || !atomic.CompareAndSwapInt32(&rl.downgraded, 0, 1) {
+		return
+	}
+	if spliceTrace {
+		traceSplice(traceFD(c), -1, rl.id())
+		print(": relay downgraded to generic copy after ", maxSpliceFailures, " splice failures, the last: ", err.Error(), "\n")
+	}
+}
+
+func spliceFDs() int {
+	return poll.PipeFDs()
+}
+
+func splicePipePool() SplicePipePoolCounts {
+	var c SplicePipePoolCounts
+	c.Hits, c.Misses = poll.PipePoolStats()
+	return c
+}
+
+func spliceEnds() SpliceEndCounts {
+	var c SpliceEndCounts
+	c.EOF, c.Limit, c.Canceled, c.Expired, c.Errors = poll.SpliceEnds()
+	return c
+}
+
+func setSplicePipeSize(fd *netFD, n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&fd.splicePipeSize, int64(n))
+}
+
+// splicePipeSize returns the pipe size set by ConfigureForSplice for a
+// copy from src to dst, the larger of the two connections' sizes.
+func splicePipeSize(dst, src *netFD) int {
+	n := atomic.LoadInt64(&dst.splicePipeSize)
+	if m := atomic.LoadInt64(&src.splicePipeSize); m > n {
+		n = m
+	}
+	return int(n)
+}
+
+// Bounds of the size returned by OptimalSpliceChunk. minSpliceChunk is
+// the smallest pipe an adaptive relay uses; pipes are 64 KiB by default;
+// defaultMaxPipeSize is the default of /proc/sys/fs/pipe-max-size, the
+// largest pipe an unprivileged process may have.
+const (
+	minSpliceChunk     = 16 << 10
+	defaultPipeSize    = 64 << 10
+	defaultMaxPipeSize = 1 << 20
+)
+
+func optimalSpliceChunk(src, dst Conn) int {
+	// Linux doubles the sizes set with SO_RCVBUF and SO_SNDBUF, to
+	// make room for its bookkeeping, and reports them doubled.
+	rcvbuf := socketBuffer(connNetFD(src), syscall.SO_RCVBUF) / 2
+	sndbuf := socketBuffer(connNetFD(dst), syscall.SO_SNDBUF) / 2
+	if rcvbuf <= 0 && sndbuf <= 0 {
+		// Neither buffer is known: the pipe decides.
+		return defaultPipeSize
+	}
+	chunk := maxPipeSize()
+	for _, n := range []int{rcvbuf, sndbuf} {
+		if n > 0 && n < chunk {
+			chunk = n
+		}
+	}
+	if chunk < minSpliceChunk {
+		return minSpliceChunk
+	}
+	// Pipe sizes are powers of two.
+	n := minSpliceChunk
+	for n*2 <= chunk {
+		n *= 2
+	}
+	return n
+}
+
+// connNetFD returns the descriptor of c, if c is a connection of this
+// package which may be spliced.
+func connNetFD(c Conn) *netFD {
+	switch c := c.(type) {
+	case *TCPConn:
+		if c.ok() {
+			return c.fd
+		}
+	case *UnixConn:
+		if c.ok() {
+			return c.fd
+		}
+	}
+	return nil
+}
+
+// socketBuffer returns the size of the buffer of fd selected by opt,
+// SO_RCVBUF or SO_SNDBUF, or 0 if it can't be had.
+func socketBuffer(fd *netFD, opt int) int {
+	if fd == nil {
+		return 0
+	}
+	var n int
+	var err error
+	if cerr := fd.pfd.RawControl(func(s uintptr) {
+		n, err = syscall.GetsockoptInt(int(s), syscall.SOL_SOCKET, opt)
+	}); cerr != nil || err != nil {
+		return 0
+	}
+	return n
+}
+
+// socketBufferSize returns the size of the send buffer of c, if send is
+// set, or else of its receive buffer, in the terms of SetWriteBuffer and
+// SetReadBuffer, or 0 if it can't be had.
+func socketBufferSize(c Conn, send bool) int {
+	opt := syscall.SO_RCVBUF
+	if send {
+		opt = syscall.SO_SNDBUF
+	}
+	// Linux reports the sizes doubled.
+	return socketBuffer(connNetFD(c), opt) / 2
+}
+
+// tcpMSS returns the maximum segment size of c, a TCP connection, or 0
+// if it can't be had.
+func tcpMSS(c Conn) int {
+	tc, ok := c.(*TCPConn)
+	if !ok || !tc.ok() {
+		return 0
+	}
+	var n int
+	var err error
+	if cerr := tc.fd.pfd.RawControl(func(s uintptr) {
+		n, err = syscall.GetsockoptInt(int(s), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	}); cerr != nil || err != nil {
+		return 0
+	}
+	return n
+}
+
+// maxPipeSize returns the largest size of a pipe which an unprivileged
+// process may set, from /proc/sys/fs/pipe-max-size.
+func maxPipeSize() int {
+	fd, err := open("/proc/sys/fs/pipe-max-size")
+	if err != nil {
+		return defaultMaxPipeSize
+	}
+	defer fd.close()
+	l, ok := fd.readLine()
+	if !ok {
+		return defaultMaxPipeSize
+	}
+	n, _, ok := dtoi(l)
+	if n < minSpliceChunk || !ok {
+		return defaultMaxPipeSize
+	}
+	return n
+}
+
+// spliceBroadcast copies src to every connection in dsts using the splice
+// and tee system calls.
+//
+// If spliceBroadcast returns handled == false, it has performed no work.
+func spliceBroadcast(dsts []*TCPConn, src *TCPConn, dropAfter time.Duration) (written []int64, errs []error, err error, handled bool) {
+	pdsts := make([]*poll.FD, len(dsts))
+	for i, c := range dsts {
+		pdsts[i] = &c.fd.pfd
+	}
+	pb := poll.Broadcast{DropAfter: dropAfter}
+	written, errs, handled, sc, err := pb.Splice(&src.fd.pfd, pdsts)
+	if !handled {
+		return nil, nil, nil, false
+	}
+	for i, e := range errs {
+		switch e {
+		case nil:
+		case poll.ErrBroadcastDropped:
+			errs[i] = ErrBroadcastDropped
+		default:
+			c := dsts[i]
+			errs[i] = &OpError{Op: "write", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: wrapSyscallError("splice", e)}
+		}
+	}
+	if err != nil {
+		err = &OpError{Op: "read", Net: src.fd.net, Source: src.fd.laddr, Addr: src.fd.raddr, Err: wrapSyscallError(sc, err)}
+	}
+	return written, errs, err, true
+}
+
+// spliceConnFD returns the descriptor underlying c, if c can be spliced,
+// and a function releasing it once the splice is done. A SpliceConn
+// backed by a net package socket is spliced through that socket's netFD;
+// any other is spliced through a duplicate of its descriptor.
+func spliceConnFD(c SpliceConn) (fd *netFD, release func(), ok bool) {
+	if !c.CanSplice() {
+		return nil, nil, false
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, nil, false
+	}
+	if r, isRaw := rc.(*rawConn); isRaw {
+		if !r.ok() {
+			return nil, nil, false
+		}
+		return r.fd, func() { runtime.KeepAlive(r.fd) }, true
+	}
+	s := -1
+	var derr error
+	if err := rc.Control(func(sysfd uintptr) {
+		s, derr = dupCloseOnExec(int(sysfd))
+	}); err != nil || derr != nil {
+		if s >= 0 {
+			poll.CloseFunc(s)
+		}
+		return nil, nil, false
+	}
+	blocking, err := isBlocking(s)
+	if err != nil {
+		poll.CloseFunc(s)
+		return nil, nil, false
+	}
+	// newSocketFD closes s if it fails.
+	if fd, err = newSocketFD(s); err != nil {
+		return nil, nil, false
+	}
+	if blocking {
+		fd.pfd.SetSharedBlocking()
+	}
+	return fd, func() { fd.Close() }, true
+}
+
+// isBlocking reports whether s is in blocking mode. The mode belongs to
+// the file s refers to, which every duplicate of s shares, so a splice
+// through a duplicate leaves it alone: reads and writes through the other
+// descriptors would otherwise fail with EAGAIN.
+func isBlocking(s int) (bool, error) {
+	flags, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(s), syscall.F_GETFL, 0)
+	if e != 0 {
+		return false, e
+	}
+	return flags&syscall.O_NONBLOCK == 0, nil
+}
+
+// spliceFromFile transfers at most remain bytes from f, a file which
+// sendfile could read, to c using the splice system call.
+//
+// If spliceFromFile returns handled == false, it has performed no work.
+func spliceFromFile(c *netFD, f *os.File, remain int64) (written int64, err error, handled bool) {
+	written, handled, sc, err := poll.SpliceFromFile(&c.pfd, int(f.Fd()), remain)
+	runtime.KeepAlive(f)
+	if !handled {
+		traceNotSpliced(c, int(f.Fd()), "", "file can't be spliced")
+	}
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// spliceFileRange transfers the n bytes of f starting at offset *offp to
+// c using the splice system call, advancing *offp atomically past the
+// data written to c.
+//
+// If spliceFileRange returns handled == false, it has performed no work.
+func spliceFileRange(c *netFD, f *os.File, offp *int64, n int64) (written int64, err error, handled bool) {
+	if !strategyAllowsSplice(nil) || !canSendFile(f) {
+		return 0, nil, false
+	}
+	written, handled, sc, err := poll.SpliceFileRange(&c.pfd, int(f.Fd()), offp, n)
+	runtime.KeepAlive(f)
+	if !handled {
+		traceNotSpliced(c, int(f.Fd()), "", "file can't be spliced")
+	}
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// sendFileDropCache is like sendFile, but advises the kernel to drop the
+// data sent from the page cache.
+func sendFileDropCache(c *netFD, r io.Reader) (written int64, err error, handled bool) {
+	if !strategyAllowsSendfile(nil) {
+		return 0, nil, false
+	}
+	var remain int64 = 1 << 62 // by default, copy until EOF
+	lr, ok := r.(*io.LimitedReader)
+	if ok {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, nil, true
+		}
+	}
+	f, ok := r.(*os.File)
+	if !ok || !canSendFile(f) {
+		return 0, nil, false
+	}
+	written, err = poll.SendFileDropCache(&c.pfd, int(f.Fd()), remain)
+	runtime.KeepAlive(f)
+	if lr != nil {
+		lr.N = remain - written
+	}
+	return written, wrapSyscallError("sendfile", err), written > 0
+}
+
+// sendFileRange sends the n bytes of f starting at offset off to c using
+// the sendfile system call, without using or changing f's offset.
+//
+// If sendFileRange returns handled == false, the caller should send the
+// rest of the data by other means; written counts the data which has
+// already been sent.
+func sendFileRange(c *netFD, f *os.File, off, n int64) (written int64, err error, handled bool) {
+	if !strategyAllowsSendfile(nil) || !canSendFile(f) {
+		return 0, nil, false
+	}
+	written, err = poll.SendFileRange(&c.pfd, int(f.Fd()), off, n)
+	runtime.KeepAlive(f)
+	// EINVAL and ENOSYS mean that f's file system doesn't support
+	// sendfile.
+	if err == syscall.EINVAL || err == syscall.ENOSYS {
+		return written, nil, false
+	}
+	return written, wrapSyscallError("sendfile", err), true
+}
+
+// spliceFileFD returns a netFD for a duplicate of f's descriptor, if f is
+// a stream socket, such as a file returned by the File method of a
+// TCPConn, a pseudo-terminal master or a pipe, such as a FIFO, and a
+// function releasing it once the splice is done. Such files are usually
+// in blocking mode, which is shared by every descriptor for the file and
+// so is left alone: a socket is then spliced once poll reports it ready,
+// and splices between pipes don't block anyway. A pseudo-terminal master
+// in blocking mode is not spliced. Other files cost spliceFileFD an
+// fstat.
+func spliceFileFD(f *os.File) (fd *netFD, release func(), ok bool) {
+	if f == nil {
+		return nil, nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, false
+	}
+	// Unlike f.Fd, fileSysfd leaves a file which os polls in
+	// non-blocking mode.
+	sysfd := fileSysfd(f)
+	var kind string
+	switch mode := fi.Mode(); {
+	case mode&os.ModeSocket != 0:
+		kind = "socket"
+	case mode&os.ModeNamedPipe != 0:
+		kind = "fifo"
+	case mode&os.ModeCharDevice != 0 && isPtyMaster(sysfd):
+		kind = "pty"
+	default:
+		return nil, nil, false
+	}
+	s, err := dupCloseOnExec(sysfd)
+	runtime.KeepAlive(f)
+	if err != nil {
+		return nil, nil, false
+	}
+	blocking, err := isBlocking(s)
+	if err != nil || blocking && kind == "pty" {
+		poll.CloseFunc(s)
+		return nil, nil, false
+	}
+	if kind == "socket" {
+		fd, err = newSocketFD(s)
+	} else {
+		fd, err = newFileSpliceFD(s, kind)
+	}
+	if err != nil {
+		return nil, nil, false
+	}
+	if blocking && kind == "socket" {
+		fd.pfd.SetSharedBlocking()
+	}
+	return fd, func() { fd.Close() }, true
+}
+
+// newFileSpliceFD returns a netFD for s, the descriptor of a
+// pseudo-terminal master in non-blocking mode, for net "pty", or of a
+// pipe, for net "fifo", which is only good for splicing. s is closed if newFileSpliceFD fails.
+func newFileSpliceFD(s int, net string) (*netFD, error) {
+	fd := &netFD{
+		pfd: poll.FD{
+			Sysfd:         s,
+			IsStream:      true,
+			ZeroReadIsEOF: true,
+		},
+		net: net,
+	}
+	if err := fd.pfd.Init("file", true); err != nil {
+		poll.CloseFunc(s)
+		return nil, err
+	}
+	return fd, nil
+}
+
+// fileSysfd returns the descriptor of f without changing its mode, which
+// f.Fd does.
+//
+//go:linkname fileSysfd os.sysfd
+func fileSysfd(f *os.File) int
+
+// isPtyMaster reports whether fd is the master side of a
+// pseudo-terminal. Only a master has a slave number to report.
+func isPtyMaster(fd int) bool {
+	var n uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	return errno == 0
+}
+
+// spliceToFile transfers data from c to w using the splice system call,
+// if w is an *os.File for a regular file, a pipe or a pseudo-terminal
+// master. Other files, such as terminals, may not support splice and are
+// left to the caller.
+//
+// If spliceToFile returns handled == false, the caller should copy the
+// rest of the data by other means; written counts the data which has
+// already been transferred.
+func spliceToFile(w io.Writer, c *netFD) (written int64, err error, handled bool) {
+	f, ok := w.(*os.File)
+	if !ok || f == nil || !strategyAllowsSplice(nil) {
+		return 0, nil, false
+	}
+	// Unlike f.Fd, fileSysfd leaves a file which os polls, such as
+	// the write end of a pipe made by os.Pipe, in non-blocking mode,
+	// in which Close still interrupts its writes.
+	fd := fileSysfd(f)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return 0, nil, false
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFIFO:
+		// The pipe serves as the buffer of the splice.
+		if p, release, ok := spliceFileFD(f); ok {
+			written, sc, err := poll.SplicePipe(&p.pfd, &c.pfd, 1<<62)
+			release()
+			testHookSpliceToFile(true)
+			return written, wrapSyscallError(sc, err), true
+		}
+	case syscall.S_IFREG:
+	case syscall.S_IFCHR:
+		if !isPtyMaster(fd) {
+			testHookSpliceToFile(false)
+			return 0, nil, false
+		}
+		// A master in non-blocking mode is waited for like a socket.
+		if p, release, ok := spliceFileFD(f); ok {
+			written, handled, sc, err := poll.Splice(&p.pfd, &c.pfd, 1<<62)
+			release()
+			testHookSpliceToFile(handled)
+			return written, wrapSyscallError(sc, err), handled
+		}
+	default:
+		testHookSpliceToFile(false)
+		return 0, nil, false
+	}
+	traceCopied(fd, traceFD(c), "")
+	written, handled, sc, err := poll.SpliceToFile(fd, &c.pfd)
+	runtime.KeepAlive(f)
+	testHookSpliceToFile(handled)
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// spliceToLog is like spliceToFile for a regular file f, telling s about
+// the data written to f.
+func spliceToLog(f *os.File, c *netFD, s *logSyncer) (written int64, err error, handled bool) {
+	if !strategyAllowsSplice(nil) {
+		return 0, nil, false
+	}
+	// fileSysfd leaves the mode of f alone, should it not be a
+	// regular file after all.
+	fd := fileSysfd(f)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		testHookSpliceToFile(false)
+		return 0, nil, false
+	}
+	traceCopied(fd, traceFD(c), "")
+	written, handled, sc, err := poll.SpliceToFileFunc(fd, &c.pfd, s.wrote)
+	runtime.KeepAlive(f)
+	testHookSpliceToFile(handled)
+	return written, wrapSyscallError(sc, err), handled
+}
+
+// syncFileData flushes the data of f to stable storage with
+// fdatasync(2).
+func syncFileData(f *os.File) error {
+	if err := syscall.Fdatasync(int(f.Fd())); err != nil {
+		return os.NewSyscallError("fdatasync", err)
+	}
+	return nil
+}
+
+// pollRelay returns the internal/poll parameters corresponding to rl,
+// cancelled by done.
+func (rl *Relay) pollRelay(done <-chan struct{}) *poll.Relay {
+	pr := &poll.Relay{Done: done, PipeSize: testHookRelayPipeSize}
+	if rl == nil {
+		return pr
+	}
+	pr.PreferDrain = rl.Mode == ThroughputMode
+	pr.DrainLimit = rl.DrainLimit
+	pr.AdaptivePipe = rl.AdaptivePipe
+	pr.Urgent = rl.Urgent
+	pr.LowWater = rl.LowWater
+	pr.NotSentLowWater = rl.NotSentLowWater
+	pr.Account = rl.Account
+	if rl.Budget != nil {
+		pr.Budget = rl.Budget
+	}
+	pr.Inspect = rl.Inspect
+	if c := rl.Capture; c != nil {
+		dir := rl.CaptureDirection
+		pr.Capture = func(b []byte) { c.record(dir, b) }
+	}
+	if f := rl.Timestamps; f != nil {
+		pr.Timestamp = func(offset int64, acked bool, sw, hw time.Time) {
+			f(TxTimestamp{Offset: offset, Acked: acked, Software: sw, Hardware: hw})
+		}
+	}
+	pr.Redirected = rl.Redirected
+	pr.DedicatedPoller = rl.DedicatedPoller
+	pr.MaxPipeFDs = rl.MaxSpliceFDs
+	switch rl.LimitPolicy {
+	case WaitAtLimit:
+		pr.LimitPolicy = poll.PipeLimitWait
+	case ExceedLimit:
+		pr.LimitPolicy = poll.PipeLimitExceed
+	}
+	pr.Stats = &rl.stats
+	pr.ID = rl.ID
+	return pr
+}
+
+// spliceDiscard discards the next n bytes read from c using the splice
+// system call, without copying them into userspace.
+//
+// If spliceDiscard returns handled == false, it has performed no work.
+func spliceDiscard(c *netFD, n int64) (discarded int64, err error, handled bool) {
+	if !strategyAllowsSplice(nil) {
+		return 0, nil, false
+	}
+	discarded, handled, sc, err := poll.Discard(&c.pfd, n)
+	return discarded, wrapSyscallError(sc, err), handled
+}
+
+// setDSCP marks the packets sent on c, if it is an IP socket, with the
+// differentiated services code point dscp, and returns a function which
+// restores the marking c had before.
+func setDSCP(c *netFD, dscp int) (restore func(), err error) {
+	if dscp > 63 {
+		return nil, syscall.EINVAL
+	}
+	type sockopt struct{ level, name int }
+	var opts []sockopt
+	switch c.family {
+	case syscall.AF_INET:
+		opts = append(opts, sockopt{syscall.IPPROTO_IP, syscall.IP_TOS})
+	case syscall.AF_INET6:
+		opts = append(opts, sockopt{syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS})
+		// The packets of an IPv6 socket connected to an IPv4
+		// address take the IPv4 option.
+		if a, ok := c.raddr.(*TCPAddr); ok && a.IP.To4() != nil {
+			opts = append(opts, sockopt{syscall.IPPROTO_IP, syscall.IP_TOS})
+		}
+	}
+	old := make([]int, len(opts))
+	if cerr := c.pfd.RawControl(func(s uintptr) {
+		for i, o := range opts {
+			if old[i], err = syscall.GetsockoptInt(int(s), o.level, o.name); err != nil {
+				return
+			}
+		}
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, wrapSyscallError("getsockopt", err)
+	}
+	restore = func() {
+		for i, o := range opts {
+			c.pfd.SetsockoptInt(o.level, o.name, old[i])
+		}
+		runtime.KeepAlive(c)
+	}
+	for _, o := range opts {
+		if err := c.pfd.SetsockoptInt(o.level, o.name, dscp<<2); err != nil {
+			restore()
+			return nil, wrapSyscallError("setsockopt", err)
+		}
+	}
+	runtime.KeepAlive(c)
+	return restore, nil
+}
+
+func peek(c *netFD, b []byte) (int, error) {
+	n, err := c.pfd.Peek(b)
+	runtime.KeepAlive(c)
+	return n, wrapSyscallError("recvfrom", err)
+}
+
+// splicer is the platform state of a Splicer.
+type splicer struct {
+	ps poll.Splicer
+
+	// dst is the destination of the data held to combine writes.
+	dst *TCPConn
+}
+
+func (s *splicer) spliceTo(dst, src *TCPConn, n int64, combine int, h *spliceHold) (int64, error) {
+	s.ps.Src = &src.fd.pfd
+	s.ps.Hold = h.wait
+	s.ps.Combine = combine
+	written, handled, sc, err := s.ps.SpliceTo(&dst.fd.pfd, n)
+	s.ps.Hold = nil
+	s.ps.Combine = 0
+	if !handled {
+		return genericSpliceTo(dst, src, n, h)
+	}
+	if s.ps.Combined() > 0 {
+		s.dst = dst
+	}
+	return written, wrapSyscallError(sc, err)
+}
+
+// combinedDst returns the destination of the data held to combine
+// writes, or nil if there is none.
+func (s *splicer) combinedDst() *TCPConn {
+	if s.ps.Combined() == 0 {
+		return nil
+	}
+	return s.dst
+}
+
+func (s *splicer) flushCombined() (int64, error) {
+	written, sc, err := s.ps.FlushCombined()
+	if s.ps.Combined() == 0 {
+		s.dst = nil
+	}
+	return written, wrapSyscallError(sc, err)
+}
+
+// relayTo splices src to dst through s until src reaches EOF, starting
+// with the data already buffered in s. dstFailed reports whether err came
+// from dst, in which case the data not written to dst stays buffered.
+//
+// If relayTo returns handled == false, it has performed no work.
+func (s *splicer) relayTo(dst, src *TCPConn) (written int64, err error, dstFailed, handled bool) {
+	s.ps.Src = &src.fd.pfd
+	written, handled, sc, err := s.ps.SpliceTo(&dst.fd.pfd, 1<<62)
+	if err == io.EOF {
+		err = nil
+	}
+	return written, wrapSyscallError(sc, err), s.ps.DstFailed, handled
+}
+
+func (s *splicer) flush(dst *TCPConn) (int64, error) {
+	written, sc, err := s.ps.Flush(&dst.fd.pfd)
+	return written, wrapSyscallError(sc, err)
+}
+
+func (s *splicer) readBuffered(b []byte) (int, error) {
+	n, err := s.ps.ReadBuffered(b)
+	return n, wrapSyscallError("read", err)
+}
+
+func (s *splicer) buffered() int {
+	return s.ps.Buffered()
+}
+
+func (s *splicer) close() error {
+	s.dst = nil
+	return s.ps.Close()
+}
+
+func copyFromPacketDevice(c *TCPConn, dev *PacketDevice) (int64, error) {
+	var written int64
+	for {
+		n, spliced, sc, err := poll.SpliceFromPacket(&c.fd.pfd, dev.pfd)
+		if !spliced && err == nil {
+			m, err := genericCopyFromPacketDevice(c, dev)
+			return written + m, err
+		}
+		written += int64(n)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, wrapSyscallError(sc, err)
+		}
+	}
+}
+
+func copyToPacketDevice(dev *PacketDevice, c *TCPConn) (int64, error) {
+	var written int64
+	for {
+		n, spliced, sc, err := poll.SpliceToPacket(dev.pfd, &c.fd.pfd)
+		written += int64(n)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, wrapSyscallError(sc, err)
+		}
+		if !spliced {
+			m, err := genericCopyToPacketDevice(dev, c)
+			return written + m, err
+		}
+	}
+}
+
+func copyFromUDP(c *TCPConn, u *UDPConn) (int64, error) {
+	written, spliced, sc, err := poll.SpliceFromDatagrams(&c.fd.pfd, &u.fd.pfd)
+	if !spliced && err == nil {
+		return genericCopyFromUDP(c, u)
+	}
+	return written, wrapSyscallError(sc, err)
+}
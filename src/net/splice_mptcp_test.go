@@ -0,0 +1,171 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// ipprotoMPTCP is the protocol of Multipath TCP sockets, from the Linux
+// include/uapi/linux/in.h.
+const ipprotoMPTCP = 262
+
+// mptcpSocket returns a blocking MPTCP socket, or an error if the kernel
+// doesn't support MPTCP.
+func mptcpSocket() (int, error) {
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, ipprotoMPTCP)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return s, nil
+}
+
+// mptcpSocketPair returns a connection made over loopback by an MPTCP
+// socket to an MPTCP listener, and the connection the listener accepts
+// for it.
+func mptcpSocketPair() (client, server Conn, err error) {
+	ls, err := mptcpSocket()
+	if err != nil {
+		return nil, nil, err
+	}
+	lf := os.NewFile(uintptr(ls), "mptcp-listener")
+	defer lf.Close()
+	if err := syscall.Bind(ls, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		return nil, nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(ls, 1); err != nil {
+		return nil, nil, os.NewSyscallError("listen", err)
+	}
+	lsa, err := syscall.Getsockname(ls)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("getsockname", err)
+	}
+	ln, err := FileListener(lf)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+
+	cs, err := mptcpSocket()
+	if err != nil {
+		return nil, nil, err
+	}
+	cf := os.NewFile(uintptr(cs), "mptcp-client")
+	defer cf.Close()
+	// The connection completes in the listener's backlog.
+	if err := syscall.Connect(cs, lsa); err != nil {
+		return nil, nil, os.NewSyscallError("connect", err)
+	}
+	if client, err = FileConn(cf); err != nil {
+		return nil, nil, err
+	}
+	if server, err = ln.Accept(); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// socketProtocol returns the protocol of the socket of c.
+func socketProtocol(t *testing.T, c *TCPConn) int {
+	return getsockoptInt(t, c, syscall.SOL_SOCKET, syscall.SO_PROTOCOL)
+}
+
+func TestSpliceMPTCP(t *testing.T) {
+	if c, s, err := mptcpSocketPair(); err != nil {
+		t.Skipf("MPTCP not supported: %v", err)
+	} else {
+		c.Close()
+		s.Close()
+	}
+
+	tests := []struct {
+		srcMPTCP, dstMPTCP bool
+	}{
+		{true, false},
+		{false, true},
+		{true, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("src=%v,dst=%v", tt.srcMPTCP, tt.dstMPTCP), func(t *testing.T) {
+			testSpliceMPTCP(t, tt.srcMPTCP, tt.dstMPTCP)
+		})
+	}
+}
+
+func testSpliceMPTCP(t *testing.T, srcMPTCP, dstMPTCP bool) {
+	pair := func(mptcp bool) (client, server Conn) {
+		var err error
+		if mptcp {
+			client, server, err = mptcpSocketPair()
+		} else {
+			client, server, err = spliceTestSocketPair("tcp")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+	writer, s := pair(srcMPTCP)
+	defer writer.Close()
+	defer s.Close()
+	d, reader := pair(dstMPTCP)
+	defer reader.Close()
+	defer d.Close()
+	src, dst := s.(*TCPConn), d.(*TCPConn)
+
+	for _, c := range []struct {
+		conn  *TCPConn
+		mptcp bool
+	}{{src, srcMPTCP}, {dst, dstMPTCP}} {
+		want := syscall.IPPROTO_TCP
+		if c.mptcp {
+			want = ipprotoMPTCP
+		}
+		if got := socketProtocol(t, c.conn); got != want {
+			t.Fatalf("socket protocol %d; want %d", got, want)
+		}
+	}
+
+	var how string
+	defer func(hook func(string)) { testHookReadFrom = hook }(testHookReadFrom)
+	testHookReadFrom = func(h string) { how = h }
+
+	want := make([]byte, 1<<20)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(reader)
+		readDone <- b
+	}()
+	go func() {
+		writer.Write(want)
+		writer.(*TCPConn).CloseWrite()
+	}()
+
+	n, err := dst.ReadFrom(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("ReadFrom copied %d bytes; want %d", n, len(want))
+	}
+	if how != "splice" {
+		t.Errorf("ReadFrom used %s; want splice", how)
+	}
+	dst.CloseWrite()
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes which differ from the %d bytes sent", len(got), len(want))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,amd64
+
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// The bpf(2) system call and the parts of its interface used to set up
+// a sockmap redirect.
+const (
+	sysBPF = 321
+
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfProgAttach    = 8
+
+	bpfMapTypeSockmap = 15
+	bpfProgTypeSkSkb  = 14
+
+	bpfSkSkbStreamParser  = 4
+	bpfSkSkbStreamVerdict = 5
+
+	bpfFuncSkRedirectMap = 52
+)
+
+// A bpfInsn is an eBPF instruction. regs holds the source register in
+// its upper four bits and the destination register in the lower four.
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// newSockmap returns a BPF_MAP_TYPE_SOCKMAP which holds one socket.
+func newSockmap() (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries uint32
+	}{bpfMapTypeSockmap, 4, 4, 1}
+	return bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// setSockmap puts the socket s in the sockmap m.
+func setSockmap(m, s int) error {
+	key, value := uint32(0), uint32(s)
+	attr := struct {
+		mapFD       uint32
+		_           uint32
+		key, value  uint64
+		updateFlags uint64
+	}{mapFD: uint32(m), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// loadSkSkbProg loads insns as a BPF_PROG_TYPE_SK_SKB program.
+func loadSkSkbProg(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType, insnCnt uint32
+		insns, license    uint64
+	}{bpfProgTypeSkSkb, uint32(len(insns)), uint64(uintptr(unsafe.Pointer(&insns[0]))), uint64(uintptr(unsafe.Pointer(&license[0])))}
+	return bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// attachSockmapProg attaches prog to the sockmap m as attachType.
+func attachSockmapProg(m, prog, attachType int) error {
+	attr := struct {
+		target, prog, attachType, flags uint32
+	}{uint32(m), uint32(prog), uint32(attachType), 0}
+	_, err := bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// redirectSockmap makes the kernel forward the data received by src to
+// dst, with a stream verdict program which redirects everything
+// received by the sockets of one sockmap, holding src, to the egress of
+// the socket in another, holding dst. release closes the maps and
+// programs.
+func redirectSockmap(src, dst *TCPConn) (release func(), err error) {
+	var fds []int
+	release = func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	in, err := newSockmap()
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, in)
+	out, err := newSockmap()
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, out)
+
+	// The parser makes each skb a message of its own:
+	//	r0 = skb->len
+	//	exit
+	parser, err := loadSkSkbProg([]bpfInsn{
+		{code: 0x61, regs: 1 << 4},
+		{code: 0x95},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, parser)
+	// The verdict redirects every message to the egress of the
+	// socket in out:
+	//	r2 = out
+	//	r3 = 0 // key
+	//	r4 = 0 // flags
+	//	r0 = bpf_sk_redirect_map(skb, out, 0, 0)
+	//	exit
+	verdict, err := loadSkSkbProg([]bpfInsn{
+		{code: 0x18, regs: 1<<4 | 2, imm: int32(out)}, {},
+		{code: 0xb7, regs: 3},
+		{code: 0xb7, regs: 4},
+		{code: 0x85, imm: bpfFuncSkRedirectMap},
+		{code: 0x95},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, verdict)
+
+	if err := attachSockmapProg(in, parser, bpfSkSkbStreamParser); err != nil {
+		return nil, err
+	}
+	if err := attachSockmapProg(in, verdict, bpfSkSkbStreamVerdict); err != nil {
+		return nil, err
+	}
+	if err := setSockmap(out, dst.fd.pfd.Sysfd); err != nil {
+		return nil, err
+	}
+	if err := setSockmap(in, src.fd.pfd.Sysfd); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+func TestRelayRedirectedSockmap(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("sockmaps require root")
+	}
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+	undo, err := redirectSockmap(src, dst)
+	if err != nil {
+		t.Skipf("setting up sockmap redirect: %v", err)
+	}
+	defer undo()
+
+	want := make([]byte, 1<<22)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	go func() {
+		srv.Write(want)
+		srv.CloseWrite()
+	}()
+
+	rl := &Relay{Redirected: true}
+	n, err := rl.Copy(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("copy reported %d bytes; want %d", n, len(want))
+	}
+	dst.CloseWrite()
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("relayed %d bytes differ from %d bytes written", len(got), len(want))
+	}
+	// The data went around the relay's pipe.
+	if st := rl.Stats(); st.Active == 0 || st.Reads != 0 || st.Writes != 0 {
+		t.Errorf("relay stats %+v; want time spent active, and no reads or writes", st)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package net
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+func splice(c *netFD, r io.Reader, rl *Relay, done <-chan struct{}, end time.Time) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceFile(c *netFD, r io.Reader, rl *Relay, done <-chan struct{}, end time.Time) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceWithHeader(c, s *netFD, header []byte, rl *Relay) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func optimalSpliceChunk(src, dst Conn) int {
+	return 0
+}
+
+func socketBufferSize(c Conn, send bool) int {
+	return 0
+}
+
+func tcpMSS(c Conn) int {
+	return 0
+}
+
+func spliceFDs() int {
+	return 0
+}
+
+func splicePipePool() SplicePipePoolCounts {
+	return SplicePipePoolCounts{}
+}
+
+func spliceEnds() SpliceEndCounts {
+	return SpliceEndCounts{}
+}
+
+func setSplicePipeSize(fd *netFD, n int) {}
+
+func spliceBroadcast(dsts []*TCPConn, src *TCPConn, dropAfter time.Duration) ([]int64, []error, error, bool) {
+	return nil, nil, nil, false
+}
+
+func spliceConnFD(c SpliceConn) (*netFD, func(), bool) {
+	return nil, nil, false
+}
+
+func sendFileDropCache(c *netFD, r io.Reader) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceFileFD(f *os.File) (*netFD, func(), bool) {
+	return nil, nil, false
+}
+
+func spliceToFile(w io.Writer, c *netFD) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceToLog(f *os.File, c *netFD, s *logSyncer) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func syncFileData(f *os.File) error {
+	return f.Sync()
+}
+
+func sendFileRange(c *netFD, f *os.File, off, n int64) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceFileRange(c *netFD, f *os.File, offp *int64, n int64) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func spliceDiscard(c *netFD, n int64) (int64, error, bool) {
+	return 0, nil, false
+}
+
+func setDSCP(c *netFD, dscp int) (func(), error) {
+	return func() {}, nil
+}
+
+func peek(c *netFD, b []byte) (int, error) {
+	return 0, errNoPeek
+}
+
+type splicer struct{}
+
+func (s *splicer) spliceTo(dst, src *TCPConn, n int64, combine int, h *spliceHold) (int64, error) {
+	return genericSpliceTo(dst, src, n, h)
+}
+
+func (s *splicer) combinedDst() *TCPConn {
+	return nil
+}
+
+func (s *splicer) flushCombined() (int64, error) {
+	return 0, nil
+}
+
+func (s *splicer) relayTo(dst, src *TCPConn) (int64, error, bool, bool) {
+	return 0, nil, false, false
+}
+
+func (s *splicer) flush(dst *TCPConn) (int64, error) {
+	return 0, nil
+}
+
+func (s *splicer) readBuffered(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *splicer) buffered() int {
+	return 0
+}
+
+func (s *splicer) close() error {
+	return nil
+}
+
+func copyFromPacketDevice(c *TCPConn, dev *PacketDevice) (int64, error) {
+	return genericCopyFromPacketDevice(c, dev)
+}
+
+func copyToPacketDevice(dev *PacketDevice, c *TCPConn) (int64, error) {
+	return genericCopyToPacketDevice(dev, c)
+}
+
+func copyFromUDP(c *TCPConn, u *UDPConn) (int64, error) {
+	return genericCopyFromUDP(c, u)
+}
@@ -0,0 +1,5979 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"internal/poll"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestSplice(t *testing.T) {
+	t.Run("simple", testSpliceSimple)
+	t.Run("big", testSpliceBig)
+	t.Run("honorsLimitedReader", testSpliceHonorsLimitedReader)
+	t.Run("readerAtEOF", testSpliceReaderAtEOF)
+	t.Run("halfClosedSource", testSpliceHalfClosedSource)
+	t.Run("trailingBurst", testSpliceTrailingBurst)
+	t.Run("bufferedHandshake", testSpliceBufferedHandshake)
+	t.Run("discardPadding", testSpliceDiscardPadding)
+	t.Run("lowWaterShortData", testSpliceLowWaterShortData)
+	t.Run("smallSendBuffer", testSpliceSmallSendBuffer)
+	t.Run("asymmetricMTU", testSpliceAsymmetricMTU)
+	t.Run("cancelDuringWaitWrite", testSpliceCancelDuringWaitWrite)
+	t.Run("cancelBetweenPumps", testSpliceCancelBetweenPumps)
+	t.Run("expiredDeadline", testSpliceExpiredDeadline)
+	t.Run("sourceBound", testSpliceSourceBound)
+	t.Run("startOffset", testSpliceStartOffset)
+}
+
+// testSpliceSourceBound checks that a relay whose source trickles in
+// data much slower than the destination takes it waits for the source
+// between chunks, rather than spinning on it.
+func testSpliceSourceBound(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rl := new(Relay)
+	srv.relay = rl
+	copyDone := srv.Copy()
+
+	const (
+		chunks   = 20
+		interval = 10 * time.Millisecond
+	)
+	chunk := bytes.Repeat([]byte("drip"), 64)
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	for i := 0; i < chunks; i++ {
+		time.Sleep(interval)
+		if _, err := srv.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.CloseWrite()
+	if err := <-copyDone; err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	srv.serverDown.(*TCPConn).CloseWrite()
+	if got, want := <-readDone, bytes.Repeat(chunk, chunks); !bytes.Equal(got, want) {
+		t.Errorf("relayed %d bytes differ from %d bytes written", len(got), len(want))
+	}
+
+	// Each chunk is waited for, and moved with a single read and
+	// write, which the destination never holds up.
+	st := rl.Stats()
+	if st.ReadWaits < chunks/2 || st.ReadWaits > 2*chunks {
+		t.Errorf("relay waited for its source %d times; want about %d", st.ReadWaits, chunks)
+	}
+	if st.Reads > 2*chunks || st.Writes > 2*chunks {
+		t.Errorf("relay made %d reads and %d writes for %d chunks", st.Reads, st.Writes, chunks)
+	}
+	if st.WriteWaits != 0 {
+		t.Errorf("relay waited for its destination %d times; want 0", st.WriteWaits)
+	}
+	if st.Wait < chunks*interval/2 || st.Active > st.Wait/4 {
+		t.Errorf("relay spent %v waiting and %v active; want most of it waiting", st.Wait, st.Active)
+	}
+}
+
+// testSpliceStartOffset checks that a splice starts with the first byte
+// a Read of the source would have returned, when the source has already
+// been read from and the rest of its data is queued on its socket. A
+// wrapper of the source which has read ahead of that byte declines to be
+// spliced, so the data it holds is copied first.
+func testSpliceStartOffset(t *testing.T) {
+	payload := spliceTestData(1 << 16)
+	for _, readAhead := range []bool{false, true} {
+		for _, off := range []int{0, 1, 100} {
+			t.Run(fmt.Sprintf("readAhead=%t/%d", readAhead, off), func(t *testing.T) {
+				testSpliceStartOffsetAt(t, payload, readAhead, off)
+			})
+		}
+	}
+}
+
+func testSpliceStartOffsetAt(t *testing.T, payload []byte, readAhead bool, off int) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	if _, err := srv.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseWrite()
+	if err := waitInq(src, len(payload)); err != nil {
+		t.Fatal(err)
+	}
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+
+	var n int64
+	if readAhead {
+		rc := &readAheadConn{Conn: src, br: bufio.NewReader(src)}
+		if _, err := rc.br.Peek(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rc.br.Discard(off); err != nil {
+			t.Fatal(err)
+		}
+		if rc.CanSplice() {
+			t.Fatal("nothing read ahead")
+		}
+		n, err = dst.ReadFrom(rc)
+	} else {
+		if _, err := io.ReadFull(src, make([]byte, off)); err != nil {
+			t.Fatal(err)
+		}
+		var handled bool
+		n, err, handled = splice(dst.fd, src, nil, nil, noDeadline)
+		if !handled {
+			t.Fatal("not spliced")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.CloseWrite()
+
+	want := payload[off:]
+	if n != int64(len(want)) {
+		t.Errorf("copied %d bytes; want %d", n, len(want))
+	}
+	got := <-readDone
+	if len(got) > 0 && got[0] != want[0] {
+		t.Errorf("first byte copied is %d; want %d", got[0], want[0])
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("copied %d bytes differ from the %d bytes after offset %d", len(got), len(want), off)
+	}
+}
+
+// readAheadConn is a SpliceConn which reads its TCP connection through a
+// bufio.Reader, and so may only be spliced while nothing is buffered. It
+// embeds a Conn rather than the *TCPConn, whose WriteTo method would read
+// past the buffer.
+type readAheadConn struct {
+	Conn
+	br *bufio.Reader
+}
+
+func (c *readAheadConn) Read(b []byte) (int, error) { return c.br.Read(b) }
+func (c *readAheadConn) CanSplice() bool            { return c.br.Buffered() == 0 }
+
+func (c *readAheadConn) SyscallConn() (syscall.RawConn, error) {
+	return c.Conn.(*TCPConn).SyscallConn()
+}
+
+func testSpliceExpiredDeadline(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+	if _, err := srv.Write([]byte("expired")); err != nil {
+		t.Fatal(err)
+	}
+	dst.SetWriteDeadline(time.Now().Add(-time.Second))
+
+	start := time.Now()
+	n, err := dst.ReadFrom(src)
+	if ne, ok := err.(Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v; want timeout", err)
+	}
+	if n != 0 {
+		t.Errorf("copied %d bytes past the deadline", n)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expired deadline took %v to report", d)
+	}
+}
+
+func testSpliceSimple(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	copyDone := srv.Copy()
+	msg1 := []byte("splice test part 1 ")
+	msg2 := []byte(" splice test part 2")
+	if _, err := srv.Write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Write(msg2); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg1)+len(msg2))
+	if _, err := io.ReadFull(srv, got); err != nil {
+		t.Fatal(err)
+	}
+	if want := append(msg1, msg2...); !bytes.Equal(got, want) {
+		t.Errorf("got %q, wrote %q", got, want)
+	}
+	srv.CloseWrite()
+	srv.CloseRead()
+	if err := <-copyDone; err != nil {
+		t.Errorf("splice: %v", err)
+	}
+}
+
+func testSpliceBig(t *testing.T) {
+	size := 1<<31 - 1
+	if testing.Short() {
+		size = 1 << 25
+	}
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	big := make([]byte, size)
+	copyDone := srv.Copy()
+	type readResult struct {
+		b   []byte
+		err error
+	}
+	readDone := make(chan readResult)
+	go func() {
+		got := make([]byte, len(big))
+		_, err := io.ReadFull(srv, got)
+		readDone <- readResult{got, err}
+	}()
+	if _, err := srv.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	res := <-readDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	got := res.b
+	if !bytes.Equal(got, big) {
+		t.Errorf("input and output differ")
+	}
+	srv.CloseWrite()
+	srv.CloseRead()
+	if err := <-copyDone; err != nil {
+		t.Errorf("splice: %v", err)
+	}
+}
+
+func testSpliceHonorsLimitedReader(t *testing.T) {
+	t.Run("stopsAfterN", testSpliceStopsAfterN)
+	t.Run("updatesN", testSpliceUpdatesN)
+}
+
+func testSpliceStopsAfterN(t *testing.T) {
+	clientUp, serverUp, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientUp.Close()
+	defer serverUp.Close()
+	clientDown, serverDown, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDown.Close()
+	defer serverDown.Close()
+	count := 128
+	copyDone := make(chan error)
+	lr := &io.LimitedReader{
+		N: int64(count),
+		R: serverUp,
+	}
+	go func() {
+		_, err := io.Copy(serverDown, lr)
+		serverDown.Close()
+		copyDone <- err
+	}()
+	msg := make([]byte, 2*count)
+	if _, err := clientUp.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	clientUp.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, clientDown); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != count {
+		t.Errorf("splice transferred %d bytes, want to stop after %d", buf.Len(), count)
+	}
+	clientDown.Close()
+	if err := <-copyDone; err != nil {
+		t.Errorf("splice: %v", err)
+	}
+}
+
+func testSpliceUpdatesN(t *testing.T) {
+	clientUp, serverUp, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientUp.Close()
+	defer serverUp.Close()
+	clientDown, serverDown, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDown.Close()
+	defer serverDown.Close()
+	count := 128
+	copyDone := make(chan error)
+	lr := &io.LimitedReader{
+		N: int64(100 + count),
+		R: serverUp,
+	}
+	go func() {
+		_, err := io.Copy(serverDown, lr)
+		copyDone <- err
+	}()
+	msg := make([]byte, count)
+	if _, err := clientUp.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	clientUp.Close()
+	got := make([]byte, count)
+	if _, err := io.ReadFull(clientDown, got); err != nil {
+		t.Fatal(err)
+	}
+	clientDown.Close()
+	if err := <-copyDone; err != nil {
+		t.Errorf("splice: %v", err)
+	}
+	wantN := int64(100)
+	if lr.N != wantN {
+		t.Errorf("lr.N = %d, want %d", lr.N, wantN)
+	}
+}
+
+func testSpliceReaderAtEOF(t *testing.T) {
+	clientUp, serverUp, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientUp.Close()
+	defer serverUp.Close()
+	clientDown, serverDown, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDown.Close()
+	defer serverDown.Close()
+
+	serverUp.Close()
+	_, err, handled := splice(serverDown.(*TCPConn).fd, serverUp, nil, nil, noDeadline)
+	if !handled {
+		t.Errorf("closed connection: got err = %v, handled = %t, want handled = true", err, handled)
+	}
+	lr := &io.LimitedReader{
+		N: 0,
+		R: serverUp,
+	}
+	_, err, handled = splice(serverDown.(*TCPConn).fd, lr, nil, nil, noDeadline)
+	if !handled {
+		t.Errorf("exhausted LimitedReader: got err = %v, handled = %t, want handled = true", err, handled)
+	}
+}
+
+// streamEndRelays are the relays, by ReadFrom if rl is nil, whose
+// handling of the end of a stream testSpliceHalfClosedSource and
+// testSpliceTrailingBurst check.
+var streamEndRelays = []struct {
+	name string
+	rl   *Relay
+}{
+	{"readFrom", nil},
+	{"throughputMode", &Relay{Mode: ThroughputMode}},
+	{"drainLimit", &Relay{DrainLimit: 1000}},
+	{"lowWater", &Relay{LowWater: 32 << 10}},
+}
+
+// testSpliceHalfClosedSource checks that a relay from a connection whose
+// peer has sent its data and then closed its side of the connection
+// delivers every byte before it reports EOF.
+func testSpliceHalfClosedSource(t *testing.T) {
+	for _, r := range streamEndRelays {
+		for _, size := range []int{1, 4095, 65537, 1<<20 + 3} {
+			t.Run(fmt.Sprintf("%s/%d", r.name, size), func(t *testing.T) {
+				testSpliceHalfClosedSourceSize(t, r.rl, size)
+			})
+		}
+	}
+}
+
+func testSpliceHalfClosedSourceSize(t *testing.T, rl *Relay, size int) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	want := spliceTestData(size)
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := srv.Write(want)
+		srv.CloseWrite()
+		writeDone <- err
+	}()
+	// Let the data, and for small sizes the FIN after it, reach the
+	// source before the relay starts, so that the relay finds data
+	// followed by EOF.
+	buffered := size
+	if buffered > 32<<10 {
+		buffered = 32 << 10
+	}
+	if err := waitInq(srv.serverUp.(*TCPConn), buffered); err != nil {
+		t.Fatal(err)
+	}
+	if size == buffered {
+		if err := <-writeDone; err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	readDone := make(chan error, 1)
+	var got []byte
+	go func() {
+		var err error
+		got, err = ioutil.ReadAll(srv)
+		readDone <- err
+	}()
+	var n int64
+	if rl == nil {
+		n, err = srv.serverDown.(*TCPConn).ReadFrom(srv.serverUp)
+	} else {
+		n, err = rl.Copy(srv.serverDown, srv.serverUp)
+	}
+	if err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	if n != int64(size) {
+		t.Errorf("relayed %d bytes; want %d", n, size)
+	}
+	if size != buffered {
+		if err := <-writeDone; err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.serverDown.(*TCPConn).CloseWrite()
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes which differ from %d bytes sent", len(got), len(want))
+	}
+}
+
+// testSpliceTrailingBurst checks that a relay which is waiting on its
+// source delivers every byte of a burst which the peer sends and then
+// closes the connection after at once, so that the FIN closely follows
+// the last data segment.
+func testSpliceTrailingBurst(t *testing.T) {
+	for _, r := range streamEndRelays {
+		for _, size := range []int{1, 4095, 65537} {
+			t.Run(fmt.Sprintf("%s/%d", r.name, size), func(t *testing.T) {
+				for i := 0; i < 10; i++ {
+					testSpliceTrailingBurstSize(t, r.rl, size)
+				}
+			})
+		}
+	}
+}
+
+func testSpliceTrailingBurstSize(t *testing.T, rl *Relay, size int) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	const lead = "lead"
+	want := make([]byte, len(lead)+size)
+	copy(want, lead)
+	for i := len(lead); i < len(want); i++ {
+		want[i] = byte(i % 251)
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	copyDone := make(chan result, 1)
+	go func() {
+		var r result
+		if rl == nil {
+			r.n, r.err = srv.serverDown.(*TCPConn).ReadFrom(srv.serverUp)
+		} else {
+			r.n, r.err = rl.Copy(srv.serverDown, srv.serverUp)
+		}
+		srv.serverDown.(*TCPConn).CloseWrite()
+		copyDone <- r
+	}()
+
+	// Once the lead has gone through, the relay waits for more.
+	if _, err := srv.Write(want[:len(lead)]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(lead))
+	if _, err := io.ReadFull(srv, got); err != nil {
+		t.Fatal(err)
+	}
+	// The burst goes out in a few writes, and the close right after.
+	writeDone := make(chan error, 1)
+	go func() {
+		rest := want[len(lead):]
+		for len(rest) > 0 {
+			m := len(rest)/2 + 1
+			if _, err := srv.Write(rest[:m]); err != nil {
+				writeDone <- err
+				return
+			}
+			rest = rest[m:]
+		}
+		writeDone <- srv.clientUp.Close()
+	}()
+
+	tail, err := ioutil.ReadAll(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, tail...)
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+	r := <-copyDone
+	if r.err != nil {
+		t.Errorf("relay: %v", r.err)
+	}
+	if r.n != int64(len(want)) {
+		t.Errorf("relayed %d bytes; want %d", r.n, len(want))
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received %d bytes which differ from %d bytes sent", len(got), len(want))
+	}
+}
+
+// waitInq waits until at least n bytes are queued for reading on c.
+func waitInq(c *TCPConn, n int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, n)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		var m int
+		var rerr error
+		if err := rc.Control(func(fd uintptr) {
+			m, _, rerr = syscall.Recvfrom(int(fd), b, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		}); err != nil {
+			return err
+		}
+		if rerr != nil && rerr != syscall.EAGAIN {
+			return os.NewSyscallError("recvfrom", rerr)
+		}
+		if m >= n {
+			return nil
+		}
+	}
+	return fmt.Errorf("fewer than %d bytes queued after 5s", n)
+}
+
+// testSpliceBufferedHandshake simulates a proxy that reads a handshake
+// through a bufio.Reader, which leaves part of the tunneled payload
+// buffered in userspace, before relaying the rest of the connection.
+// io.Copy hands the bufio.Reader to its WriteTo method, which flushes
+// the buffered bytes and then lets the destination splice from the
+// underlying connection.
+func testSpliceBufferedHandshake(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	const handshake = "CONNECT example.com:443 HTTP/1.1\r\n\r\n"
+	payload := spliceTestData(1 << 20)
+
+	copyDone := make(chan error, 1)
+	go func() {
+		defer srv.serverDown.(*TCPConn).CloseWrite()
+		br := bufio.NewReader(srv.serverUp)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				copyDone <- err
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+		}
+		if br.Buffered() == 0 {
+			copyDone <- fmt.Errorf("no tunneled bytes buffered during handshake")
+			return
+		}
+		_, err := io.Copy(srv.serverDown, br)
+		copyDone <- err
+	}()
+
+	// Send the handshake and the start of the tunneled stream in a
+	// single write, so the handshake read buffers some of the payload.
+	if _, err := srv.Write(append([]byte(handshake), payload[:512]...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Write(payload[512:]); err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseWrite()
+
+	got, err := ioutil.ReadAll(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("relayed %d bytes differ from %d byte payload", len(got), len(payload))
+	}
+	if err := <-copyDone; err != nil {
+		t.Errorf("relay: %v", err)
+	}
+}
+
+func testSpliceDiscardPadding(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	const (
+		payloadLen = 1 << 18
+		paddingLen = 1<<16 + 7
+		next       = "next frame"
+	)
+	frame := make([]byte, payloadLen+paddingLen)
+	for i := range frame[:payloadLen] {
+		frame[i] = byte(i % 253)
+	}
+	for i := range frame[payloadLen:] {
+		frame[payloadLen+i] = 0xff
+	}
+
+	type relayResult struct {
+		discarded int64
+		next      []byte
+		err       error
+	}
+	relayDone := make(chan relayResult, 1)
+	go func() {
+		var res relayResult
+		defer func() { relayDone <- res }()
+		if _, res.err = io.CopyN(srv.serverDown, srv.serverUp, payloadLen); res.err != nil {
+			return
+		}
+		if res.discarded, res.err = srv.serverUp.(*TCPConn).Discard(paddingLen); res.err != nil {
+			return
+		}
+		res.next = make([]byte, len(next))
+		_, res.err = io.ReadFull(srv.serverUp, res.next)
+	}()
+
+	if _, err := srv.Write(append(frame, next...)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, payloadLen)
+	if _, err := io.ReadFull(srv, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame[:payloadLen]) {
+		t.Error("relayed payload differs from frame payload")
+	}
+	res := <-relayDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.discarded != paddingLen {
+		t.Errorf("discarded %d bytes, want %d", res.discarded, paddingLen)
+	}
+	if string(res.next) != next {
+		t.Errorf("read %q after padding, want %q", res.next, next)
+	}
+
+	// Discarding past EOF reports how much was skipped.
+	srv.Write(make([]byte, 10))
+	srv.CloseWrite()
+	n, err := srv.serverUp.(*TCPConn).Discard(20)
+	if n != 10 || err != io.EOF {
+		t.Errorf("Discard past EOF = %d, %v; want 10, EOF", n, err)
+	}
+}
+
+// testSpliceSmallSendBuffer checks that relays whose pipes are much
+// larger than the send buffer of the destination still move data
+// intact, and at a reasonable rate: handed a whole pipe at once, a
+// socket with a tiny send buffer used to idle on every write.
+func testSpliceSmallSendBuffer(t *testing.T) {
+	defer func(size int) { testHookRelayPipeSize = size }(testHookRelayPipeSize)
+	for _, tt := range []struct {
+		name     string
+		rl       *Relay
+		pipeSize int
+	}{
+		{"default", nil, 0},
+		{"drainLimit", &Relay{DrainLimit: 16 << 10}, 0},
+		{"adaptivePipe", &Relay{AdaptivePipe: true}, 0},
+		{"throughputMode", &Relay{Mode: ThroughputMode}, 0},
+		{"bigPipe", &Relay{}, 1 << 20},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testHookRelayPipeSize = tt.pipeSize
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			// The kernel raises the buffer to its minimum.
+			if err := srv.serverDown.(*TCPConn).SetWriteBuffer(1); err != nil {
+				t.Fatal(err)
+			}
+			srv.relay = tt.rl
+			data := spliceTestData(1 << 23)
+			res := srv.transfer(data)
+			checkTransfer(t, data, res)
+			if res.elapsed > 2*time.Second {
+				t.Errorf("relay took %v", res.elapsed)
+			}
+		})
+	}
+}
+
+// testSpliceLowWaterShortData checks that a relay with a low water mark
+// above the data available still returns promptly, whether the copy ends
+// at EOF or at the limit of an io.LimitedReader, and that the source's
+// low water mark is restored afterwards.
+func testSpliceLowWaterShortData(t *testing.T) {
+	for _, limited := range []bool{false, true} {
+		name := "eof"
+		if limited {
+			name = "limitedReader"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			// The relay drains the first chunk as soon as it
+			// starts, and then waits for the second one, which
+			// is less than its low water mark.
+			const size = 100
+			if _, err := srv.Write(make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitInq(srv.serverUp.(*TCPConn), size); err != nil {
+				t.Fatal(err)
+			}
+			rl := &Relay{LowWater: 32 << 10}
+			copyDone := make(chan error, 1)
+			go func() {
+				var src io.Reader = srv.serverUp
+				if limited {
+					src = io.LimitReader(src, 2*size)
+				}
+				n, err := rl.Copy(srv.serverDown, src)
+				if err == nil && n != 2*size {
+					err = fmt.Errorf("relayed %d bytes; want %d", n, 2*size)
+				}
+				copyDone <- err
+			}()
+			time.Sleep(10 * time.Millisecond)
+			if _, err := srv.Write(make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+			if !limited {
+				srv.CloseWrite()
+			}
+			select {
+			case err := <-copyDone:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay still waiting for data above its low water mark")
+			}
+			if st := rl.Stats(); st.Reads == 0 || st.ReadBytes != 2*size {
+				t.Errorf("got %+v; want %d bytes spliced", st, 2*size)
+			}
+
+			rc, err := srv.serverUp.(*TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lowat int
+			var serr error
+			if err := rc.Control(func(fd uintptr) {
+				lowat, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVLOWAT)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if serr != nil {
+				t.Fatal(serr)
+			}
+			if lowat != 1 {
+				t.Errorf("SO_RCVLOWAT = %d after the relay; want 1", lowat)
+			}
+		})
+	}
+}
+
+func testSpliceCancelDuringWaitWrite(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		srv.Close()
+		wg.Wait()
+	}()
+
+	// Nothing reads from the downstream connection, so once the
+	// socket buffers fill up the relay blocks waiting to pump the
+	// data in its pipe.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		chunk := make([]byte, 1<<16)
+		for {
+			if _, err := srv.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	pipesClosed := 0
+	origClose := poll.CloseFunc
+	poll.CloseFunc = func(fd int) error {
+		var st syscall.Stat_t
+		if syscall.Fstat(fd, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFIFO {
+			mu.Lock()
+			pipesClosed++
+			mu.Unlock()
+		}
+		return origClose(fd)
+	}
+	defer func() { poll.CloseFunc = origClose }()
+
+	ngr := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := new(Relay).CopyContext(ctx, srv.serverDown, srv.serverUp)
+		copyDone <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-copyDone:
+		if oe, ok := err.(*OpError); !ok || oe.Err != errCanceled {
+			t.Fatalf("got %v; want OpError with Err == errCanceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop after cancel")
+	}
+	mu.Lock()
+	if pipesClosed < 2 {
+		t.Errorf("closed %d pipe descriptors; want 2", pipesClosed)
+	}
+	mu.Unlock()
+	for i := 0; runtime.NumGoroutine() > ngr; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines after cancel; want %d", runtime.NumGoroutine(), ngr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testSpliceCancelBetweenPumps(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		srv.Close()
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		chunk := make([]byte, 1<<12)
+		for {
+			if _, err := srv.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	relayed := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, _ := io.CopyN(ioutil.Discard, srv, 1<<20)
+		if n == 1<<20 {
+			close(relayed)
+		}
+		io.Copy(ioutil.Discard, srv)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	copyDone := make(chan error, 1)
+	var written int64
+	go func() {
+		var err error
+		written, err = new(Relay).CopyContext(ctx, srv.serverDown, srv.serverUp)
+		copyDone <- err
+	}()
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay made no progress")
+	}
+	cancel()
+
+	select {
+	case err := <-copyDone:
+		if oe, ok := err.(*OpError); !ok || oe.Err != errCanceled {
+			t.Fatalf("got %v; want OpError with Err == errCanceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop after cancel")
+	}
+	if written < 1<<20 {
+		t.Errorf("relayed %d bytes; want at least %d", written, 1<<20)
+	}
+
+	// The deadlines used to interrupt the relay must not outlive it.
+	if _, err := srv.serverUp.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after cancel: %v", err)
+	}
+}
+
+func TestSplicerBuffered(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Each frame is a 2-byte length followed by the body. All of
+	// the frames are sent before the first one is relayed, so
+	// the Splicer drains the following frames into its pipe.
+	bodies := [][]byte{
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("b"), 3000),
+		bytes.Repeat([]byte("c"), 7),
+	}
+	var stream []byte
+	for _, body := range bodies {
+		stream = append(stream, byte(len(body)>>8), byte(len(body)))
+		stream = append(stream, body...)
+	}
+	if _, err := srv.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseWrite()
+
+	sp := NewSplicer(srv.serverUp.(*TCPConn))
+	defer sp.Close()
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(srv.serverUp, hdr); err != nil {
+		t.Fatal(err)
+	}
+	for i, body := range bodies {
+		if n := int(hdr[0])<<8 | int(hdr[1]); n != len(body) {
+			t.Fatalf("frame %d: header says %d bytes; want %d", i, n, len(body))
+		}
+		n, err := sp.SpliceTo(srv.serverDown.(*TCPConn), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(body)) {
+			t.Fatalf("frame %d: spliced %d bytes; want %d", i, n, len(body))
+		}
+		if i == len(bodies)-1 {
+			break
+		}
+		if _, err := io.ReadFull(sp.Buffered(), hdr); err != nil {
+			t.Fatalf("frame %d: reading next header from buffer: %v", i, err)
+		}
+	}
+	if n, err := sp.Buffered().Read(hdr); n != 0 || err != io.EOF {
+		t.Errorf("buffer after last frame: got (%d, %v); want (0, EOF)", n, err)
+	}
+	if _, err := sp.SpliceTo(srv.serverDown.(*TCPConn), 1); err != io.EOF {
+		t.Errorf("splice past EOF: got %v; want EOF", err)
+	}
+
+	srv.serverDown.(*TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Join(bodies, nil); !bytes.Equal(got, want) {
+		t.Errorf("relayed %d bytes differ from the %d body bytes", len(got), len(want))
+	}
+}
+
+func TestSplicerAbort(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	want := spliceTestData(1 << 23)
+	go srv.Write(want)
+
+	// Nothing reads from the downstream connection, so the transfer
+	// stalls with the pipe full, until the write deadline aborts it.
+	sp := NewSplicer(srv.serverUp.(*TCPConn))
+	defer sp.Close()
+	srv.serverDown.(*TCPConn).SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := sp.SpliceTo(srv.serverDown.(*TCPConn), int64(len(want)))
+	if ne, ok := err.(Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v; want timeout", err)
+	}
+
+	var one [1]byte
+	if m, err := sp.Abort(one[:]); m != 1 || err != io.ErrShortBuffer {
+		t.Fatalf("Abort with a 1-byte buffer: got (%d, %v); want (1, %v)", m, err, io.ErrShortBuffer)
+	}
+	rest := make([]byte, len(want))
+	m, err := sp.Abort(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == 0 {
+		t.Fatal("no data was buffered when the transfer was aborted")
+	}
+	aborted := append(one[:], rest[:m]...)
+
+	// Every byte must be either at the destination, in the abort
+	// buffer, or still readable from the source.
+	got := make([]byte, n, len(want))
+	if _, err := io.ReadFull(srv, got); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, aborted...)
+	tail := make([]byte, len(want)-len(got))
+	if _, err := io.ReadFull(srv.serverUp, tail); err != nil {
+		t.Fatalf("reading the source after Abort: %v", err)
+	}
+	got = append(got, tail...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("relayed %d, aborted %d and read %d bytes, which differ from the %d bytes written", n, len(aborted), len(tail), len(want))
+	}
+}
+
+func TestSplicerCloseWith(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy ResidualPolicy
+	}{
+		{"discard", DiscardResidual},
+		{"flush", FlushResidual},
+		{"drain", DrainResidual},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testSplicerCloseWith(t, tt.policy)
+		})
+	}
+}
+
+func testSplicerCloseWith(t *testing.T, policy ResidualPolicy) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	// The Splicer drains the rest along with the first part, and
+	// is closed while the source is still open.
+	first := bytes.Repeat([]byte("a"), 1000)
+	rest := bytes.Repeat([]byte("b"), 3000)
+	if _, err := srv.Write(append(first, rest...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitInq(src, len(first)+len(rest)); err != nil {
+		t.Fatal(err)
+	}
+	fds := SpliceFDs()
+	sp := NewSplicer(src)
+	if _, err := sp.SpliceTo(dst, int64(len(first))); err != nil {
+		t.Fatal(err)
+	}
+	residual, err := sp.CloseWith(policy, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pipe still holding data can't be reused, so it is closed.
+	if n := SpliceFDs(); policy == DiscardResidual && n > fds {
+		t.Errorf("%d splice fds after close; want at most %d", n, fds)
+	}
+	if n, err := sp.Buffered().Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("buffer after close: got (%d, %v); want (0, EOF)", n, err)
+	}
+
+	dst.CloseWrite()
+	got, err := ioutil.ReadAll(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGot, wantResidual := first, []byte(nil)
+	switch policy {
+	case FlushResidual:
+		wantGot = append(first, rest...)
+	case DrainResidual:
+		wantResidual = rest
+	}
+	if !bytes.Equal(got, wantGot) {
+		t.Errorf("destination received %d bytes; want %d", len(got), len(wantGot))
+	}
+	if !bytes.Equal(residual, wantResidual) {
+		t.Errorf("residual of %d bytes; want %d", len(residual), len(wantResidual))
+	}
+}
+
+// TestSplicerPause pauses a Splicer in the middle of a transfer, checks
+// that the Splicer stops draining its source, so that TCP flow control
+// stops the sender, and then resumes the transfer to its end.
+func TestSplicerPause(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// Small socket buffers make the sender block soon after the
+	// Splicer stops draining the source.
+	if err := srv.clientUp.(*TCPConn).SetWriteBuffer(32 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.serverUp.(*TCPConn).SetReadBuffer(32 << 10); err != nil {
+		t.Fatal(err)
+	}
+
+	const total = 8 << 20
+	want := spliceTestData(total)
+	// The writer sends the first part, and the rest once the
+	// Splicer is paused in the middle of the transfer.
+	const first = 1 << 20
+	var sent, received int64
+	paused := make(chan struct{})
+	go func() {
+		for b := want; len(b) > 0; {
+			if len(b) == total-first {
+				select {
+				case <-paused:
+				case <-time.After(5 * time.Second):
+					return
+				}
+			}
+			n, err := srv.Write(b[:32<<10])
+			atomic.AddInt64(&sent, int64(n))
+			if err != nil {
+				return
+			}
+			b = b[n:]
+		}
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		var got []byte
+		b := make([]byte, 32<<10)
+		for {
+			n, err := srv.Read(b)
+			got = append(got, b[:n]...)
+			atomic.AddInt64(&received, int64(n))
+			if err != nil {
+				readDone <- got
+				return
+			}
+		}
+	}()
+
+	sp := NewSplicer(srv.serverUp.(*TCPConn))
+	defer sp.Close()
+	type result struct {
+		n   int64
+		err error
+	}
+	spliceDone := make(chan result, 1)
+	go func() {
+		n, err := sp.SpliceTo(srv.serverDown.(*TCPConn), total)
+		srv.serverDown.(*TCPConn).CloseWrite()
+		spliceDone <- result{n, err}
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the first part", func() bool { return atomic.LoadInt64(&received) == first })
+	sp.Pause()
+	sp.Pause()
+	close(paused)
+	// Once what was in flight has landed, the sender is blocked.
+	last := int64(-1)
+	waitFor("the sender to block", func() bool {
+		s := atomic.LoadInt64(&sent)
+		stalled := s == last
+		last = s
+		time.Sleep(50 * time.Millisecond)
+		return stalled
+	})
+	s, r := atomic.LoadInt64(&sent), atomic.LoadInt64(&received)
+	if s == total {
+		t.Fatal("sender sent everything while the Splicer was paused")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s1, r1 := atomic.LoadInt64(&sent), atomic.LoadInt64(&received); s1 != s || r1 != r {
+		t.Fatalf("while paused, sent went from %d to %d and received from %d to %d; want no progress", s, s1, r, r1)
+	}
+
+	sp.Resume()
+	sp.Resume()
+	select {
+	case res := <-spliceDone:
+		if res.err != nil || res.n != total {
+			t.Fatalf("SpliceTo = %d, %v; want %d, <nil>", res.n, res.err, total)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("SpliceTo did not complete after Resume")
+	}
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("relayed %d bytes differ from %d bytes sent", len(got), len(want))
+	}
+}
+
+// tcpSegsOut returns the number of segments sent on c, from the
+// tcpi_segs_out field of struct tcp_info, which Linux 4.2 added.
+func tcpSegsOut(t *testing.T, c *TCPConn) (int, bool) {
+	t.Helper()
+	// tcpi_segs_out follows the 136 bytes before it.
+	var info [35]uint32
+	size := uint32(unsafe.Sizeof(info))
+	var err error
+	if cerr := c.fd.pfd.RawControl(func(s uintptr) {
+		err = getsockopt(int(s), syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&info), &size)
+	}); cerr != nil || err != nil {
+		t.Fatalf("TCP_INFO: %v, %v", cerr, err)
+	}
+	if size < uint32(unsafe.Sizeof(info)) {
+		return 0, false
+	}
+	return int(info[34]), true
+}
+
+// TestSplicerCombine transfers many small frames with a Splicer, with
+// and without combining their writes, and counts the TCP segments
+// which carry them.
+func TestSplicerCombine(t *testing.T) {
+	const (
+		frames    = 1000
+		frameSize = 100
+	)
+	transfer := func(combine int) (segs int) {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+		want := spliceTestData(frames * frameSize)
+		if _, err := srv.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(srv)
+			readDone <- b
+		}()
+		segs0, ok := tcpSegsOut(t, dst)
+		if !ok {
+			t.Skip("kernel doesn't report segments sent")
+		}
+
+		sp := NewSplicer(src)
+		sp.Combine = combine
+		for i := 0; i < frames; i++ {
+			if _, err := sp.SpliceTo(dst, frameSize); err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+		}
+		if combine > 0 {
+			// The last frames are held until flushed.
+			if sp.s.combinedDst() != dst {
+				t.Errorf("combine %d: no data held after the last frame", combine)
+			}
+			if err := sp.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		segs1, _ := tcpSegsOut(t, dst)
+		if err := sp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst.CloseWrite()
+		if got := <-readDone; !bytes.Equal(got, want) {
+			t.Errorf("combine %d: relayed %d bytes differ from %d bytes sent", combine, len(got), len(want))
+		}
+		return segs1 - segs0
+	}
+
+	separate := transfer(0)
+	combined := transfer(16 << 10)
+	t.Logf("%d frames of %d bytes: %d segments separately, %d combined", frames, frameSize, separate, combined)
+	// 100000 bytes in bursts of 16 KiB take 7 segments. Without
+	// combining, TCP autocorking already merges some of the frames
+	// which it finds queued behind others.
+	if combined > 20 || combined*3 > separate {
+		t.Errorf("combining sent %d segments, %d without; want far fewer", combined, separate)
+	}
+}
+
+func TestSpliceToFile(t *testing.T) {
+	if addr := os.Getenv("GOTEST_SPLICE_STDOUT_ADDR"); addr != "" {
+		// In child process: dump the connection to stdout, like
+		// a command line tool would, and report whether it was
+		// spliced on stderr.
+		var spliced bool
+		testHookSpliceToFile = func(handled bool) { spliced = handled }
+		c, err := Dial("tcp", addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if _, err := io.Copy(os.Stdout, c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "spliced=%v", spliced)
+		os.Exit(0)
+	}
+
+	t.Run("file", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "splice-stdout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		got := testSpliceToStdout(t, f, true, func() ([]byte, error) {
+			return ioutil.ReadFile(f.Name())
+		})
+		if !bytes.Equal(got, spliceToFileData) {
+			t.Errorf("stdout holds %d bytes which differ from the %d bytes sent", len(got), len(spliceToFileData))
+		}
+	})
+	t.Run("pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			readDone <- b
+		}()
+		got := testSpliceToStdout(t, w, true, func() ([]byte, error) {
+			w.Close()
+			return <-readDone, nil
+		})
+		if !bytes.Equal(got, spliceToFileData) {
+			t.Errorf("stdout delivered %d bytes which differ from the %d bytes sent", len(got), len(spliceToFileData))
+		}
+	})
+	t.Run("terminal", func(t *testing.T) {
+		master, slave, err := openPty()
+		if err != nil {
+			t.Skipf("no pseudo-terminal: %v", err)
+		}
+		defer master.Close()
+		readDone := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, len(spliceToFileData))
+			n, _ := io.ReadFull(master, b)
+			readDone <- b[:n]
+		}()
+		got := testSpliceToStdout(t, slave, false, func() ([]byte, error) {
+			slave.Close()
+			return <-readDone, nil
+		})
+		if !bytes.Equal(got, spliceToFileData) {
+			t.Errorf("terminal received %d bytes which differ from the %d bytes sent", len(got), len(spliceToFileData))
+		}
+	})
+	t.Run("ptyMaster", func(t *testing.T) {
+		master, slave, err := openPty()
+		if err != nil {
+			t.Skipf("no pseudo-terminal: %v", err)
+		}
+		defer slave.Close()
+		if err := makeRaw(slave); err != nil {
+			master.Close()
+			t.Fatal(err)
+		}
+		readDone := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, len(spliceToFileData))
+			n, _ := io.ReadFull(slave, b)
+			readDone <- b[:n]
+		}()
+		got := testSpliceToStdout(t, master, true, func() ([]byte, error) {
+			defer master.Close()
+			return <-readDone, nil
+		})
+		if !bytes.Equal(got, spliceToFileData) {
+			t.Errorf("terminal received %d bytes which differ from the %d bytes sent", len(got), len(spliceToFileData))
+		}
+	})
+}
+
+// TestSpliceToPipeClose copies a connection to the write end of a pipe
+// made by os.Pipe, which must be left in non-blocking mode: Close then
+// interrupts a later write blocked on the full pipe.
+func TestSpliceToPipeClose(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	defer func(hook func(bool)) { testHookSpliceToFile = hook }(testHookSpliceToFile)
+	var spliced bool
+	testHookSpliceToFile = func(handled bool) { spliced = handled }
+
+	want := spliceTestData(1 << 20)
+	readDone := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, len(want))
+		n, _ := io.ReadFull(r, b)
+		readDone <- b[:n]
+	}()
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, server)
+		copyDone <- err
+	}()
+	if _, err := client.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := <-copyDone; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("pipe delivered %d bytes which differ from the %d bytes sent", len(got), len(want))
+	}
+	if !spliced {
+		t.Error("copy to the pipe was not spliced")
+	}
+
+	// Nothing reads the pipe any more, so the write blocks.
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 1<<20))
+		writeDone <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	w.Close()
+	select {
+	case err := <-writeDone:
+		if err == nil {
+			t.Error("write to the closed pipe succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		// Closing the read end releases the write.
+		r.Close()
+		t.Fatal("Close did not interrupt a write blocked on the pipe")
+	}
+}
+
+// spliceToFileData is sent to the stdout of the child processes of
+// TestSpliceToFile. It has no newlines, which a terminal would
+// translate.
+var spliceToFileData = bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+
+// testSpliceToStdout runs a child process which copies a connection to
+// its stdout, stdout, and returns what the child wrote, as reported by
+// output after the child exits.
+func testSpliceToStdout(t *testing.T, stdout *os.File, wantSpliced bool, output func() ([]byte, error)) []byte {
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSpliceToFile$")
+	cmd.Env = append(os.Environ(), "GOTEST_SPLICE_STDOUT_ADDR="+ln.Addr().String())
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal(err)
+	}
+	_, err = c.Write(spliceToFileData)
+	c.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child: %v: %s", err, stderr.Bytes())
+	}
+	if want := fmt.Sprintf("spliced=%v", wantSpliced); stderr.String() != want {
+		t.Errorf("child reported %q; want %q", stderr.String(), want)
+	}
+	b, err := output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriteToLog(t *testing.T) {
+	t.Run("spliced", func(t *testing.T) {
+		testWriteToLog(t, os.O_WRONLY, SyncPolicy{Bytes: 1 << 18, Interval: 20 * time.Millisecond}, true)
+	})
+	t.Run("fdatasync", func(t *testing.T) {
+		testWriteToLog(t, os.O_WRONLY, SyncPolicy{Bytes: 1 << 18, Interval: 20 * time.Millisecond, DataOnly: true}, true)
+	})
+	t.Run("append", func(t *testing.T) {
+		testWriteToLog(t, os.O_WRONLY|os.O_APPEND, SyncPolicy{Bytes: 1 << 18, Interval: 20 * time.Millisecond}, false)
+	})
+}
+
+// testWriteToLog copies a stream to the end of a log file opened with
+// flag, checking that the file is synced while the connection is quiet,
+// and that it holds all of the data when WriteToLog returns.
+func testWriteToLog(t *testing.T, flag int, policy SyncPolicy, wantSpliced bool) {
+	tmp, err := ioutil.TempFile("", "splice-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	const header = "log header\n"
+	tmp.WriteString(header)
+	tmp.Close()
+	f, err := os.OpenFile(tmp.Name(), flag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	var syncs int32
+	synced := make(chan bool, 1)
+	defer func() { testHookLogSync = func(error) {} }()
+	testHookLogSync = func(err error) {
+		if err != nil {
+			t.Errorf("sync: %v", err)
+		}
+		atomic.AddInt32(&syncs, 1)
+		select {
+		case synced <- true:
+		default:
+		}
+	}
+	var spliced bool
+	defer func() { testHookSpliceToFile = func(bool) {} }()
+	testHookSpliceToFile = func(handled bool) { spliced = handled }
+
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	data := spliceTestData(1<<20 + 1<<10)
+	writeDone := make(chan error, 1)
+	go func() {
+		defer client.(*TCPConn).CloseWrite()
+		// Less than policy.Bytes, then a pause: only the interval
+		// has the file synced.
+		if _, err := client.Write(data[:1<<10]); err != nil {
+			writeDone <- err
+			return
+		}
+		select {
+		case <-synced:
+		case <-time.After(5 * time.Second):
+			writeDone <- errors.New("file not synced while the connection was quiet")
+			return
+		}
+		_, err := client.Write(data[1<<10:])
+		writeDone <- err
+	}()
+
+	n, err := server.(*TCPConn).WriteToLog(f, policy)
+	if werr := <-writeDone; werr != nil {
+		t.Fatal(werr)
+	}
+	if err != nil {
+		t.Fatalf("WriteToLog: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("WriteToLog copied %d bytes; want %d", n, len(data))
+	}
+	if spliced != wantSpliced {
+		t.Errorf("spliced: %v; want %v", spliced, wantSpliced)
+	}
+	// One sync while the connection was quiet, and the last one.
+	if n := atomic.LoadInt32(&syncs); n < 2 {
+		t.Errorf("file synced %d times; want at least 2", n)
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != int64(len(header)+len(data)) {
+		t.Errorf("file offset %d, %v; want %d", off, err, len(header)+len(data))
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte(header), data...); !bytes.Equal(got, want) {
+		t.Errorf("log holds %d bytes which differ from the %d bytes written", len(got), len(want))
+	}
+}
+
+// openPty opens a new pseudo-terminal, and returns its master and slave
+// sides. The master is left in non-blocking mode, without which a relay
+// doesn't splice it.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fileSysfd(master)), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, nil, os.NewSyscallError("ioctl", errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fileSysfd(master)), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		master.Close()
+		return nil, nil, os.NewSyscallError("ioctl", errno)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// makeRaw puts the terminal f into raw mode, in which data passes
+// through it unchanged and is not echoed.
+func makeRaw(f *os.File) error {
+	var tio syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&tio))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	tio.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	tio.Oflag &^= syscall.OPOST
+	tio.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	tio.Cflag &^= syscall.CSIZE | syscall.PARENB
+	tio.Cflag |= syscall.CS8
+	tio.Cc[syscall.VMIN], tio.Cc[syscall.VTIME] = 1, 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&tio))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// TestSplicePty relays between a socket and the master of a
+// pseudo-terminal, like a remote shell server, with a program on the
+// slave which echoes what it reads. Closing the slave ends the relay
+// from the master cleanly, although reading the master then fails with
+// EIO.
+func TestSplicePty(t *testing.T) {
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	if err := makeRaw(slave); err != nil {
+		t.Fatal(err)
+	}
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Every byte value goes through, control characters included.
+	want := spliceTestData(1 << 18)
+	type result struct {
+		n   int64
+		err error
+	}
+	var in, out Relay
+	inDone := make(chan result, 1)
+	go func() {
+		n, err := in.Copy(master, server)
+		inDone <- result{n, err}
+	}()
+	outDone := make(chan result, 1)
+	go func() {
+		n, err := out.Copy(server, master)
+		server.(*TCPConn).CloseWrite()
+		outDone <- result{n, err}
+	}()
+	echoDone := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(slave, slave, int64(len(want)))
+		slave.Close()
+		echoDone <- err
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		readDone <- b
+	}()
+
+	if _, err := client.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	client.(*TCPConn).CloseWrite()
+	for _, c := range []struct {
+		name string
+		done chan result
+		rl   *Relay
+	}{
+		{"socket to pty", inDone, &in},
+		{"pty to socket", outDone, &out},
+	} {
+		select {
+		case res := <-c.done:
+			if res.n != int64(len(want)) || res.err != nil {
+				t.Errorf("%s: got (%d, %v); want (%d, <nil>)", c.name, res.n, res.err, len(want))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: relay did not finish", c.name)
+		}
+		if st := c.rl.Stats(); st.WriteBytes != int64(len(want)) {
+			t.Errorf("%s: spliced %d bytes; want %d", c.name, st.WriteBytes, len(want))
+		}
+	}
+	if err := <-echoDone; err != nil {
+		t.Errorf("echo: %v", err)
+	}
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("echoed %d bytes differ from the %d bytes sent", len(got), len(want))
+	}
+}
+
+func TestSpliceTrace(t *testing.T) {
+	if os.Getenv("GOTEST_SPLICE_TRACE") != "" {
+		// In child process, run with GODEBUG=splicetrace=1: make
+		// a transfer which stops at a limit, one which reaches EOF,
+		// two which can't be spliced, the second by a relay with an
+		// ID, and one to a connection with a tiny send buffer, and
+		// report the descriptors on stdout.
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dst, src := srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn)
+		srv.Write(make([]byte, 3000))
+		srv.CloseWrite()
+		dst.ReadFrom(&io.LimitedReader{R: src, N: 1000})
+		dst.ReadFrom(src)
+		dst.ReadFrom(bytes.NewReader(make([]byte, 10)))
+		(&Relay{ID: "conn-42"}).Copy(dst, bytes.NewReader(make([]byte, 10)))
+
+		small, err := newSpliceTestServer()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		smallDst, smallSrc := small.serverDown.(*TCPConn), small.serverUp.(*TCPConn)
+		smallDst.SetWriteBuffer(1)
+		go io.Copy(ioutil.Discard, small)
+		go func() {
+			small.Write(make([]byte, 1<<20))
+			small.CloseWrite()
+		}()
+		smallDst.ReadFrom(smallSrc)
+		fmt.Printf("%d %d %d %d", dst.fd.pfd.Sysfd, src.fd.pfd.Sysfd, smallDst.fd.pfd.Sysfd, smallSrc.fd.pfd.Sysfd)
+		os.Exit(0)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSpliceTrace$")
+	cmd.Env = append(os.Environ(), "GOTEST_SPLICE_TRACE=1", "GODEBUG=splicetrace=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("child: %v: %s", err, stderr.Bytes())
+	}
+	var dst, src, smallDst, smallSrc int
+	if _, err := fmt.Sscan(stdout.String(), &dst, &src, &smallDst, &smallSrc); err != nil {
+		t.Fatalf("child reported %q: %v", stdout.String(), err)
+	}
+	want := []string{
+		fmt.Sprintf(`go package net: splice\(%d <- %d\) = 1000 bytes, pipe [0-9]+, limit`, dst, src),
+		fmt.Sprintf(`go package net: splice\(%d <- %d\) = 2000 bytes, pipe [0-9]+, eof`, dst, src),
+		fmt.Sprintf(`go package net: splice\(%d <- -1\): not spliced, unsupported source`, dst),
+		fmt.Sprintf(`go package net: splice\(%d <- -1\) relay conn-42: not spliced, unsupported source`, dst),
+		fmt.Sprintf(`go package net: splice\(%d <- %d\) = 1048576 bytes, pipe [0-9]+, small send buffer [0-9]+, eof`, smallDst, smallSrc),
+	}
+	got := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("child traced %q; want %d lines", got, len(want))
+	}
+	for i, line := range got {
+		if !regexp.MustCompile("^" + want[i] + "$").MatchString(line) {
+			t.Errorf("trace line %d: got %q; want match for %q", i, line, want[i])
+		}
+	}
+}
+
+func TestSpliceIsZeroCopy(t *testing.T) {
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	sock := client.(*TCPConn).fd.pfd.Sysfd
+	peer := server.(*TCPConn).fd.pfd.Sysfd
+
+	f, err := ioutil.TempFile("", "splice-zerocopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	file := int(f.Fd())
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	pipe := int(pw.Fd())
+
+	check := func(name string, dst, src int, want bool) {
+		if got := spliceIsZeroCopy(dst, src); got != want {
+			t.Errorf("%s: spliceIsZeroCopy = %v; want %v", name, got, want)
+		}
+	}
+	check("socket to socket", sock, peer, true)
+	check("file to socket", sock, file, true)
+	check("socket to pipe", pipe, sock, true)
+	check("socket to file", file, sock, false)
+	check("bad descriptor", sock, -1, false)
+
+	master, slave, err := openPty()
+	if err != nil {
+		t.Logf("no pseudo-terminal: %v", err)
+		return
+	}
+	defer master.Close()
+	defer slave.Close()
+	pty := int(master.Fd())
+	check("pty to socket", sock, pty, false)
+	check("socket to pty", pty, sock, false)
+}
+
+func TestSpliceFIFO(t *testing.T) {
+	t.Run("to", func(t *testing.T) { testSpliceFIFO(t, true) })
+	t.Run("from", func(t *testing.T) { testSpliceFIFO(t, false) })
+	t.Run("noReader", testSpliceFIFONoReader)
+}
+
+// openFIFO creates a FIFO in a new temporary directory, and opens both of
+// its ends. cleanup closes them and removes the directory.
+func openFIFO(t *testing.T) (r, w *os.File, cleanup func()) {
+	dir, err := ioutil.TempDir("", "splice-fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := dir + "/fifo"
+	if err := syscall.Mkfifo(name, 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	// Opening the read end without O_NONBLOCK would wait for a
+	// writer, and the write end fails with ENXIO without a reader.
+	r, err = os.OpenFile(name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	w, err = os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return r, w, func() {
+		r.Close()
+		w.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testSpliceFIFO splices a connection into a FIFO, or a FIFO into a
+// connection, with more data than the FIFO holds, and checks that the
+// data went through the FIFO alone, without a pipe of the package's own.
+func testSpliceFIFO(t *testing.T, toFIFO bool) {
+	r, w, cleanup := openFIFO(t)
+	defer cleanup()
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	want := spliceTestData(4 << 20)
+	poll.TrimPipePool()
+	fds := SpliceFDs()
+	writeDone := make(chan error, 1)
+	readDone := make(chan []byte, 1)
+	var n int64
+	if toFIFO {
+		go func() {
+			_, err := client.Write(want)
+			client.(*TCPConn).CloseWrite()
+			writeDone <- err
+		}()
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			readDone <- b
+		}()
+		n, err = server.(*TCPConn).WriteTo(w)
+		w.Close()
+	} else {
+		go func() {
+			_, err := w.Write(want)
+			w.Close()
+			writeDone <- err
+		}()
+		go func() {
+			b, _ := ioutil.ReadAll(client)
+			readDone <- b
+		}()
+		n, err = server.(*TCPConn).ReadFrom(r)
+		server.(*TCPConn).CloseWrite()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readDone; n != int64(len(want)) || !bytes.Equal(got, want) {
+		t.Errorf("spliced %d bytes, read back %d; want %d, the same", n, len(got), len(want))
+	}
+	if got := SpliceFDs(); got > fds {
+		t.Errorf("%d splice fds after splicing; want at most %d, for no pipe of its own", got, fds)
+	}
+}
+
+// testSpliceFIFONoReader splices a connection into a FIFO whose reader is
+// gone, which fails with EPIPE.
+func testSpliceFIFONoReader(t *testing.T) {
+	r, w, cleanup := openFIFO(t)
+	defer cleanup()
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	r.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	client.(*TCPConn).CloseWrite()
+	_, err = server.(*TCPConn).WriteTo(w)
+	if oe, ok := err.(*OpError); !ok || oe.Err.(*os.SyscallError).Err != syscall.EPIPE {
+		t.Errorf("got %v; want EPIPE", err)
+	}
+}
+
+func TestSpliceDedicatedPoller(t *testing.T) {
+	// The dedicated poller is only used with more than one P.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	t.Run("deadline", testSpliceDedicatedPollerDeadline)
+	t.Run("close", testSpliceDedicatedPollerClose)
+}
+
+func testSpliceDedicatedPollerDeadline(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.relay = &Relay{DedicatedPoller: true}
+	srv.serverUp.(*TCPConn).SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	copyDone := srv.Copy()
+
+	select {
+	case err := <-copyDone:
+		if ne, ok := err.(Error); !ok || !ne.Timeout() {
+			t.Fatalf("got %v; want timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay ignored the read deadline")
+	}
+}
+
+func testSpliceDedicatedPollerClose(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.relay = &Relay{DedicatedPoller: true}
+	copyDone := srv.Copy()
+	time.Sleep(50 * time.Millisecond)
+	srv.serverUp.Close()
+
+	select {
+	case err := <-copyDone:
+		if err == nil {
+			t.Fatal("relay of a closed connection succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay ignored Close")
+	}
+}
+
+func TestSpliceEcho(t *testing.T) {
+	t.Run("sharedPoller", func(t *testing.T) {
+		testSpliceEcho(t, &Relay{})
+	})
+	t.Run("dedicatedPoller", func(t *testing.T) {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+		testSpliceEcho(t, &Relay{DedicatedPoller: true})
+	})
+}
+
+// testSpliceEcho relays a connection's input back to the same
+// connection's output.
+func testSpliceEcho(t *testing.T, rl *Relay) {
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	copyDone := make(chan error, 1)
+	go func() {
+		if rl.DedicatedPoller {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+		}
+		_, err := rl.Copy(server, server)
+		copyDone <- err
+	}()
+
+	// A relay which deadlocks on its own connection never echoes
+	// anything, so give up rather than hang.
+	watchdog := time.AfterFunc(10*time.Second, func() {
+		client.Close()
+		server.Close()
+	})
+	defer watchdog.Stop()
+
+	want := spliceTestData(1 << 22)
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := client.Write(want)
+		client.(*TCPConn).CloseWrite()
+		writeDone <- err
+	}()
+	readDone := make(chan error, 1)
+	var got []byte
+	go func() {
+		var err error
+		got, err = ioutil.ReadAll(client)
+		readDone <- err
+	}()
+
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-copyDone; err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	server.(*TCPConn).CloseWrite()
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echoed %d bytes differ from %d bytes written", len(got), len(want))
+	}
+	// Only a spliced relay records its activity.
+	if st := rl.Stats(); st.Active == 0 {
+		t.Error("relay fell back to io.Copy")
+	}
+}
+
+// proxyConn is a Conn from outside the net package, such as one which
+// strips a proxy protocol header, which opts into splicing.
+type proxyConn struct {
+	Conn
+	rc        syscall.RawConn
+	canSplice bool
+}
+
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) { return c.rc, nil }
+func (c *proxyConn) CanSplice() bool                       { return c.canSplice }
+
+// fdRawConn is a syscall.RawConn which is not backed by the net package.
+type fdRawConn uintptr
+
+func (fd fdRawConn) Control(f func(uintptr)) error {
+	f(uintptr(fd))
+	return nil
+}
+
+func (fdRawConn) Read(func(uintptr) bool) error  { return syscall.EINVAL }
+func (fdRawConn) Write(func(uintptr) bool) error { return syscall.EINVAL }
+
+// TestSpliceConn relays between TCP connections of which either or both
+// are wrapped, by a SpliceConn or as the *os.File of the connection, and
+// checks that the relay splices unless the wrapper declines it.
+func TestSpliceConn(t *testing.T) {
+	// File puts the socket into blocking mode, which a relay splicing
+	// through a duplicate of its descriptor must leave alone.
+	var files []*os.File
+	file := func(c *TCPConn) *os.File {
+		f, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+		return f
+	}
+	netRawConn := func(c *TCPConn) syscall.RawConn {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rc
+	}
+	foreignRawConn := func(c *TCPConn) syscall.RawConn {
+		var fd uintptr
+		if err := netRawConn(c).Control(func(sysfd uintptr) { fd = sysfd }); err != nil {
+			t.Fatal(err)
+		}
+		return fdRawConn(fd)
+	}
+	blockingRawConn := func(c *TCPConn) syscall.RawConn {
+		return fdRawConn(file(c).Fd())
+	}
+	proxy := func(rawConn func(*TCPConn) syscall.RawConn, canSplice bool) func(*TCPConn) io.ReadWriter {
+		return func(c *TCPConn) io.ReadWriter {
+			return &proxyConn{Conn: c, rc: rawConn(c), canSplice: canSplice}
+		}
+	}
+	asFile := func(c *TCPConn) io.ReadWriter {
+		return file(c)
+	}
+
+	for _, tt := range []struct {
+		name string
+		// wrapSrc and wrapDst, if not nil, wrap the connections
+		// the relay copies between.
+		wrapSrc, wrapDst func(*TCPConn) io.ReadWriter
+		wantSplice       bool
+	}{
+		{"src", proxy(netRawConn, true), nil, true},
+		{"dst", nil, proxy(netRawConn, true), true},
+		{"both", proxy(netRawConn, true), proxy(netRawConn, true), true},
+		{"foreignSrc", proxy(foreignRawConn, true), nil, true},
+		{"foreignDst", nil, proxy(foreignRawConn, true), true},
+		{"blocking", proxy(blockingRawConn, true), proxy(blockingRawConn, true), true},
+		{"declined", proxy(netRawConn, false), proxy(netRawConn, false), false},
+		{"fileSrc", asFile, nil, true},
+		{"fileDst", nil, asFile, true},
+		{"fileBoth", asFile, asFile, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			files = nil
+			defer func() {
+				for _, f := range files {
+					f.Close()
+				}
+			}()
+			var dst io.Writer = srv.serverDown
+			var src io.Reader = srv.serverUp
+			if tt.wrapDst != nil {
+				dst = tt.wrapDst(srv.serverDown.(*TCPConn))
+			}
+			if tt.wrapSrc != nil {
+				src = tt.wrapSrc(srv.serverUp.(*TCPConn))
+			}
+			rl := new(Relay)
+			copyDone := make(chan error, 1)
+			go func() {
+				_, err := rl.Copy(dst, src)
+				copyDone <- err
+			}()
+
+			want := spliceTestData(1 << 20)
+			readDone := make(chan error, 1)
+			var got []byte
+			go func() {
+				var err error
+				got, err = ioutil.ReadAll(srv)
+				readDone <- err
+			}()
+			if _, err := srv.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			srv.CloseWrite()
+			if err := <-copyDone; err != nil {
+				t.Errorf("relay: %v", err)
+			}
+			for _, f := range files {
+				flags, _, e := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+				if e != 0 {
+					t.Fatal(os.NewSyscallError("fcntl", e))
+				}
+				if flags&syscall.O_NONBLOCK != 0 {
+					t.Errorf("%s left in non-blocking mode", f.Name())
+				}
+			}
+			srv.serverDown.(*TCPConn).CloseWrite()
+			if err := <-readDone; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("relayed %d bytes differ from %d bytes written", len(got), len(want))
+			}
+			// Only a spliced relay records its activity.
+			if spliced := rl.Stats().Active != 0; spliced != tt.wantSplice {
+				t.Errorf("spliced = %v; want %v", spliced, tt.wantSplice)
+			}
+		})
+	}
+}
+
+// TestSpliceFileDup relays from one *os.File of a connection, or from a
+// SpliceConn using its descriptor, while another goroutine writes to a
+// second *os.File, both in blocking mode. The relay must not put the
+// connection into non-blocking mode, which would make the writes fail
+// with EAGAIN.
+func TestSpliceFileDup(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  func(c *TCPConn, f *os.File) io.Reader
+	}{
+		{"file", func(c *TCPConn, f *os.File) io.Reader { return f }},
+		{"spliceConn", func(c *TCPConn, f *os.File) io.Reader {
+			return &proxyConn{Conn: c, rc: fdRawConn(f.Fd()), canSplice: true}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			c := srv.serverUp.(*TCPConn)
+			fRead, err := c.File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fRead.Close()
+			fWrite, err := c.File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fWrite.Close()
+
+			rl := new(Relay)
+			res := make(chan relayResult, 1)
+			go func() {
+				var r relayResult
+				r.n, r.err = rl.Copy(srv.serverDown, tt.src(c, fRead))
+				res <- r
+			}()
+			// The writes back to the client fill up the send buffer of the
+			// connection, so that they block while the relay runs.
+			back := spliceTestData(4 << 20)
+			writeDone := make(chan error, 1)
+			go func() {
+				_, err := fWrite.Write(back)
+				writeDone <- err
+			}()
+			backDone := make(chan []byte, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				b := make([]byte, len(back))
+				n, _ := io.ReadFull(srv.clientUp.(Conn), b)
+				backDone <- b[:n]
+			}()
+			readDone := make(chan []byte, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(srv.clientDown)
+				readDone <- b
+			}()
+
+			want := spliceTestData(4 << 20)
+			if _, err := srv.clientUp.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			srv.CloseWrite()
+			if r := <-res; r.err != nil || r.n != int64(len(want)) {
+				t.Errorf("relay: got (%d, %v); want (%d, <nil>)", r.n, r.err, len(want))
+			}
+			if err := <-writeDone; err != nil {
+				t.Errorf("write to the other file: %v", err)
+			}
+			c.CloseWrite()
+			srv.serverDown.(*TCPConn).CloseWrite()
+			if got := <-readDone; !bytes.Equal(got, want) {
+				t.Errorf("relayed %d bytes differ from %d bytes written", len(got), len(want))
+			}
+			if got := <-backDone; !bytes.Equal(got, back) {
+				t.Errorf("read %d bytes written back, which differ from the %d bytes written", len(got), len(back))
+			}
+			if rl.Stats().Active == 0 {
+				t.Error("relay fell back to io.Copy")
+			}
+		})
+	}
+}
+
+// fileConnPair returns a connected pair of Unix stream connections
+// made by FileConn from the descriptors of a socketpair.
+func fileConnPair(t *testing.T) (c1, c2 *UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cs [2]*UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs[i] = c.(*UnixConn)
+	}
+	return cs[0], cs[1]
+}
+
+func TestSpliceFileConn(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		unixDown bool
+	}{
+		{"src", false},
+		{"dst", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// One side of the relay is a TCP connection, and the
+			// other a connection made by FileConn.
+			uc, us := fileConnPair(t)
+			defer uc.Close()
+			defer us.Close()
+			tc, ts, err := spliceTestSocketPair("tcp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tc.Close()
+			defer ts.Close()
+			type closeWriter interface {
+				Conn
+				CloseWrite() error
+			}
+			writer, src, dst, reader := closeWriter(uc), closeWriter(us), ts.(closeWriter), tc
+			if tt.unixDown {
+				writer, src, dst, reader = tc.(closeWriter), ts.(closeWriter), us, uc
+			}
+
+			rl := new(Relay)
+			copyDone := make(chan error, 1)
+			go func() {
+				_, err := rl.Copy(dst, src)
+				copyDone <- err
+			}()
+			want := spliceTestData(1 << 20)
+			readDone := make(chan []byte, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(reader)
+				readDone <- b
+			}()
+			if _, err := writer.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			writer.CloseWrite()
+			if err := <-copyDone; err != nil {
+				t.Errorf("relay: %v", err)
+			}
+			dst.CloseWrite()
+			if got := <-readDone; !bytes.Equal(got, want) {
+				t.Errorf("relayed %d bytes differ from %d bytes written", len(got), len(want))
+			}
+			if rl.Stats().Active == 0 {
+				t.Error("relay fell back to io.Copy")
+			}
+		})
+	}
+}
+
+// waitSpliceFDs waits for SpliceFDs to report want descriptors, letting
+// the garbage collector close the pipes kept for reuse in the meantime.
+func waitSpliceFDs(t *testing.T, want int) {
+	for i := 0; SpliceFDs() != want; i++ {
+		if i == 200 {
+			t.Fatalf("SpliceFDs() = %d; want %d", SpliceFDs(), want)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSplicePipePool(t *testing.T) {
+	// A garbage collection empties the pool, so the first relay has
+	// to allocate its pipe.
+	runtime.GC()
+	c0 := SplicePipePool()
+	for i := 0; i < 2; i++ {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.relay = new(Relay)
+		data := spliceTestData(1 << 16)
+		checkTransfer(t, data, srv.transfer(data))
+		srv.Close()
+	}
+	c1 := SplicePipePool()
+	if c1.Misses == c0.Misses {
+		t.Errorf("relay with an empty pool counted no miss: %+v -> %+v", c0, c1)
+	}
+	if got := c1.Hits + c1.Misses - c0.Hits - c0.Misses; got < 2 {
+		t.Errorf("two relays counted %d pipes; want at least 2", got)
+	}
+}
+
+func TestSpliceFDLimit(t *testing.T) {
+	// Wait for the pipes kept for reuse to be collected, so that
+	// SpliceFDs counts the pipes of this test only.
+	waitSpliceFDs(t, 0)
+
+	// Each relay waits for data while holding a pipe.
+	const relays = 4
+	var srvs []*spliceTestServer
+	var copies []<-chan error
+	defer func() {
+		for i, srv := range srvs {
+			srv.CloseWrite()
+			if err := <-copies[i]; err != nil {
+				t.Errorf("relay %d: %v", i, err)
+			}
+			srv.Close()
+		}
+	}()
+	for i := 0; i < relays; i++ {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvs = append(srvs, srv)
+		copies = append(copies, srv.Copy())
+	}
+	waitSpliceFDs(t, 2*relays)
+
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.relay = &Relay{MaxSpliceFDs: 2 * relays}
+	srvs = append(srvs, srv)
+	copies = append(copies, srv.Copy())
+	msg := []byte("over the limit")
+	if _, err := srv.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(srv, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got %q, wrote %q", got, msg)
+	}
+	if n := SpliceFDs(); n != 2*relays {
+		t.Errorf("SpliceFDs() = %d over the limit; want %d", n, 2*relays)
+	}
+}
+
+func TestSpliceLimitPolicy(t *testing.T) {
+	msg := []byte("over the limit")
+	// start starts a relay with rl on a new server, to which it writes
+	// msg.
+	start := func(t *testing.T, rl *Relay) (*spliceTestServer, <-chan error) {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.relay = rl
+		copyDone := srv.Copy()
+		if _, err := srv.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		return srv, copyDone
+	}
+	// finish checks that srv relays msg, and waits for its relay.
+	finish := func(t *testing.T, srv *spliceTestServer, copyDone <-chan error) {
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(srv, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("got %q, wrote %q", got, msg)
+		}
+		srv.CloseWrite()
+		if err := <-copyDone; err != nil {
+			t.Errorf("relay: %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy SpliceLimitPolicy
+	}{
+		{"fallback", FallbackAtLimit},
+		{"wait", WaitAtLimit},
+		{"exceed", ExceedLimit},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &Relay{MaxSpliceFDs: 2, LimitPolicy: tt.policy}
+			waitSpliceFDs(t, 0)
+			// The first relay holds the only pipe allowed while it
+			// waits for more data.
+			holder, holderDone := start(t, nil)
+			defer holder.Close()
+			waitSpliceFDs(t, 2)
+
+			srv, copyDone := start(t, rl)
+			defer srv.Close()
+			switch tt.policy {
+			case FallbackAtLimit:
+				finish(t, srv, copyDone)
+				if n := SpliceFDs(); n != 2 {
+					t.Errorf("SpliceFDs() = %d after a copy over the limit; want 2", n)
+				}
+			case ExceedLimit:
+				waitSpliceFDs(t, 4)
+				finish(t, srv, copyDone)
+			case WaitAtLimit:
+				b := make([]byte, 1)
+				srv.clientDown.(*TCPConn).SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, err := srv.Read(b)
+				if ne, ok := err.(Error); n != 0 || !ok || !ne.Timeout() {
+					t.Fatalf("read %d bytes, %v while the relay waited for a pipe; want a timeout", n, err)
+				}
+				srv.clientDown.(*TCPConn).SetReadDeadline(noDeadline)
+
+				// The relay gets the pipe of the first relay
+				// once it is done.
+				finish(t, holder, holderDone)
+				finish(t, srv, copyDone)
+				if n := SpliceFDs(); n != 2 {
+					t.Errorf("SpliceFDs() = %d; want 2", n)
+				}
+
+				// A relay which waits for a pipe can be
+				// canceled, and neither a deadline nor Close
+				// of its connections is held up by the wait.
+				holder, holderDone = start(t, nil)
+				defer holder.Close()
+				waiter, err := newSpliceTestServer()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer waiter.Close()
+				ctx, cancel := context.WithCancel(context.Background())
+				waiterDone := make(chan error, 1)
+				go func() {
+					_, err := rl.CopyContext(ctx, waiter.serverDown, waiter.serverUp)
+					waiterDone <- err
+				}()
+				time.Sleep(50 * time.Millisecond)
+				if _, err := waiter.serverDown.Write(msg); err != nil {
+					t.Fatalf("write while the relay waited for a pipe: %v", err)
+				}
+				waiter.serverUp.(*TCPConn).SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if err, ok := (<-waiterDone).(Error); !ok || !err.Timeout() {
+					t.Fatalf("relay waiting for a pipe past its deadline: %v; want a timeout", err)
+				}
+				waiter.serverUp.(*TCPConn).SetReadDeadline(noDeadline)
+				go func() {
+					_, err := rl.CopyContext(ctx, waiter.serverDown, waiter.serverUp)
+					waiterDone <- err
+				}()
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+				select {
+				case err := <-waiterDone:
+					if err == nil {
+						t.Errorf("canceled relay succeeded")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("canceled relay still waiting for a pipe")
+				}
+				go func() {
+					_, err := rl.Copy(waiter.serverDown, waiter.serverUp)
+					waiterDone <- err
+				}()
+				time.Sleep(50 * time.Millisecond)
+				waiter.serverUp.Close()
+				select {
+				case err := <-waiterDone:
+					if err == nil {
+						t.Errorf("relay from a closed connection succeeded")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("relay from a closed connection still waiting for a pipe")
+				}
+			}
+			finish(t, holder, holderDone)
+		})
+	}
+}
+
+func TestSpliceStrategy(t *testing.T) {
+	want := bytes.Repeat([]byte("strategy"), 1<<15)
+	f, err := ioutil.TempFile("", "splice-strategy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(hook func(string)) { testHookReadFrom = hook }(testHookReadFrom)
+	var how string
+	testHookReadFrom = func(h string) { how = h }
+
+	// relay copies the reader returned by src to a connection with
+	// a Relay of strategy s, and returns how it was copied.
+	relay := func(t *testing.T, s SpliceStrategy, src func(t *testing.T) io.Reader) string {
+		client, server, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		defer server.Close()
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(client)
+			readDone <- b
+		}()
+		how = ""
+		n, err := (&Relay{Strategy: s}).Copy(server, src(t))
+		if n != int64(len(want)) || err != nil {
+			t.Errorf("got (%d, %v); want (%d, <nil>)", n, err, len(want))
+		}
+		server.(*TCPConn).CloseWrite()
+		if got := <-readDone; !bytes.Equal(got, want) {
+			t.Errorf("copied %d bytes differ from the %d bytes sent", len(got), len(want))
+		}
+		return how
+	}
+	fromFile := func(t *testing.T) io.Reader {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	var sources []Conn
+	defer func() {
+		for _, c := range sources {
+			c.Close()
+		}
+	}()
+	fromSocket := func(t *testing.T) io.Reader {
+		client, server, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, server)
+		go func() {
+			defer client.Close()
+			client.Write(want)
+		}()
+		return server
+	}
+
+	for _, tt := range []struct {
+		name         string
+		strategy     SpliceStrategy
+		file, socket string
+	}{
+		{"auto", AutoStrategy, "sendfile", "splice"},
+		{"sendfileOnly", SendfileOnlyStrategy, "sendfile", "generic"},
+		{"spliceOnly", SpliceOnlyStrategy, "splice", "splice"},
+		{"generic", GenericStrategy, "generic", "generic"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relay(t, tt.strategy, fromFile); got != tt.file {
+				t.Errorf("copy from a file used %s; want %s", got, tt.file)
+			}
+			if got := relay(t, tt.strategy, fromSocket); got != tt.socket {
+				t.Errorf("copy from a socket used %s; want %s", got, tt.socket)
+			}
+		})
+	}
+}
+
+// TestSpliceFileBig checks that a Relay sends a file of more than 4 GiB,
+// more than one sendfile or splice system call can, in one call.
+func TestSpliceFileBig(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	const size = 1<<32 + 1<<20
+	marker := []byte("the end of a big file")
+	f, err := ioutil.TempFile("", "splice-big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// The file is sparse, but for the marker at its end, so that it
+	// takes no space on disk and is read from zeroed pages.
+	if err := f.Truncate(size); err != nil {
+		t.Skipf("can't make a %d byte file: %v", int64(size), err)
+	}
+	if _, err := f.WriteAt(marker, size-int64(len(marker))); err != nil {
+		t.Skipf("can't make a %d byte file: %v", int64(size), err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 > 1<<20 {
+		t.Skipf("file system doesn't support sparse files")
+	}
+
+	defer func(hook func(string)) { testHookReadFrom = hook }(testHookReadFrom)
+	var how string
+	testHookReadFrom = func(h string) { how = h }
+	for _, tt := range []struct {
+		strategy SpliceStrategy
+		how      string
+	}{
+		{AutoStrategy, "sendfile"},
+		{SpliceOnlyStrategy, "splice"},
+	} {
+		t.Run(tt.how, func(t *testing.T) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			client, server, err := spliceTestSocketPair("tcp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			defer server.Close()
+			type readResult struct {
+				n    int64
+				tail []byte
+				err  error
+			}
+			readDone := make(chan readResult, 1)
+			go func() {
+				tw := &tailWriter{tail: make([]byte, 0, len(marker))}
+				n, err := io.Copy(tw, client)
+				readDone <- readResult{n, tw.tail, err}
+			}()
+			how = ""
+			n, err := (&Relay{Strategy: tt.strategy}).Copy(server, f)
+			if n != size || err != nil {
+				t.Errorf("Copy = %d, %v; want %d, <nil>", n, err, int64(size))
+			}
+			if how != tt.how {
+				t.Errorf("file sent with %q; want %q", how, tt.how)
+			}
+			server.(*TCPConn).CloseWrite()
+			res := <-readDone
+			if res.n != size || res.err != nil {
+				t.Errorf("received %d bytes, %v; want %d, <nil>", res.n, res.err, int64(size))
+			}
+			if !bytes.Equal(res.tail, marker) {
+				t.Errorf("received data ends with %q; want %q", res.tail, marker)
+			}
+		})
+	}
+}
+
+// tailWriter is an io.Writer which keeps the last cap(tail) bytes written
+// to it.
+type tailWriter struct {
+	tail []byte
+}
+
+func (tw *tailWriter) Write(b []byte) (int, error) {
+	if len(b) >= cap(tw.tail) {
+		tw.tail = append(tw.tail[:0], b[len(b)-cap(tw.tail):]...)
+		return len(b), nil
+	}
+	if over := len(tw.tail) + len(b) - cap(tw.tail); over > 0 {
+		tw.tail = append(tw.tail[:0], tw.tail[over:]...)
+	}
+	tw.tail = append(tw.tail, b...)
+	return len(b), nil
+}
+
+func TestSplicePipeAllocator(t *testing.T) {
+	var calls int32
+	var failed bool
+	defer poll.SetPipeAllocator(poll.SetPipeAllocator(func(flags int) (int, int, error) {
+		atomic.AddInt32(&calls, 1)
+		if failed {
+			return -1, -1, syscall.ENFILE
+		}
+		var fds [2]int
+		err := syscall.Pipe2(fds[:], flags)
+		return fds[0], fds[1], err
+	}))
+	var how string
+	defer func() { testHookReadFrom = func(string) {} }()
+	testHookReadFrom = func(s string) { how = s }
+
+	for _, tt := range []struct {
+		failed bool
+		want   string
+	}{
+		{false, "splice"},
+		// A copy without a pipe falls back.
+		{true, "generic"},
+	} {
+		failed = tt.failed
+		// Empty the pipe pool, so that the copy needs a new pipe.
+		runtime.GC()
+		poll.TrimPipePool()
+		calls0 := atomic.LoadInt32(&calls)
+
+		client, server, err := spliceTestSocketPair("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte("allocated")); err != nil {
+			t.Fatal(err)
+		}
+		client.(*TCPConn).CloseWrite()
+		// Echo the data back.
+		if _, err := server.(*TCPConn).ReadFrom(server.(*TCPConn)); err != nil {
+			t.Fatal(err)
+		}
+		server.(*TCPConn).CloseWrite()
+		got, err := ioutil.ReadAll(client)
+		client.Close()
+		server.Close()
+		if err != nil || string(got) != "allocated" {
+			t.Errorf("failed=%v: read %q, %v; want %q", tt.failed, got, err, "allocated")
+		}
+		if atomic.LoadInt32(&calls) == calls0 {
+			t.Errorf("failed=%v: allocator not called", tt.failed)
+		}
+		if how != tt.want {
+			t.Errorf("failed=%v: copied by %s; want %s", tt.failed, how, tt.want)
+		}
+	}
+	poll.TrimPipePool()
+}
+
+// TestSpliceConcurrent runs many spliced copies at once, some through a
+// shared Relay, while the pipe pool is trimmed and the FD count and relay
+// statistics are read, for the race detector to check.
+func TestSpliceConcurrent(t *testing.T) {
+	copies := 32
+	if testing.Short() {
+		copies = 8
+	}
+	const size = 1 << 18
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	shared := new(Relay)
+	adaptive := &Relay{AdaptivePipe: true}
+
+	done := make(chan struct{})
+	watchDone := make(chan bool)
+	go func() {
+		defer close(watchDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			SpliceFDs()
+			poll.TrimPipePool()
+			shared.Stats()
+			adaptive.Stats()
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, copies)
+	for i := 0; i < copies; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- spliceConcurrentCopy(i, payload, shared, adaptive)
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	<-watchDone
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// Every third copy goes through the shared relay.
+	want := int64((copies + 2) / 3 * size)
+	if st := shared.Stats(); st.ReadBytes != want {
+		t.Errorf("shared relay read %d bytes; want %d", st.ReadBytes, want)
+	}
+}
+
+// spliceConcurrentCopy copies payload between two connections, by
+// ReadFrom or through one of the relays depending on i, and checks that
+// it arrives intact.
+func spliceConcurrentCopy(i int, payload []byte, shared, adaptive *Relay) error {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	go func() {
+		srv.Write(payload)
+		srv.CloseWrite()
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	var n int64
+	switch i % 3 {
+	case 0:
+		n, err = shared.Copy(dst, src)
+	case 1:
+		n, err = adaptive.Copy(dst, src)
+	default:
+		n, err = dst.ReadFrom(src)
+	}
+	dst.CloseWrite()
+	got := <-readDone
+	if err != nil {
+		return fmt.Errorf("copy %d: %v", i, err)
+	}
+	if n != int64(len(payload)) || !bytes.Equal(got, payload) {
+		return fmt.Errorf("copy %d: copied %d bytes, received %d; want %d intact", i, n, len(got), len(payload))
+	}
+	return nil
+}
+
+func TestRelayStats(t *testing.T) {
+	type relay struct {
+		srv      *spliceTestServer
+		copyDone <-chan error
+	}
+	newRelay := func() relay {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.relay = new(Relay)
+		return relay{srv, srv.Copy()}
+	}
+	bulk := newRelay()
+	defer bulk.srv.Close()
+	small := make([]relay, 3)
+	for i := range small {
+		small[i] = newRelay()
+		defer small[i].srv.Close()
+	}
+
+	var wg sync.WaitGroup
+	run := func(r relay, write func(*spliceTestServer)) {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.Copy(ioutil.Discard, r.srv)
+		}()
+		go func() {
+			defer wg.Done()
+			write(r.srv)
+			r.srv.CloseWrite()
+			if err := <-r.copyDone; err != nil {
+				t.Error(err)
+			}
+			r.srv.serverDown.(*TCPConn).CloseWrite()
+		}()
+	}
+	run(bulk, func(srv *spliceTestServer) {
+		chunk := make([]byte, 1<<16)
+		for i := 0; i < 1<<9; i++ {
+			srv.Write(chunk)
+		}
+	})
+	for _, r := range small {
+		run(r, func(srv *spliceTestServer) {
+			for i := 0; i < 5; i++ {
+				time.Sleep(10 * time.Millisecond)
+				srv.Write([]byte("ping"))
+			}
+		})
+	}
+	wg.Wait()
+
+	if st := bulk.srv.relay.Stats(); st.Active <= 0 || st.Reads <= 0 || st.ReadBytes != 1<<25 || st.Writes <= 0 || st.WriteBytes != 1<<25 {
+		t.Errorf("bulk relay: %+v; want time spent active and %d bytes read and written", st, 1<<25)
+	}
+	for i, r := range small {
+		// The small relays spend most of their time waiting
+		// for the next write.
+		st := r.srv.relay.Stats()
+		if st.Wait < 40*time.Millisecond || st.Active <= 0 || st.Wait < st.Active {
+			t.Errorf("small relay %d: %+v; want mostly waiting", i, st)
+		}
+	}
+}
+
+// TestRelayWaits checks that the waits counted by RelayStats tell a
+// relay held up by its destination from one which is not.
+func TestRelayWaits(t *testing.T) {
+	const size = 1 << 18
+	relay := func(t *testing.T, constrained bool) RelayStats {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		if err := srv.configure(nil); err != nil {
+			t.Fatal(err)
+		}
+		if constrained {
+			// The destination takes 32 KiB at a time, and its
+			// reader is slow to make room for more.
+			srv.serverDown.(*TCPConn).SetWriteBuffer(32 << 10)
+			srv.clientDown.(*TCPConn).SetReadBuffer(32 << 10)
+		}
+		rl := new(Relay)
+		srv.relay = rl
+		copyDone := srv.Copy()
+		readDone := make(chan int64, 1)
+		go func() {
+			var n int64
+			b := make([]byte, 4<<10)
+			for {
+				if constrained {
+					time.Sleep(time.Millisecond)
+				}
+				m, err := srv.Read(b)
+				n += int64(m)
+				if err != nil {
+					readDone <- n
+					return
+				}
+			}
+		}()
+		if _, err := srv.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		srv.CloseWrite()
+		if err := <-copyDone; err != nil {
+			t.Fatalf("relay: %v", err)
+		}
+		srv.serverDown.(*TCPConn).CloseWrite()
+		if n := <-readDone; n != size {
+			t.Fatalf("relayed %d bytes; want %d", n, size)
+		}
+		return rl.Stats()
+	}
+
+	fast := relay(t, false)
+	slow := relay(t, true)
+	if slow.WriteWaits == 0 {
+		t.Errorf("constrained relay: %+v; want waits for the destination", slow)
+	}
+	if fast.WriteWaits > 4 || fast.WriteWaits >= slow.WriteWaits {
+		t.Errorf("unconstrained relay waited for its destination %d times, constrained relay %d times; want few and fewer", fast.WriteWaits, slow.WriteWaits)
+	}
+}
+
+// TestSpliceZeroWindow checks that a relay whose destination's peer stops
+// reading, so that the peer advertises a zero window which the kernel
+// then probes, waits for the destination without failing or spinning,
+// gives up at the destination's write deadline, and resumes as soon as
+// the peer reads again.
+func TestSpliceZeroWindow(t *testing.T) {
+	const size = 1 << 20
+	data := spliceTestData(size)
+	start := func(t *testing.T) (*spliceTestServer, *Relay, <-chan error) {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Small buffers fill long before the data runs out.
+		srv.serverDown.(*TCPConn).SetWriteBuffer(16 << 10)
+		srv.clientDown.(*TCPConn).SetReadBuffer(16 << 10)
+		go func() {
+			srv.Write(data)
+			srv.CloseWrite()
+		}()
+		rl := new(Relay)
+		srv.relay = rl
+		return srv, rl, srv.Copy()
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		srv, rl, copyDone := start(t)
+		defer srv.Close()
+		const deadline = 500 * time.Millisecond
+		begin := time.Now()
+		srv.serverDown.(*TCPConn).SetWriteDeadline(begin.Add(deadline))
+		waitZeroWindow(t, srv.clientDown.(*TCPConn))
+		err := <-copyDone
+		if ne, ok := err.(Error); !ok || !ne.Timeout() {
+			t.Fatalf("relay: %v; want timeout", err)
+		}
+		if d := time.Since(begin); d < deadline {
+			t.Errorf("relay returned after %v; want after the %v deadline", d, deadline)
+		}
+		// The relay waits for the window to open, rather than trying
+		// the destination again and again.
+		if st := rl.Stats(); st.WriteWaits == 0 || st.WriteWaits > 100 {
+			t.Errorf("relay waited for its destination %d times; want a few", st.WriteWaits)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		srv, _, copyDone := start(t)
+		defer srv.Close()
+		waitZeroWindow(t, srv.clientDown.(*TCPConn))
+		// Let the kernel probe the window for a while.
+		select {
+		case err := <-copyDone:
+			t.Fatalf("relay returned while the window was closed: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		begin := time.Now()
+		readDone := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(srv.clientDown)
+			readDone <- b
+		}()
+		if err := <-copyDone; err != nil {
+			t.Fatalf("relay: %v", err)
+		}
+		if d := time.Since(begin); d > 2*time.Second {
+			t.Errorf("relay took %v to finish once the window opened", d)
+		}
+		srv.serverDown.(*TCPConn).CloseWrite()
+		if got := <-readDone; !bytes.Equal(got, data) {
+			t.Errorf("received %d bytes which differ from the %d sent", len(got), len(data))
+		}
+	})
+}
+
+// waitZeroWindow waits until the data queued for reading on c stops
+// growing, because c's receive buffer is full and c advertises a zero
+// window to its peer.
+func waitZeroWindow(t *testing.T, c *TCPConn) {
+	t.Helper()
+	inq := func() int {
+		var n int32
+		c.fd.pfd.RawControl(func(s uintptr) {
+			syscall.Syscall(syscall.SYS_IOCTL, s, syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+		})
+		return int(n)
+	}
+	last := -1
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		n := inq()
+		if n > 0 && n == last {
+			return
+		}
+		last = n
+	}
+	t.Fatalf("receive queue still growing, at %d bytes", last)
+}
+
+func TestRelayGroup(t *testing.T) {
+	// Wait for the pipes kept for reuse to be closed, so that
+	// SpliceFDs counts the pipes of this test only.
+	poll.TrimPipePool()
+	waitSpliceFDs(t, 0)
+
+	var srvs []*spliceTestServer
+	defer func() {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		srv, err := newSpliceTestServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvs = append(srvs, srv)
+	}
+
+	g := NewRelayGroup(context.Background())
+	// The first two relays wait for data which never comes, each
+	// holding a pipe.
+	for _, srv := range srvs[:2] {
+		g.Go(new(Relay), srv.serverDown, srv.serverUp)
+	}
+	waitSpliceFDs(t, 4)
+	// The last fails once it has written data.
+	errStop := errors.New("stop")
+	g.Go(&Relay{Account: func(int64) error { return errStop }}, srvs[2].serverDown, srvs[2].serverUp)
+	if _, err := srvs[2].Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDone := make(chan error, 1)
+	go func() { waitDone <- g.Wait() }()
+	select {
+	case err := <-waitDone:
+		if oe, ok := err.(*OpError); !ok || oe.Err != errStop {
+			t.Errorf("Wait() = %v; want the error of the failed relay", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relays still running 5s after one failed")
+	}
+	// The relays gave their pipes back for reuse.
+	poll.TrimPipePool()
+	waitSpliceFDs(t, 0)
+}
+
+// tcpNotSentLowat is the TCP_NOTSENT_LOWAT socket option, which package
+// syscall lacks.
+const tcpNotSentLowat = 0x19
+
+func TestRelayNotSentLowWater(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	dst := srv.serverDown.(*TCPConn)
+	before := getsockoptInt(t, dst, syscall.IPPROTO_TCP, tcpNotSentLowat)
+
+	var mu sync.Mutex
+	var pipeSizes []int
+	defer func(trace func(dst, src int, written int64, pipeSize, sendBuf int, end, id string)) {
+		poll.SpliceTrace = trace
+	}(poll.SpliceTrace)
+	poll.SpliceTrace = func(dst, src int, written int64, pipeSize, sendBuf int, end, id string) {
+		mu.Lock()
+		pipeSizes = append(pipeSizes, pipeSize)
+		mu.Unlock()
+	}
+
+	const lowat = 16 << 10
+	// during holds the option of dst as the relay writes to it.
+	var during []int
+	rl := &Relay{NotSentLowWater: lowat}
+	rl.Account = func(int64) error {
+		during = append(during, getsockoptInt(t, dst, syscall.IPPROTO_TCP, tcpNotSentLowat))
+		return nil
+	}
+	srv.relay = rl
+	want := spliceTestData(1 << 18)
+	checkTransfer(t, want, srv.transfer(want))
+
+	if len(during) == 0 {
+		t.Fatal("relay fell back to io.Copy")
+	}
+	for _, v := range during {
+		if v != lowat {
+			t.Fatalf("TCP_NOTSENT_LOWAT = %d during the relay; want %d", v, lowat)
+		}
+	}
+	if v := getsockoptInt(t, dst, syscall.IPPROTO_TCP, tcpNotSentLowat); v != before {
+		t.Errorf("TCP_NOTSENT_LOWAT = %d after the relay; want %d", v, before)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pipeSizes) != 1 || pipeSizes[0] != lowat {
+		t.Errorf("pipe sizes %v; want [%d]", pipeSizes, lowat)
+	}
+}
+
+func TestRelayDSCP(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		t.Run(network, func(t *testing.T) {
+			if network == "tcp6" && !supportsIPv6() {
+				t.Skip("IPv6 is not supported")
+			}
+			testRelayDSCP(t, network)
+		})
+	}
+}
+
+func testRelayDSCP(t *testing.T, network string) {
+	srv, err := newSpliceTestServerNetwork(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	clientUp, serverUp := srv.clientUp.(Conn), srv.serverUp.(Conn)
+	clientDown, serverDown := srv.clientDown.(Conn), srv.serverDown.(Conn)
+
+	const dscp = 46 // expedited forwarding
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if network == "tcp6" {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	// dscpOf returns the DSCP with which c marks its packets. The
+	// kernel manages the ECN bits of a TCP socket.
+	dscpOf := func(c Conn) int {
+		tos, err := syscall.GetsockoptInt(c.(*TCPConn).fd.pfd.Sysfd, level, opt)
+		if err != nil {
+			t.Error(err)
+		}
+		return tos >> 2
+	}
+
+	want := []byte("marked")
+	marked := make(chan int, 1)
+	go func() {
+		defer clientUp.(*TCPConn).CloseWrite()
+		clientUp.Write(want)
+		// Look at the destination while the copy is running.
+		io.ReadFull(clientDown, make([]byte, len(want)))
+		marked <- dscpOf(serverDown)
+	}()
+	rl := &Relay{DSCP: dscp}
+	if _, err := rl.Copy(serverDown, serverUp); err != nil {
+		t.Fatal(err)
+	}
+	if st := rl.Stats(); st.Active == 0 {
+		t.Error("relay was not spliced")
+	}
+	if got := <-marked; got != dscp {
+		t.Errorf("destination has DSCP %d during the copy; want %d", got, dscp)
+	}
+	if got := dscpOf(serverDown); got != 0 {
+		t.Errorf("destination has DSCP %d after the copy; want it restored to 0", got)
+	}
+	if got := dscpOf(serverUp); got != 0 {
+		t.Errorf("source has DSCP %d; want it unmarked", got)
+	}
+}
+
+func TestTCPConnPeek(t *testing.T) {
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	c := server.(*TCPConn)
+
+	// A peek waits for all of b, which arrives in two writes.
+	go func() {
+		client.Write([]byte("hel"))
+		time.Sleep(10 * time.Millisecond)
+		client.Write([]byte("lo, world"))
+	}()
+	b := make([]byte, 5)
+	if n, err := c.Peek(b); n != len(b) || err != nil || string(b) != "hello" {
+		t.Fatalf("Peek() = %d, %v, %q; want 5, <nil>, \"hello\"", n, err, b)
+	}
+	// The bytes peeked at are read again.
+	b = make([]byte, 12)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello, world" {
+		t.Fatalf("read %q, %v after Peek; want \"hello, world\"", b, err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Peek(make([]byte, 1)); err == nil || !err.(Error).Timeout() {
+		t.Fatalf("Peek() past the deadline: %v; want a timeout", err)
+	}
+	c.SetReadDeadline(noDeadline)
+
+	client.Write([]byte("ab"))
+	client.(*TCPConn).CloseWrite()
+	if n, err := c.Peek(make([]byte, 4)); n != 2 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("Peek() short of EOF = %d, %v; want 2, %v", n, err, io.ErrUnexpectedEOF)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Peek(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Fatalf("Peek() at EOF = %d, %v; want 0, %v", n, err, io.EOF)
+	}
+}
+
+func TestRelayCopyAfterPeek(t *testing.T) {
+	testRelayPaths(t, testRelayCopyAfterPeek)
+}
+
+func testRelayCopyAfterPeek(t *testing.T, spliced bool) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	want := spliceTestData(1 << 18)
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	go func() {
+		srv.Write(want)
+		srv.CloseWrite()
+	}()
+
+	// The data is peeked at both with Peek, and by the caller with
+	// a recv of its own, which sees at least as much as Peek waited
+	// for.
+	const n = 100
+	b := make([]byte, n)
+	if _, err := src.Peek(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want[:n]) {
+		t.Fatalf("Peek() = %q; want %q", b, want[:n])
+	}
+	rc, err := src.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 4096)
+	var m int
+	var rerr error
+	if err := rc.Read(func(s uintptr) bool {
+		m, _, rerr = syscall.Recvfrom(int(s), b, syscall.MSG_PEEK)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rerr != nil || m < n || !bytes.Equal(b[:m], want[:m]) {
+		t.Fatalf("recv(MSG_PEEK) = %d, %v; want at least %d bytes from the start of the stream", m, rerr, n)
+	}
+
+	rl := new(Relay)
+	written, err := rl.Copy(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(want)) {
+		t.Errorf("copied %d bytes; want %d", written, len(want))
+	}
+	if got := rl.Stats().Active != 0; got != spliced {
+		t.Errorf("relay spliced: %v; want %v", got, spliced)
+	}
+	dst.CloseWrite()
+	// The peeked data reaches the destination once, in place.
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes which differ from the %d bytes sent", len(got), len(want))
+	}
+}
+
+func TestSplicePendingError(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	peer, src, dst := srv.clientUp.(*TCPConn), srv.serverUp.(*TCPConn), srv.serverDown
+
+	// The peer shuts down its side of the connection, and then
+	// resets it, which leaves EPIPE pending on src. Reads from src
+	// report EOF regardless.
+	peer.CloseWrite()
+	if n, err := src.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("got %d, %v; want 0, %v", n, err, io.EOF)
+	}
+	peer.SetLinger(0)
+	peer.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		n, err := new(Relay).Copy(dst, src)
+		if n != 0 {
+			t.Errorf("copied %d bytes", n)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		oe, ok := err.(*OpError)
+		if !ok {
+			t.Fatalf("got %v; want an *OpError", err)
+		}
+		if se, ok := oe.Err.(*os.SyscallError); !ok || se.Syscall != "splice" || se.Err != syscall.EPIPE {
+			t.Fatalf("got %v; want splice error %v", err, syscall.EPIPE)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay from a reset connection hung")
+	}
+}
+
+// Tests that closing either connection of a relay while it copies fails
+// the copy with the error for a closed connection, and never with the
+// EBADF of a descriptor closed under a system call: the copy holds the
+// descriptors until it returns.
+func TestSpliceCloseRace(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	tests := []struct {
+		name  string
+		relay func() *Relay
+		// idle is set for a relay which has to be closed before
+		// any data reaches it. Such a relay waits only for src.
+		idle bool
+	}{
+		{"spliced", func() *Relay { return new(Relay) }, false},
+		{"dedicatedPoller", func() *Relay { return &Relay{DedicatedPoller: true} }, false},
+		{"adaptive", func() *Relay { return &Relay{AdaptivePipe: true} }, false},
+		// Without a sockmap, data reaching a redirected relay
+		// fails it with ErrNotRedirected.
+		{"redirected", func() *Relay { return &Relay{Redirected: true} }, true},
+	}
+	iters := 100
+	if testing.Short() {
+		iters = 20
+	}
+	for _, tt := range tests {
+		for _, closeSrc := range []bool{true, false} {
+			if tt.idle && !closeSrc {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/closeSrc=%v", tt.name, closeSrc), func(t *testing.T) {
+				for i := 0; i < iters; i++ {
+					// Spread the close over the start of the
+					// copy, a wait, and a transfer.
+					delay := time.Duration(i%10) * 100 * time.Microsecond
+					testSpliceCloseRace(t, tt.relay(), tt.idle, closeSrc, delay)
+				}
+			})
+		}
+	}
+}
+
+func testSpliceCloseRace(t *testing.T, rl *Relay, idle, closeSrc bool, delay time.Duration) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	writer, src := srv.clientUp.(Conn), srv.serverUp.(Conn)
+	dst, reader := srv.serverDown.(Conn), srv.clientDown.(Conn)
+
+	// The peers keep data flowing, unless the relay is idle, until
+	// their connections are closed, so that only the close ends the
+	// copy.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if idle {
+			writer.Read(make([]byte, 1))
+			return
+		}
+		b := make([]byte, 64<<10)
+		for {
+			if _, err := writer.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(ioutil.Discard, reader)
+	}()
+	defer func() {
+		writer.Close()
+		reader.Close()
+		wg.Wait()
+	}()
+
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := rl.Copy(dst, src)
+		copyDone <- err
+	}()
+	time.Sleep(delay)
+	if closeSrc {
+		src.Close()
+	} else {
+		dst.Close()
+	}
+
+	select {
+	case err := <-copyDone:
+		if err == nil {
+			t.Fatal("relay of a closed connection succeeded")
+		}
+		if errnoIn(err) == syscall.EBADF {
+			t.Fatalf("relay failed with %v; want the error for a closed connection", err)
+		}
+		if perr := parseCloseError(err, false); perr != nil {
+			t.Fatalf("relay failed with %v: %v", err, perr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay ignored Close")
+	}
+}
+
+// errnoIn returns the syscall.Errno which err wraps, or 0.
+func errnoIn(err error) syscall.Errno {
+	for {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e
+		case *OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *RelayError:
+			err = e.Err
+		default:
+			return 0
+		}
+	}
+}
+
+func TestSpliceEnds(t *testing.T) {
+	tests := []struct {
+		name string
+		// copy makes a spliced copy from src to dst, whose peers
+		// are writer and reader.
+		copy func(writer, src, dst, reader Conn) error
+		want SpliceEndCounts
+	}{
+		{
+			name: "eof",
+			copy: func(writer, src, dst, reader Conn) error {
+				go func() {
+					writer.Write(make([]byte, 1<<16))
+					writer.(*TCPConn).CloseWrite()
+				}()
+				_, err := new(Relay).Copy(dst, src)
+				return err
+			},
+			want: SpliceEndCounts{EOF: 1},
+		},
+		{
+			name: "limit",
+			copy: func(writer, src, dst, reader Conn) error {
+				go writer.Write(make([]byte, 1<<16))
+				_, err := new(Relay).CopyN(dst, src, 1000)
+				return err
+			},
+			want: SpliceEndCounts{Limit: 1},
+		},
+		{
+			name: "canceled",
+			copy: func(writer, src, dst, reader Conn) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				if _, err := new(Relay).CopyContext(ctx, dst, src); err == nil {
+					return errors.New("canceled copy succeeded")
+				}
+				return nil
+			},
+			want: SpliceEndCounts{Canceled: 1},
+		},
+		{
+			name: "expired",
+			copy: func(writer, src, dst, reader Conn) error {
+				_, err := (&Relay{TimeSlice: 50 * time.Millisecond}).Copy(dst, src)
+				if err == ErrSliceExpired {
+					err = nil
+				}
+				return err
+			},
+			want: SpliceEndCounts{Expired: 1},
+		},
+		{
+			name: "error",
+			copy: func(writer, src, dst, reader Conn) error {
+				// The reader resets its connection, so that
+				// the data written to dst fails the copy.
+				reader.(*TCPConn).SetLinger(0)
+				reader.Close()
+				go writer.Write(make([]byte, 1<<16))
+				if _, err := new(Relay).Copy(dst, src); err == nil {
+					return errors.New("copy to a reset connection succeeded")
+				}
+				return nil
+			},
+			want: SpliceEndCounts{Errors: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			writer, src := srv.clientUp.(Conn), srv.serverUp.(Conn)
+			dst, reader := srv.serverDown.(Conn), srv.clientDown.(Conn)
+			go io.Copy(ioutil.Discard, reader)
+
+			before := SpliceEnds()
+			if err := tt.copy(writer, src, dst, reader); err != nil {
+				t.Fatal(err)
+			}
+			after := SpliceEnds()
+			got := SpliceEndCounts{
+				EOF:      after.EOF - before.EOF,
+				Limit:    after.Limit - before.Limit,
+				Canceled: after.Canceled - before.Canceled,
+				Expired:  after.Expired - before.Expired,
+				Errors:   after.Errors - before.Errors,
+			}
+			if got != tt.want {
+				t.Errorf("copy counted %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayTimestamps(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	dst := srv.serverDown.(*TCPConn)
+	if getsockoptInt(t, dst, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING) != 0 {
+		t.Fatal("SO_TIMESTAMPING set before the copy")
+	}
+
+	var stamps []TxTimestamp
+	rl := &Relay{Timestamps: func(ts TxTimestamp) { stamps = append(stamps, ts) }}
+	srv.relay = rl
+	want := spliceTestData(1 << 20)
+	start := time.Now()
+	res := srv.transfer(want)
+	end := start.Add(res.elapsed)
+	checkTransfer(t, want, res)
+	if rl.Stats().Active == 0 {
+		t.Fatal("copy wasn't spliced")
+	}
+	if got := getsockoptInt(t, dst, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING); got != 0 {
+		t.Errorf("SO_TIMESTAMPING left at %#x after the copy", got)
+	}
+
+	if len(stamps) == 0 {
+		t.Skip("no timestamps reported; kernel doesn't support SO_TIMESTAMPING on TCP")
+	}
+	n := res.n
+	var sent, acked int64
+	for _, ts := range stamps {
+		if ts.Offset <= 0 || ts.Offset > n {
+			t.Fatalf("timestamp at offset %d of a %d-byte copy", ts.Offset, n)
+		}
+		if ts.Software.Before(start) || ts.Software.After(end) {
+			t.Errorf("timestamp at %v, outside the copy from %v to %v", ts.Software, start, end)
+		}
+		// Each kind of timestamp follows the data in order.
+		last := &sent
+		if ts.Acked {
+			last = &acked
+		}
+		if ts.Offset < *last {
+			t.Errorf("timestamp at offset %d after one at %d", ts.Offset, *last)
+		}
+		*last = ts.Offset
+	}
+	if sent == 0 {
+		t.Error("no transmission timestamps")
+	}
+	// The copy waits for the acknowledgment of all its data.
+	if acked != n {
+		t.Errorf("acknowledgments stamped up to offset %d; want %d", acked, n)
+	}
+}
+
+// relayOnce copies 64 KiB between fresh connections with rl, checking
+// that the data arrives intact.
+func relayOnce(t *testing.T, rl *Relay) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.relay = rl
+	want := bytes.Repeat([]byte("downgrade"), 64<<10/9)
+	checkTransfer(t, want, srv.transfer(want))
+}
+
+func TestRelayDowngrade(t *testing.T) {
+	// spliceTries counts the copies which tried to splice: those by
+	// a Relay, and all of them.
+	type spliceTries struct{ relay, all int }
+	// fail makes the hook fail the splice of the copies by a Relay
+	// whose numbers, from 0, it holds.
+	fail := func(copies ...int) *spliceTries {
+		tries := new(spliceTries)
+		testHookSpliceFail = func(rl *Relay) error {
+			tries.all++
+			if rl == nil {
+				return nil
+			}
+			defer func() { tries.relay++ }()
+			for _, c := range copies {
+				if c == tries.relay {
+					return syscall.EINVAL
+				}
+			}
+			return nil
+		}
+		return tries
+	}
+	defer func(hook func(*Relay) error) { testHookSpliceFail = hook }(testHookSpliceFail)
+
+	t.Run("downgrade", func(t *testing.T) {
+		tries := fail(0, 1, 2)
+		rl := new(Relay)
+		for i := 0; i < maxSpliceFailures; i++ {
+			relayOnce(t, rl)
+			if want := i+1 == maxSpliceFailures; rl.Downgraded() != want {
+				t.Fatalf("after %d failed copies, Downgraded() = %v; want %v", i+1, !want, want)
+			}
+		}
+		// Once downgraded, the relay copies through userspace, with
+		// no splice at all.
+		all := tries.all
+		for i := 0; i < 2; i++ {
+			relayOnce(t, rl)
+		}
+		if !rl.Downgraded() {
+			t.Error("relay no longer downgraded")
+		}
+		if tries.all != all {
+			t.Errorf("downgraded relay tried to splice %d times", tries.all-all)
+		}
+		if rl.Stats().Active != 0 {
+			t.Error("downgraded relay spliced")
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		// A copy which splices in between resets the count.
+		tries := fail(0, 1, 3, 4)
+		rl := new(Relay)
+		for i := 0; i < 5; i++ {
+			relayOnce(t, rl)
+		}
+		if rl.Downgraded() {
+			t.Error("relay downgraded after failures which weren't consecutive")
+		}
+		if tries.relay != 5 {
+			t.Errorf("%d copies tried to splice; want 5", tries.relay)
+		}
+		if rl.Stats().Active == 0 {
+			t.Error("relay never spliced")
+		}
+	})
+}
+
+func TestRelayID(t *testing.T) {
+	testRelayPaths(t, testRelayID)
+}
+
+func testRelayID(t *testing.T, spliced bool) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	var mu sync.Mutex
+	var ids []string
+	defer func(trace func(dst, src int, written int64, pipeSize, sendBuf int, end, id string)) {
+		poll.SpliceTrace = trace
+	}(poll.SpliceTrace)
+	poll.SpliceTrace = func(dst, src int, written int64, pipeSize, sendBuf int, end, id string) {
+		mu.Lock()
+		ids = append(ids, id)
+		mu.Unlock()
+	}
+
+	const id = "conn-42"
+	rl := &Relay{ID: id}
+	go srv.Write([]byte("hello"))
+	if n, err := rl.CopyN(dst, src, 5); n != 5 || err != nil {
+		t.Fatalf("CopyN = %d, %v; want 5, <nil>", n, err)
+	}
+	mu.Lock()
+	traced := ids
+	mu.Unlock()
+	if spliced && (len(traced) != 1 || traced[0] != id) {
+		t.Errorf("traced relays %q; want [%q]", traced, id)
+	}
+	if !spliced && len(traced) != 0 {
+		t.Errorf("traced relays %q; want none", traced)
+	}
+
+	// A copy failing with a timeout carries the ID, and is still
+	// reported as a timeout.
+	src.SetReadDeadline(time.Now().Add(-time.Second))
+	_, err = rl.Copy(dst, src)
+	src.SetReadDeadline(noDeadline)
+	oe, ok := err.(*OpError)
+	if !ok {
+		t.Fatalf("Copy from a source past its deadline: %v; want an *OpError", err)
+	}
+	if re, ok := oe.Err.(*RelayError); !ok || re.ID != id {
+		t.Fatalf("Copy failed with %#v; want a *RelayError with ID %q", oe.Err, id)
+	}
+	if !strings.Contains(err.Error(), "relay "+id+": ") {
+		t.Errorf("error %q doesn't mention relay %q", err, id)
+	}
+	if !oe.Timeout() {
+		t.Errorf("error %v is not a timeout", err)
+	}
+
+	// A relay without an ID leaves its errors as they are.
+	src.SetReadDeadline(time.Now().Add(-time.Second))
+	_, err = new(Relay).Copy(dst, src)
+	src.SetReadDeadline(noDeadline)
+	if oe, ok := err.(*OpError); !ok || !oe.Timeout() {
+		t.Fatalf("Copy without an ID: %v; want a timeout", err)
+	} else if _, ok := oe.Err.(*RelayError); ok {
+		t.Errorf("Copy without an ID failed with %v; want no *RelayError", err)
+	}
+}
+
+// TestRelayCopyLimit checks that the copies of a Relay which stop at a
+// length stop there, or at EOF before it, report how they ended, and
+// leave the data past the length on the source.
+func TestRelayCopyLimit(t *testing.T) {
+	for _, tt := range []struct {
+		copy     string
+		name     string
+		size, n  int64
+		closeSrc bool // the source reaches EOF after size bytes
+		err      error
+	}{
+		// The limit is reached with more data ready on the source,
+		// which is still open.
+		{"CopyN", "limit", 30000, 20000, false, nil},
+		{"CopyN", "eof", 10000, 20000, true, io.EOF},
+		{"CopyUpTo", "exact", 20000, 20000, true, nil},
+		{"CopyUpTo", "short", 10000, 20000, true, nil},
+		{"CopyUpTo", "long", 30000, 20000, true, nil},
+		{"CopyLength", "match", 20000, 20000, true, nil},
+		{"CopyLength", "short", 10000, 20000, true, &LengthError{Want: 20000, Got: 10000}},
+		// On a keep-alive connection, the body is followed by more
+		// data, or by nothing yet, neither of which is read.
+		{"CopyLength", "keepAlive", 30000, 20000, false, nil},
+		{"CopyLength", "keepAliveIdle", 20000, 20000, false, nil},
+		{"CopyLengthEOF", "match", 20000, 20000, true, nil},
+		// The data past the body is peeked at, not read.
+		{"CopyLengthEOF", "long", 30000, 20000, true, &LengthError{Want: 20000, Got: 20000, Long: true}},
+	} {
+		t.Run(tt.copy+"/"+tt.name, func(t *testing.T) {
+			testRelayCopyLimit(t, tt.copy, tt.size, tt.n, tt.closeSrc, tt.err)
+		})
+	}
+}
+
+func testRelayCopyLimit(t *testing.T, copy string, size, n int64, closeSrc bool, wantErr error) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	want := spliceTestData(int(size))
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	if _, err := srv.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitInq(src, int(size)); err != nil {
+		t.Fatal(err)
+	}
+	if closeSrc {
+		srv.CloseWrite()
+	}
+
+	type result struct {
+		written int64
+		full    bool
+		err     error
+	}
+	rl := new(Relay)
+	copyDone := make(chan result, 1)
+	go func() {
+		var r result
+		switch copy {
+		case "CopyN":
+			r.written, r.err = rl.CopyN(dst, src, n)
+		case "CopyUpTo":
+			r.written, r.full, r.err = rl.CopyUpTo(dst, src, n)
+		case "CopyLength":
+			r.written, r.err = rl.CopyLength(dst, src, n, false)
+		case "CopyLengthEOF":
+			r.written, r.err = rl.CopyLength(dst, src, n, true)
+		}
+		copyDone <- r
+	}()
+	var r result
+	select {
+	case r = <-copyDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked past the limit", copy)
+	}
+	written := size
+	if size > n {
+		written = n
+	}
+	if r.written != written || !reflect.DeepEqual(r.err, wantErr) {
+		t.Errorf("%s = %d, %v; want %d, %v", copy, r.written, r.err, written, wantErr)
+	}
+	if copy == "CopyUpTo" && r.full != (size >= n) {
+		t.Errorf("CopyUpTo full = %v; want %v", r.full, size >= n)
+	}
+	if rl.Stats().Active == 0 {
+		t.Error("relay fell back to io.Copy")
+	}
+	if !closeSrc {
+		srv.CloseWrite()
+	}
+	rest, err := ioutil.ReadAll(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, want[written:]) {
+		t.Errorf("%d bytes left on the source; want %d", len(rest), size-written)
+	}
+
+	dst.CloseWrite()
+	if got := <-readDone; !bytes.Equal(got, want[:written]) {
+		t.Errorf("relayed %d bytes differ from the first %d bytes written", len(got), written)
+	}
+}
+
+// TestRelayCopyUpToAccountError checks that an error from Account fails
+// the copy even when the write it rejects is the one reaching the limit.
+func TestRelayCopyUpToAccountError(t *testing.T) {
+	errQuota := errors.New("over quota")
+	rl := &Relay{Account: func(written int64) error {
+		if written >= 5 {
+			return errQuota
+		}
+		return nil
+	}}
+	var dst bytes.Buffer
+	if n, full, err := rl.CopyUpTo(&dst, strings.NewReader("hello, world"), 5); n != 5 || !full || err != errQuota {
+		t.Errorf("CopyUpTo = %d, %v, %v; want 5, true, %v", n, full, err, errQuota)
+	}
+	if n, err := rl.CopyN(&dst, strings.NewReader("hello, world"), 5); n != 5 || err != errQuota {
+		t.Errorf("CopyN = %d, %v; want 5, %v", n, err, errQuota)
+	}
+}
+
+// TestRelayCopyLengthExtra checks that CopyLength returns the byte past
+// the body which it reads from a source it can't peek at.
+func TestRelayCopyLengthExtra(t *testing.T) {
+	var dst bytes.Buffer
+	_, err := new(Relay).CopyLength(&dst, strings.NewReader("body!"), 4, true)
+	le, ok := err.(*LengthError)
+	if !ok || !le.Long || string(le.Extra) != "!" {
+		t.Errorf("CopyLength = %v; want a long *LengthError with Extra %q", err, "!")
+	}
+	if dst.String() != "body" {
+		t.Errorf("copied %q; want %q", dst.String(), "body")
+	}
+}
+
+func TestRelayCopyWithHeader(t *testing.T) {
+	testRelayPaths(t, testRelayCopyWithHeader)
+}
+
+// proxyV2Signature starts a PROXY protocol v2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyV2Header returns the PROXY protocol v2 header of a TCP over IPv4
+// connection from src to dst.
+func proxyV2Header(src, dst *TCPAddr) []byte {
+	h := append([]byte(proxyV2Signature), 0x21, 0x11, 0, 12)
+	h = append(h, src.IP.To4()...)
+	h = append(h, dst.IP.To4()...)
+	return append(h, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+}
+
+// parseProxyV2Header parses the PROXY protocol v2 header of a TCP over
+// IPv4 connection at the start of b, as a backend does, and returns the
+// addresses it holds and the rest of b.
+func parseProxyV2Header(b []byte) (src, dst *TCPAddr, rest []byte, err error) {
+	if len(b) < 16 || string(b[:12]) != proxyV2Signature {
+		return nil, nil, nil, errors.New("no PROXY v2 signature")
+	}
+	if b[12] != 0x21 || b[13] != 0x11 {
+		return nil, nil, nil, fmt.Errorf("command %#x, family %#x; want PROXY, TCP over IPv4", b[12], b[13])
+	}
+	n := int(b[14])<<8 | int(b[15])
+	if n < 12 || len(b) < 16+n {
+		return nil, nil, nil, fmt.Errorf("addresses of %d bytes", n)
+	}
+	a := b[16:]
+	src = &TCPAddr{IP: IPv4(a[0], a[1], a[2], a[3]), Port: int(a[8])<<8 | int(a[9])}
+	dst = &TCPAddr{IP: IPv4(a[4], a[5], a[6], a[7]), Port: int(a[10])<<8 | int(a[11])}
+	return src, dst, b[16+n:], nil
+}
+
+func testRelayCopyWithHeader(t *testing.T, spliced bool) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+	clientAddr, proxyAddr := src.RemoteAddr().(*TCPAddr), src.LocalAddr().(*TCPAddr)
+
+	// The payload is made of digits, which a concurrent write of
+	// "MARK" to dst can't be mistaken for.
+	payload := make([]byte, 1<<18)
+	for i := range payload {
+		payload[i] = '0' + byte(i%10)
+	}
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+	go func() {
+		srv.Write(payload)
+		srv.CloseWrite()
+	}()
+	markDone := make(chan error, 1)
+	go func() {
+		_, err := dst.Write([]byte("MARK"))
+		markDone <- err
+	}()
+	if !spliced {
+		// Only a spliced copy keeps other writes from coming
+		// between the header and the data.
+		if err := <-markDone; err != nil {
+			t.Fatal(err)
+		}
+		markDone <- nil
+	}
+
+	rl := new(Relay)
+	n, err := rl.CopyWithHeader(dst, src, proxyV2Header(clientAddr, proxyAddr))
+	if err != nil {
+		t.Fatalf("CopyWithHeader: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Errorf("CopyWithHeader copied %d bytes; want %d", n, len(payload))
+	}
+	if got := rl.Stats().Active != 0; got != spliced {
+		t.Errorf("relay spliced: %v; want %v", got, spliced)
+	}
+	if err := <-markDone; err != nil {
+		t.Fatal(err)
+	}
+	dst.CloseWrite()
+	got := <-readDone
+
+	// The concurrent write may come before the header or, as the
+	// copy takes place, after data copied, but not between the
+	// header and the first data.
+	i := bytes.Index(got, []byte("MARK"))
+	if i < 0 {
+		t.Fatal("concurrent write lost")
+	}
+	got = append(got[:i:i], got[i+4:]...)
+	s, d, rest, err := parseProxyV2Header(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != clientAddr.String() || d.String() != proxyAddr.String() {
+		t.Errorf("header addresses %v -> %v; want %v -> %v", s, d, clientAddr, proxyAddr)
+	}
+	if !bytes.Equal(rest, payload) {
+		t.Errorf("received %d bytes after the header which differ from the %d bytes of the payload", len(rest), len(payload))
+	}
+
+	// The header of a copy from an idle source is sent at once.
+	srv2, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Close()
+	src, dst = srv2.serverUp.(*TCPConn), srv2.serverDown.(*TCPConn)
+	header := proxyV2Header(clientAddr, proxyAddr)
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := rl.CopyWithHeader(dst, src, header)
+		copyDone <- err
+	}()
+	srv2.clientDown.(*TCPConn).SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len(header))
+	if _, err := io.ReadFull(srv2, b); err != nil || !bytes.Equal(b, header) {
+		t.Errorf("read %q, %v before the source sent anything; want the header", b, err)
+	}
+	srv2.CloseWrite()
+	if err := <-copyDone; err != nil {
+		t.Errorf("CopyWithHeader from an idle source: %v", err)
+	}
+}
+
+func TestRelayCopyTCP(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	const size = 1 << 20
+	go func() {
+		srv.Write(make([]byte, size))
+		srv.CloseWrite()
+	}()
+	readDone := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, srv)
+		readDone <- n
+	}()
+	res, err := new(Relay).CopyTCP(srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.serverDown.(*TCPConn).CloseWrite()
+	if n := <-readDone; res.Written != size || n != size {
+		t.Errorf("relay wrote %d bytes, peer read %d; want %d", res.Written, n, size)
+	}
+	for _, ti := range []struct {
+		name string
+		info *TCPInfo
+	}{
+		{"source", res.Src},
+		{"destination", res.Dst},
+	} {
+		if ti.info == nil {
+			t.Errorf("no TCP_INFO for the %s", ti.name)
+			continue
+		}
+		t.Logf("%s: %+v", ti.name, *ti.info)
+		// Loopback round trips take microseconds, and nothing
+		// is lost.
+		if ti.info.RTT <= 0 || ti.info.RTT > time.Second || ti.info.RTTVar < 0 {
+			t.Errorf("%s: implausible round-trip time %v ± %v", ti.name, ti.info.RTT, ti.info.RTTVar)
+		}
+		if ti.info.CongestionWindow <= 0 || ti.info.MSS <= 0 || ti.info.Retransmits < 0 {
+			t.Errorf("%s: implausible congestion window %d segments of %d bytes, %d retransmits", ti.name, ti.info.CongestionWindow, ti.info.MSS, ti.info.Retransmits)
+		}
+	}
+}
+
+// xorTransformer flips the bits of the data it transforms, unless
+// passthrough is set.
+type xorTransformer struct {
+	passthrough bool
+	w           *xorWriter // the last writer returned
+}
+
+func (t *xorTransformer) Passthrough() bool { return t.passthrough }
+
+func (t *xorTransformer) NewWriter(w io.Writer) io.WriteCloser {
+	t.w = &xorWriter{w: w}
+	return t.w
+}
+
+type xorWriter struct {
+	w      io.Writer
+	closed bool
+}
+
+func (w *xorWriter) Write(b []byte) (int, error) {
+	x := make([]byte, len(b))
+	for i := range b {
+		x[i] = ^b[i]
+	}
+	return w.w.Write(x)
+}
+
+func (w *xorWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// TestRelayOptions relays a stream with each of the options of a Relay
+// which shape the copy, both spliced and through userspace, and checks
+// what the option does.
+func TestRelayOptions(t *testing.T) {
+	const (
+		quota       = 1 << 20
+		budgetRate  = 1 << 20
+		budgetBurst = 64 << 10
+	)
+	errOverQuota := errors.New("over quota")
+	for _, tt := range []struct {
+		name string
+		size int
+		// relay returns the Relay of a copy.
+		relay func(t *testing.T) *Relay
+		// userspace is set for options which keep the copy from
+		// being spliced.
+		userspace bool
+		// check, if not nil, checks the copy, which otherwise
+		// must relay the data intact.
+		check func(t *testing.T, rl *Relay, data []byte, res relayResult)
+	}{
+		{
+			name:  "drainLimit",
+			size:  1 << 22,
+			relay: func(*testing.T) *Relay { return &Relay{DrainLimit: 4096} },
+		},
+		{
+			name:  "adaptivePipe",
+			size:  1 << 22,
+			relay: func(*testing.T) *Relay { return &Relay{AdaptivePipe: true} },
+		},
+		{
+			name:  "lowWater",
+			size:  1 << 22,
+			relay: func(*testing.T) *Relay { return &Relay{LowWater: 32 << 10} },
+		},
+		{
+			name:  "throughputMode",
+			size:  1 << 22,
+			relay: func(*testing.T) *Relay { return &Relay{Mode: ThroughputMode} },
+		},
+		{
+			name:  "transformPassthrough",
+			size:  1 << 20,
+			relay: func(*testing.T) *Relay { return &Relay{Transform: &xorTransformer{passthrough: true}} },
+		},
+		{
+			name:      "transform",
+			size:      1 << 20,
+			relay:     func(*testing.T) *Relay { return &Relay{Transform: new(xorTransformer)} },
+			userspace: true,
+			check: func(t *testing.T, rl *Relay, data []byte, res relayResult) {
+				want := make([]byte, len(data))
+				for i := range data {
+					want[i] = ^data[i]
+				}
+				checkTransfer(t, want, res)
+				if xt := rl.Transform.(*xorTransformer); xt.w == nil || !xt.w.closed {
+					t.Error("transforming writer was not closed")
+				}
+			},
+		},
+		{
+			name: "account",
+			size: 4 * quota,
+			relay: func(t *testing.T) *Relay {
+				var last int64
+				return &Relay{Account: func(written int64) error {
+					if written <= last {
+						t.Errorf("Account(%d) after Account(%d)", written, last)
+					}
+					last = written
+					if written >= quota {
+						return errOverQuota
+					}
+					return nil
+				}}
+			},
+			check: func(t *testing.T, rl *Relay, data []byte, res relayResult) {
+				err := res.err
+				if oe, ok := err.(*OpError); ok {
+					err = oe.Err
+				}
+				if err != errOverQuota {
+					t.Fatalf("copy: %v; want %v", err, errOverQuota)
+				}
+				// The copy stops within one write of the quota.
+				if res.n < quota || res.n >= quota+64<<10 {
+					t.Errorf("copy stopped after %d bytes; want %d or a little more", res.n, quota)
+				}
+				if !bytes.Equal(res.got, data[:res.n]) {
+					t.Errorf("destination got %d bytes; want the first %d written", len(res.got), res.n)
+				}
+			},
+		},
+		{
+			// The source has far more data ready than the budget
+			// lets through, and the data the relay holds while it
+			// waits for the budget must reach the destination
+			// intact.
+			name:  "budget",
+			size:  1 << 20,
+			relay: func(*testing.T) *Relay { return &Relay{Budget: NewOutputBudget(budgetRate, budgetBurst)} },
+			check: func(t *testing.T, rl *Relay, data []byte, res relayResult) {
+				checkTransfer(t, data, res)
+				if min := time.Duration(len(data)-budgetBurst) * time.Second / budgetRate; res.elapsed < min*9/10 {
+					t.Errorf("copy took %v; want at least %v", res.elapsed, min)
+				}
+				for _, a := range res.arrivals {
+					if allowed := budgetBurst + int(a.at.Seconds()*budgetRate); a.received > allowed {
+						t.Errorf("destination got %d bytes after %v; want at most %d", a.received, a.at, allowed)
+						break
+					}
+				}
+			},
+		},
+		// An odd size of the inspection buffer doesn't line up with
+		// the chunks the data arrives in.
+		{
+			name:  "inspect",
+			size:  256 << 10,
+			relay: func(*testing.T) *Relay { return &Relay{Inspect: make([]byte, 1000)} },
+			check: checkInspected,
+		},
+		{
+			name:  "inspectShort",
+			size:  100,
+			relay: func(*testing.T) *Relay { return &Relay{Inspect: make([]byte, 1000)} },
+			check: checkInspected,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testRelayPaths(t, func(t *testing.T, spliced bool) {
+				srv, err := newSpliceTestServer()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer srv.Close()
+				rl := tt.relay(t)
+				srv.relay = rl
+				data := spliceTestData(tt.size)
+				res := srv.transfer(data)
+				if tt.check != nil {
+					tt.check(t, rl, data, res)
+				} else {
+					checkTransfer(t, data, res)
+				}
+				if got, want := rl.Stats().Active != 0, spliced && !tt.userspace; got != want {
+					t.Errorf("spliced = %v; want %v", got, want)
+				}
+			})
+		})
+	}
+}
+
+// checkInspected checks that the inspection buffer of rl holds the start
+// of data, which the copy relayed intact.
+func checkInspected(t *testing.T, rl *Relay, data []byte, res relayResult) {
+	checkTransfer(t, data, res)
+	prefix := len(rl.Inspect)
+	if len(data) < prefix {
+		prefix = len(data)
+	}
+	if !bytes.Equal(rl.Inspect[:prefix], data[:prefix]) {
+		t.Errorf("inspection buffer holds %q; want the first %d bytes of the stream", rl.Inspect[:prefix], prefix)
+	}
+}
+
+// TestRelayCapture relays a payload each way between a client and a
+// server, with both relays recording to the same capture file, and checks
+// that the records of each direction hold its payload, in order.
+func TestRelayCapture(t *testing.T) {
+	testRelayPaths(t, testRelayCapture)
+}
+
+func testRelayCapture(t *testing.T, spliced bool) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	f, err := ioutil.TempFile("", "relay-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The client sends a large payload, to which the server replies
+	// with a small one.
+	var payload [2][]byte
+	for dir, size := range []int{1 << 20, 1000} {
+		payload[dir] = make([]byte, size)
+		for i := range payload[dir] {
+			payload[dir][i] = byte((dir + i) % 251)
+		}
+	}
+	go func() {
+		srv.Write(payload[0])
+		srv.CloseWrite()
+	}()
+	client, server := srv.clientUp.(*TCPConn), srv.clientDown.(*TCPConn)
+	go func() {
+		server.Write(payload[1])
+		server.CloseWrite()
+	}()
+	var received [2]chan []byte
+	for dir, c := range []*TCPConn{server, client} {
+		received[dir] = make(chan []byte, 1)
+		go func(c *TCPConn, ch chan []byte) {
+			b, _ := ioutil.ReadAll(c)
+			ch <- b
+		}(c, received[dir])
+	}
+
+	capture := NewCapture(f)
+	relays := [2]*Relay{
+		{Capture: capture, CaptureDirection: 0},
+		{Capture: capture, CaptureDirection: 1},
+	}
+	var wg sync.WaitGroup
+	up, down := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+	// Small send buffers make the relays write part of what they
+	// hold at a time, leaving the rest to be written, but not
+	// captured, again.
+	for _, c := range []*TCPConn{up, down} {
+		if err := c.SetWriteBuffer(8 << 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dir, ends := range [][2]*TCPConn{{down, up}, {up, down}} {
+		wg.Add(1)
+		go func(dir int, dst, src *TCPConn) {
+			defer wg.Done()
+			if n, err := relays[dir].Copy(dst, src); n != int64(len(payload[dir])) || err != nil {
+				t.Errorf("copy %d: %d, %v; want %d, <nil>", dir, n, err, len(payload[dir]))
+			}
+			dst.CloseWrite()
+		}(dir, ends[0], ends[1])
+	}
+	wg.Wait()
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for dir, rl := range relays {
+		if got := <-received[dir]; !bytes.Equal(got, payload[dir]) {
+			t.Errorf("direction %d: destination got %d bytes; want the %d sent", dir, len(got), len(payload[dir]))
+		}
+		if got := rl.Stats().Active != 0; got != spliced {
+			t.Errorf("direction %d: spliced = %v; want %v", dir, got, spliced)
+		}
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		captured [2][]byte
+		last     int64
+	)
+	for len(b) > 0 {
+		if len(b) < 13 {
+			t.Fatalf("capture ends with a truncated header of %d bytes", len(b))
+		}
+		var ts int64
+		for _, c := range b[:8] {
+			ts = ts<<8 | int64(c)
+		}
+		dir := b[8]
+		n := int(b[9])<<24 | int(b[10])<<16 | int(b[11])<<8 | int(b[12])
+		b = b[13:]
+		if dir > 1 || n > len(b) {
+			t.Fatalf("bad record header: direction %d, length %d with %d bytes left", dir, n, len(b))
+		}
+		// The records of the two directions may be written out
+		// of order, but not by much.
+		if ts < last-int64(time.Second) || ts > time.Now().UnixNano() {
+			t.Errorf("record timestamped %v after one timestamped %v", time.Unix(0, ts), time.Unix(0, last))
+		}
+		if ts > last {
+			last = ts
+		}
+		captured[dir] = append(captured[dir], b[:n]...)
+		b = b[n:]
+	}
+	if dropped := capture.Dropped(); dropped > 0 {
+		// The capture gave way to the relays.
+		t.Logf("capture dropped %d bytes", dropped)
+		if total := int64(len(captured[0]) + len(captured[1])); total+dropped != int64(len(payload[0])+len(payload[1])) {
+			t.Errorf("captured %d and dropped %d bytes; want %d in all", total, dropped, len(payload[0])+len(payload[1]))
+		}
+		return
+	}
+	for dir := range payload {
+		if !bytes.Equal(captured[dir], payload[dir]) {
+			t.Errorf("direction %d: captured %d bytes; want the %d sent", dir, len(captured[dir]), len(payload[dir]))
+		}
+	}
+}
+
+// TestRelayTimeSlice checks that a copy from a source which keeps sending
+// returns, once its time slice is over, with the data copied so far and
+// ErrSliceExpired, and that a further copy carries on from there.
+func TestRelayTimeSlice(t *testing.T) {
+	testRelayPaths(t, testRelayTimeSlice)
+}
+
+func testRelayTimeSlice(t *testing.T, spliced bool) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// The source sends in small chunks, between which the relay
+	// waits for it, until told to stop.
+	var sent []byte
+	stop := make(chan struct{})
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		defer srv.CloseWrite()
+		chunk := make([]byte, 4<<10)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			for j := range chunk {
+				chunk[j] = byte((i + j) % 251)
+			}
+			if _, err := srv.Write(chunk); err != nil {
+				return
+			}
+			sent = append(sent, chunk...)
+		}
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+
+	const slice = 100 * time.Millisecond
+	rl := &Relay{TimeSlice: slice}
+	start := time.Now()
+	n, err := rl.Copy(srv.serverDown, srv.serverUp)
+	elapsed := time.Since(start)
+	if err != ErrSliceExpired || n == 0 {
+		t.Fatalf("copy: %d, %v; want some data, %v", n, err, ErrSliceExpired)
+	}
+	if elapsed < slice || elapsed > slice+time.Second {
+		t.Errorf("copy returned after %v; want about %v", elapsed, slice)
+	}
+	if got := rl.Stats().Active != 0; got != spliced {
+		t.Errorf("spliced = %v; want %v", got, spliced)
+	}
+
+	// Without a slice, the copy carries on to EOF, which it would
+	// not if the deadline of the slice were left behind.
+	close(stop)
+	<-writeDone
+	rl.TimeSlice = 0
+	m, err := rl.Copy(srv.serverDown, srv.serverUp)
+	if err != nil {
+		t.Fatalf("resumed copy: %v", err)
+	}
+	if n+m != int64(len(sent)) {
+		t.Errorf("copied %d bytes, then %d; want %d in all", n, m, len(sent))
+	}
+	srv.serverDown.(*TCPConn).CloseWrite()
+	if got := <-readDone; !bytes.Equal(got, sent) {
+		t.Errorf("destination got %d bytes which differ from the %d sent", len(got), len(sent))
+	}
+}
+
+// TestRelayNotRedirected checks that a relay told that the kernel
+// redirects its data fails, leaving the data on the source, if the data
+// turns up on the source after all.
+func TestRelayNotRedirected(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src := srv.serverUp.(*TCPConn)
+	msg := []byte("not redirected")
+	if _, err := srv.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	rl := &Relay{Redirected: true}
+	n, err := rl.Copy(srv.serverDown, src)
+	if oe, ok := err.(*OpError); !ok || oe.Err != poll.ErrNotRedirected {
+		t.Fatalf("copy: %d, %v; want %v", n, err, poll.ErrNotRedirected)
+	}
+	if n != 0 {
+		t.Errorf("copy reported %d bytes; want 0", n)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(src, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("source has %q; want %q", got, msg)
+	}
+}
+
+func TestRelayDropCache(t *testing.T) {
+	f, err := os.Open(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	client, server, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		readDone <- b
+	}()
+	// Send the file in two parts, to check that a limited source is
+	// accounted for.
+	const first = 100000
+	rl := &Relay{DropCache: true}
+	lr := &io.LimitedReader{R: f, N: first}
+	n, err := rl.Copy(server, lr)
+	if err != nil || n != first || lr.N != 0 {
+		t.Fatalf("first part: copied %d bytes, %v, %d left; want %d, <nil>, 0 left", n, err, lr.N, first)
+	}
+	n, err = rl.Copy(server, f)
+	if err != nil || n != twainLen-first {
+		t.Fatalf("second part: copied %d bytes, %v; want %d, <nil>", n, err, twainLen-first)
+	}
+	server.(*TCPConn).CloseWrite()
+
+	want, err := ioutil.ReadFile(twain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readDone; !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes which differ from the %d bytes of %s", len(got), len(want), twain)
+	}
+}
+
+func TestConfigureForSplice(t *testing.T) {
+	c, peer, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer peer.Close()
+	tc := c.(*TCPConn)
+	getsockopt := func(level, opt int) int {
+		t.Helper()
+		return getsockoptInt(t, tc, level, opt)
+	}
+
+	if err := tc.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureForSplice(tc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := getsockopt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Error("TCP_NODELAY not set by default")
+	}
+	// Linux doubles the requested buffer sizes to allow for
+	// bookkeeping overhead.
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < defaultSpliceBuffer {
+		t.Errorf("SO_RCVBUF = %d, want at least %d", v, defaultSpliceBuffer)
+	}
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < defaultSpliceBuffer {
+		t.Errorf("SO_SNDBUF = %d, want at least %d", v, defaultSpliceBuffer)
+	}
+
+	opts := &SpliceOptions{
+		ReadBuffer:  1 << 20,
+		WriteBuffer: 512 << 10,
+		Delay:       true,
+		KeepAlive:   42 * time.Second,
+	}
+	if err := ConfigureForSplice(tc, opts); err != nil {
+		t.Fatal(err)
+	}
+	if v := getsockopt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Error("TCP_NODELAY set with Delay = true")
+	}
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < opts.ReadBuffer {
+		t.Errorf("SO_RCVBUF = %d, want at least %d", v, opts.ReadBuffer)
+	}
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < opts.WriteBuffer {
+		t.Errorf("SO_SNDBUF = %d, want at least %d", v, opts.WriteBuffer)
+	}
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Error("SO_KEEPALIVE not set")
+	}
+	if v := getsockopt(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 42 {
+		t.Errorf("TCP_KEEPINTVL = %d, want 42", v)
+	}
+
+	if err := ConfigureForSplice(tc, &SpliceOptions{KeepAlive: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Error("SO_KEEPALIVE set with negative KeepAlive")
+	}
+}
+
+// getsockoptInt returns the value of the integer socket option of c at
+// level and opt.
+func getsockoptInt(t *testing.T, c *TCPConn, level, opt int) int {
+	t.Helper()
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestOptimalSpliceChunk(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	src, dst := srv.serverUp.(*TCPConn), srv.serverDown.(*TCPConn)
+
+	for _, tt := range []struct {
+		rcvbuf, sndbuf int
+	}{
+		{64 << 10, 192 << 10},
+		{160 << 10, 48 << 10},
+		{256 << 10, 256 << 10},
+		// Smaller than any pipe worth splicing through.
+		{4 << 10, 4 << 10},
+	} {
+		if err := src.SetReadBuffer(tt.rcvbuf); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.SetWriteBuffer(tt.sndbuf); err != nil {
+			t.Fatal(err)
+		}
+		// The kernel doubles the sizes, and may cap them.
+		rcvbuf := getsockoptInt(t, src, syscall.SOL_SOCKET, syscall.SO_RCVBUF) / 2
+		sndbuf := getsockoptInt(t, dst, syscall.SOL_SOCKET, syscall.SO_SNDBUF) / 2
+		smaller := rcvbuf
+		if sndbuf < smaller {
+			smaller = sndbuf
+		}
+		// The largest power of two no larger than the smaller
+		// buffer, but at least 16 KiB.
+		lo, hi := smaller/2, smaller
+		if hi < 16<<10 {
+			lo, hi = 16<<10, 16<<10
+		}
+		n := OptimalSpliceChunk(src, dst)
+		if n < lo || n > hi || n&(n-1) != 0 {
+			t.Errorf("buffers %d and %d: OptimalSpliceChunk = %d; want a power of two in [%d, %d]", rcvbuf, sndbuf, n, lo, hi)
+		}
+	}
+
+	// Without buffers to go by, the recommendation is the size of a
+	// default pipe.
+	c1, c2 := Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if n := OptimalSpliceChunk(c1, c2); n != 64<<10 {
+		t.Errorf("OptimalSpliceChunk of in-memory connections = %d; want %d", n, 64<<10)
+	}
+}
+
+func TestSpliceOptimizedListener(t *testing.T) {
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &SpliceOptions{WriteBuffer: 512 << 10, KeepAlive: 42 * time.Second}
+	ln = SpliceOptimizedListener(ln, opts)
+	defer ln.Close()
+	// Changes to opts don't affect the listener.
+	opts.KeepAlive = 0
+
+	// A relay between two accepted connections, whose peers are
+	// clientUp and clientDown.
+	var conns [2]*TCPConn
+	var clients [2]Conn
+	for i := range conns {
+		clients[i], err = Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].Close()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		tc, ok := c.(*TCPConn)
+		if !ok {
+			t.Fatalf("accepted %T; want *TCPConn", c)
+		}
+		conns[i] = tc
+
+		if v := getsockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+			t.Errorf("conn %d: TCP_NODELAY not set", i)
+		}
+		if v := getsockoptInt(t, tc, syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < defaultSpliceBuffer {
+			t.Errorf("conn %d: SO_RCVBUF = %d, want at least %d", i, v, defaultSpliceBuffer)
+		}
+		if v := getsockoptInt(t, tc, syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < opts.WriteBuffer {
+			t.Errorf("conn %d: SO_SNDBUF = %d, want at least %d", i, v, opts.WriteBuffer)
+		}
+		if v := getsockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 42 {
+			t.Errorf("conn %d: TCP_KEEPINTVL = %d, want 42", i, v)
+		}
+	}
+
+	rl := new(Relay)
+	srv := &spliceTestServer{clientUp: clients[0], serverUp: conns[0], clientDown: clients[1], serverDown: conns[1], relay: rl}
+	data := spliceTestData(1 << 22)
+	checkTransfer(t, data, srv.transfer(data))
+	if rl.Stats().Active == 0 {
+		t.Error("relay between accepted connections was not spliced")
+	}
+}
+
+func TestSpliceOptimizedListenerPipeSize(t *testing.T) {
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const pipeSize = 256 << 10
+	ln = SpliceOptimizedListener(ln, &SpliceOptions{PipeSize: pipeSize})
+	defer ln.Close()
+
+	var mu sync.Mutex
+	sizes := make(map[int][]int)
+	defer func(trace func(dst, src int, written int64, pipeSize, sendBuf int, end, id string)) {
+		poll.SpliceTrace = trace
+	}(poll.SpliceTrace)
+	poll.SpliceTrace = func(dst, src int, written int64, pipeSize, sendBuf int, end, id string) {
+		mu.Lock()
+		sizes[src] = append(sizes[src], pipeSize)
+		mu.Unlock()
+	}
+
+	// A relay from an accepted connection to one which has not been
+	// configured takes its pipe size from the accepted connection.
+	client, err := Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	clientDown, serverDown, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientDown.Close()
+	defer serverDown.Close()
+	srv := &spliceTestServer{clientUp: client, serverUp: c, clientDown: clientDown, serverDown: serverDown}
+	data := spliceTestData(1 << 20)
+	checkTransfer(t, data, srv.transfer(data))
+
+	src := c.(*TCPConn).fd.pfd.Sysfd
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes[src]) == 0 {
+		t.Fatal("relay from the accepted connection was not spliced")
+	}
+	for _, size := range sizes[src] {
+		if size != pipeSize {
+			t.Errorf("relay from the accepted connection used a %d byte pipe; want %d", size, pipeSize)
+		}
+	}
+}
+
+func TestSpliceRawSockets(t *testing.T) {
+	if !testableNetwork("ip4") {
+		t.Skip("raw sockets not testable")
+	}
+
+	// The relay reads protocol 253 packets and forwards them as
+	// protocol 254 packets, so that it never sees its own output.
+	lo := &IPAddr{IP: IPv4(127, 0, 0, 1)}
+	in, err := ListenIP("ip4:253", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := DialIP("ip4:254", nil, lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	sink, err := ListenIP("ip4:254", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	source, err := DialIP("ip4:253", nil, lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	tc, peer, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	defer peer.Close()
+	if _, _, handled := splice(tc.(*TCPConn).fd, in, nil, nil, noDeadline); handled {
+		t.Error("splice handled a raw IP source")
+	}
+	if _, handled, _, _ := poll.Splice(&tc.(*TCPConn).fd.pfd, &in.fd.pfd, 1); handled {
+		t.Error("poll.Splice handled a raw IP source")
+	}
+
+	// Reading a raw IPv4 socket returns the IP header too, so relay
+	// with ReadFrom, which strips it.
+	relayDone := make(chan struct{})
+	defer func() {
+		in.Close()
+		<-relayDone
+	}()
+	go func() {
+		defer close(relayDone)
+		b := make([]byte, 1<<16)
+		for {
+			n, _, err := in.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if _, err := out.Write(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	sizes := []int{1, 1000, 17, 1400}
+	for _, n := range sizes {
+		if _, err := source.Write(bytes.Repeat([]byte{byte(n)}, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1<<16)
+	for _, want := range sizes {
+		n, _, err := sink.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want || !bytes.Equal(b[:n], bytes.Repeat([]byte{byte(want)}, want)) {
+			t.Fatalf("relayed packet of %d bytes, want %d", n, want)
+		}
+	}
+}
+
+func TestSpliceUrgent(t *testing.T) {
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	peer, reader := srv.clientUp.(Conn), srv.clientDown.(Conn)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := (&Relay{Urgent: true}).Copy(srv.serverDown, srv.serverUp)
+		srv.serverDown.(*TCPConn).CloseWrite()
+		done <- err
+	}()
+
+	// The urgent byte follows the in-band data before it, and
+	// precedes the data after it, in separate segments.
+	before, after := []byte("before the mark"), []byte("after the mark")
+	if _, err := peer.Write(before); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendUrgent(peer.(*TCPConn), '!'); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := peer.Write(after); err != nil {
+		t.Fatal(err)
+	}
+	peer.(*TCPConn).CloseWrite()
+
+	// Reads stop at the mark, so the data read before it is
+	// exactly the data sent before the urgent byte.
+	reader.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []byte
+	b := make([]byte, 64)
+	for {
+		mark, err := atUrgentMark(reader.(*TCPConn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark {
+			break
+		}
+		n, err := reader.Read(b)
+		if err != nil {
+			t.Fatalf("read %q before the mark: %v", got, err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if !bytes.Equal(got, before) {
+		t.Errorf("received %q before the mark; want %q", got, before)
+	}
+	c, err := recvUrgent(reader.(*TCPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != '!' {
+		t.Errorf("received urgent byte %q; want %q", c, '!')
+	}
+	got, err = ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, after) {
+		t.Errorf("received %q after the mark; want %q", got, after)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendUrgent sends c to the peer of conn as TCP urgent data.
+func sendUrgent(conn *TCPConn, c byte) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		_, serr = syscall.SendmsgN(int(fd), []byte{c}, nil, nil, syscall.MSG_OOB)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// atUrgentMark reports whether the next byte to be read from conn is the
+// mark of its urgent data.
+func atUrgentMark(conn *TCPConn) (bool, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var mark int32
+	var merr error
+	err = rc.Control(func(fd uintptr) {
+		_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.SIOCATMARK, uintptr(unsafe.Pointer(&mark)))
+		if e != 0 {
+			merr = e
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	return mark != 0, merr
+}
+
+// recvUrgent receives the urgent byte pending on conn, waiting for it to
+// arrive if need be.
+func recvUrgent(conn *TCPConn) (byte, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var b [1]byte
+	var rerr error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = rc.Control(func(fd uintptr) {
+			_, _, rerr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_OOB)
+		})
+		if err != nil {
+			return 0, err
+		}
+		if rerr != syscall.EAGAIN || time.Now().After(deadline) {
+			return b[0], rerr
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkTCPReadFrom(b *testing.B) {
+	testHookUninstaller.Do(uninstallTestHooks)
+
+	var chunkSizes []int
+	for i := uint(10); i <= 20; i++ {
+		chunkSizes = append(chunkSizes, 1<<i)
+	}
+	// To benchmark the genericReadFrom code path, set this to false.
+	useSplice := true
+	for _, chunkSize := range chunkSizes {
+		b.Run(fmt.Sprint(chunkSize), func(b *testing.B) {
+			benchSplice(b, chunkSize, useSplice, nil)
+		})
+	}
+}
+
+// BenchmarkRelay measures relays of a stream written in chunks of a given
+// size, between connections configured for splicing and with the options
+// of a Relay which trade latency for throughput.
+func BenchmarkRelay(b *testing.B) {
+	testHookUninstaller.Do(uninstallTestHooks)
+
+	configure := func(opts *SpliceOptions) func(*spliceTestServer) error {
+		return func(srv *spliceTestServer) error {
+			return srv.configure(opts)
+		}
+	}
+	relay := func(rl *Relay) func(*spliceTestServer) error {
+		return func(srv *spliceTestServer) error {
+			srv.relay = rl
+			return nil
+		}
+	}
+	for _, tt := range []struct {
+		name      string
+		chunkSize int
+		setup     func(*spliceTestServer) error
+	}{
+		{"untuned", 1 << 16, nil},
+		{"configured/default", 1 << 16, configure(&SpliceOptions{})},
+		{"configured/autotuned", 1 << 16, configure(&SpliceOptions{ReadBuffer: -1, WriteBuffer: -1})},
+		{"configured/buffers=1M", 1 << 16, configure(&SpliceOptions{ReadBuffer: 1 << 20, WriteBuffer: 1 << 20})},
+		{"latencyMode/chunk=1K", 1 << 10, relay(&Relay{Mode: LatencyMode})},
+		{"latencyMode/chunk=1M", 1 << 20, relay(&Relay{Mode: LatencyMode})},
+		{"throughputMode/chunk=1K", 1 << 10, relay(&Relay{Mode: ThroughputMode})},
+		{"throughputMode/chunk=1M", 1 << 20, relay(&Relay{Mode: ThroughputMode})},
+		{"lowWater=64K/chunk=1K", 1 << 10, relay(&Relay{LowWater: 64 << 10})},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			benchSplice(b, tt.chunkSize, true, tt.setup)
+		})
+	}
+}
+
+// BenchmarkRelayLatency measures how long records spend in a relay, with
+// the options of a Relay which trade throughput for latency. Each record
+// carries the time at which it was written, so that the reader can
+// measure its latency from end to end, and the jitter, the standard
+// deviation of the latency. A slow reader yields after each record, so
+// that the writer gets ahead of it.
+func BenchmarkRelayLatency(b *testing.B) {
+	testHookUninstaller.Do(uninstallTestHooks)
+
+	for _, tt := range []struct {
+		name       string
+		rl         *Relay
+		recordSize int
+		slowReader bool
+	}{
+		{"default", &Relay{}, 1 << 10, false},
+		{"drainLimit=4K", &Relay{DrainLimit: 4 << 10}, 1 << 10, false},
+		{"dedicatedPoller", &Relay{DedicatedPoller: true}, 1 << 10, false},
+		{"slowReader/default", &Relay{}, 4 << 10, true},
+		// NotSentLowWater keeps the relay and its destination from
+		// buffering records behind those already sent.
+		{"slowReader/notSentLowWater=16K", &Relay{NotSentLowWater: 16 << 10}, 4 << 10, true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			srv, err := newSpliceTestServer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer srv.Close()
+			srv.relay = tt.rl
+			copyDone := srv.Copy()
+
+			readDone := make(chan struct{})
+			var sum, sumSq float64
+			go func() {
+				defer close(readDone)
+				rec := make([]byte, tt.recordSize)
+				for i := 0; i < b.N; i++ {
+					if _, err := io.ReadFull(srv, rec); err != nil {
+						b.Error(err)
+						return
+					}
+					var sent int64
+					for _, c := range rec[:8] {
+						sent = sent<<8 | int64(c)
+					}
+					d := float64(time.Now().UnixNano() - sent)
+					sum += d
+					sumSq += d * d
+					if tt.slowReader {
+						runtime.Gosched()
+					}
+				}
+			}()
+			rec := make([]byte, tt.recordSize)
+			b.SetBytes(int64(tt.recordSize))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				now := time.Now().UnixNano()
+				for j := 7; j >= 0; j-- {
+					rec[j] = byte(now)
+					now >>= 8
+				}
+				if _, err := srv.Write(rec); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-readDone
+			b.StopTimer()
+			srv.CloseWrite()
+			<-copyDone
+			mean := sum / float64(b.N)
+			b.Logf("N=%d latency %v, jitter %v", b.N, time.Duration(mean), time.Duration(math.Sqrt(sumSq/float64(b.N)-mean*mean)))
+		})
+	}
+}
+
+// BenchmarkSpliceUnix compares relays between Unix stream connections,
+// spliced with various pipe sizes and copied through userspace. With -v,
+// it reports whether splicing beats the userspace copy for each chunk
+// size.
+func BenchmarkSpliceUnix(b *testing.B) {
+	testHookUninstaller.Do(uninstallTestHooks)
+	if !testableNetwork("unix") {
+		b.Skip("unix not testable")
+	}
+	defer func(size int) { testHookRelayPipeSize = size }(testHookRelayPipeSize)
+
+	chunkSizes := []int{1 << 10, 16 << 10, 256 << 10}
+	pipeSizes := []int{16 << 10, 64 << 10, 256 << 10, 1 << 20}
+	// rates holds the throughput, in bytes per second, of the last
+	// run of each sub-benchmark.
+	rates := make(map[string]float64)
+	run := func(name string, chunkSize, pipeSize int, useSplice bool) {
+		b.Run(name, func(b *testing.B) {
+			testHookRelayPipeSize = pipeSize
+			d := benchSpliceNetwork(b, "unix", chunkSize, useSplice, func(srv *spliceTestServer) error {
+				// A UnixConn has no ReadFrom method, so
+				// only a Relay splices it.
+				srv.relay = new(Relay)
+				return nil
+			})
+			rates[name] = float64(chunkSize) * float64(b.N) / d.Seconds()
+		})
+	}
+	genericName := func(chunkSize int) string {
+		return fmt.Sprintf("generic/chunk=%d", chunkSize)
+	}
+	spliceName := func(chunkSize, pipeSize int) string {
+		return fmt.Sprintf("splice/pipe=%d/chunk=%d", pipeSize, chunkSize)
+	}
+	for _, chunkSize := range chunkSizes {
+		run(genericName(chunkSize), chunkSize, 0, false)
+		for _, pipeSize := range pipeSizes {
+			run(spliceName(chunkSize, pipeSize), chunkSize, pipeSize, true)
+		}
+	}
+
+	// Report whether splicing pays off for each chunk size, with its
+	// best pipe size.
+	for _, chunkSize := range chunkSizes {
+		generic := rates[genericName(chunkSize)]
+		var best float64
+		var bestPipe int
+		for _, pipeSize := range pipeSizes {
+			if r := rates[spliceName(chunkSize, pipeSize)]; r > best {
+				best, bestPipe = r, pipeSize
+			}
+		}
+		if generic == 0 || best == 0 {
+			continue
+		}
+		verdict := "splice beats generic copy"
+		if generic > best {
+			verdict = "generic copy beats splice"
+		}
+		b.Logf("chunk=%d: splice %.0f MB/s with pipe=%d, generic %.0f MB/s: %s", chunkSize, best/1e6, bestPipe, generic/1e6, verdict)
+	}
+}
+
+// newAsymmetricMTUServer returns a spliceTestServer which relays from a
+// connection with loopback's 64 KiB MTU, which delivers data in large
+// bursts, to one whose segments carry 1448 bytes, as over Ethernet. If
+// sendBuffer is positive, it is the send buffer size of the relay's
+// destination.
+func newAsymmetricMTUServer(sendBuffer int) (*spliceTestServer, error) {
+	clientUp, serverUp, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		return nil, err
+	}
+	clientDown, serverDown, err := spliceTestSocketPairMSS(1448)
+	if err != nil {
+		clientUp.Close()
+		serverUp.Close()
+		return nil, err
+	}
+	srv := &spliceTestServer{clientUp: clientUp, clientDown: clientDown, serverUp: serverUp, serverDown: serverDown}
+	if sendBuffer > 0 {
+		if err := serverDown.(*TCPConn).SetWriteBuffer(sendBuffer); err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+// relayStatsPerMiB returns the reads, read waits, writes and write
+// waits of st for each MiB written.
+func relayStatsPerMiB(st RelayStats) (reads, readWaits, writes, writeWaits float64) {
+	mib := float64(st.WriteBytes) / (1 << 20)
+	return float64(st.Reads) / mib, float64(st.ReadWaits) / mib, float64(st.Writes) / mib, float64(st.WriteWaits) / mib
+}
+
+// testSpliceAsymmetricMTU checks that a relay to a connection with a
+// small MTU, whose reader takes a segment's worth at a time, from one
+// which delivers large bursts, moves data in large splices rather than
+// waking up for every few segments.
+func testSpliceAsymmetricMTU(t *testing.T) {
+	srv, err := newAsymmetricMTUServer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// The reader's receive window is a few segments.
+	if err := srv.clientDown.(*TCPConn).SetReadBuffer(4096); err != nil {
+		t.Fatal(err)
+	}
+	rl := new(Relay)
+	srv.relay = rl
+	data := spliceTestData(1 << 23)
+	checkTransfer(t, data, srv.transfer(data))
+
+	// The relay takes 16 reads and 16 writes per MiB when every
+	// splice fills or empties a 64 KiB pipe, and waits for the
+	// destination about once per MiB. Allow for four times that.
+	reads, readWaits, writes, writeWaits := relayStatsPerMiB(rl.Stats())
+	t.Logf("per MiB: %.1f reads, %.1f read waits, %.1f writes, %.1f write waits", reads, readWaits, writes, writeWaits)
+	if reads > 64 || writes > 64 {
+		t.Errorf("%.1f reads and %.1f writes per MiB; want at most 64 each", reads, writes)
+	}
+	if readWaits+writeWaits > 64 {
+		t.Errorf("%.1f waits per MiB; want at most 64", readWaits+writeWaits)
+	}
+}
+
+// BenchmarkRelayAsymmetricMTU measures a relay between the connections
+// of newAsymmetricMTUServer, whose reader takes a segment's worth at a
+// time. It reports the system calls made by the relay for each MiB.
+func BenchmarkRelayAsymmetricMTU(b *testing.B) {
+	testHookUninstaller.Do(uninstallTestHooks)
+
+	for _, tt := range []struct {
+		name       string
+		sendBuffer int
+	}{
+		{"defaultSendBuffer", 0},
+		{"smallSendBuffer", 1},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			srv, err := newAsymmetricMTUServer(tt.sendBuffer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer srv.Close()
+			rl := new(Relay)
+			srv.relay = rl
+			copyDone := srv.Copy()
+
+			const chunk = 64 << 10
+			readDone := make(chan error, 1)
+			go func() {
+				buf := make([]byte, 1448)
+				n, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{srv}, buf)
+				if err == nil && n != int64(b.N)*chunk {
+					err = fmt.Errorf("read %d bytes; want %d", n, int64(b.N)*chunk)
+				}
+				readDone <- err
+			}()
+			buf := make([]byte, chunk)
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := srv.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			srv.CloseWrite()
+			if err := <-copyDone; err != nil {
+				b.Fatal(err)
+			}
+			srv.serverDown.(*TCPConn).CloseWrite()
+			if err := <-readDone; err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			reads, readWaits, writes, writeWaits := relayStatsPerMiB(rl.Stats())
+			b.Logf("N=%d per MiB: %.1f reads, %.1f read waits, %.1f writes, %.1f write waits", b.N, reads, readWaits, writes, writeWaits)
+		})
+	}
+}
+
+// benchSplice measures a relay through a spliceTestServer which has been
+// prepared by setup, if it is not nil.
+func benchSplice(b *testing.B, chunkSize int, useSplice bool, setup func(*spliceTestServer) error) {
+	benchSpliceNetwork(b, "tcp", chunkSize, useSplice, setup)
+}
+
+// benchSpliceNetwork is like benchSplice, but relays between connections
+// on network. It returns the time taken by the relay.
+func benchSpliceNetwork(b *testing.B, network string, chunkSize int, useSplice bool, setup func(*spliceTestServer) error) time.Duration {
+	srv, err := newSpliceTestServerNetwork(network)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	if setup != nil {
+		if err := setup(srv); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var copyDone <-chan error
+	if useSplice {
+		copyDone = srv.Copy()
+	} else {
+		copyDone = srv.CopyNoSplice()
+	}
+	chunk := make([]byte, chunkSize)
+	discardDone := make(chan struct{})
+	go func() {
+		for {
+			buf := make([]byte, chunkSize)
+			_, err := srv.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+		discardDone <- struct{}{}
+	}()
+	b.SetBytes(int64(chunkSize))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		srv.Write(chunk)
+	}
+	srv.CloseWrite()
+	<-copyDone
+	d := time.Since(start)
+	srv.CloseRead()
+	<-discardDone
+	return d
+}
+
+type spliceTestServer struct {
+	clientUp   io.WriteCloser
+	clientDown io.ReadCloser
+	serverUp   io.ReadCloser
+	serverDown io.WriteCloser
+
+	// relay, if not nil, is used by Copy instead of io.Copy.
+	relay *Relay
+}
+
+func newSpliceTestServer() (*spliceTestServer, error) {
+	return newSpliceTestServerNetwork("tcp")
+}
+
+// newSpliceTestServerNetwork is like newSpliceTestServer, but both of the
+// server's connections are on network, which is "tcp" or "unix".
+func newSpliceTestServerNetwork(network string) (*spliceTestServer, error) {
+	clientUp, serverUp, err := spliceTestSocketPair(network)
+	if err != nil {
+		return nil, err
+	}
+	clientDown, serverDown, err := spliceTestSocketPair(network)
+	if err != nil {
+		clientUp.Close()
+		serverUp.Close()
+		return nil, err
+	}
+	return &spliceTestServer{clientUp: clientUp, clientDown: clientDown, serverUp: serverUp, serverDown: serverDown}, nil
+}
+
+// configure applies opts to all of the server's connections.
+func (srv *spliceTestServer) configure(opts *SpliceOptions) error {
+	for _, c := range []interface{}{srv.clientUp, srv.clientDown, srv.serverUp, srv.serverDown} {
+		if err := ConfigureForSplice(c.(*TCPConn), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read reads from the downstream connection.
+func (srv *spliceTestServer) Read(b []byte) (int, error) {
+	return srv.clientDown.Read(b)
+}
+
+// Write writes to the upstream connection.
+func (srv *spliceTestServer) Write(b []byte) (int, error) {
+	return srv.clientUp.Write(b)
+}
+
+// Close closes the server.
+func (srv *spliceTestServer) Close() error {
+	err := srv.closeUp()
+	err1 := srv.closeDown()
+	if err == nil {
+		return err1
+	}
+	return err
+}
+
+// CloseWrite closes the client side of the upstream connection.
+func (srv *spliceTestServer) CloseWrite() error {
+	return srv.clientUp.(interface {
+		CloseWrite() error
+	}).CloseWrite()
+}
+
+// CloseRead closes the client side of the downstream connection.
+func (srv *spliceTestServer) CloseRead() error {
+	return srv.clientDown.(interface {
+		CloseRead() error
+	}).CloseRead()
+}
+
+// Copy copies from the server side of the upstream connection
+// to the server side of the downstream connection, in a separate
+// goroutine. Copy is done when the first send on the returned
+// channel succeeds.
+func (srv *spliceTestServer) Copy() <-chan error {
+	copy := io.Copy
+	if srv.relay != nil {
+		copy = srv.relay.Copy
+	}
+	ch := make(chan error)
+	go func() {
+		if srv.relay != nil && srv.relay.DedicatedPoller {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+		}
+		_, err := copy(srv.serverDown, srv.serverUp)
+		ch <- err
+		close(ch)
+	}()
+	return ch
+}
+
+// CopyNoSplice is like Copy, but ensures that the splice code path
+// is not reached.
+func (srv *spliceTestServer) CopyNoSplice() <-chan error {
+	type onlyReader struct {
+		io.Reader
+	}
+	ch := make(chan error)
+	go func() {
+		_, err := io.Copy(srv.serverDown, onlyReader{srv.serverUp})
+		ch <- err
+		close(ch)
+	}()
+	return ch
+}
+
+// relayResult is the outcome of a transfer through a spliceTestServer.
+type relayResult struct {
+	n       int64
+	err     error
+	elapsed time.Duration
+
+	// got is the data received by the downstream client, and
+	// arrivals holds, for each of its reads, how long after the
+	// start of the transfer it returned and how much had been
+	// received by then.
+	got      []byte
+	arrivals []relayArrival
+}
+
+type relayArrival struct {
+	at       time.Duration
+	received int
+}
+
+// transfer writes data to the upstream connection and closes it, while
+// copying from the server side of the upstream connection to the server
+// side of the downstream connection like Copy, but in the calling
+// goroutine. If the copy stops short, the write is left blocked until the
+// server is closed.
+func (srv *spliceTestServer) transfer(data []byte) relayResult {
+	start := time.Now()
+	readDone := make(chan relayResult, 1)
+	go func() {
+		var res relayResult
+		b := make([]byte, 32<<10)
+		for {
+			n, err := srv.Read(b)
+			res.got = append(res.got, b[:n]...)
+			res.arrivals = append(res.arrivals, relayArrival{time.Since(start), len(res.got)})
+			if err != nil {
+				readDone <- res
+				return
+			}
+		}
+	}()
+	go func() {
+		srv.Write(data)
+		srv.CloseWrite()
+	}()
+
+	var res relayResult
+	if rl := srv.relay; rl != nil {
+		if rl.DedicatedPoller {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+		}
+		res.n, res.err = rl.Copy(srv.serverDown, srv.serverUp)
+	} else {
+		res.n, res.err = io.Copy(srv.serverDown, srv.serverUp)
+	}
+	res.elapsed = time.Since(start)
+	srv.serverDown.(*TCPConn).CloseWrite()
+	r := <-readDone
+	res.got, res.arrivals = r.got, r.arrivals
+	return res
+}
+
+// checkTransfer checks that the transfer which came to res relayed all
+// of data intact.
+func checkTransfer(t *testing.T, data []byte, res relayResult) {
+	t.Helper()
+	if res.n != int64(len(data)) || res.err != nil {
+		t.Errorf("relay: %d, %v; want %d, <nil>", res.n, res.err, len(data))
+	}
+	if !bytes.Equal(res.got, data) {
+		t.Errorf("relayed %d bytes differ from %d bytes written", len(res.got), len(data))
+	}
+}
+
+// spliceTestData returns n bytes of data in which every byte value
+// occurs, and which doesn't repeat with the period of a page.
+func spliceTestData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// testRelayPaths runs f once with the copies of a Relay spliced, and once
+// with them held to the copy through userspace.
+func testRelayPaths(t *testing.T, f func(t *testing.T, spliced bool)) {
+	for _, spliced := range []bool{true, false} {
+		t.Run(fmt.Sprintf("spliced=%v", spliced), func(t *testing.T) {
+			if !spliced {
+				defer func(s SpliceStrategy) { testHookSpliceStrategy = s }(testHookSpliceStrategy)
+				testHookSpliceStrategy = GenericStrategy
+			}
+			f(t, spliced)
+		})
+	}
+}
+
+func (srv *spliceTestServer) closeUp() error {
+	var err, err1 error
+	if srv.serverUp != nil {
+		err = srv.serverUp.Close()
+	}
+	if srv.clientUp != nil {
+		err1 = srv.clientUp.Close()
+	}
+	if err == nil {
+		return err1
+	}
+	return err
+}
+
+func (srv *spliceTestServer) closeDown() error {
+	var err, err1 error
+	if srv.serverDown != nil {
+		err = srv.serverDown.Close()
+	}
+	if srv.clientDown != nil {
+		err1 = srv.clientDown.Close()
+	}
+	if err == nil {
+		return err1
+	}
+	return err
+}
+
+func spliceTestSocketPair(net string) (client, server Conn, err error) {
+	ln, err := newLocalListener(net)
+	if err != nil {
+		return nil, nil, err
+	}
+	return acceptSpliceTestPair(ln)
+}
+
+// spliceTestSocketPairMSS is like spliceTestSocketPair for "tcp", but
+// the connection's segments carry at most mss bytes, as over a link
+// with a small MTU.
+func spliceTestSocketPairMSS(mss int) (client, server Conn, err error) {
+	ln, err := newLocalListener("tcp")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The MSS of the listener is passed on to the connections it
+	// accepts, and is announced to the peer in the handshake.
+	fd := ln.(*TCPListener).fd
+	if err := fd.pfd.SetsockoptInt(syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss); err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return acceptSpliceTestPair(ln)
+}
+
+// acceptSpliceTestPair returns a connection to ln, and the connection ln
+// accepts for it. It closes ln.
+func acceptSpliceTestPair(ln Listener) (client, server Conn, err error) {
+	defer ln.Close()
+	var cerr, serr error
+	acceptDone := make(chan struct{})
+	go func() {
+		server, serr = ln.Accept()
+		acceptDone <- struct{}{}
+	}()
+	client, cerr = Dial(ln.Addr().Network(), ln.Addr().String())
+	<-acceptDone
+	if cerr != nil {
+		if server != nil {
+			server.Close()
+		}
+		return nil, nil, cerr
+	}
+	if serr != nil {
+		if client != nil {
+			client.Close()
+		}
+		return nil, nil, serr
+	}
+	return client, server, nil
+}
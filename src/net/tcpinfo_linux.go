@@ -0,0 +1,34 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//go:linkname getsockopt syscall.getsockopt
+func getsockopt(s, level, name int, val unsafe.Pointer, vallen *uint32) error
+
+// tcpInfo returns the state of the TCP connection of fd, as reported by
+// the TCP_INFO socket option, or nil if it can't be had.
+func tcpInfo(fd *netFD) *TCPInfo {
+	var ti syscall.TCPInfo
+	var err error
+	size := uint32(unsafe.Sizeof(ti))
+	if cerr := fd.pfd.RawControl(func(s uintptr) {
+		err = getsockopt(int(s), syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&ti), &size)
+	}); cerr != nil || err != nil {
+		return nil
+	}
+	return &TCPInfo{
+		RTT:              time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:           time.Duration(ti.Rttvar) * time.Microsecond,
+		Retransmits:      int64(ti.Total_retrans),
+		CongestionWindow: int(ti.Snd_cwnd),
+		MSS:              int(ti.Snd_mss),
+	}
+}
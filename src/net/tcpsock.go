@@ -6,8 +6,11 @@ package net
 
 import (
 	"context"
+	"errors"
 	"io"
 	"os"
+	"sort"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -96,6 +99,15 @@ func (c *TCPConn) SyscallConn() (syscall.RawConn, error) {
 }
 
 // ReadFrom implements the io.ReaderFrom ReadFrom method.
+//
+// On Linux, ReadFrom moves the data of a TCP connection, or of a
+// SpliceConn which reports that it can be spliced, straight from the
+// socket underlying r. The copy starts with the first byte that a Read of
+// r would have returned, so no data queued on the socket when ReadFrom is
+// called is skipped. Data which a wrapper of the connection has read ahead
+// into a buffer of its own is no longer on the socket, and is not copied:
+// such a wrapper must decline to be spliced while it holds that data, or
+// write it out first, as the WriteTo method of a bufio.Reader does.
 func (c *TCPConn) ReadFrom(r io.Reader) (int64, error) {
 	if !c.ok() {
 		return 0, syscall.EINVAL
@@ -107,6 +119,250 @@ func (c *TCPConn) ReadFrom(r io.Reader) (int64, error) {
 	return n, err
 }
 
+// WriteTo implements the io.WriterTo WriteTo method.
+func (c *TCPConn) WriteTo(w io.Writer) (int64, error) {
+	if !c.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := c.writeTo(w)
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "writeto", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// Discard skips the next n bytes read from the connection, returning
+// the number of bytes discarded. If Discard skips fewer than n bytes,
+// it also returns an error; the error is io.EOF if the peer closed
+// the connection first.
+//
+// On Linux, the bytes are discarded without being copied into the
+// process, which makes Discard suited to skipping padding or unwanted
+// payloads after a bounded io.CopyN.
+func (c *TCPConn) Discard(n int64) (int64, error) {
+	if !c.ok() {
+		return 0, syscall.EINVAL
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	d, err := c.discard(n)
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "read", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return d, err
+}
+
+// Peek reads len(b) bytes from the connection into b without consuming
+// them, so that the next Read, or a copy from the connection such as a
+// Relay, returns the same bytes again, and only once. Peek waits until
+// len(b) bytes have arrived, or the read deadline passes. If the
+// connection reaches EOF first, Peek returns the bytes which arrived
+// and io.ErrUnexpectedEOF, or io.EOF if there were none. b must be
+// smaller than the connection's receive buffer, which would otherwise
+// never hold all of it.
+//
+// A router which picks the backend of a TLS connection by the server
+// name in its ClientHello can so peek at the ClientHello, and then
+// splice the whole connection, ClientHello included, to the backend
+// without terminating TLS.
+//
+// Peek is only supported on Linux.
+func (c *TCPConn) Peek(b []byte) (int, error) {
+	if !c.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := peek(c.fd, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = &OpError{Op: "read", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// ReadFromFile sends length bytes of f, starting at offset, to the
+// connection, returning the number of bytes sent. If ReadFromFile sends
+// fewer than length bytes, it also returns an error; the error is io.EOF
+// if f ends first. ReadFromFile neither uses nor changes the offset of f,
+// so several goroutines may send sections of the same file at once, as a
+// server of byte ranges does.
+//
+// On Linux, the data is sent with the sendfile system call, without
+// being copied into the process. The kernel refers to the pages of f
+// rather than to a copy until the peer has acknowledged them, so a change
+// made to the section after ReadFromFile returns may still reach the
+// peer. A file which can't change, such as a memfd sealed with
+// F_SEAL_WRITE, is safe from this.
+func (c *TCPConn) ReadFromFile(f *os.File, offset, length int64) (int64, error) {
+	if !c.ok() || f == nil || offset < 0 || length < 0 {
+		return 0, syscall.EINVAL
+	}
+	n, err := c.readFromFile(f, offset, length)
+	if err == nil && n < length {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// A FileTransfer sends a section of a file to TCP connections, keeping
+// track of how far it has got, so that a transfer which is interrupted,
+// by the loss of the connection or of the process, can be resumed from
+// where it stopped, as a server of resumable downloads does.
+type FileTransfer struct {
+	f   *os.File
+	off int64 // accessed atomically
+	end int64
+
+	// permitted holds the ranges of f which may be sent, sorted by
+	// offset, if restricted is set.
+	permitted  []FileRange
+	restricted bool
+}
+
+// A FileRange is the section of a file of Length bytes starting at
+// Offset.
+type FileRange struct {
+	Offset, Length int64
+}
+
+// ErrRangeForbidden is returned by FileTransfer.SendTo when the data
+// which remains to be sent is not all within the ranges which the
+// transfer permits.
+var ErrRangeForbidden = errors.New("file range not permitted")
+
+// NewFileTransfer returns a FileTransfer of the length bytes of f
+// starting at offset. Like ReadFromFile, the transfer neither uses nor
+// changes the offset of f.
+func NewFileTransfer(f *os.File, offset, length int64) *FileTransfer {
+	return &FileTransfer{f: f, off: offset, end: offset + length}
+}
+
+// Offset returns the offset in the file of the first byte which has not
+// been sent. It may be called while SendTo runs, to checkpoint the
+// transfer. A byte counts as sent once it has been written to the
+// connection, which does not mean that the peer has received it.
+func (t *FileTransfer) Offset() int64 {
+	return atomic.LoadInt64(&t.off)
+}
+
+// Remaining returns the number of bytes which remain to be sent.
+func (t *FileTransfer) Remaining() int64 {
+	return t.end - t.Offset()
+}
+
+// Permit restricts t to the given ranges of the file, which may overlap
+// and come in any order. SendTo then fails with ErrRangeForbidden,
+// before sending anything, if any byte which remains to be sent lies
+// outside every permitted range. Permit with no ranges forbids the whole
+// file. Permit must not be called while SendTo runs.
+func (t *FileTransfer) Permit(ranges ...FileRange) {
+	t.permitted = t.permitted[:0]
+	for _, r := range ranges {
+		if r.Length > 0 {
+			t.permitted = append(t.permitted, r)
+		}
+	}
+	sort.Slice(t.permitted, func(i, j int) bool {
+		return t.permitted[i].Offset < t.permitted[j].Offset
+	})
+	t.restricted = true
+}
+
+// permits reports whether the ranges permitted by t cover the bytes of
+// the file from off up to end.
+func (t *FileTransfer) permits(off, end int64) bool {
+	if !t.restricted || off >= end {
+		return true
+	}
+	for _, r := range t.permitted {
+		if r.Offset > off {
+			break
+		}
+		if r.Offset+r.Length > off {
+			off = r.Offset + r.Length
+		}
+		if off >= end {
+			return true
+		}
+	}
+	return false
+}
+
+// SendTo sends the rest of the section to c, returning the number of
+// bytes sent. If SendTo sends fewer bytes than remained, it also returns
+// an error; the error is io.EOF if the file ends first. SendTo may be
+// called again, with another connection, to resume the transfer.
+// Only one SendTo may run at a time.
+//
+// On Linux, the data is spliced from the file through a pipe. Data which
+// has been read into the pipe but not written to c when SendTo fails
+// does not count as sent.
+func (t *FileTransfer) SendTo(c *TCPConn) (int64, error) {
+	if !c.ok() || t.f == nil || t.Offset() < 0 || t.Remaining() < 0 {
+		return 0, syscall.EINVAL
+	}
+	if !t.permits(t.Offset(), t.end) {
+		return 0, &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: ErrRangeForbidden}
+	}
+	n, err := c.sendFileTransfer(t)
+	if err == nil && t.Remaining() > 0 {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// A SyncPolicy says how often WriteToLog flushes the data it has written
+// to a file to stable storage. A zero SyncPolicy syncs only once the
+// copy is done.
+type SyncPolicy struct {
+	// Bytes, if positive, is the amount of data written after which
+	// the file is synced.
+	Bytes int64
+
+	// Interval, if positive, is the longest that data written to the
+	// file waits to be synced, even if the connection goes quiet.
+	Interval time.Duration
+
+	// DataOnly makes the syncs flush the data of the file but only
+	// the metadata needed to read it back, with fdatasync(2) where
+	// the system has it, rather than fsync(2).
+	DataOnly bool
+}
+
+// WriteToLog copies data from c to f, such as the log file of a
+// write-ahead log receiver, until c reaches EOF, writing it at the
+// current offset of f, and returns the number of bytes copied. The file
+// is synced as policy says while the copy runs, and once more at its
+// end, before WriteToLog returns. The syncs happen in the background
+// and do not hold up the copy: a byte is known to be durable once a
+// sync which started after it was written has completed. If a sync
+// fails, the copy stops, and WriteToLog returns the error, once the next
+// data arrives or c reaches EOF.
+//
+// On Linux, the data is spliced from the socket to f, as by WriteTo,
+// and the offset of f is advanced past it. A file opened with O_APPEND
+// can't be spliced to, and is written to by other means; a log opened
+// for writing and positioned at its end with Seek is spliced to.
+func (c *TCPConn) WriteToLog(f *os.File, policy SyncPolicy) (int64, error) {
+	if !c.ok() || f == nil {
+		return 0, syscall.EINVAL
+	}
+	s := newLogSyncer(f, policy)
+	n, err := c.writeToLog(f, s)
+	if serr := s.stop(); err == nil {
+		err = serr
+	}
+	if err != nil && err != io.EOF {
+		err = &OpError{Op: "writeto", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
 // CloseRead shuts down the reading side of the TCP connection.
 // Most callers should just use Close.
 func (c *TCPConn) CloseRead() error {
@@ -322,3 +578,28 @@ func ListenTCP(network string, laddr *TCPAddr) (*TCPListener, error) {
 	}
 	return ln, nil
 }
+
+// noWriteTo can be embedded alongside another type to hide the WriteTo
+// method of that other type.
+type noWriteTo struct{}
+
+// WriteTo hides another WriteTo method. It is never called.
+func (noWriteTo) WriteTo(io.Writer) (int64, error) {
+	panic("can't happen")
+}
+
+// tcpConnWithoutWriteTo implements all the methods of *TCPConn other
+// than WriteTo. This is used to permit WriteTo to call io.Copy without
+// leading to a recursive call to WriteTo, while still letting the
+// destination splice from the connection.
+type tcpConnWithoutWriteTo struct {
+	noWriteTo
+	*TCPConn
+}
+
+// Fallback implementation of io.WriterTo's WriteTo, when splice isn't
+// applicable.
+func genericWriteTo(c *TCPConn, w io.Writer) (int64, error) {
+	// Use wrapper to hide existing c.WriteTo from io.Copy.
+	return io.Copy(w, tcpConnWithoutWriteTo{TCPConn: c})
+}
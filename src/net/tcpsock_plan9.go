@@ -14,6 +14,26 @@ func (c *TCPConn) readFrom(r io.Reader) (int64, error) {
 	return genericReadFrom(c, r)
 }
 
+func (c *TCPConn) writeTo(w io.Writer) (int64, error) {
+	return genericWriteTo(c, w)
+}
+
+func (c *TCPConn) writeToLog(f *os.File, s *logSyncer) (int64, error) {
+	return genericWriteToLog(c, s)
+}
+
+func (c *TCPConn) discard(n int64) (int64, error) {
+	return genericDiscard(c, n)
+}
+
+func (c *TCPConn) readFromFile(f *os.File, off, n int64) (int64, error) {
+	return genericReadFromFile(c, f, off, n)
+}
+
+func (c *TCPConn) sendFileTransfer(t *FileTransfer) (int64, error) {
+	return genericSendFileTransfer(c, t)
+}
+
 func dialTCP(ctx context.Context, net string, laddr, raddr *TCPAddr) (*TCPConn, error) {
 	if testHookDialTCP != nil {
 		return testHookDialTCP(ctx, net, laddr, raddr)
@@ -45,12 +45,65 @@ func (a *TCPAddr) toLocal(net string) sockaddr {
 }
 
 func (c *TCPConn) readFrom(r io.Reader) (int64, error) {
+	if n, err, handled := splice(c.fd, r, nil, nil, noDeadline); handled {
+		testHookReadFrom("splice")
+		return n, err
+	}
 	if n, err, handled := sendFile(c.fd, r); handled {
+		testHookReadFrom("sendfile")
+		return n, err
+	}
+	if n, err, handled := spliceFile(c.fd, r, nil, nil, noDeadline); handled {
+		testHookReadFrom("splice")
 		return n, err
 	}
+	testHookReadFrom("generic")
 	return genericReadFrom(c, r)
 }
 
+func (c *TCPConn) writeTo(w io.Writer) (int64, error) {
+	n, err, handled := spliceToFile(w, c.fd)
+	if handled {
+		return n, err
+	}
+	m, err := genericWriteTo(c, w)
+	return n + m, err
+}
+
+func (c *TCPConn) writeToLog(f *os.File, s *logSyncer) (int64, error) {
+	n, err, handled := spliceToLog(f, c.fd, s)
+	if handled {
+		return n, err
+	}
+	m, err := genericWriteToLog(c, s)
+	return n + m, err
+}
+
+func (c *TCPConn) discard(n int64) (int64, error) {
+	if d, err, handled := spliceDiscard(c.fd, n); handled {
+		return d, err
+	}
+	return genericDiscard(c, n)
+}
+
+func (c *TCPConn) readFromFile(f *os.File, off, n int64) (int64, error) {
+	written, err, handled := sendFileRange(c.fd, f, off, n)
+	if handled {
+		return written, err
+	}
+	m, err := genericReadFromFile(c, f, off+written, n-written)
+	return written + m, err
+}
+
+func (c *TCPConn) sendFileTransfer(t *FileTransfer) (int64, error) {
+	written, err, handled := spliceFileRange(c.fd, t.f, &t.off, t.end-t.Offset())
+	if handled {
+		return written, err
+	}
+	m, err := genericSendFileTransfer(c, t)
+	return written + m, err
+}
+
 func dialTCP(ctx context.Context, net string, laddr, raddr *TCPAddr) (*TCPConn, error) {
 	if testHookDialTCP != nil {
 		return testHookDialTCP(ctx, net, laddr, raddr)
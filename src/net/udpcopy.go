@@ -0,0 +1,46 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import "syscall"
+
+// CopyFromUDP reads datagrams from u and writes their payloads to c, in
+// the order in which they arrive, as a single stream, until reading from
+// u fails, for instance because u is closed or its read deadline passes.
+// It returns the number of bytes written to c and the error which stopped
+// the copy. Datagrams are not reordered, nor checked for their origin;
+// u is typically connected to the peer sending the stream.
+//
+// On Linux, the payloads are moved to the kernel buffer from which they
+// are spliced to c without being copied again, so that only reading them
+// from u copies them into userspace.
+func CopyFromUDP(c *TCPConn, u *UDPConn) (int64, error) {
+	if !c.ok() || !u.ok() {
+		return 0, syscall.EINVAL
+	}
+	n, err := copyFromUDP(c, u)
+	if err != nil {
+		err = &OpError{Op: "readfrom", Net: c.fd.net, Source: c.fd.laddr, Addr: c.fd.raddr, Err: err}
+	}
+	return n, err
+}
+
+// Fallback implementation of CopyFromUDP, when splice isn't applicable.
+func genericCopyFromUDP(c *TCPConn, u *UDPConn) (int64, error) {
+	var written int64
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := u.Read(buf)
+		if n > 0 {
+			if _, err := c.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCopyFromUDP(t *testing.T) {
+	if !testableNetwork("udp4") || !testableNetwork("tcp") {
+		t.Skip("udp4 or tcp not testable")
+	}
+	t.Run("default", func(t *testing.T) {
+		testCopyFromUDP(t, CopyFromUDP)
+	})
+	t.Run("generic", func(t *testing.T) {
+		testCopyFromUDP(t, genericCopyFromUDP)
+	})
+}
+
+func testCopyFromUDP(t *testing.T, copy func(*TCPConn, *UDPConn) (int64, error)) {
+	u, err := ListenUDP("udp4", &UDPAddr{IP: IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	sender, err := DialUDP("udp4", nil, u.LocalAddr().(*UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	c, s, err := spliceTestSocketPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Close()
+	dst := s.(*TCPConn)
+
+	type result struct {
+		n   int64
+		err error
+	}
+	copyDone := make(chan result, 1)
+	go func() {
+		n, err := copy(dst, u)
+		copyDone <- result{n, err}
+	}()
+
+	// Send the datagrams in rounds, reading each round from the TCP
+	// connection before sending the next one, so that none of them
+	// is dropped for lack of room in u's receive buffer.
+	var total int64
+	off := 0
+	for round := 0; round < 20; round++ {
+		var want []byte
+		for i := 0; i < 16; i++ {
+			size := 1 + (round*16+i)*577%9000
+			d := make([]byte, size)
+			for j := range d {
+				d[j] = byte((off + j) % 251)
+			}
+			off += size
+			if _, err := sender.Write(d); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, d...)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("round %d: received %d bytes which differ from the datagrams sent", round, len(got))
+		}
+		total += int64(len(want))
+	}
+
+	u.Close()
+	res := <-copyDone
+	if res.err == nil {
+		t.Error("copy succeeded after the UDP connection was closed")
+	}
+	if res.n != total {
+		t.Errorf("copied %d bytes; want %d", res.n, total)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package net
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"syscall"
+)
+
+// errWebSocketFrameSize is returned for a WebSocket frame whose payload
+// length has its most significant bit set, which RFC 6455 forbids.
+var errWebSocketFrameSize = errors.New("websocket frame too large")
+
+// ForwardWebSocket forwards the WebSocket frames (RFC 6455) which src
+// receives, once the opening handshake is over, to dst, until src reaches
+// EOF or an error occurs. It returns the number of bytes written to dst.
+// EOF in the middle of a frame is reported as io.ErrUnexpectedEOF.
+//
+// Frame headers are read in userspace. On Linux, the payloads of unmasked
+// frames, which servers send, are then spliced to dst, so that they are
+// not copied into userspace. A proxy is the client of dst's peer, and
+// must choose its own masking keys (RFC 6455, section 10.3), so masked
+// frames, which clients send, are forwarded with a new key, which takes
+// copying their payloads through userspace.
+func ForwardWebSocket(dst, src *TCPConn) (written int64, err error) {
+	if !src.ok() || !dst.ok() {
+		return 0, syscall.EINVAL
+	}
+	sp := NewSplicer(src)
+	defer sp.Close()
+	var (
+		hdr [14]byte
+		buf []byte
+	)
+	for {
+		// The Splicer may have read the start of the frame from
+		// src along with the previous payload.
+		r := io.MultiReader(sp.Buffered(), src)
+		h, payload, err := readWebSocketHeader(r, hdr[:])
+		if err == errWebSocketFrameSize {
+			err = &OpError{Op: "read", Net: src.fd.net, Source: src.fd.laddr, Addr: src.fd.raddr, Err: err}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		masked := h[1]&0x80 != 0
+		testHookForwardWebSocket(!masked)
+		if !masked {
+			n, err := dst.Write(h)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			n64, err := sp.SpliceTo(dst, payload)
+			written += n64
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		var key [4]byte
+		copy(key[:], h[len(h)-4:])
+		newKey := rand.Uint32()
+		for i := 0; i < 4; i++ {
+			h[len(h)-4+i] = byte(newKey >> uint(24-8*i))
+			key[i] ^= h[len(h)-4+i]
+		}
+		n, err := dst.Write(h)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if buf == nil {
+			buf = make([]byte, 32*1024)
+		}
+		for off := int64(0); off < payload; {
+			b := buf
+			if int64(len(b)) > payload-off {
+				b = b[:payload-off]
+			}
+			if _, err := io.ReadFull(r, b); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return written, err
+			}
+			// Unmask with the old key and mask with the new one.
+			for i := range b {
+				b[i] ^= key[(off+int64(i))%4]
+			}
+			n, err := dst.Write(b)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			off += int64(len(b))
+		}
+	}
+}
+
+// readWebSocketHeader reads a WebSocket frame header from r into b,
+// which must be large enough for the largest header, and returns the
+// header and the length of the frame's payload. It returns io.EOF if r
+// is at EOF before the header starts.
+func readWebSocketHeader(r io.Reader, b []byte) (hdr []byte, payload int64, err error) {
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil, 0, err
+	}
+	n := 2
+	switch l := b[1] & 0x7f; l {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	default:
+		payload = int64(l)
+	}
+	if b[1]&0x80 != 0 {
+		n += 4
+	}
+	if _, err := io.ReadFull(r, b[2:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	switch b[1] & 0x7f {
+	case 126:
+		payload = int64(b[2])<<8 | int64(b[3])
+	case 127:
+		if b[2]&0x80 != 0 {
+			return nil, 0, errWebSocketFrameSize
+		}
+		for _, c := range b[2:10] {
+			payload = payload<<8 | int64(c)
+		}
+	}
+	return b[:n], payload, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package net
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// webSocketFrame returns a binary WebSocket frame holding payload,
+// masked with key unless key is nil.
+func webSocketFrame(payload, key []byte) []byte {
+	f := []byte{0x82, 0}
+	switch n := len(payload); {
+	case n < 126:
+		f[1] = byte(n)
+	case n < 1<<16:
+		f[1] = 126
+		f = append(f, byte(n>>8), byte(n))
+	default:
+		f[1] = 127
+		for i := 56; i >= 0; i -= 8 {
+			f = append(f, byte(n>>uint(i)))
+		}
+	}
+	if key == nil {
+		return append(f, payload...)
+	}
+	f[1] |= 0x80
+	f = append(f, key...)
+	for i, c := range payload {
+		f = append(f, c^key[i%4])
+	}
+	return f
+}
+
+func TestForwardWebSocket(t *testing.T) {
+	if !testableNetwork("tcp") {
+		t.Skip("tcp not testable")
+	}
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	payloads := make([][]byte, 6)
+	for i, n := range []int{1 << 20, 100, 3 << 20, 1000, 1 << 20, 70000} {
+		payloads[i] = make([]byte, n)
+		for j := range payloads[i] {
+			payloads[i][j] = byte((i + j) % 251)
+		}
+	}
+	masked := func(i int) bool { return i%2 == 1 || i == 4 }
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+
+	var spliced []bool
+	defer func() { testHookForwardWebSocket = func(bool) {} }()
+	testHookForwardWebSocket = func(s bool) { spliced = append(spliced, s) }
+
+	go func() {
+		for i, p := range payloads {
+			var k []byte
+			if masked(i) {
+				k = key
+			}
+			srv.Write(webSocketFrame(p, k))
+		}
+		srv.CloseWrite()
+	}()
+	readDone := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(srv)
+		readDone <- b
+	}()
+
+	written, err := ForwardWebSocket(srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.serverDown.(*TCPConn).CloseWrite()
+	got := <-readDone
+	if written != int64(len(got)) {
+		t.Errorf("wrote %d bytes; peer received %d", written, len(got))
+	}
+
+	r := bytes.NewReader(got)
+	var hdr [14]byte
+	for i, p := range payloads {
+		h, n, err := readWebSocketHeader(r, hdr[:])
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if n != int64(len(p)) {
+			t.Fatalf("frame %d: payload of %d bytes; want %d", i, n, len(p))
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if masked(i) {
+			if h[1]&0x80 == 0 {
+				t.Fatalf("frame %d: not masked", i)
+			}
+			k := h[len(h)-4:]
+			for j := range b {
+				b[j] ^= k[j%4]
+			}
+		}
+		if !bytes.Equal(b, p) {
+			t.Errorf("frame %d: payload differs", i)
+		}
+		if i < len(spliced) && spliced[i] == masked(i) {
+			t.Errorf("frame %d: spliced = %v; want %v", i, spliced[i], !masked(i))
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d trailing bytes", r.Len())
+	}
+	if len(spliced) != len(payloads) {
+		t.Errorf("forwarded %d frames; want %d", len(spliced), len(payloads))
+	}
+}
+
+func TestForwardWebSocketTruncated(t *testing.T) {
+	if !testableNetwork("tcp") {
+		t.Skip("tcp not testable")
+	}
+	srv, err := newSpliceTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go io.Copy(ioutil.Discard, srv)
+
+	f := webSocketFrame(make([]byte, 1000), nil)
+	srv.Write(f[:500])
+	srv.CloseWrite()
+	if _, err := ForwardWebSocket(srv.serverDown.(*TCPConn), srv.serverUp.(*TCPConn)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -70,6 +70,16 @@ func (f *File) Fd() uintptr {
 	return uintptr(f.pfd.Sysfd)
 }
 
+// sysfd returns the file descriptor of f, or -1 if f is nil. Unlike Fd,
+// it leaves the descriptor in non-blocking mode, if it is. It is used by
+// package net through go:linkname, to splice from and to files.
+func sysfd(f *File) int {
+	if f == nil {
+		return -1
+	}
+	return f.pfd.Sysfd
+}
+
 // NewFile returns a new File with the given file descriptor and
 // name. The returned value will be nil if fd is not a valid file
 // descriptor.